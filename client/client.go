@@ -0,0 +1,365 @@
+// Package client is a Go client for the encoder's server mode
+// (`go run . serve`). It covers the endpoints described in api/openapi.yaml:
+// submitting encode jobs, polling them, listing archives, downloading videos
+// and streaming decoded files.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Job is an encode submitted to the server.
+type Job struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	Kind    string    `json:"kind"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Status  string    `json:"status"` // queued, running, paused, done or failed
+	Error   string    `json:"error,omitempty"`
+	Archive string    `json:"archive,omitempty"` // archive ID once done
+	Created time.Time `json:"created"`
+	// Where the frame bytes written beyond the file went, once done
+	Overhead *CapacityOverhead `json:"overhead,omitempty"`
+}
+
+// Finished reports whether the job has stopped, successfully or not.
+func (j *Job) Finished() bool {
+	return j.Status == "done" || j.Status == "failed"
+}
+
+// Archive is an encoded file stored by the server. Its ID is the video's SHA-256.
+type Archive struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Owner   string    `json:"owner,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// UsageTotals counts archives, encoded source bytes and stored video bytes.
+type UsageTotals struct {
+	Archives int   `json:"archives"`
+	Encoded  int64 `json:"encoded_bytes"`
+	Stored   int64 `json:"stored_bytes"`
+}
+
+// Usage is the caller's storage use. ByUser and ByBackend are only filled
+// in for admins.
+type Usage struct {
+	User       string                 `json:"user"`
+	Usage      UsageTotals            `json:"usage"`
+	Summary    string                 `json:"summary"` // Usage for people, in the locale of Accept-Language
+	QuotaBytes int64                  `json:"quota_bytes,omitempty"`
+	ByUser     map[string]UsageTotals `json:"by_user,omitempty"`
+	ByBackend  map[string]UsageTotals `json:"by_backend,omitempty"`
+}
+
+// CapacityPlan is what encoding a file of Size bytes takes with one of the
+// server's profiles: the videos written, their frames and running time, and
+// where the frame bytes that do not hold the file go. Overhead and Size add
+// up to TotalBytes.
+type CapacityPlan struct {
+	Size       int64            `json:"size"`
+	Profile    Profile          `json:"profile"`
+	FrameBytes int              `json:"frame_bytes"`      // data bytes per frame
+	Frames     int64            `json:"frames"`           // in every part
+	Seconds    float64          `json:"duration_seconds"` // of the data video
+	TotalBytes int64            `json:"total_bytes"`
+	Parts      []CapacityPart   `json:"parts"`
+	Overhead   CapacityOverhead `json:"overhead"`
+}
+
+// Profile is a named set of encoding settings kept in the server's catalog.
+type Profile struct {
+	Mode           string `json:"mode"`
+	BlockSize      int    `json:"block_size,omitempty"`
+	BitsPerChannel int    `json:"bits_per_channel,omitempty"`
+	Coefficients   int    `json:"dct_coefficients,omitempty"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	FPS            int    `json:"fps"`
+	Codec          string `json:"codec,omitempty"`  // ffv1 or h264; by the video's extension if empty
+	Parity         int    `json:"parity,omitempty"` // recovery volume parity in percent
+	Cold           bool   `json:"cold,omitempty"`   // scrubbed metadata, random names and frame rates
+}
+
+// CapacityPart is one video of a plan.
+type CapacityPart struct {
+	Kind    string  `json:"kind"` // data, share or recovery
+	Frames  int64   `json:"frames"`
+	Seconds float64 `json:"duration_seconds"`
+}
+
+// CapacityOverhead breaks down the frame bytes that do not hold the file.
+type CapacityOverhead struct {
+	Compression int64 `json:"compression"` // negative when compression saved bytes
+	Headers     int64 `json:"headers"`
+	Padding     int64 `json:"padding"`
+	ECC         int64 `json:"ecc"`
+	Encryption  int64 `json:"encryption"`
+	MAC         int64 `json:"mac"`
+	Copies      int64 `json:"copies"`
+}
+
+// SeekUnit is a stretch of an archive's video that starts at a keyframe and
+// decodes on its own once appended to the video's first HeaderSize bytes.
+type SeekUnit struct {
+	FirstFrame int   `json:"first_frame"`
+	Frames     int   `json:"frames"`
+	Offset     int64 `json:"offset"`
+	Length     int64 `json:"length"`
+	DataStart  int64 `json:"data_start"`
+	DataEnd    int64 `json:"data_end"`
+}
+
+// SeekIndex lists the decodable units of an archive's video.
+type SeekIndex struct {
+	Video      string     `json:"video"`
+	Size       int64      `json:"size"`
+	HeaderSize int64      `json:"header_size"`
+	FrameBytes int        `json:"frame_bytes"`
+	Units      []SeekUnit `json:"units"`
+}
+
+// APIError is an error response from the server. Rule names the screening
+// rule that turned an upload down (max_bytes, extension or command), if one
+// did.
+type APIError struct {
+	StatusCode int
+	Message    string
+	Rule       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Client talks to one server with one user's bearer token.
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client // http.DefaultClient when nil
+}
+
+// New returns a client for the server at baseURL, e.g. "http://localhost:8080".
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, query url.Values, header http.Header) (*http.Response, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		apiErr := &APIError{StatusCode: resp.StatusCode, Message: resp.Status}
+		var e struct {
+			Error string `json:"error"`
+			Rule  string `json:"rule"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e) == nil && e.Error != "" {
+			apiErr.Message, apiErr.Rule = e.Error, e.Rule
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v any) error {
+	resp, err := c.do(ctx, http.MethodGet, path, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse response from %s: %v", path, err)
+	}
+	return nil
+}
+
+// Encode uploads a file under name and queues it for encoding. Use WaitJob
+// to follow the returned job.
+func (c *Client) Encode(ctx context.Context, name string, file io.Reader) (*Job, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/encode", file, url.Values{"name": {name}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var j Job
+	if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+		return nil, fmt.Errorf("failed to parse job: %v", err)
+	}
+	return &j, nil
+}
+
+// Job returns the current state of a job.
+func (c *Client) Job(ctx context.Context, id string) (*Job, error) {
+	var j Job
+	if err := c.getJSON(ctx, "/jobs/"+url.PathEscape(id), &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// Jobs lists the caller's jobs, oldest first.
+func (c *Client) Jobs(ctx context.Context) ([]Job, error) {
+	var jobs []Job
+	if err := c.getJSON(ctx, "/jobs", &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// WaitJob polls a job every interval until it finishes or ctx is done,
+// calling progress (if not nil) with every state it sees. A job that ends
+// in failure is returned together with an error carrying its message.
+func (c *Client) WaitJob(ctx context.Context, id string, interval time.Duration, progress func(Job)) (*Job, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		j, err := c.Job(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if progress != nil {
+			progress(*j)
+		}
+		if j.Finished() {
+			if j.Status == "failed" {
+				return j, fmt.Errorf("job %s failed: %s", j.ID, j.Error)
+			}
+			return j, nil
+		}
+		select {
+		case <-ctx.Done():
+			return j, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Archives lists the archives the caller can access.
+func (c *Client) Archives(ctx context.Context) ([]Archive, error) {
+	var archives []Archive
+	if err := c.getJSON(ctx, "/archives", &archives); err != nil {
+		return nil, err
+	}
+	return archives, nil
+}
+
+// Usage returns the caller's storage use and quota.
+func (c *Client) Usage(ctx context.Context) (*Usage, error) {
+	var u Usage
+	if err := c.getJSON(ctx, "/usage", &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// PlanCapacity works out what encoding a file of size bytes would take with
+// the named profile from the server's catalog, or with the server's own
+// settings when profile is empty, without uploading anything.
+func (c *Client) PlanCapacity(ctx context.Context, size int64, profile string) (*CapacityPlan, error) {
+	query := url.Values{"size": {fmt.Sprint(size)}}
+	if profile != "" {
+		query.Set("profile", profile)
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/estimate", nil, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var plan CapacityPlan
+	if err := json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+		return nil, fmt.Errorf("failed to parse capacity plan: %v", err)
+	}
+	return &plan, nil
+}
+
+func (c *Client) download(ctx context.Context, method, path string, body io.Reader, query url.Values, w io.Writer) (int64, error) {
+	resp, err := c.do(ctx, method, path, body, query, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("download interrupted after %d bytes: %v", n, err)
+	}
+	return n, nil
+}
+
+// DownloadVideo writes an archive's encoded video to w.
+func (c *Client) DownloadVideo(ctx context.Context, id string, w io.Writer) (int64, error) {
+	return c.download(ctx, http.MethodGet, "/archives/"+url.PathEscape(id)+"/video", nil, nil, w)
+}
+
+// Index returns the seek index of an archive's video.
+func (c *Client) Index(ctx context.Context, id string) (*SeekIndex, error) {
+	var idx SeekIndex
+	if err := c.getJSON(ctx, "/archives/"+url.PathEscape(id)+"/index", &idx); err != nil {
+		return nil, err
+	}
+	return &idx, nil
+}
+
+// DownloadVideoRange writes length bytes of an archive's video, starting at
+// offset, to w. Combine the video's header with the units of a SeekIndex to
+// fetch part of a video that still decodes.
+func (c *Client) DownloadVideoRange(ctx context.Context, id string, offset, length int64, w io.Writer) (int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/archives/"+url.PathEscape(id)+"/video", nil, nil,
+		http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("server ignored the range request (status %d)", resp.StatusCode)
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("download interrupted after %d bytes: %v", n, err)
+	}
+	return n, nil
+}
+
+// DownloadFile writes an archive's original file to w. The server streams it
+// while decoding and aborts the connection if a frame is damaged, which
+// shows up here as an error.
+func (c *Client) DownloadFile(ctx context.Context, id string, w io.Writer) (int64, error) {
+	return c.download(ctx, http.MethodGet, "/archives/"+url.PathEscape(id)+"/file", nil, nil, w)
+}
+
+// Decode uploads a video and writes the decoded file to w.
+func (c *Client) Decode(ctx context.Context, name string, video io.Reader, w io.Writer) (int64, error) {
+	return c.download(ctx, http.MethodPost, "/decode", video, url.Values{"name": {name}}, w)
+}
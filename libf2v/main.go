@@ -0,0 +1,169 @@
+// Command libf2v is the encoder and decoder as a C library, for programs in
+// Python, C#, Rust or anything else that calls C, built with make libf2v or
+// on each platform with
+//
+//	go build -buildmode=c-shared -o libf2v.so ./libf2v     # Linux
+//	go build -buildmode=c-shared -o libf2v.dylib ./libf2v  # macOS
+//	go build -buildmode=c-shared -o f2v.dll ./libf2v       # Windows
+//
+// which writes the library under exactly that name and its header next to
+// it, named the same with .h: libf2v.h, or f2v.h for f2v.dll. f2v_encode
+// and f2v_decode work as Encoder.EncodeFile and Decoder.DecodeFile do, with
+// their settings given as a JSON object:
+//
+//	{"mode": "block", "block_size": 4, "width": 1280, "height": 720,
+//	 "fps": 25, "codec": "h264", "compress": "zstd", "parity": 10,
+//	 "backend": "png"}
+//
+// Fields left out take the command line tool's defaults, and only mode,
+// block_size, bits_per_channel, coefficients and backend matter to a
+// decode. Both return NULL on success or an error message the caller frees
+// with f2v_free, and fill in *result, unless it is NULL, with what they did.
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+// What an encode or decode did, as f2v.Result has it.
+typedef struct {
+	int64_t frames;
+	int64_t payload_bytes;
+	int64_t frame_bytes;
+	int64_t parity_bytes;
+	double overhead;
+	double seconds;
+	double throughput; // payload bytes per second
+} f2v_result;
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"unsafe"
+
+	"video-file-encoder-decoder/pkg/f2v"
+)
+
+// settings are the JSON options f2v_encode and f2v_decode take.
+type settings struct {
+	Mode           string `json:"mode"`
+	BlockSize      int    `json:"block_size"`
+	BitsPerChannel int    `json:"bits_per_channel"`
+	Coefficients   int    `json:"coefficients"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	FPS            int    `json:"fps"`
+	Codec          string `json:"codec"`
+	Compress       string `json:"compress"`
+	Parity         int    `json:"parity"`
+	Backend        string `json:"backend"` // opencv or png
+}
+
+// parseSettings reads options, which may be NULL or empty for none.
+func parseSettings(options *C.char) (settings, error) {
+	var s settings
+	if options == nil {
+		return s, nil
+	}
+	if text := C.GoString(options); text != "" {
+		if err := json.Unmarshal([]byte(text), &s); err != nil {
+			return s, fmt.Errorf("invalid options: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// backend returns the CodecBackend s names, nil for OpenCV.
+func (s settings) backend() (f2v.CodecBackend, error) {
+	switch s.Backend {
+	case "", "opencv":
+		return nil, nil
+	case "png":
+		return f2v.PNGSequence{}, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q; use opencv or png", s.Backend)
+}
+
+func (s settings) layout() f2v.Layout {
+	return f2v.Layout{Mode: s.Mode, BlockSize: s.BlockSize, BitsPerChannel: s.BitsPerChannel, Coefficients: s.Coefficients}
+}
+
+// run calls fn, turning a panic into an error rather than taking the
+// calling program down with it, and reports the outcome the C way.
+func run(result *C.f2v_result, fn func() (f2v.Result, error)) (msg *C.char) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg = C.CString(fmt.Sprintf("internal error: %v", r))
+		}
+	}()
+	res, err := fn()
+	if result != nil {
+		*result = C.f2v_result{
+			frames:        C.int64_t(res.Frames),
+			payload_bytes: C.int64_t(res.PayloadBytes),
+			frame_bytes:   C.int64_t(res.FrameBytes),
+			parity_bytes:  C.int64_t(res.ParityBytes),
+			overhead:      C.double(res.Overhead),
+			seconds:       C.double(res.Duration.Seconds()),
+			throughput:    C.double(res.Throughput),
+		}
+	}
+	if err != nil {
+		return C.CString(err.Error())
+	}
+	return nil
+}
+
+// f2v_encode encodes the file at input into the video at output.
+//
+//export f2v_encode
+func f2v_encode(input, output, options *C.char, result *C.f2v_result) *C.char {
+	return run(result, func() (f2v.Result, error) {
+		s, err := parseSettings(options)
+		if err != nil {
+			return f2v.Result{}, err
+		}
+		b, err := s.backend()
+		if err != nil {
+			return f2v.Result{}, err
+		}
+		enc := f2v.Encoder{
+			Layout: s.layout(),
+			Width:  s.Width, Height: s.Height, FPS: s.FPS,
+			Codec: s.Codec, Compress: s.Compress, Parity: s.Parity,
+			Backend: b,
+		}
+		return enc.EncodeFile(context.Background(), C.GoString(input), C.GoString(output))
+	})
+}
+
+// f2v_decode decodes the video at video, a local file or a URL, into the
+// file at output, whose folder must exist.
+//
+//export f2v_decode
+func f2v_decode(video, output, options *C.char, result *C.f2v_result) *C.char {
+	return run(result, func() (f2v.Result, error) {
+		s, err := parseSettings(options)
+		if err != nil {
+			return f2v.Result{}, err
+		}
+		b, err := s.backend()
+		if err != nil {
+			return f2v.Result{}, err
+		}
+		dec := f2v.Decoder{Layout: s.layout(), Backend: b}
+		return dec.DecodeFile(context.Background(), C.GoString(video), C.GoString(output))
+	})
+}
+
+// f2v_free frees an error message f2v_encode or f2v_decode returned.
+//
+//export f2v_free
+func f2v_free(msg *C.char) {
+	C.free(unsafe.Pointer(msg))
+}
+
+func main() {}
@@ -0,0 +1,249 @@
+// Package mobile is the encoder and decoder for Android and iOS apps, built
+// with gomobile:
+//
+//	gomobile bind -target=android -o f2v.aar ./mobile
+//	gomobile bind -target=ios -o F2v.xcframework ./mobile
+//
+// Everything here sticks to what gomobile can carry across: strings,
+// numbers, byte slices, errors, and interfaces for callbacks, so there are
+// no channels or contexts. A Job stands in for the context, reporting
+// progress to a listener and cancelling from another thread.
+package mobile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"video-file-encoder-decoder/pkg/f2v"
+)
+
+// Options are the settings of an encode or decode; the zero value of any
+// field takes the command line tool's default. Only the layout fields,
+// Mode to Coefficients, and Backend matter to a decode.
+type Options struct {
+	Mode           string // raw, block, dct or barcode; block, dct and barcode also survive a camera
+	BlockSize      int
+	BitsPerChannel int
+	Coefficients   int
+	Width, Height  int
+	FPS            int
+	Codec          string // h264, ffv1, ...
+	Compress       string // zstd, lz4 or brotli, with an optional :level
+	Parity         int    // recovery volume parity in percent
+	Backend        string // opencv or png
+}
+
+// NewOptions returns the default settings, to change field by field.
+func NewOptions() *Options {
+	return &Options{}
+}
+
+func (o *Options) layout() f2v.Layout {
+	if o == nil {
+		return f2v.Layout{}
+	}
+	return f2v.Layout{Mode: o.Mode, BlockSize: o.BlockSize, BitsPerChannel: o.BitsPerChannel, Coefficients: o.Coefficients}
+}
+
+func (o *Options) backend() (f2v.CodecBackend, error) {
+	if o == nil {
+		return nil, nil
+	}
+	switch o.Backend {
+	case "", "opencv":
+		return nil, nil
+	case "png":
+		return f2v.PNGSequence{}, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q; use opencv or png", o.Backend)
+}
+
+func (o *Options) encoder(j *Job) (*f2v.Encoder, error) {
+	b, err := o.backend()
+	if err != nil {
+		return nil, err
+	}
+	e := &f2v.Encoder{Layout: o.layout(), Backend: b, Progress: j.progress()}
+	if o != nil {
+		e.Width, e.Height, e.FPS = o.Width, o.Height, o.FPS
+		e.Codec, e.Compress, e.Parity = o.Codec, o.Compress, o.Parity
+	}
+	return e, nil
+}
+
+func (o *Options) decoder(j *Job) (*f2v.Decoder, error) {
+	b, err := o.backend()
+	if err != nil {
+		return nil, err
+	}
+	return &f2v.Decoder{Layout: o.layout(), Backend: b, Progress: j.progress()}, nil
+}
+
+// Result is what an encode or decode did; see f2v.Result.
+type Result struct {
+	Frames       int64
+	PayloadBytes int64
+	FrameBytes   int64
+	ParityBytes  int64
+	Overhead     float64
+	Seconds      float64
+	Throughput   float64 // payload bytes per second
+}
+
+func newResult(r f2v.Result) *Result {
+	return &Result{
+		Frames:       r.Frames,
+		PayloadBytes: r.PayloadBytes,
+		FrameBytes:   r.FrameBytes,
+		ParityBytes:  r.ParityBytes,
+		Overhead:     r.Overhead,
+		Seconds:      r.Duration.Seconds(),
+		Throughput:   r.Throughput,
+	}
+}
+
+// ProgressListener is told how far a job has got after every frame; totals
+// not known are 0, as for f2v.Progress. It is called on the job's thread.
+type ProgressListener interface {
+	OnProgress(frame, totalFrames, bytesDone, totalBytes int64)
+}
+
+// Job follows one encode or decode: its listener hears how far it has got,
+// and Cancel stops it from any thread. A nil Job is one nobody follows.
+type Job struct {
+	listener ProgressListener
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewJob returns a job reporting to listener, which may be nil.
+func NewJob(listener ProgressListener) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Job{listener: listener, ctx: ctx, cancel: cancel}
+}
+
+// Cancel stops the job before its next frame; it then fails with an error
+// saying it was cancelled.
+func (j *Job) Cancel() {
+	if j != nil {
+		j.cancel()
+	}
+}
+
+func (j *Job) context() context.Context {
+	if j == nil {
+		return context.Background()
+	}
+	return j.ctx
+}
+
+func (j *Job) progress() f2v.Progress {
+	if j == nil || j.listener == nil {
+		return nil
+	}
+	return j.listener.OnProgress
+}
+
+// EncodeFile encodes the file at input into the video at output, a path
+// in the app's storage.
+func EncodeFile(input, output string, o *Options, j *Job) (*Result, error) {
+	e, err := o.encoder(j)
+	if err != nil {
+		return nil, err
+	}
+	res, err := e.EncodeFile(j.context(), input, output)
+	return newResult(res), err
+}
+
+// EncodeBytes encodes data into the video at output.
+func EncodeBytes(data []byte, output string, o *Options, j *Job) (*Result, error) {
+	e, err := o.encoder(j)
+	if err != nil {
+		return nil, err
+	}
+	res, err := e.Encode(j.context(), bytes.NewReader(data), output)
+	return newResult(res), err
+}
+
+// DecodeFile decodes the video at video, a path or a URL, into the file at
+// output, whose folder must exist.
+func DecodeFile(video, output string, o *Options, j *Job) (*Result, error) {
+	d, err := o.decoder(j)
+	if err != nil {
+		return nil, err
+	}
+	res, err := d.DecodeFile(j.context(), video, output)
+	return newResult(res), err
+}
+
+// DecodeBytes decodes the video at video, a path or a URL, and returns
+// what it holds.
+func DecodeBytes(video string, o *Options, j *Job) ([]byte, error) {
+	d, err := o.decoder(j)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp("", "f2v-mobile-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := d.Decode(j.context(), video, f); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(f.Name())
+}
+
+// Receiver takes an air-gapped transfer through the phone's camera: the
+// app hands it every frame the camera catches while the sender plays the
+// video on a loop on their screen, until AddFrame reports that the file is
+// complete.
+type Receiver struct {
+	r *f2v.Receiver
+}
+
+// NewReceiver starts receiving a video encoded with o, which must be in
+// block, dct or barcode mode. The Receiver must be closed.
+func NewReceiver(o *Options) (*Receiver, error) {
+	d, err := o.decoder(nil)
+	if err != nil {
+		return nil, err
+	}
+	r, err := d.Receiver()
+	if err != nil {
+		return nil, err
+	}
+	return &Receiver{r}, nil
+}
+
+// AddFrame takes a camera frame of width*height*3 bytes of BGR pixels and
+// reports whether every frame of the video is now in.
+func (r *Receiver) AddFrame(bgr []byte, width, height int) (bool, error) {
+	return r.r.AddFrame(bgr, width, height)
+}
+
+// Frames returns how many frames are in so far.
+func (r *Receiver) Frames() int64 {
+	frames, _ := r.r.Received()
+	return frames
+}
+
+// TotalFrames returns how many frames the video has, 0 until its final
+// frame has been seen.
+func (r *Receiver) TotalFrames() int64 {
+	_, total := r.r.Received()
+	return total
+}
+
+// Data returns the file once every frame is in.
+func (r *Receiver) Data() ([]byte, error) {
+	return r.r.Data()
+}
+
+// Close lets go of the Receiver.
+func (r *Receiver) Close() error {
+	return r.r.Close()
+}
@@ -0,0 +1,119 @@
+package f2v
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+)
+
+// Instead of a key file or password, data can be encrypted to age
+// recipients, so the keys people already use with age open their videos
+// too. The payload is then a standard age file rather than an FVE envelope,
+// holding the same name-prefixed plaintext; age-encryption.org/v1 at its
+// start tells the two apart.
+
+var ageMagic = []byte("age-encryption.org/")
+
+// parseAgeRecipient parses an age1... public key.
+func parseAgeRecipient(s string) (age.Recipient, error) {
+	r, err := age.ParseX25519Recipient(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age recipient %q: %w", s, err)
+	}
+	return r, nil
+}
+
+// loadAgeIdentities reads the identities of an age key file, as written by
+// age-keygen.
+func loadAgeIdentities(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age identity file: %w", err)
+	}
+	defer f.Close()
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age identity file %s: %w", path, err)
+	}
+	return ids, nil
+}
+
+// ageEncrypt returns a writer that encrypts to every recipient into dst.
+func ageEncrypt(dst io.Writer, recipients []age.Recipient) (io.WriteCloser, error) {
+	w, err := age.Encrypt(dst, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("age: %w", err)
+	}
+	return w, nil
+}
+
+// ageOpen starts decrypting an age file with any of the identities. age
+// checks each chunk as it is read, so the reader fails on altered data.
+func ageOpen(r io.Reader, identities []age.Identity) (io.Reader, error) {
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("the video was encrypted to age recipients; give -age-identity")
+	}
+	plain, err := age.Decrypt(r, identities...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, fmt.Errorf("none of the -age-identity keys is a recipient of the video")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("age: %w", err)
+	}
+	return plain, nil
+}
+
+// ageDecrypt opens a whole age payload.
+func ageDecrypt(data []byte, identities []age.Identity) ([]byte, error) {
+	r, err := ageOpen(bytes.NewReader(data), identities)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, mismatched("decryption failed: the data was altered (%v)", err)
+	}
+	return plain, nil
+}
+
+// ageStream decrypts an age file written to it into dst as it comes in.
+type ageStream struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newAgeStream(dst io.Writer, identities []age.Identity) *ageStream {
+	pr, pw := io.Pipe()
+	a := &ageStream{pw: pw, done: make(chan error, 1)}
+	go func() {
+		r, err := ageOpen(pr, identities)
+		if err == nil {
+			if _, err = io.Copy(dst, r); err != nil {
+				err = mismatched("decryption failed: the data was altered or cut short (%v)", err)
+			}
+		}
+		// Unblock the writer if decryption stopped early
+		pr.CloseWithError(err)
+		a.done <- err
+	}()
+	return a
+}
+
+func (a *ageStream) Write(p []byte) (int, error) {
+	return a.pw.Write(p)
+}
+
+func (a *ageStream) Close() error {
+	a.pw.Close()
+	return <-a.done
+}
+
+func (a *ageStream) abort(err error) {
+	a.pw.CloseWithError(err)
+	<-a.done
+}
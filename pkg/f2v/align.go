@@ -0,0 +1,96 @@
+//go:build !(js && wasm)
+
+package f2v
+
+import (
+	"image"
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+// minMarkerScore is the normalized correlation a corner must reach before it
+// is trusted as a sync marker.
+const minMarkerScore = 0.6
+
+// alignFrame locates the four corner sync markers in a captured frame and
+// warps it back onto the layout's canonical grid, undoing cropping, scaling
+// or letterboxing applied by a hosting platform. Frames whose markers are not
+// in the corners, as in screen recordings and camera shots, are searched for
+// the markers' shape instead. When the markers cannot be found the frame is
+// simply stretched to the canonical size and found is false. The returned
+// Mat must be closed by the caller.
+func alignFrame(frame gocv.Mat, l layout) (aligned gocv.Mat, found bool) {
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(frame, &gray, gocv.ColorBGRToGray)
+
+	if centers, ok := findMarkers(gray, l); ok {
+		return warpToLayout(frame, centers, l), true
+	}
+	if aligned, ok := alignCapture(frame, gray, l); ok {
+		return aligned, true
+	}
+	aligned = gocv.NewMat()
+	gocv.Resize(frame, &aligned, image.Pt(l.width, l.height), 0, 0, gocv.InterpolationLinear)
+	return aligned, false
+}
+
+// findMarkers searches each quadrant of a grayscale frame for its sync marker
+// and returns the marker centres in the order of layout.markerOrigins. A few
+// candidate scales are tried, derived from how the frame size differs from the
+// canonical one, and the scale with the best worst-corner match wins.
+func findMarkers(gray gocv.Mat, l layout) (centers [4]gocv.Point2f, ok bool) {
+	w, h := gray.Cols(), gray.Rows()
+	sx, sy := float64(w)/float64(l.width), float64(h)/float64(l.height)
+
+	pattern, err := gocv.NewMatFromBytes(markerSize, markerSize, gocv.MatTypeCV8U, markerPattern())
+	if err != nil {
+		return centers, false
+	}
+	defer pattern.Close()
+
+	quadrants := [4]image.Rectangle{
+		image.Rect(0, 0, w/2, h/2),
+		image.Rect(w/2, 0, w, h/2),
+		image.Rect(0, h/2, w/2, h),
+		image.Rect(w/2, h/2, w, h),
+	}
+
+	bestScore := float32(-1)
+	for _, scale := range []float64{math.Min(sx, sy), math.Max(sx, sy), 1} {
+		size := int(math.Round(markerSize * scale))
+		if size < markerSize/2 || size > w/2 || size > h/2 {
+			continue
+		}
+
+		templ := gocv.NewMat()
+		gocv.Resize(pattern, &templ, image.Pt(size, size), 0, 0, gocv.InterpolationArea)
+
+		var candidate [4]gocv.Point2f
+		worst := float32(1)
+		for i, quadrant := range quadrants {
+			region := gray.Region(quadrant)
+			result := gocv.NewMat()
+			mask := gocv.NewMat()
+			gocv.MatchTemplate(region, templ, &result, gocv.TmCcoeffNormed, mask)
+			_, score, _, loc := gocv.MinMaxLoc(result)
+			result.Close()
+			mask.Close()
+			region.Close()
+
+			candidate[i] = gocv.Point2f{
+				X: float32(quadrant.Min.X+loc.X) + float32(size-1)/2,
+				Y: float32(quadrant.Min.Y+loc.Y) + float32(size-1)/2,
+			}
+			worst = min(worst, score)
+		}
+		templ.Close()
+
+		if worst > bestScore {
+			bestScore, centers = worst, candidate
+		}
+	}
+
+	return centers, bestScore >= minMarkerScore
+}
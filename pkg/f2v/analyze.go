@@ -0,0 +1,212 @@
+package f2v
+
+import (
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+// -tune makes a quick first pass over each input before encoding it. It
+// measures the byte entropy and how well samples of the data deflate, then
+// picks the compression, the density within the chosen mode and the parity.
+// Whatever compression saves is spent on robustness: the tuned video never
+// has more frames than the untuned one would.
+
+const (
+	tuneSamples       = 8
+	tuneSampleSize    = 128 << 10
+	tuneMinSaving     = 0.05 // compress only when samples shrink by at least this much
+	tuneMaxEntropy    = 7.9  // bits per byte above which data is taken as incompressible
+	tuneParity        = 5    // parity percent for uncompressed data
+	tuneDeflateParity = 10   // parity percent for compressed data, where one bad byte spoils the rest
+)
+
+// inputAnalysis is what -tune chose for one file.
+type inputAnalysis struct {
+	size     int
+	entropy  float64 // Shannon entropy in bits per byte
+	ratio    float64 // estimated deflated size relative to the input
+	compress bool
+	data     []byte // what to encode: the input, or its deflate stream
+	layout   layout
+	parity   int
+}
+
+// byteEntropy returns the Shannon entropy of data in bits per byte.
+func byteEntropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	h := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(data))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// deflateRatio estimates how far data deflates from evenly spread samples.
+func deflateRatio(data []byte) float64 {
+	if len(data) == 0 {
+		return 1
+	}
+	var in, out int
+	step := max(tuneSampleSize, len(data)/tuneSamples)
+	for off := 0; off < len(data); off += step {
+		sample := data[off:min(off+tuneSampleSize, len(data))]
+		var buf bytes.Buffer
+		z, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		z.Write(sample)
+		z.Close()
+		in += len(sample)
+		out += buf.Len()
+	}
+	return float64(out) / float64(in)
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	z, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := z.Write(data); err != nil {
+		return nil, err
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// densityCandidates returns the settings of l's mode at its frame size, most
+// robust first. Raw mode has no settings to choose from.
+func densityCandidates(l layout) []layout {
+	var out []layout
+	switch l.mode {
+	case modeBlock, modeDCT:
+		for _, c := range tuneCandidates(l) {
+			if c.mode == l.mode {
+				out = append(out, c)
+			}
+		}
+	case modeBarcode:
+		for _, cell := range []int{2, 3, 4, 5, 6, 8, 10, 12} {
+			c := l.writtenLike(layout{width: l.width, height: l.height, mode: modeBarcode, blockSize: cell, markers: true})
+			if c.validate() == nil {
+				out = append(out, c)
+			}
+		}
+	}
+	slices.SortStableFunc(out, func(a, b layout) int { return cmp.Compare(a.capacity(), b.capacity()) })
+	return out
+}
+
+// framesFor returns the number of frames size bytes take in layout l.
+func framesFor(size int, l layout) int {
+	per := l.capacity() - frameHeaderSize
+	return max(1, (size+per-1)/per)
+}
+
+// analyzeInput runs the first pass of -tune over data encoded with opts.
+func analyzeInput(data []byte, opts encodeOptions) (*inputAnalysis, error) {
+	a := &inputAnalysis{size: len(data), entropy: byteEntropy(data), ratio: 1, data: data, layout: opts.layout, parity: opts.parity}
+	if a.entropy < tuneMaxEntropy {
+		a.ratio = deflateRatio(data)
+	}
+	// The robust head must stay readable on its own, so it is never compressed
+	if a.ratio <= 1-tuneMinSaving && opts.head == 0 {
+		compressed, err := deflate(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress input: %w", err)
+		}
+		if len(compressed) < len(data) {
+			a.compress, a.data = true, compressed
+			a.ratio = float64(len(compressed)) / float64(max(1, len(data)))
+		}
+	}
+
+	budget := framesFor(len(data), opts.layout)
+	for _, c := range densityCandidates(opts.layout) {
+		if framesFor(len(a.data), c) <= budget {
+			a.layout = c
+			break
+		}
+	}
+
+	// Segmented videos take no recovery volume
+	if opts.parity == 0 && opts.head == 0 {
+		a.parity = tuneParity
+		if a.compress {
+			a.parity = tuneDeflateParity
+		}
+	}
+	return a, nil
+}
+
+func (a *inputAnalysis) print(w io.Writer, name string) {
+	compression := "no compression"
+	if a.compress {
+		compression = "deflate to " + display.percent(a.ratio, 0)
+	}
+	parity := "no parity"
+	if a.parity > 0 {
+		parity = fmt.Sprintf("%d%% parity", a.parity)
+	}
+	fmt.Fprintf(w, "Tuned %s: %s, entropy %s bits/byte, %s, %s, %s\n",
+		name, display.bytes(int64(a.size)), display.number(a.entropy, 2), compression, a.layout.describe(), parity)
+}
+
+// inflater decompresses the deflate stream written to it into dst.
+type inflater struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newInflater(dst io.Writer) *inflater {
+	pr, pw := io.Pipe()
+	z := &inflater{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := io.Copy(dst, flate.NewReader(pr))
+		pr.CloseWithError(err)
+		z.done <- err
+	}()
+	return z
+}
+
+func (z *inflater) Write(p []byte) (int, error) {
+	return z.pw.Write(p)
+}
+
+// Close ends the stream and reports whether it decompressed cleanly.
+func (z *inflater) Close() error {
+	z.pw.Close()
+	if err := <-z.done; err != nil {
+		return fmt.Errorf("failed to decompress data: %w", err)
+	}
+	return nil
+}
+
+// inflate decompresses a whole deflate stream.
+func inflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	z := newInflater(&buf)
+	z.Write(data)
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// abort stops decompression after the compressed stream failed.
+func (z *inflater) abort(err error) {
+	z.pw.CloseWithError(err)
+	<-z.done
+}
@@ -0,0 +1,160 @@
+package f2v
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// append adds files to an f2v archive video without packing what it holds
+// again. The archive's directory starts a frame of its own, so every frame
+// before it holds nothing but file data: the new files' data goes on from
+// there, followed by a directory listing the old entries and the new. With
+// ffmpeg on the PATH the old data frames are copied into the new video as
+// they are and only the new frames are encoded; without it, or for .mp4
+// videos, whose frames depend on each other, the old frames are decoded and
+// encoded again. A -dedup archive stays one, and new files share chunks
+// with the old ones. With -compress-mode per-file the new files, or their
+// new chunks, are compressed on their own, whatever the old ones were. Files already in the archive at the same size, mode and
+// modification time are left as they are; changed ones replace theirs, whose
+// data stays behind unlisted. The video is only replaced once the new
+// directory reads back.
+
+// appendArchive adds the files of inputs, folders or single files, to the
+// archive in video and returns how many entries were written and how many
+// were there already.
+func appendArchive(video string, inputs []string, opts encodeOptions) (int, int, error) {
+	t, err := readArchiveTail(video, opts.layout)
+	if errors.Is(err, errNoTail) {
+		return 0, 0, fmt.Errorf("only local archives encoded without -encrypt, -compress, -tune, -mac-key or a cover can be appended to")
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if int64(opts.layout.capacity()-frameHeaderSize) != t.per {
+		return 0, 0, fmt.Errorf("%s has %d data bytes per frame, not %d; give the flags it was encoded with", video, t.per, opts.layout.capacity()-frameHeaderSize)
+	}
+	if t.offset%t.per != 0 {
+		return 0, 0, malformed("the directory of %s does not start a frame", video)
+	}
+
+	pr, pw := io.Pipe()
+	a := newArchiveWriter(pw, t.dir, t.offset, int(t.per))
+	a.dedup = opts.dedup || len(t.dir.Chunks) > 0
+	if opts.perFile {
+		a.compress = opts.compress
+	}
+	go func() {
+		var err error
+		for _, in := range inputs {
+			if err = walkPack(in, opts.filter, a.add); err != nil {
+				err = fmt.Errorf("failed to pack %s: %w", in, err)
+				break
+			}
+		}
+		if err == nil {
+			err = a.close()
+		}
+		pw.CloseWithError(err)
+	}()
+	dir, base := filepath.Split(video)
+	temp := filepath.Join(dir, ".append-"+base)
+	defer os.Remove(temp)
+	err = writeAppended(video, temp, pr, t, opts)
+	// Stop the packer if encoding gave up early
+	pr.CloseWithError(err)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := readArchiveTail(temp, opts.layout); err != nil {
+		return 0, 0, fmt.Errorf("the appended video does not read back: %w", err)
+	}
+	if err := os.Rename(temp, video); err != nil {
+		return 0, 0, fmt.Errorf("failed to replace %s: %w", video, err)
+	}
+	return a.added, a.unchanged, nil
+}
+
+// writeAppended writes output as video's frames up to its directory and
+// then frames of the data read from r.
+func writeAppended(video, output string, r io.Reader, t *archiveTail, opts encodeOptions) error {
+	first := t.offset / t.per
+	fps, err := videoFPS(video, opts.layout)
+	if err != nil {
+		return err
+	}
+	if ffmpeg, err := exec.LookPath("ffmpeg"); err == nil && videoCodec(video) == "FFV1" {
+		dir, base := filepath.Split(output)
+		tail := filepath.Join(dir, ".tail-"+base)
+		defer os.Remove(tail)
+		if _, err := streamToVideoFrom(r, tail, opts.layout, fps, 0, uint32(first)); err != nil {
+			return err
+		}
+		if err := concatVideos(ffmpeg, video, first, tail, output); err != nil {
+			return err
+		}
+		if opts.layout.cold {
+			if err := scrubMetadata(output); err != nil {
+				opts.log().Warn("Scrubbing the video's metadata failed", "video", output, "err", err)
+			}
+		}
+		return nil
+	}
+
+	// The old frames' data, cut off where the directory starts
+	head, hw := io.Pipe()
+	go func() {
+		hw.CloseWithError(decodeVideo(video, hw, decodeOptions{layout: opts.layout}, nil))
+	}()
+	defer head.Close()
+	old := &countingReader{r: io.LimitReader(head, t.offset)}
+	if _, err := streamToVideo(io.MultiReader(old, r), output, opts.layout, fps, 0); err != nil {
+		return err
+	}
+	if old.n != t.offset {
+		return fmt.Errorf("%s ended after %d of its %d bytes of file data", video, old.n, t.offset)
+	}
+	return nil
+}
+
+// concatVideos writes output as the first frames of head followed by all of
+// tail, copying the frames as they are coded.
+func concatVideos(ffmpeg, head string, frames int64, tail, output string) error {
+	dir, base := filepath.Split(output)
+	cut := filepath.Join(dir, ".head-"+base)
+	defer os.Remove(cut)
+	if msg, err := exec.Command(ffmpeg, "-v", "error", "-y", "-i", head, "-map", "0:v:0", "-frames:v", fmt.Sprint(frames), "-c", "copy", cut).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to copy the frames of %s: %v: %s", head, err, strings.TrimSpace(string(msg)))
+	}
+	list := filepath.Join(dir, ".concat-"+base+".txt")
+	defer os.Remove(list)
+	quote := func(p string) string {
+		abs, _ := filepath.Abs(p)
+		return "'" + strings.ReplaceAll(abs, "'", `'\''`) + "'"
+	}
+	if err := os.WriteFile(list, []byte("file "+quote(cut)+"\nfile "+quote(tail)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", list, err)
+	}
+	if msg, err := exec.Command(ffmpeg, "-v", "error", "-y", "-f", "concat", "-safe", "0", "-i", list, "-c", "copy", output).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to join the frames: %v: %s", err, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// videoFPS returns the frame rate of a video.
+func videoFPS(video string, l layout) (int, error) {
+	cap, cleanup, err := openVideo(video, l)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+	fps := cap.fps()
+	if fps <= 0 {
+		return 0, malformed("%s has no frame rate", video)
+	}
+	return fps, nil
+}
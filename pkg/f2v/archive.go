@@ -0,0 +1,828 @@
+package f2v
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// -pack f2v packs a folder into the encoder's own archive format, for many
+// small files in one video without the headers and padding of tar or zip.
+// The files' data lies back to back, and a central directory at the end
+// lists each entry's name, offset, size and SHA-256:
+//
+//	magic     [4]byte "F2VA"
+//	version   uint8
+//	data of every entry, back to back
+//	zeros up to the start of the next frame
+//	directory JSON (archiveDirectory)
+//	trailer:
+//	  magic   [4]byte "F2VD"
+//	  offset  uint64  where the directory starts
+//	  length  uint64  its length in bytes
+//
+// Integers are big-endian. The directory starts a frame of its own, so that
+// it and the trailer can be read from the last frames of a video alone.
+// Decoding an archive video unpacks it into the output folder, checking
+// every file against its hash; ls lists it from the directory alone and
+// extract reads a single file from just the frames that hold it.
+//
+// -compress compresses the whole archive as one stream, which packs best
+// but has to be decompressed from the start to get at any file, and rules
+// out extract reading just the frames of one. With -compress-mode per-file
+// each file, or each chunk with -dedup, is compressed on its own instead:
+// the directory records the algorithm and the stored size per entry, and
+// files that look compressed already are stored as they are.
+
+const (
+	archiveVersion     = 1
+	archiveHeaderSize  = 5
+	archiveTrailerSize = 20
+)
+
+var (
+	archiveMagic        = [4]byte{'F', '2', 'V', 'A'}
+	archiveTrailerMagic = [4]byte{'F', '2', 'V', 'D'}
+)
+
+// archiveEntry is a file, folder or symlink in an archive. Offsets count
+// from the start of the archive.
+type archiveEntry struct {
+	Name     string      `json:"name"` // <dir>/<path>, with a trailing slash for folders
+	Offset   int64       `json:"offset,omitempty"`
+	Size     int64       `json:"size,omitempty"`
+	SHA256   string      `json:"sha256,omitempty"`
+	Mode     fs.FileMode `json:"mode"`
+	Modified time.Time   `json:"modified"`
+	Link     string      `json:"link,omitempty"` // symlink target
+	// with -dedup, the hashes of the chunks the file is made of, in order,
+	// in place of Offset
+	Chunks []string `json:"chunks,omitempty"`
+	// with -compress-mode per-file, the algorithm the data, or its chunks,
+	// are compressed with, and for a file not in chunks the bytes stored
+	Compression string `json:"compression,omitempty"`
+	Stored      int64  `json:"stored,omitempty"`
+}
+
+// archiveChunk is where a chunk of a -dedup archive is stored.
+type archiveChunk struct {
+	SHA256 string `json:"sha256"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Base   int    `json:"base,omitempty"` // 0 for this archive, else the video Bases[Base-1]
+	// for a chunk compressed on its own, as for archiveEntry
+	Compression string `json:"compression,omitempty"`
+	Stored      int64  `json:"stored,omitempty"`
+}
+
+type archiveDirectory struct {
+	Version int            `json:"version"`
+	Entries []archiveEntry `json:"entries"`
+	Chunks  []archiveChunk `json:"chunks,omitempty"`
+	// with -base, the videos holding chunks of this archive, nearest first
+	Bases []string `json:"bases,omitempty"`
+
+	chunkIndex map[string]int // Chunks by hash
+}
+
+// archiveSpan is a run of an entry's data in an archive.
+type archiveSpan struct {
+	base         int // as in archiveChunk
+	offset, size int64
+	sha256       string // of the chunk, for chunks
+	stored       int64  // bytes at offset when compressed, else 0
+}
+
+// length is how many bytes sp takes in the archive.
+func (sp archiveSpan) length() int64 {
+	if sp.stored > 0 {
+		return sp.stored
+	}
+	return sp.size
+}
+
+func (d *archiveDirectory) indexChunks() {
+	d.chunkIndex = make(map[string]int, len(d.Chunks))
+	for i, c := range d.Chunks {
+		d.chunkIndex[c.SHA256] = i
+	}
+}
+
+// spans returns where the data of e lies, in order.
+func (d *archiveDirectory) spans(e archiveEntry) []archiveSpan {
+	if e.Chunks == nil {
+		if e.Size == 0 {
+			return nil
+		}
+		return []archiveSpan{{offset: e.Offset, size: e.Size, stored: e.Stored}}
+	}
+	spans := make([]archiveSpan, len(e.Chunks))
+	for i, h := range e.Chunks {
+		c := d.Chunks[d.chunkIndex[h]]
+		spans[i] = archiveSpan{base: c.Base, offset: c.Offset, size: c.Size, sha256: c.SHA256, stored: c.Stored}
+	}
+	return spans
+}
+
+// archiveOptions are how an f2v archive is packed.
+type archiveOptions struct {
+	frameBytes int // data bytes per frame, where the directory starts
+	dedup      bool
+	compress   *compression // with -compress-mode per-file, for each file
+	// with -base, the video an incremental archive refers to and its
+	// directory
+	base    string
+	baseDir *archiveDirectory
+}
+
+// packArchive writes dir to w as an archive, and returns its regular files
+// as the catalog records them.
+func packArchive(dir string, filter *pathFilter, ao archiveOptions, w io.Writer) ([]catalogFile, error) {
+	a := newArchiveWriter(w, &archiveDirectory{Version: archiveVersion}, 0, ao.frameBytes)
+	a.dedup, a.compress = ao.dedup, ao.compress
+	if ao.baseDir != nil {
+		a.setBase(ao.base, ao.baseDir)
+	}
+	if _, err := a.cw.Write(append(archiveMagic[:], archiveVersion)); err != nil {
+		return nil, err
+	}
+	if err := walkPack(dir, filter, a.add); err != nil {
+		return nil, err
+	}
+	if err := a.close(); err != nil {
+		return nil, err
+	}
+	return a.dir.catalogFiles(), nil
+}
+
+// archiveWriter writes entries' data to an archive from offset on, and the
+// directory after them.
+type archiveWriter struct {
+	cw         *countingWriter // n is the archive offset
+	dir        *archiveDirectory
+	names      map[string]int // entry index by name
+	frameBytes int
+	dedup      bool         // split files into chunks stored once
+	compress   *compression // compress each file, or chunk, on its own
+	added      int          // entries add wrote
+	unchanged  int          // entries add found in the directory, or the base, as they are
+	// with -base, the chunks and entries of the base, its chunks as the
+	// directory refers to them
+	baseChunks  map[string]archiveChunk
+	baseEntries map[string]archiveEntry
+}
+
+func newArchiveWriter(w io.Writer, d *archiveDirectory, offset int64, frameBytes int) *archiveWriter {
+	a := &archiveWriter{cw: &countingWriter{w: w, n: offset}, dir: d, names: make(map[string]int), frameBytes: frameBytes}
+	for i, e := range d.Entries {
+		a.names[e.Name] = i
+	}
+	d.indexChunks()
+	return a
+}
+
+// add writes the entry name, read from full, replacing any entry of that
+// name in the directory unless it is the same size, mode and age.
+func (a *archiveWriter) add(name, full string, info fs.FileInfo) error {
+	e := archiveEntry{Name: name, Mode: info.Mode(), Modified: info.ModTime().UTC()}
+	i, ok := a.names[name]
+	if ok {
+		if old := a.dir.Entries[i]; old.Mode == e.Mode && old.Modified.Equal(e.Modified) && (!e.Mode.IsRegular() || old.Size == info.Size()) {
+			a.unchanged++
+			return nil
+		}
+	}
+	if old, found := a.baseEntries[name]; found && e.Mode.IsRegular() && old.Mode == e.Mode && old.Modified.Equal(e.Modified) && old.Size == info.Size() && old.Chunks != nil {
+		// Unchanged since the base, so its chunks are there already
+		for _, h := range old.Chunks {
+			a.useChunk(h)
+		}
+		a.unchanged++
+		return a.put(i, ok, old)
+	}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		link, err := os.Readlink(full)
+		if err != nil {
+			return err
+		}
+		e.Link = link
+	case info.Mode().IsRegular():
+		f, err := os.Open(full)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if a.dedup {
+			e.Chunks = []string{}
+			err = splitChunks(io.TeeReader(f, h), a.addChunk(&e))
+		} else {
+			err = a.addData(&e, io.TeeReader(f, h))
+		}
+		if err != nil {
+			return err
+		}
+		e.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	a.added++
+	return a.put(i, ok, e)
+}
+
+// addData writes the data of e read from r, compressed if a compresses and
+// it does not look compressed already.
+func (a *archiveWriter) addData(e *archiveEntry, r io.Reader) error {
+	e.Offset = a.cw.n
+	if a.compress == nil {
+		var err error
+		e.Size, err = io.Copy(a.cw, r)
+		return err
+	}
+	head := make([]byte, compressProbeSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	r = io.MultiReader(bytes.NewReader(head[:n]), r)
+	if n == 0 || skipCompression(head[:n]) != "" {
+		e.Size, err = io.Copy(a.cw, r)
+		return err
+	}
+	w, err := a.compress.newCompressor(a.cw)
+	if err != nil {
+		return err
+	}
+	if e.Size, err = io.Copy(w, r); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	e.Compression, e.Stored = a.compress.name(), a.cw.n-e.Offset
+	return nil
+}
+
+// put stores e in the directory, at i if found is set.
+func (a *archiveWriter) put(i int, found bool, e archiveEntry) error {
+	if found {
+		a.dir.Entries[i] = e
+	} else {
+		a.names[e.Name] = len(a.dir.Entries)
+		a.dir.Entries = append(a.dir.Entries, e)
+	}
+	return nil
+}
+
+// useChunk lists the chunk with hash h in the directory if it is only in
+// the base so far, and reports whether it is stored anywhere.
+func (a *archiveWriter) useChunk(h string) bool {
+	if _, ok := a.dir.chunkIndex[h]; ok {
+		return true
+	}
+	c, ok := a.baseChunks[h]
+	if ok {
+		a.dir.chunkIndex[h] = len(a.dir.Chunks)
+		a.dir.Chunks = append(a.dir.Chunks, c)
+	}
+	return ok
+}
+
+// addChunk returns a splitChunks callback that adds each chunk to e,
+// writing the chunks not stored yet.
+func (a *archiveWriter) addChunk(e *archiveEntry) func([]byte) error {
+	return func(chunk []byte) error {
+		sum := sha256.Sum256(chunk)
+		h := hex.EncodeToString(sum[:])
+		e.Chunks = append(e.Chunks, h)
+		e.Size += int64(len(chunk))
+		if !a.useChunk(h) {
+			c := archiveChunk{SHA256: h, Offset: a.cw.n, Size: int64(len(chunk))}
+			if a.compress != nil {
+				z, err := compressBytes(chunk, *a.compress)
+				if err != nil {
+					return err
+				}
+				// Kept only where it saves something
+				if len(z) < len(chunk) {
+					chunk, c.Compression, c.Stored = z, a.compress.name(), int64(len(z))
+				}
+			}
+			a.dir.chunkIndex[h] = len(a.dir.Chunks)
+			a.dir.Chunks = append(a.dir.Chunks, c)
+			if _, err := a.cw.Write(chunk); err != nil {
+				return err
+			}
+		}
+		if c := a.dir.Chunks[a.dir.chunkIndex[h]]; c.Compression != "" {
+			e.Compression = c.Compression
+		}
+		return nil
+	}
+}
+
+// close pads the data to the next frame and writes the directory and the
+// trailer.
+func (a *archiveWriter) close() error {
+	per := int64(a.frameBytes)
+	if pad := (per - a.cw.n%per) % per; pad > 0 {
+		if err := writeZeros(a.cw, pad); err != nil {
+			return err
+		}
+	}
+	body, err := json.Marshal(a.dir)
+	if err != nil {
+		return err
+	}
+	trailer := make([]byte, archiveTrailerSize)
+	copy(trailer, archiveTrailerMagic[:])
+	binary.BigEndian.PutUint64(trailer[4:], uint64(a.cw.n))
+	binary.BigEndian.PutUint64(trailer[12:], uint64(len(body)))
+	_, err = a.cw.Write(append(body, trailer...))
+	return err
+}
+
+// catalogFiles lists the regular files of the archive as the catalog
+// records them, for restore. Files whose chunks are not stored one after
+// the other, and files compressed on their own, are left out.
+func (d *archiveDirectory) catalogFiles() []catalogFile {
+	var files []catalogFile
+	for _, e := range d.Entries {
+		if !e.Mode.IsRegular() {
+			continue
+		}
+		spans := d.spans(e)
+		offset := e.Offset
+		if len(spans) > 0 {
+			offset = spans[0].offset
+		}
+		for i, sp := range spans {
+			if sp.base != 0 || sp.stored > 0 || i > 0 && sp.offset != spans[i-1].offset+spans[i-1].size {
+				offset = -1
+			}
+		}
+		if offset >= 0 {
+			files = append(files, catalogFile{Name: e.Name, Offset: offset, Size: e.Size})
+		}
+	}
+	return files
+}
+
+// isArchive reports whether data starts like an archive.
+func isArchive(data []byte) bool {
+	return len(data) >= archiveHeaderSize && bytes.Equal(data[:4], archiveMagic[:])
+}
+
+// parseArchiveTrailer returns where the directory of an archive size bytes
+// long starts and how long it is, from the trailer at its end.
+func parseArchiveTrailer(trailer []byte, size int64) (int64, int64, error) {
+	if len(trailer) != archiveTrailerSize || !bytes.Equal(trailer[:4], archiveTrailerMagic[:]) {
+		return 0, 0, malformed("archive has no directory trailer")
+	}
+	offset, length := binary.BigEndian.Uint64(trailer[4:]), binary.BigEndian.Uint64(trailer[12:])
+	end := uint64(size - archiveTrailerSize)
+	if offset < archiveHeaderSize || offset > end || length != end-offset {
+		return 0, 0, malformed("archive directory at %d, %d bytes long, does not fit before the trailer", offset, length)
+	}
+	return int64(offset), int64(length), nil
+}
+
+// parseArchiveDirectory parses a directory of an archive size bytes long,
+// checking that every entry lies within the data before it.
+func parseArchiveDirectory(body []byte, offset int64) (*archiveDirectory, error) {
+	var d archiveDirectory
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, malformed("invalid archive directory: %v", err)
+	}
+	if d.Version != archiveVersion {
+		return nil, unsupported("unsupported archive version %d", d.Version)
+	}
+	inData := func(off, size int64) bool {
+		return off >= 0 && size >= 0 && size <= offset && off <= offset-size
+	}
+	for _, c := range d.Chunks {
+		if c.Base < 0 || c.Base > len(d.Bases) {
+			return nil, malformed("archive chunk %s is in base %d of %d", c.SHA256, c.Base, len(d.Bases))
+		}
+		if c.Base == 0 && !inData(c.Offset, archiveSpan{size: c.Size, stored: c.Stored}.length()) {
+			return nil, malformed("archive chunk %s runs past the data", c.SHA256)
+		}
+	}
+	for _, b := range d.Bases {
+		if b != filepath.Base(b) || b == "." || b == ".." {
+			return nil, malformed("archive base %q is not a file name", b)
+		}
+	}
+	d.indexChunks()
+	for _, e := range d.Entries {
+		if e.Chunks == nil {
+			if !inData(e.Offset, archiveSpan{size: e.Size, stored: e.Stored}.length()) {
+				return nil, malformed("archive entry %s runs past the data", e.Name)
+			}
+			continue
+		}
+		var size int64
+		for _, h := range e.Chunks {
+			i, ok := d.chunkIndex[h]
+			if !ok {
+				return nil, malformed("archive entry %s refers to a chunk it does not have", e.Name)
+			}
+			size += d.Chunks[i].Size
+		}
+		if size != e.Size {
+			return nil, malformed("the chunks of archive entry %s add up to %d bytes, not %d", e.Name, size, e.Size)
+		}
+	}
+	return &d, nil
+}
+
+// parseArchive parses a whole archive's directory.
+func parseArchive(data []byte) (*archiveDirectory, error) {
+	return readArchiveAt(bytes.NewReader(data), int64(len(data)))
+}
+
+// readArchiveAt parses the directory of an archive size bytes long that ra
+// holds, reading just its header, trailer and directory.
+func readArchiveAt(ra io.ReaderAt, size int64) (*archiveDirectory, error) {
+	head := make([]byte, archiveHeaderSize)
+	if _, err := ra.ReadAt(head[:min(size, archiveHeaderSize)], 0); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	if size < archiveHeaderSize || !isArchive(head) {
+		return nil, malformed("not an archive")
+	}
+	if head[4] != archiveVersion {
+		return nil, unsupported("unsupported archive version %d", head[4])
+	}
+	if size < archiveHeaderSize+archiveTrailerSize {
+		return nil, malformed("archive ends before its trailer")
+	}
+	trailer := make([]byte, archiveTrailerSize)
+	if _, err := io.ReadFull(io.NewSectionReader(ra, size-archiveTrailerSize, archiveTrailerSize), trailer); err != nil {
+		return nil, fmt.Errorf("failed to read archive trailer: %w", err)
+	}
+	offset, length, err := parseArchiveTrailer(trailer, size)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(io.NewSectionReader(ra, offset, length), body); err != nil {
+		return nil, fmt.Errorf("failed to read archive directory: %w", err)
+	}
+	return parseArchiveDirectory(body, offset)
+}
+
+// entryPath returns where an entry unpacks to under dir, refusing names
+// that would land outside it.
+func entryPath(dir, name string) (string, error) {
+	clean := path.Clean(strings.TrimSuffix(name, "/"))
+	if clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", malformed("archive entry %q points outside the output folder", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+// checkLink refuses a symlink entry whose target is absolute or climbs out
+// of the output folder. A ".." is only allowed ahead of the target's other
+// parts, climbing from the link's own folder, so a link through another
+// link cannot climb further than its text shows.
+func checkLink(e archiveEntry) error {
+	depth := strings.Count(path.Clean(e.Name), "/")
+	ok := e.Link != "" && !path.IsAbs(e.Link) && !filepath.IsAbs(e.Link) && filepath.VolumeName(e.Link) == ""
+	down := false
+	for _, part := range strings.FieldsFunc(e.Link, func(r rune) bool { return r == '/' || r == '\\' }) {
+		switch part {
+		case ".":
+		case "..":
+			ok = ok && !down && depth > 0
+			depth--
+		default:
+			down = true
+		}
+	}
+	if !ok {
+		return malformed("archive symlink %s points outside the output folder: %q", e.Name, e.Link)
+	}
+	return nil
+}
+
+// checkParents refuses to write at out when a folder between dir and out
+// is a symlink, which the write would follow.
+func checkParents(dir, out string) error {
+	rel, err := filepath.Rel(dir, filepath.Dir(out))
+	if err != nil || rel == "." {
+		return err
+	}
+	p := dir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+		if info, err := os.Lstat(p); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return malformed("archive entry %s is under the symlink %s", out, p)
+		}
+	}
+	return nil
+}
+
+// unpackArchive writes the entries of the archive r reads into dir,
+// checking each file against its hash, and returns the top folder they went
+// into, or dir if they do not share one.
+func unpackArchive(r *archiveReader, dir string) (string, error) {
+	d := r.dir
+	root := ""
+	for i, e := range d.Entries {
+		out, err := entryPath(dir, e.Name)
+		if err != nil {
+			return "", err
+		}
+		top, _, _ := strings.Cut(e.Name, "/")
+		if i == 0 {
+			root = top
+		} else if top != root {
+			root = ""
+		}
+		if e.Mode&fs.ModeSymlink != 0 {
+			if err := checkLink(e); err != nil {
+				return "", err
+			}
+		}
+		if err := checkParents(dir, out); err != nil {
+			return "", err
+		}
+		var data []byte
+		if e.Mode.IsRegular() {
+			if data, err = r.read(e); err != nil {
+				return "", err
+			}
+		}
+		if err := writeEntry(out, e, data); err != nil {
+			return "", err
+		}
+	}
+	// Folders get their times once nothing more is written into them
+	for _, e := range d.Entries {
+		if e.Mode.IsDir() {
+			out, _ := entryPath(dir, e.Name)
+			os.Chtimes(out, e.Modified, e.Modified)
+		}
+	}
+	if root == "" {
+		return dir, nil
+	}
+	return filepath.Join(dir, root), nil
+}
+
+// writeEntry creates the file, folder or symlink of e at out.
+func writeEntry(out string, e archiveEntry, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return fmt.Errorf("failed to create output folder: %w", err)
+	}
+	switch {
+	case e.Mode.IsDir():
+		if err := os.MkdirAll(out, e.Mode.Perm()|0700); err != nil {
+			return fmt.Errorf("failed to create output folder: %w", err)
+		}
+		return nil
+	case e.Mode&fs.ModeSymlink != 0:
+		os.Remove(out)
+		if err := os.Symlink(e.Link, out); err != nil {
+			return fmt.Errorf("failed to create %s: %w", out, err)
+		}
+		return nil
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != e.SHA256 {
+		return mismatched("%s does not match its hash in the archive directory", e.Name)
+	}
+	if err := os.WriteFile(out, data, e.Mode.Perm()); err != nil {
+		return fmt.Errorf("failed to write %s: %w", out, err)
+	}
+	os.Chtimes(out, e.Modified, e.Modified)
+	return nil
+}
+
+// readArchiveDirectory returns the directory of the f2v archive in a video.
+// For a plain archive, taken as the frames hold it, only the last frames
+// are read: the trailer in them says which frames hold the directory. When
+// the data was encrypted, compressed or otherwise changed, or the frames
+// cannot be sought to, the whole video is decoded instead.
+func readArchiveDirectory(video string, opts decodeOptions) (*archiveDirectory, error) {
+	t, err := readArchiveTail(video, opts.layout)
+	if err == nil {
+		return t.dir, nil
+	}
+	if !errors.Is(err, errNoTail) {
+		return nil, err
+	}
+	d, _, err := decodeArchive(video, opts)
+	return d, err
+}
+
+// decodeArchive decodes the whole f2v archive in a video.
+func decodeArchive(video string, opts decodeOptions) (*archiveDirectory, []byte, error) {
+	var data bytes.Buffer
+	if err := decodeVideo(video, &data, opts, nil); err != nil {
+		return nil, nil, err
+	}
+	if !isArchive(data.Bytes()) {
+		return nil, nil, fmt.Errorf("%s does not hold an f2v archive", video)
+	}
+	d, err := parseArchive(data.Bytes())
+	return d, data.Bytes(), err
+}
+
+// errNoTail is why readArchiveTail could not read a video from its end.
+var errNoTail = errors.New("archive cannot be read from the end of the video")
+
+// archiveTail is the directory of a plain archive as read from the end of a
+// video.
+type archiveTail struct {
+	dir    *archiveDirectory
+	offset int64 // where the directory starts
+	per    int64 // data bytes in a frame
+}
+
+// readArchiveTail reads the directory of a plain archive from the end of a
+// video.
+func readArchiveTail(video string, l layout) (*archiveTail, error) {
+	if isURL(video) {
+		return nil, errNoTail
+	}
+	cap, cleanup, err := openVideo(video, l)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	n := cap.Info().Frames
+	if n <= 0 {
+		return nil, errNoTail
+	}
+	// The trailer may straddle the last two frames before the index frame;
+	// one more frame covers a duplicate or a frame count that is one off
+	cap.SeekFrame(max(0, n-4))
+	var prev, last *scannedFrame
+	err = scanFrames(cap, l, func(f scannedFrame) (bool, error) {
+		if f.err != nil || f.header.flags&(dataFlags|frameFlagParity|frameFlagTable) != 0 {
+			return false, errNoTail
+		}
+		if last == nil || f.header.seq > last.header.seq {
+			f.data = slices.Clone(f.data)
+			prev, last = last, &f
+		}
+		return !f.header.last(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if last == nil || !last.header.last() {
+		return nil, errNoTail
+	}
+	per := int64(last.capacity)
+	seq := int64(last.header.seq)
+	size := seq*per + int64(len(last.data))
+	tail := last.data
+	if prev != nil && prev.header.seq+1 == last.header.seq {
+		tail = append(prev.data, tail...)
+	}
+	if int64(len(tail)) < min(size, archiveTrailerSize) {
+		return nil, errNoTail
+	}
+	if size < archiveHeaderSize+archiveTrailerSize {
+		return nil, fmt.Errorf("%s does not hold an f2v archive", video)
+	}
+	offset, length, err := parseArchiveTrailer(tail[len(tail)-archiveTrailerSize:], size)
+	if err != nil {
+		return nil, fmt.Errorf("%s does not hold an f2v archive", video)
+	}
+	first := offset / per
+	span, err := readFrameSpan(video, l, first, seq)
+	if err != nil {
+		return nil, err
+	}
+	start := offset - first*per
+	d, err := parseArchiveDirectory(span[start:start+length], offset)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveTail{dir: d, offset: offset, per: per}, nil
+}
+
+// print lists the entries of d as ls -l would, with each file's hash.
+func (d *archiveDirectory) print(w io.Writer, u units) {
+	var files, folders int
+	var total int64
+	for _, e := range d.Entries {
+		hash, name := e.SHA256, e.Name
+		switch {
+		case e.Mode.IsDir():
+			folders++
+		case e.Mode&fs.ModeSymlink != 0:
+			name += " -> " + e.Link
+		default:
+			files++
+			total += e.Size
+			if e.Compression != "" {
+				name += " (" + e.Compression + ")"
+			}
+		}
+		if hash == "" {
+			hash = "-"
+		}
+		fmt.Fprintf(w, "%s %10s %s %-64s %s\n", e.Mode, u.bytes(e.Size), e.Modified.Local().Format("2006-01-02 15:04"), hash, name)
+	}
+	fmt.Fprintf(w, "%s files and %s folders, %s in total\n", u.count(int64(files)), u.count(int64(folders)), u.bytes(total))
+	if len(d.Bases) > 0 {
+		fmt.Fprintf(w, "Based on %s\n", strings.Join(d.Bases, ", "))
+	}
+}
+
+// find returns the entry named name, or if no entry is, the only one named
+// so below the top folder.
+func (d *archiveDirectory) find(name string) (archiveEntry, bool) {
+	var found []archiveEntry
+	for _, e := range d.Entries {
+		if e.Name == name {
+			return e, true
+		}
+		if _, rest, _ := strings.Cut(e.Name, "/"); rest == name {
+			found = append(found, e)
+		}
+	}
+	if len(found) != 1 {
+		return archiveEntry{}, false
+	}
+	return found[0], true
+}
+
+// extractEntry writes the file name of the archive in a video into dir and
+// returns its path. For a plain archive only the frames holding the file are
+// read, found from the directory at the end of the video.
+func extractEntry(video, name, dir string, opts decodeOptions) (string, error) {
+	r, err := openArchive(video, opts)
+	if err != nil {
+		return "", err
+	}
+	e, ok := r.dir.find(name)
+	if !ok {
+		return "", fmt.Errorf("%s is not in %s", name, video)
+	}
+	if !e.Mode.IsRegular() {
+		return "", fmt.Errorf("%s is not a file", e.Name)
+	}
+	data, err := r.read(e)
+	if err != nil {
+		return "", err
+	}
+	out := filepath.Join(dir, path.Base(e.Name))
+	return out, writeEntry(out, e, data)
+}
+
+// readArchiveSpans returns the data at spans of the archive in video, read
+// from just the frames holding them, each run of frames once.
+func readArchiveSpans(video string, l layout, per int64, spans [][2]int64) ([]byte, error) {
+	var runs [][2]int64
+	for _, s := range spans {
+		runs = append(runs, [2]int64{s[0] / per, (s[0] + s[1] - 1) / per})
+	}
+	slices.SortFunc(runs, func(a, b [2]int64) int { return cmp.Compare(a[0], b[0]) })
+	var merged [][2]int64
+	for _, r := range runs {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1]+1 {
+			merged[n-1][1] = max(merged[n-1][1], r[1])
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	read := make([][]byte, len(merged))
+	for i, r := range merged {
+		var err error
+		if read[i], err = readFrameSpan(video, l, r[0], r[1]); err != nil {
+			return nil, err
+		}
+	}
+	var out []byte
+	for _, s := range spans {
+		i, _ := slices.BinarySearchFunc(merged, s[0]/per, func(r [2]int64, frame int64) int {
+			switch {
+			case r[1] < frame:
+				return -1
+			case r[0] > frame:
+				return 1
+			}
+			return 0
+		})
+		start := s[0] - merged[i][0]*per
+		out = append(out, read[i][start:start+s[1]]...)
+	}
+	return out, nil
+}
@@ -0,0 +1,335 @@
+package f2v
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// packTestBytes packs files, by name under a folder called pack, into an
+// f2v archive in memory.
+func packTestBytes(t *testing.T, dedup bool, files map[string][]byte) []byte {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), "pack")
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := packArchive(src, nil, archiveOptions{frameBytes: 1000, dedup: dedup}, &buf); err != nil {
+		t.Fatalf("packing: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// withDirectory returns the archive data with its directory replaced by
+// body, and the trailer rewritten to match.
+func withDirectory(t *testing.T, data, body []byte) []byte {
+	t.Helper()
+	offset, _, err := parseArchiveTrailer(data[len(data)-archiveTrailerSize:], int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := append(bytes.Clone(data[:offset]), body...)
+	trailer := make([]byte, archiveTrailerSize)
+	copy(trailer, archiveTrailerMagic[:])
+	binary.BigEndian.PutUint64(trailer[4:], uint64(offset))
+	binary.BigEndian.PutUint64(trailer[12:], uint64(len(body)))
+	return append(out, trailer...)
+}
+
+// changeDirectory returns the archive data with its directory changed.
+func changeDirectory(t *testing.T, data []byte, change func(d *archiveDirectory)) []byte {
+	t.Helper()
+	d, err := parseArchive(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(d)
+	body, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return withDirectory(t, data, body)
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	shared := randomBytes(t, 300<<10)
+	files := map[string][]byte{
+		"shared.bin":      shared,
+		"docs/copy.bin":   shared,
+		"docs/notes.txt":  []byte("notes\n"),
+		"empty":           nil,
+		"deep/a/b/c.json": []byte(`{"c": true}`),
+	}
+	for _, dedup := range []bool{false, true} {
+		data := packTestBytes(t, dedup, files)
+		d, err := parseArchive(data)
+		if err != nil {
+			t.Fatalf("dedup %v: %v", dedup, err)
+		}
+		if dedup {
+			var stored int64
+			for _, c := range d.Chunks {
+				stored += c.Size
+			}
+			if limit := int64(len(shared) + 100); stored > limit {
+				t.Errorf("dedup stores %d bytes of chunks, want no more than %d", stored, limit)
+			}
+		}
+		r := &archiveReader{dir: d, data: bytes.NewReader(data), size: int64(len(data))}
+		for name, want := range files {
+			e, ok := d.find(name)
+			if !ok {
+				t.Errorf("dedup %v: %s is not in the archive", dedup, name)
+				continue
+			}
+			if got, err := r.read(e); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("dedup %v: %s read back as %d bytes, %v", dedup, name, len(got), err)
+			}
+		}
+
+		out := t.TempDir()
+		root, err := unpackArchive(r, out)
+		if err != nil {
+			t.Fatalf("dedup %v: unpacking: %v", dedup, err)
+		}
+		if root != filepath.Join(out, "pack") {
+			t.Errorf("dedup %v: unpacked into %s", dedup, root)
+		}
+		for name, want := range files {
+			if got, err := os.ReadFile(filepath.Join(root, name)); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("dedup %v: %s unpacked as %d bytes, %v", dedup, name, len(got), err)
+			}
+		}
+	}
+}
+
+func TestArchiveTamper(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		data := packTestBytes(t, dedup, map[string][]byte{"a.bin": randomBytes(t, 5000)})
+		d, err := parseArchive(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, _ := d.find("a.bin")
+		spans := d.spans(e)
+		data[spans[len(spans)-1].offset+10] ^= 1
+		r := &archiveReader{dir: d, data: bytes.NewReader(data), size: int64(len(data))}
+		if _, err := unpackArchive(r, t.TempDir()); !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("dedup %v: unpacked an altered file with %v, want a checksum mismatch", dedup, err)
+		}
+	}
+}
+
+func TestParseArchiveRefuses(t *testing.T) {
+	plain := packTestBytes(t, false, map[string][]byte{"a.txt": []byte("a"), "b.bin": randomBytes(t, 3000)})
+	dedup := packTestBytes(t, true, map[string][]byte{"a.txt": []byte("a"), "b.bin": randomBytes(t, 3000)})
+	entry := func(d *archiveDirectory, name string) *archiveEntry {
+		for i := range d.Entries {
+			if d.Entries[i].Name == "pack/"+name {
+				return &d.Entries[i]
+			}
+		}
+		t.Fatalf("%s is not in the archive", name)
+		return nil
+	}
+	offset, _, _ := parseArchiveTrailer(plain[len(plain)-archiveTrailerSize:], int64(len(plain)))
+	for _, c := range []struct {
+		what string
+		data []byte
+		want error
+	}{
+		{"no magic", append([]byte("F2VX"), plain[4:]...), ErrCorruptFrame},
+		{"version 2", append([]byte("F2VA\x02"), plain[5:]...), ErrUnsupportedVersion},
+		{"header only", plain[:archiveHeaderSize], ErrCorruptFrame},
+		{"cut short", plain[:len(plain)-1], ErrCorruptFrame},
+		{"trailer with no magic", append(bytes.Clone(plain[:len(plain)-archiveTrailerSize]), make([]byte, archiveTrailerSize)...), ErrCorruptFrame},
+		{"directory past the trailer", func() []byte {
+			c := bytes.Clone(plain)
+			binary.BigEndian.PutUint64(c[len(c)-16:], uint64(len(c)))
+			return c
+		}(), ErrCorruptFrame},
+		{"directory inside the header", func() []byte {
+			c := bytes.Clone(plain)
+			binary.BigEndian.PutUint64(c[len(c)-16:], 2)
+			return c
+		}(), ErrCorruptFrame},
+		{"directory that is not JSON", withDirectory(t, plain, []byte("{\"version\": 1,")), ErrCorruptFrame},
+		{"directory version 2", changeDirectory(t, plain, func(d *archiveDirectory) { d.Version = 2 }), ErrUnsupportedVersion},
+		{"entry past the data", changeDirectory(t, plain, func(d *archiveDirectory) { entry(d, "b.bin").Offset = offset - 10 }), ErrCorruptFrame},
+		{"entry at a negative offset", changeDirectory(t, plain, func(d *archiveDirectory) { entry(d, "b.bin").Offset = -1 }), ErrCorruptFrame},
+		{"missing chunk", changeDirectory(t, dedup, func(d *archiveDirectory) { entry(d, "b.bin").Chunks[0] = hashOf('0') }), ErrCorruptFrame},
+		{"chunks that do not add up", changeDirectory(t, dedup, func(d *archiveDirectory) { entry(d, "b.bin").Size++ }), ErrCorruptFrame},
+		{"chunk past the data", changeDirectory(t, dedup, func(d *archiveDirectory) { d.Chunks[0].Offset = offset }), ErrCorruptFrame},
+		{"chunk in a base it does not list", changeDirectory(t, dedup, func(d *archiveDirectory) { d.Chunks[0].Base = 1 }), ErrCorruptFrame},
+		{"base that is not a file name", changeDirectory(t, dedup, func(d *archiveDirectory) { d.Bases = []string{"../base.mkv"} }), ErrCorruptFrame},
+	} {
+		if _, err := parseArchive(c.data); !errors.Is(err, c.want) {
+			t.Errorf("%s: %v, want %v", c.what, err, c.want)
+		}
+	}
+}
+
+func TestEntryPath(t *testing.T) {
+	dir := filepath.Join("out", "dir")
+	for name, want := range map[string]string{
+		"pack/a.txt":     filepath.Join(dir, "pack", "a.txt"),
+		"pack/docs/":     filepath.Join(dir, "pack", "docs"),
+		"pack/../b.txt":  filepath.Join(dir, "b.txt"),
+		"./pack/./c.txt": filepath.Join(dir, "pack", "c.txt"),
+	} {
+		if got, err := entryPath(dir, name); err != nil || got != want {
+			t.Errorf("%s unpacks to %s, %v; want %s", name, got, err, want)
+		}
+	}
+	for _, name := range []string{"", ".", "/", "..", "../x", "/etc/passwd", "pack/../../x", "a/../../../x"} {
+		if got, err := entryPath(dir, name); !errors.Is(err, ErrCorruptFrame) {
+			t.Errorf("%q unpacks to %s, %v", name, got, err)
+		}
+	}
+}
+
+func TestUnpackArchiveStaysInside(t *testing.T) {
+	data := packTestBytes(t, false, map[string][]byte{"x.txt": []byte("x")})
+	link := func(name, target string) archiveEntry {
+		return archiveEntry{Name: "pack/" + name, Mode: fs.ModeSymlink | 0777, Link: target}
+	}
+	// under returns the archive with a symlink and then x.txt below it
+	under := func(l archiveEntry) []byte {
+		return changeDirectory(t, data, func(d *archiveDirectory) {
+			for i, e := range d.Entries {
+				if e.Name == "pack/x.txt" {
+					d.Entries[i].Name = l.Name + "/x.txt"
+					d.Entries = append(d.Entries[:i], append([]archiveEntry{l}, d.Entries[i:]...)...)
+					return
+				}
+			}
+			t.Fatal("x.txt is not in the archive")
+		})
+	}
+	outside := t.TempDir()
+	for _, c := range []struct {
+		what string
+		data []byte
+	}{
+		{"absolute link", under(link("a", outside))},
+		{"link climbing out", under(link("a", "../../x"))},
+		{"link climbing past the folder", under(link("a", "../.."))},
+		{"link climbing through its own parts", under(link("a", "docs/../../.."))},
+		{"link that climbs after going down", under(link("sub/a", "b/../../.."))},
+		{"link inside the folder", under(link("a", "."))},
+	} {
+		out := filepath.Join(t.TempDir(), "out")
+		d, err := parseArchive(c.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &archiveReader{dir: d, data: bytes.NewReader(c.data), size: int64(len(c.data))}
+		if _, err := unpackArchive(r, out); !errors.Is(err, ErrCorruptFrame) {
+			t.Errorf("%s: unpacked with %v, want it refused", c.what, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "x.txt")); err == nil {
+		t.Error("a file was written outside the output folder")
+	}
+
+	// A symlink already in the output folder is not followed either
+	out := t.TempDir()
+	os.MkdirAll(filepath.Join(out, "pack"), 0755)
+	if err := os.Symlink(outside, filepath.Join(out, "pack", "a")); err != nil {
+		t.Skip("cannot create symlinks:", err)
+	}
+	plain := changeDirectory(t, data, func(d *archiveDirectory) {
+		for i := range d.Entries {
+			if d.Entries[i].Name == "pack/x.txt" {
+				d.Entries[i].Name = "pack/a/x.txt"
+			}
+		}
+	})
+	d, _ := parseArchive(plain)
+	r := &archiveReader{dir: d, data: bytes.NewReader(plain), size: int64(len(plain))}
+	if _, err := unpackArchive(r, out); !errors.Is(err, ErrCorruptFrame) {
+		t.Errorf("wrote through a symlink in the output folder with %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "x.txt")); err == nil {
+		t.Error("a file was written outside the output folder")
+	}
+}
+
+func TestUnpackArchiveLinks(t *testing.T) {
+	data := packTestBytes(t, false, map[string][]byte{"docs/x.txt": []byte("x")})
+	data = changeDirectory(t, data, func(d *archiveDirectory) {
+		for _, l := range [][2]string{{"pack/to-x", "docs/x.txt"}, {"pack/docs/up", "../docs/./x.txt"}, {"pack/docs/top", ".."}} {
+			d.Entries = append(d.Entries, archiveEntry{Name: l[0], Mode: fs.ModeSymlink | 0777, Link: l[1]})
+		}
+	})
+	d, err := parseArchive(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	r := &archiveReader{dir: d, data: bytes.NewReader(data), size: int64(len(data))}
+	root, err := unpackArchive(r, out)
+	if err != nil {
+		t.Fatalf("unpacking links that stay inside: %v", err)
+	}
+	for _, name := range []string{"to-x", "docs/up", "docs/top/docs/x.txt"} {
+		if got, err := os.ReadFile(filepath.Join(root, name)); err != nil || string(got) != "x" {
+			t.Errorf("%s reads %q, %v", name, got, err)
+		}
+	}
+}
+
+func FuzzParseArchive(f *testing.F) {
+	src := filepath.Join(f.TempDir(), "pack")
+	os.MkdirAll(filepath.Join(src, "docs"), 0755)
+	os.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(src, "docs", "b.bin"), bytes.Repeat([]byte("b"), 3000), 0644)
+	for _, dedup := range []bool{false, true} {
+		var buf bytes.Buffer
+		if _, err := packArchive(src, nil, archiveOptions{frameBytes: 100, dedup: dedup}, &buf); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+		f.Add(buf.Bytes()[:buf.Len()-1])
+	}
+	f.Add(append(archiveMagic[:], archiveVersion))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d, err := parseArchive(data)
+		if err != nil {
+			return
+		}
+		// Every entry lies within the data before the directory
+		r := &archiveReader{dir: d, data: bytes.NewReader(data), size: int64(len(data))}
+		for _, e := range d.Entries {
+			if e.Mode.IsRegular() && !hasBaseChunks(d, e) {
+				r.read(e)
+			}
+		}
+		if _, err := parseArchive(data[:len(data)-1]); err == nil {
+			t.Fatal("parsed an archive cut short")
+		}
+	})
+}
+
+// hasBaseChunks reports whether some chunk of e is kept in a base video,
+// which reading e would open.
+func hasBaseChunks(d *archiveDirectory, e archiveEntry) bool {
+	for _, sp := range d.spans(e) {
+		if sp.base > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,580 @@
+package f2v
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+// The data to encode and the videos to decode are read from a Source, and
+// videos and decoded files are written to a Sink, so local files, HTTP, S3,
+// YouTube and standard input and output are all the same to an encode or a
+// decode. OpenCV only reads and writes videos on disk, so a video read from
+// anywhere else is downloaded to a temporary file first and one written is
+// spooled to one until it is complete.
+
+// A Source is where objects are read from: files, videos, or anything else
+// by name.
+type Source interface {
+	// Open opens the object called name for reading.
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names of every object under prefix, sorted, for
+	// reading a whole folder. Backends with no folders fail with an error
+	// wrapping errors.ErrUnsupported.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// A Sink is where objects are written to.
+type Sink interface {
+	// Create starts writing the object called name.
+	Create(ctx context.Context, name string) (SinkWriter, error)
+}
+
+// A SinkWriter is an object being written to a Sink. Nothing appears under
+// its name until Finalize succeeds; closing it first abandons it.
+type SinkWriter interface {
+	io.Writer
+	// Finalize finishes the object and makes it visible under its name.
+	Finalize() error
+	// Close releases the writer, abandoning the object if it was not
+	// finalized.
+	Close() error
+}
+
+// SourceFor returns the backend location is read from and the name it has
+// there: standard input for "-", S3 for s3://bucket/key with credentials
+// from the environment, YouTube for its watch URLs, HTTP with any token the
+// environment gives for any other http or https URL, a Plugin for
+// name://... when f2v-name is on the PATH and the local file system for
+// anything else.
+func SourceFor(location string) (Source, string, error) {
+	switch {
+	case location == "-":
+		return Stdio{}, location, nil
+	case strings.HasPrefix(location, "s3://"):
+		s, key, err := s3Location(location)
+		return s, key, err
+	case isYouTubeURL(location):
+		return YouTubeFromEnv(), location, nil
+	}
+	if scheme, ok := pluginScheme(location); ok {
+		return Plugin{Name: scheme}, location, nil
+	}
+	if isURL(location) {
+		return HTTPFromEnv(), location, nil
+	}
+	return Dir(""), location, nil
+}
+
+// SinkFor returns the backend location is written to and the name it has
+// there, as SourceFor does; YouTube takes no uploads.
+func SinkFor(location string) (Sink, string, error) {
+	switch {
+	case location == "-":
+		return Stdio{}, location, nil
+	case strings.HasPrefix(location, "s3://"):
+		s, key, err := s3Location(location)
+		return s, key, err
+	case isYouTubeURL(location):
+		return nil, "", fmt.Errorf("uploading to YouTube: %w", errors.ErrUnsupported)
+	}
+	if scheme, ok := pluginScheme(location); ok {
+		return Plugin{Name: scheme}, location, nil
+	}
+	if isURL(location) {
+		return HTTPFromEnv(), location, nil
+	}
+	return Dir(""), location, nil
+}
+
+// isYouTubeURL reports whether location is a YouTube video page, which has
+// to be downloaded through YouTube's own API.
+func isYouTubeURL(location string) bool {
+	if !isURL(location) {
+		return false
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return false
+	}
+	switch strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.") {
+	case "youtube.com", "m.youtube.com", "music.youtube.com", "youtu.be":
+		return true
+	}
+	return false
+}
+
+// Dir is the local file system under a folder, with slash-separated names
+// relative to it. Dir("") takes names as paths of their own.
+type Dir string
+
+func (d Dir) path(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(name))
+}
+
+// Open opens the file called name.
+func (d Dir) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(d.path(name))
+}
+
+// List returns the names of the files in the folder called prefix and its
+// subfolders.
+func (d Dir) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	root := d.path(prefix)
+	err := filepath.WalkDir(root, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !e.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, path.Join(prefix, filepath.ToSlash(rel)))
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// Create writes the file called name, creating its folder if need be. The
+// data goes to a temporary file next to it, renamed into place once
+// finalized.
+func (d Dir) Create(ctx context.Context, name string) (SinkWriter, error) {
+	p := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*")
+	if err != nil {
+		return nil, err
+	}
+	return &spoolWriter{f: f, send: func(f *os.File, size int64) error {
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Rename(f.Name(), p)
+	}}, nil
+}
+
+// HTTP reads objects with GET and writes them with PUT, their names being
+// their URLs.
+type HTTP struct {
+	Client *http.Client // http.DefaultClient if nil
+	Header http.Header  // added to every request, for authorization say
+}
+
+// HTTPFromEnv returns an HTTP that sends the bearer token in F2V_HTTP_TOKEN,
+// if it is set, with every request.
+func HTTPFromEnv() HTTP {
+	var h HTTP
+	if token := os.Getenv("F2V_HTTP_TOKEN"); token != "" {
+		h.Header = http.Header{"Authorization": {"Bearer " + token}}
+	}
+	return h
+}
+
+func (h HTTP) do(ctx context.Context, method, name string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, name, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range h.Header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, &statusError{code: resp.StatusCode, msg: fmt.Sprintf("%s %s: %s", method, name, resp.Status)}
+	}
+	return resp, nil
+}
+
+// Open downloads the object at the URL name.
+func (h HTTP) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := h.do(ctx, http.MethodGet, name, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List fails: HTTP has no way to list a folder.
+func (h HTTP) List(ctx context.Context, prefix string) ([]string, error) {
+	return nil, fmt.Errorf("listing %s over HTTP: %w", prefix, errors.ErrUnsupported)
+}
+
+// Create uploads the object to the URL name once it is finalized.
+func (h HTTP) Create(ctx context.Context, name string) (SinkWriter, error) {
+	return newSpoolWriter(func(f *os.File, size int64) error {
+		resp, err := h.do(ctx, http.MethodPut, name, f, size)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	})
+}
+
+// YouTube reads videos from their YouTube watch URLs, in the smallest
+// format offered since only the frames matter, and finds the uploads of a
+// channel by what they say (see locate.go).
+type YouTube struct {
+	Token  string       // an OAuth access token for the channel, for Find
+	Client *http.Client // http.DefaultClient if nil, for Find
+}
+
+// YouTubeFromEnv returns a YouTube with the access token in
+// F2V_YOUTUBE_TOKEN, if it is set.
+func YouTubeFromEnv() YouTube {
+	return YouTube{Token: os.Getenv("F2V_YOUTUBE_TOKEN")}
+}
+
+// Open downloads the video at the URL name.
+func (YouTube) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	client := youtube.Client{}
+	video, err := client.GetVideoContext(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get video info: %w", err)
+	}
+
+	// Try to get the lowest quality format to minimize download size
+	// since we only need the video for data extraction
+	formats := video.Formats.Quality("144p")
+	if len(formats) == 0 {
+		// Fallback to any available format
+		formats = video.Formats
+	}
+	if len(formats) == 0 {
+		return nil, fmt.Errorf("no suitable video formats found")
+	}
+
+	// Sort formats by size (ascending) and pick the smallest one
+	sort.Slice(formats, func(i, j int) bool {
+		return formats[i].ContentLength < formats[j].ContentLength
+	})
+
+	stream, _, err := client.GetStreamContext(ctx, video, &formats[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get video stream: %w", err)
+	}
+	return stream, nil
+}
+
+// List fails: videos are only read one URL at a time.
+func (YouTube) List(ctx context.Context, prefix string) ([]string, error) {
+	return nil, fmt.Errorf("listing YouTube videos: %w", errors.ErrUnsupported)
+}
+
+// Stdio reads from standard input and writes to standard output, whatever
+// the name.
+type Stdio struct {
+	In  io.Reader // os.Stdin if nil
+	Out io.Writer // os.Stdout if nil
+}
+
+// Open returns standard input, which stays open when closed.
+func (s Stdio) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if s.In == nil {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return io.NopCloser(s.In), nil
+}
+
+// List fails: standard input holds a single object.
+func (s Stdio) List(ctx context.Context, prefix string) ([]string, error) {
+	return nil, fmt.Errorf("listing standard input: %w", errors.ErrUnsupported)
+}
+
+// Create writes straight to standard output, which cannot take back what an
+// abandoned object wrote.
+func (s Stdio) Create(ctx context.Context, name string) (SinkWriter, error) {
+	if s.Out == nil {
+		return stdoutWriter{os.Stdout}, nil
+	}
+	return stdoutWriter{s.Out}, nil
+}
+
+type stdoutWriter struct{ io.Writer }
+
+func (stdoutWriter) Finalize() error { return nil }
+func (stdoutWriter) Close() error    { return nil }
+
+// spoolWriter collects an object in a temporary file and hands it to send
+// when finalized, for backends that need its size up front or that must not
+// show it before it is whole.
+type spoolWriter struct {
+	f    *os.File
+	size int64
+	send func(f *os.File, size int64) error
+	done bool
+}
+
+func newSpoolWriter(send func(f *os.File, size int64) error) (SinkWriter, error) {
+	f, err := os.CreateTemp("", "f2v-spool-*")
+	if err != nil {
+		return nil, err
+	}
+	return &spoolWriter{f: f, send: send}, nil
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *spoolWriter) Finalize() error {
+	if w.done {
+		return fmt.Errorf("%s is already finalized", w.f.Name())
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := w.send(w.f, w.size); err != nil {
+		return err
+	}
+	w.done = true
+	return nil
+}
+
+func (w *spoolWriter) Close() error {
+	w.f.Close()
+	err := os.Remove(w.f.Name())
+	if w.done {
+		return nil // renamed into place, or sent and no longer needed
+	}
+	return err
+}
+
+// fetch downloads the object called name from src into a temporary file
+// named like it, so its extension still tells what it is. cleanup removes
+// the file.
+func fetch(ctx context.Context, log *slog.Logger, src Source, name string) (local string, cleanup func(), err error) {
+	dir, err := os.MkdirTemp("", "f2v-fetch-*")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	base := path.Base(strings.TrimRight(name, "/"))
+	if u, err := url.Parse(name); err == nil && isURL(name) {
+		base = path.Base(u.Path)
+	}
+	if base == "." || base == "/" || base == "" {
+		base = "download"
+	}
+	local = filepath.Join(dir, base)
+	if err := download(ctx, log, src, name, local); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return local, cleanup, nil
+}
+
+// statusError is a request a server answered with a status other than 2xx.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+// downloadAttempts is how many times a download is tried that fails in a
+// way trying again could mend.
+const downloadAttempts = 3
+
+// retryable reports whether a download that failed with err could work if
+// tried again: the connection failed or broke off, or the server was busy
+// or failing.
+func retryable(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code == http.StatusTooManyRequests || status.code >= 500
+	}
+	var netErr *net.OpError
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// download copies the object called name from src to the file local. One
+// that fails in a way trying again could mend is tried again, waiting a
+// second longer each time, with a warning to log.
+func download(ctx context.Context, log *slog.Logger, src Source, name, local string) error {
+	for attempt := 1; ; attempt++ {
+		err := downloadOnce(ctx, src, name, local)
+		if err == nil || attempt == downloadAttempts || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		wait := time.Duration(attempt) * time.Second
+		log.Warn("Download retried", "name", name, "attempt", attempt+1, "wait", wait, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func downloadOnce(ctx context.Context, src Source, name, local string) error {
+	r, err := src.Open(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1024*1024) // 1MB buffer
+	if _, err := io.CopyBuffer(f, contextReader{ctx, r}, buf); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	return f.Close()
+}
+
+// upload copies the file local to the object called name in dst,
+// described by p when dst takes descriptions and p is not nil.
+func upload(ctx context.Context, dst Sink, local, name string, p *parsedUpload) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var w SinkWriter
+	if ds, ok := dst.(DescribedSink); ok && p != nil {
+		m, derr := p.describe(local)
+		if derr != nil {
+			return derr
+		}
+		w, err = ds.CreateDescribed(ctx, name, m)
+	} else {
+		w, err = dst.Create(ctx, name)
+	}
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, contextReader{ctx, f}); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", name, err)
+	}
+	return w.Finalize()
+}
+
+// stageBackends runs an encode or decode between input and output on the
+// local disk when either is remote. A remote input is downloaded into a
+// temporary folder first, all of it for a folder, which is a location ending
+// in a slash, except for a single video to decode, which the decode
+// downloads itself. A remote output is written to a temporary folder that is
+// uploaded under it after, described by describe if it is not nil. It
+// returns the locations uploaded to.
+func stageBackends(ctx context.Context, input, output string, decode bool, describe *parsedUpload, run func(input, output string)) ([]string, error) {
+	if isURL(input) && (!decode || strings.HasSuffix(input, "/")) {
+		src, name, err := SourceFor(input)
+		if err != nil {
+			return nil, err
+		}
+		dir, err := os.MkdirTemp("", "f2v-input-*")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		if strings.HasSuffix(input, "/") {
+			names, err := src.List(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range names {
+				local := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(n, name)))
+				if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+					return nil, err
+				}
+				if err := download(ctx, slog.Default(), src, n, local); err != nil {
+					return nil, err
+				}
+			}
+			input = dir
+		} else {
+			local, cleanup, err := fetch(ctx, slog.Default(), src, name)
+			if err != nil {
+				return nil, err
+			}
+			defer cleanup()
+			input = local
+		}
+	}
+	if !isURL(output) {
+		run(input, output)
+		return nil, nil
+	}
+	dst, prefix, err := SinkFor(output)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := dst.(DescribedSink); describe != nil && !ok {
+		slog.Warn("Uploading without titles or descriptions; the output keeps none", "output", output)
+	}
+	dir, err := os.MkdirTemp("", "f2v-output-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	run(input, dir)
+	var uploaded []string
+	err = filepath.WalkDir(dir, func(p string, e fs.DirEntry, err error) error {
+		if err != nil || !e.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if err := upload(ctx, dst, p, joinLocation(prefix, rel), describe); err != nil {
+			return err
+		}
+		uploaded = append(uploaded, joinLocation(output, rel))
+		return nil
+	})
+	return uploaded, err
+}
+
+// reportUploads tells what stageBackends uploaded.
+func reportUploads(uploaded []string) {
+	for _, location := range uploaded {
+		summarize(os.Stdout, "Uploaded %s", location)
+	}
+}
+
+// joinLocation names the object rel under the folder prefix of a backend.
+func joinLocation(prefix, rel string) string {
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return prefix + rel
+	}
+	return prefix + "/" + rel
+}
@@ -0,0 +1,267 @@
+package f2v
+
+import "fmt"
+
+// Barcode mode is a colored 2-D code in the style of HCCB and JAB Code:
+// square cells of blockSize pixels, each painted in one of eight palette
+// colors and so carrying three bits. The first cell row repeats the palette,
+// and the decoder classifies every other cell by the nearest of the colors
+// it actually measured there, so hue and level shifts from a re-encode move
+// the references along with the data. Like QR codes the payload is protected
+// by Reed-Solomon error correction inside the frame: the cell stream is cut
+// into codewords of at most 255 bytes with barcodeECC check bytes each,
+// interleaved byte by byte so a damaged patch of the frame spreads over all
+// of them.
+
+const (
+	barcodeBits = 3
+	barcodeECC  = 32 // check bytes per codeword; corrects up to 16 bad bytes in each
+)
+
+// barcodePalette holds the eight corners of the BGR cube, indexed by the
+// three bits a cell carries.
+var barcodePalette = [1 << barcodeBits][3]byte{
+	{0, 0, 0}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+	{0, 0, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+}
+
+// barcodeCodewords returns the number of codewords per frame and their
+// length; the few cell bytes left over are unused.
+func (l layout) barcodeCodewords() (count, length int) {
+	raw := l.blocksX() * (l.blocksY() - 1) * barcodeBits / 8
+	if raw <= 0 {
+		return 0, 0
+	}
+	count = (raw + 254) / 255
+	return count, raw / count
+}
+
+func (l layout) barcodeCapacity() int {
+	count, length := l.barcodeCodewords()
+	if length <= barcodeECC {
+		return 0
+	}
+	return count * (length - barcodeECC)
+}
+
+// fillCell paints one cell of the grid, counting rows from the top of the
+// data area.
+func (l layout) fillCell(frameData []byte, bx, by int, color [3]byte) {
+	for y := l.band() + by*l.blockSize; y < l.band()+(by+1)*l.blockSize; y++ {
+		row := y * l.width * 3
+		for x := bx * l.blockSize; x < (bx+1)*l.blockSize; x++ {
+			offset := row + x*3
+			frameData[offset], frameData[offset+1], frameData[offset+2] = color[0], color[1], color[2]
+		}
+	}
+}
+
+func (l layout) packBarcode(frameData, payload []byte) {
+	clear(frameData)
+	defer l.drawMarkers(frameData)
+
+	for bx := 0; bx < l.blocksX(); bx++ {
+		l.fillCell(frameData, bx, 0, barcodePalette[bx%len(barcodePalette)])
+	}
+
+	count, length := l.barcodeCodewords()
+	k := length - barcodeECC
+	gen := rsGenerator(barcodeECC)
+	raw := make([]byte, count*length)
+	for c := 0; c < count; c++ {
+		msg := payload[c*k : (c+1)*k]
+		codeword := append(msg[:k:k], rsCheckBytes(msg, gen)...)
+		for i, b := range codeword {
+			raw[i*count+c] = b
+		}
+	}
+
+	br := bitReader{data: raw}
+	for by := 1; by < l.blocksY(); by++ {
+		for bx := 0; bx < l.blocksX(); bx++ {
+			l.fillCell(frameData, bx, by, barcodePalette[br.read(barcodeBits)])
+		}
+	}
+}
+
+func (l layout) unpackBarcode(frameData []byte) []byte {
+	samples := l.sampleBlocks(frameData)
+	cellColor := func(i int) [3]int {
+		return [3]int{int(samples[3*i]), int(samples[3*i+1]), int(samples[3*i+2])}
+	}
+
+	// Average what each palette color turned into along the reference row
+	var refs [len(barcodePalette)][3]int
+	var counts [len(barcodePalette)]int
+	for bx := 0; bx < l.blocksX(); bx++ {
+		p := bx % len(barcodePalette)
+		for c, v := range cellColor(bx) {
+			refs[p][c] += v
+		}
+		counts[p]++
+	}
+	for p := range refs {
+		for c := range refs[p] {
+			if counts[p] > 0 {
+				refs[p][c] /= counts[p]
+			} else {
+				refs[p][c] = int(barcodePalette[p][c])
+			}
+		}
+	}
+
+	count, length := l.barcodeCodewords()
+	bw := bitWriter{data: make([]byte, 0, count*length+1)}
+	for i := l.blocksX(); i < l.blocksX()*l.blocksY(); i++ {
+		v := cellColor(i)
+		best, bestDist := 0, -1
+		for p, ref := range refs {
+			dist := 0
+			for c := range v {
+				d := v[c] - ref[c]
+				dist += d * d
+			}
+			if bestDist < 0 || dist < bestDist {
+				best, bestDist = p, dist
+			}
+		}
+		bw.write(best, barcodeBits)
+	}
+
+	// A codeword with too many errors is left as read; the frame checksum
+	// rejects it
+	k := length - barcodeECC
+	out := make([]byte, 0, l.capacity())
+	codeword := make([]byte, length)
+	for c := 0; c < count; c++ {
+		for i := range codeword {
+			codeword[i] = bw.data[i*count+c]
+		}
+		rsCorrect(codeword, barcodeECC)
+		out = append(out, codeword[:k]...)
+	}
+	return out
+}
+
+// Error-correcting Reed-Solomon over the same field as the recovery volumes.
+// Codewords are polynomials with the first byte as the highest coefficient
+// and the generator's roots are α^0 … α^(nsym-1).
+
+// rsGenerator returns the generator polynomial for nsym check bytes.
+func rsGenerator(nsym int) []byte {
+	g := []byte{1}
+	for i := 0; i < nsym; i++ {
+		next := make([]byte, len(g)+1)
+		for j, c := range g {
+			next[j] ^= c
+			next[j+1] ^= gfMul(c, gfExp[i])
+		}
+		g = next
+	}
+	return g
+}
+
+// rsCheckBytes returns the check bytes to append to msg.
+func rsCheckBytes(msg, gen []byte) []byte {
+	nsym := len(gen) - 1
+	rem := make([]byte, nsym)
+	for _, m := range msg {
+		coef := m ^ rem[0]
+		copy(rem, rem[1:])
+		rem[nsym-1] = 0
+		for j := 0; j < nsym; j++ {
+			rem[j] ^= gfMul(gen[j+1], coef)
+		}
+	}
+	return rem
+}
+
+// rsCorrect fixes up to nsym/2 wrong bytes of a codeword in place.
+func rsCorrect(codeword []byte, nsym int) error {
+	n := len(codeword)
+	syndromes := make([]byte, nsym)
+	clean := true
+	for i := range syndromes {
+		var s byte
+		for _, c := range codeword {
+			s = gfMul(s, gfExp[i]) ^ c
+		}
+		syndromes[i] = s
+		clean = clean && s == 0
+	}
+	if clean {
+		return nil
+	}
+
+	// Berlekamp-Massey: the error locator, lowest coefficient first
+	locator, prev := []byte{1}, []byte{1}
+	errors, shift, prevDiscrepancy := 0, 1, byte(1)
+	for i := 0; i < nsym; i++ {
+		d := syndromes[i]
+		for j := 1; j <= errors && j < len(locator); j++ {
+			d ^= gfMul(locator[j], syndromes[i-j])
+		}
+		if d == 0 {
+			shift++
+			continue
+		}
+		saved := append([]byte(nil), locator...)
+		coef := gfMul(d, gfInv(prevDiscrepancy))
+		for len(locator) < len(prev)+shift {
+			locator = append(locator, 0)
+		}
+		for j, p := range prev {
+			locator[j+shift] ^= gfMul(coef, p)
+		}
+		if 2*errors <= i {
+			errors, prev, prevDiscrepancy, shift = i+1-errors, saved, d, 1
+		} else {
+			shift++
+		}
+	}
+	if 2*errors > nsym {
+		return fmt.Errorf("too many errors in codeword")
+	}
+
+	eval := func(poly []byte, x byte) byte {
+		var y byte
+		for j := len(poly) - 1; j >= 0; j-- {
+			y = gfMul(y, x) ^ poly[j]
+		}
+		return y
+	}
+	// Evaluator Ω = S·Λ mod x^nsym and the formal derivative Λ'
+	omega := make([]byte, nsym)
+	for i, s := range syndromes {
+		for j, c := range locator {
+			if i+j < nsym {
+				omega[i+j] ^= gfMul(s, c)
+			}
+		}
+	}
+	derivative := make([]byte, len(locator))
+	for j := 1; j < len(locator); j += 2 {
+		derivative[j-1] = locator[j]
+	}
+
+	// Chien search over every position, with Forney's formula for the value
+	found := 0
+	for pos := 0; pos < n; pos++ {
+		power := n - 1 - pos
+		x := gfExp[power]
+		xInv := gfExp[(255-power)%255]
+		if eval(locator, xInv) != 0 {
+			continue
+		}
+		denom := eval(derivative, xInv)
+		if denom == 0 {
+			return fmt.Errorf("uncorrectable codeword")
+		}
+		codeword[pos] ^= gfMul(x, gfMul(eval(omega, xInv), gfInv(denom)))
+		found++
+	}
+	if found != errors {
+		return fmt.Errorf("uncorrectable codeword")
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+//go:build !(js && wasm)
+
+package f2v
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"gocv.io/x/gocv"
+)
+
+// Camera transfers read the camera, and show their frames, through OpenCV.
+
+// openCamera opens a capture device by number (0 is the default camera) or,
+// for anything else, by name, such as a V4L2 device path or a stream URL.
+func openCamera(device string) (*gocv.VideoCapture, error) {
+	var id interface{} = device
+	if n, err := strconv.Atoi(device); err == nil {
+		id = n
+	}
+	cap, err := gocv.OpenVideoCapture(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture device %s: %w", device, err)
+	}
+	return cap, nil
+}
+
+// receiveFile reads frames live from a capture device until it has caught
+// every frame of a video, then writes the reconstructed file.
+func receiveFile(device, outputFilename string, l layout, s *secret) error {
+	if !l.markers {
+		return fmt.Errorf("camera transfer needs sync markers; use block, dct or barcode mode")
+	}
+	cap, err := openCamera(device)
+	if err != nil {
+		return err
+	}
+	defer cap.Close()
+
+	r := newReceiveState()
+	summarize(os.Stderr, "Receiving from device %s; play the video on a loop until every frame is in", device)
+	err = scanFrames(cap, l, func(f scannedFrame) (bool, error) {
+		if !r.add(f) {
+			return true, nil
+		}
+		switch {
+		case !summarizing():
+		case r.last >= 0:
+			fmt.Fprintf(os.Stderr, "\rReceived %s of %s frames", display.count(int64(len(r.frames))), display.count(r.last+1))
+		default:
+			fmt.Fprintf(os.Stderr, "\rReceived %s frames, final frame not seen yet", display.count(int64(len(r.frames))))
+		}
+		return !r.complete(), nil
+	})
+	summarize(os.Stderr, "")
+	if err != nil {
+		return err
+	}
+	if !r.complete() {
+		return fmt.Errorf("capture ended with %d frames received, the video is incomplete", len(r.frames))
+	}
+
+	out, err := r.data(s, l.log())
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(outputFilename, out, 0644); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	summarize(os.Stdout, "Received %s frames, %s", display.count(r.last+1), display.bytes(int64(len(out))))
+	return nil
+}
@@ -0,0 +1,42 @@
+package f2v
+
+import (
+	"context"
+	"io"
+)
+
+// Encodes and decodes stop once the context in their options is done: the
+// encoder stops reading its input, the decoder stops before the next frame
+// or the next wait for a growing video, and downloads are abandoned. A
+// cancelled encode removes the videos it was writing, and a decode never
+// leaves its temporary file behind, so a cancelled run leaves nothing half
+// written.
+
+// context returns the context of the encode, or one never done.
+func (opts encodeOptions) context() context.Context {
+	if opts.ctx == nil {
+		return context.Background()
+	}
+	return opts.ctx
+}
+
+// context returns the context of the decode, or one never done.
+func (opts decodeOptions) context() context.Context {
+	if opts.ctx == nil {
+		return context.Background()
+	}
+	return opts.ctx
+}
+
+// contextReader reads from r until ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
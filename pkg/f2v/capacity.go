@@ -0,0 +1,209 @@
+package f2v
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// capacityPlan is what encoding size bytes with a profile takes: the videos
+// written, their frames and running time, and where the frame bytes that do
+// not hold the input go. The overhead and the input add up to TotalBytes,
+// the payload capacity of every frame written.
+type capacityPlan struct {
+	Size       int64            `json:"size"`
+	Profile    profile          `json:"profile"`
+	FrameBytes int              `json:"frame_bytes"` // data bytes per frame
+	Frames     int64            `json:"frames"`
+	Seconds    float64          `json:"duration_seconds"` // of the data video, or each share video
+	TotalBytes int64            `json:"total_bytes"`
+	Parts      []capacityPart   `json:"parts"`
+	Overhead   capacityOverhead `json:"overhead"`
+}
+
+// capacityPart is one video of a plan: the data video, one of the videos of
+// a -shares set, or the recovery volume.
+type capacityPart struct {
+	Kind    string  `json:"kind"` // data, share or recovery
+	Frames  int64   `json:"frames"`
+	Seconds float64 `json:"duration_seconds"`
+}
+
+type capacityOverhead struct {
+	Compression int64 `json:"compression"` // what -tune compressing the input added, negative for what it saved
+	Headers     int64 `json:"headers"`     // frame headers
+	Padding     int64 `json:"padding"`     // unused space at the end of frames and in barcode cells
+	ECC         int64 `json:"ecc"`         // barcode check bytes and recovery volumes
+	Encryption  int64 `json:"encryption"`  // envelope headers, file names, chunk tags, padding and key shares
+	MAC         int64 `json:"mac"`         // the integrity tag of unencrypted data
+	Copies      int64 `json:"copies"`      // the input again in every video of a -shares set after the first
+}
+
+// planOptions are the encode settings beyond the profile that change what a
+// file takes.
+type planOptions struct {
+	parity  int    // -parity percent, 0 for no recovery volume
+	encrypt bool   // sealed in an envelope under -key or -password
+	mac     bool   // tagged under -mac-key
+	shares  int    // N of -shares K/N, 0 for none
+	name    string // the file name sealed along with encrypted data
+	padTo   int64  // -pad-to, the least envelope size
+	// What an encode measured: the input's size once compressed, 0 if it
+	// was not, and the encrypted envelope's, 0 to work it out
+	compressed int64
+	payload    int64
+}
+
+// planCapacity works out a capacityPlan the way encodeStream would lay the
+// data out, without encoding anything.
+func planCapacity(size int64, p profile, opts planOptions) (capacityPlan, error) {
+	l, fps, err := p.settings()
+	if err != nil {
+		return capacityPlan{}, err
+	}
+	if size < 0 {
+		return capacityPlan{}, fmt.Errorf("invalid size %d", size)
+	}
+	if opts.shares > 0 && opts.parity > 0 {
+		return capacityPlan{}, fmt.Errorf("-shares does not combine with -parity")
+	}
+	plan := capacityPlan{Size: size, Profile: p, FrameBytes: l.capacity() - frameHeaderSize}
+	frameBytes := int64(plan.FrameBytes)
+
+	// In barcode mode a frame's cells hold more than its capacity: the
+	// codewords' check bytes and a few bytes too few for another codeword
+	stored, ecc := int64(l.capacity()), int64(0)
+	if l.mode == modeBarcode {
+		count, _ := l.barcodeCodewords()
+		ecc = int64(count * barcodeECC)
+		stored = int64(l.blocksX() * (l.blocksY() - 1) * barcodeBits / 8)
+	}
+	addFrames := func(kind string, frames int64) {
+		plan.Parts = append(plan.Parts, capacityPart{Kind: kind, Frames: frames, Seconds: float64(frames) / float64(fps)})
+		plan.Frames += frames
+		plan.TotalBytes += frames * stored
+		plan.Overhead.Headers += frames * frameHeaderSize
+		plan.Overhead.ECC += frames * ecc
+		plan.Overhead.Padding += frames * (stored - ecc - int64(l.capacity()))
+	}
+
+	data := size
+	if opts.compressed > 0 {
+		data = opts.compressed
+		plan.Overhead.Compression = data - size
+	}
+	payload := data
+	if opts.encrypt || opts.shares > 0 {
+		payload = envelopeLength(int64(len(namePrefix(opts.name)))+data, opts.padTo)
+	}
+	if opts.payload > 0 {
+		payload = opts.payload
+	}
+	if opts.mac {
+		payload += macSize
+		plan.Overhead.MAC = macSize
+	}
+	if opts.shares > 0 {
+		// Each video of the set carries its key share and the same
+		// encrypted data
+		payload += keyShareSize
+		frames := dataFrames(payload, frameBytes)
+		for range opts.shares {
+			addFrames("share", frames)
+		}
+		n := int64(opts.shares)
+		plan.Overhead.Encryption += n * (payload - data)
+		plan.Overhead.Padding += n * (frames*frameBytes - payload)
+		plan.Overhead.Copies += (n - 1) * data
+	} else {
+		frames := dataFrames(payload, frameBytes)
+		addFrames("data", frames)
+		plan.Overhead.Encryption += payload - plan.Overhead.MAC - data
+		plan.Overhead.Padding += frames*frameBytes - payload
+	}
+	// and each video ends with an index frame
+	if frameBytes >= videoIndexSize {
+		videos := int64(max(1, opts.shares))
+		addFrames("index", videos)
+		plan.Overhead.Headers += videos * videoIndexSize
+		plan.Overhead.Padding += videos * (frameBytes - videoIndexSize)
+	}
+
+	if opts.parity > 0 {
+		if frameBytes < recoveryInfoSize {
+			return capacityPlan{}, fmt.Errorf("frames of %d bytes are too small for a recovery volume", frameBytes)
+		}
+		// As in writeRecoveryVolume: the parity frames of every stripe
+		// between two descriptor frames
+		frames := plan.Parts[0].Frames
+		stripe := min(recoveryStripe, frames)
+		parity := max(1, (stripe*int64(opts.parity)+99)/100)
+		parityFrames := (frames + stripe - 1) / stripe * parity
+		addFrames("recovery", parityFrames+2)
+		plan.Overhead.ECC += parityFrames*frameBytes + 2*recoveryInfoSize
+		plan.Overhead.Padding += 2 * (frameBytes - recoveryInfoSize)
+	}
+	plan.Seconds = plan.Parts[0].Seconds
+	return plan, nil
+}
+
+// dataFrames returns the frames that hold n bytes; even no data takes a
+// final frame.
+func dataFrames(n, frameBytes int64) int64 {
+	return max(1, (n+frameBytes-1)/frameBytes)
+}
+
+// print writes the plan for people, or as plain numbers with -raw.
+func (p capacityPlan) print(w io.Writer, name string) {
+	seconds := func(s float64) string { return display.duration(time.Duration(s * float64(time.Second))) }
+	l, fps, _ := p.Profile.settings()
+	fmt.Fprintf(w, "%s: %s with %s at %dx%d, %d fps (%s per frame)\n", name, display.bytes(p.Size), l.describe(), l.width, l.height, fps, display.bytes(int64(p.FrameBytes)))
+	kinds := map[string]string{"data": "video", "share": "share video", "recovery": "recovery volume"}
+	for _, part := range p.Parts {
+		fmt.Fprintf(w, "  %-16s %s frames, %s\n", kinds[part.Kind]+":", display.count(part.Frames), seconds(part.Seconds))
+	}
+	fmt.Fprintf(w, "  %-16s %s frames, %s of frame capacity, %s of it the input\n", "total:", display.count(p.Frames), display.bytes(p.TotalBytes), display.percent(float64(p.Size)/float64(p.TotalBytes), 1))
+	o := p.Overhead
+	fmt.Fprintf(w, "  %-16s ", "overhead:")
+	if o.Compression != 0 {
+		fmt.Fprintf(w, "compression %s, ", display.bytes(o.Compression))
+	}
+	fmt.Fprintf(w, "headers %s, padding %s, ECC %s, encryption %s", display.bytes(o.Headers), display.bytes(o.Padding), display.bytes(o.ECC), display.bytes(o.Encryption))
+	if o.Copies > 0 {
+		fmt.Fprintf(w, ", share copies %s", display.bytes(o.Copies))
+	}
+	if o.MAC > 0 {
+		fmt.Fprintf(w, ", integrity tag %s", display.bytes(o.MAC))
+	}
+	fmt.Fprintln(w)
+}
+
+// printLayers writes what each layer of an encode added to name's bytes, or
+// saved, on the way to the frames written.
+func (p capacityPlan) printLayers(w io.Writer, name string) {
+	o := p.Overhead
+	signed := func(n int64) string {
+		if n < 0 {
+			return display.bytes(n)
+		}
+		return "+" + display.bytes(n)
+	}
+	fmt.Fprintf(w, "%s: %s in %s of frames", name, display.bytes(p.Size), display.bytes(p.TotalBytes))
+	for _, layer := range []struct {
+		name string
+		n    int64
+	}{
+		{"compression", o.Compression},
+		{"encryption", o.Encryption},
+		{"share copies", o.Copies},
+		{"integrity tag", o.MAC},
+		{"ECC", o.ECC},
+		{"frame headers", o.Headers},
+		{"padding", o.Padding},
+	} {
+		if layer.n != 0 || layer.name == "frame headers" {
+			fmt.Fprintf(w, ", %s %s", layer.name, signed(layer.n))
+		}
+	}
+	fmt.Fprintln(w)
+}
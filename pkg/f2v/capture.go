@@ -0,0 +1,206 @@
+//go:build !(js && wasm)
+
+package f2v
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+// Screen recordings and phone-camera captures show the encoded frame as just
+// a part of the picture, at an unknown size, possibly rotated and seen at an
+// angle, so the markers are nowhere near the corners that findMarkers
+// searches. findBullseyes looks for them by shape instead: each marker is a
+// set of concentric square rings, which turns up as a chain of nested
+// contours in a binarized frame.
+
+// maxBullseyes caps the candidates considered when picking the four markers.
+const maxBullseyes = 12
+
+// bullseye is a marker candidate: the centre and area of its outer contour.
+type bullseye struct {
+	center gocv.Point2f
+	area   float64
+}
+
+// findBullseyes locates the four sync markers anywhere in a grayscale frame
+// and returns their centres in the order of layout.markerOrigins, assuming
+// the frame is upright within 45 degrees.
+func findBullseyes(gray gocv.Mat) (centers [4]gocv.Point2f, ok bool) {
+	// Local thresholds cope with uneven lighting across a camera shot
+	binary := gocv.NewMat()
+	defer binary.Close()
+	window := max(11, min(gray.Cols(), gray.Rows())/16) | 1
+	gocv.AdaptiveThreshold(gray, &binary, 255, gocv.AdaptiveThresholdGaussian, gocv.ThresholdBinary, window, 0)
+
+	hierarchy := gocv.NewMat()
+	defer hierarchy.Close()
+	contours := gocv.FindContoursWithParams(binary, &hierarchy, gocv.RetrievalTree, gocv.ChainApproxNone)
+	defer contours.Close()
+	if hierarchy.Empty() {
+		return centers, false
+	}
+	child := func(i int) int { return int(hierarchy.GetVeciAt(0, i)[2]) }
+	centroid := func(i int) gocv.Point2f {
+		var sx, sy float64
+		points := contours.At(i).ToPoints()
+		for _, p := range points {
+			sx += float64(p.X)
+			sy += float64(p.Y)
+		}
+		return gocv.Point2f{X: float32(sx / float64(len(points))), Y: float32(sy / float64(len(points)))}
+	}
+
+	// A marker's outer square contains a ring hole, a smaller square and a
+	// centre hole, all sharing one centre, the inner square having a quarter
+	// of the outer one's area
+	var found []bullseye
+	for i := 0; i < contours.Size(); i++ {
+		ring := child(i)
+		if ring < 0 {
+			continue
+		}
+		inner := child(ring)
+		if inner < 0 || child(inner) < 0 {
+			continue
+		}
+		outerArea, innerArea := gocv.ContourArea(contours.At(i)), gocv.ContourArea(contours.At(inner))
+		if innerArea <= 0 || outerArea/innerArea < 2 || outerArea/innerArea > 8 {
+			continue
+		}
+		c, ci := centroid(i), centroid(inner)
+		if math.Hypot(float64(c.X-ci.X), float64(c.Y-ci.Y)) > math.Sqrt(outerArea)/4 {
+			continue
+		}
+		duplicate := false
+		for _, b := range found {
+			if math.Hypot(float64(c.X-b.center.X), float64(c.Y-b.center.Y)) < math.Sqrt(b.area)/2 {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			found = append(found, bullseye{center: c, area: outerArea})
+		}
+		if len(found) == maxBullseyes {
+			break
+		}
+	}
+	if len(found) < 4 {
+		return centers, false
+	}
+
+	// Stray matches inside the data are small and clustered; the markers
+	// span the largest quadrilateral
+	bestArea := 0.0
+	for a := 0; a < len(found); a++ {
+		for b := a + 1; b < len(found); b++ {
+			for c := b + 1; c < len(found); c++ {
+				for d := c + 1; d < len(found); d++ {
+					quad, ok := orderCorners([4]gocv.Point2f{found[a].center, found[b].center, found[c].center, found[d].center})
+					if area := quadArea(quad); ok && area > bestArea {
+						bestArea, centers = area, quad
+					}
+				}
+			}
+		}
+	}
+	return centers, bestArea > 0
+}
+
+// orderCorners sorts four points into top-left, top-right, bottom-left,
+// bottom-right order, failing when they do not form such a quadrilateral.
+func orderCorners(points [4]gocv.Point2f) (ordered [4]gocv.Point2f, ok bool) {
+	extreme := func(score func(gocv.Point2f) float32) int {
+		best := 0
+		for i, p := range points {
+			if score(p) > score(points[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+	tl := extreme(func(p gocv.Point2f) float32 { return -(p.X + p.Y) })
+	br := extreme(func(p gocv.Point2f) float32 { return p.X + p.Y })
+	tr := extreme(func(p gocv.Point2f) float32 { return p.X - p.Y })
+	bl := extreme(func(p gocv.Point2f) float32 { return p.Y - p.X })
+	seen := map[int]bool{tl: true, tr: true, bl: true, br: true}
+	if len(seen) != 4 {
+		return ordered, false
+	}
+	return [4]gocv.Point2f{points[tl], points[tr], points[bl], points[br]}, true
+}
+
+// quadArea returns the area of a quadrilateral given in markerOrigins order.
+func quadArea(q [4]gocv.Point2f) float64 {
+	ring := [4]gocv.Point2f{q[0], q[1], q[3], q[2]}
+	sum := 0.0
+	for i, p := range ring {
+		n := ring[(i+1)%4]
+		sum += float64(p.X*n.Y - n.X*p.Y)
+	}
+	return math.Abs(sum) / 2
+}
+
+// rotateCorners turns a markerOrigins-ordered set of centres by a quarter
+// turn, for frames captured sideways or upside down.
+func rotateCorners(c [4]gocv.Point2f) [4]gocv.Point2f {
+	return [4]gocv.Point2f{c[2], c[0], c[3], c[1]}
+}
+
+// warpToLayout maps the marker centres found in frame onto their places in
+// the layout.
+func warpToLayout(frame gocv.Mat, centers [4]gocv.Point2f, l layout) gocv.Mat {
+	var want [4]gocv.Point2f
+	for i, origin := range l.markerOrigins() {
+		want[i] = gocv.Point2f{
+			X: float32(origin.X) + (markerSize-1)/2.0,
+			Y: float32(origin.Y) + (markerSize-1)/2.0,
+		}
+	}
+
+	src := gocv.NewPoint2fVectorFromPoints(centers[:])
+	defer src.Close()
+	dst := gocv.NewPoint2fVectorFromPoints(want[:])
+	defer dst.Close()
+
+	transform := gocv.GetPerspectiveTransform2f(src, dst)
+	defer transform.Close()
+
+	aligned := gocv.NewMat()
+	gocv.WarpPerspectiveWithParams(frame, &aligned, transform, image.Pt(l.width, l.height),
+		gocv.InterpolationLinear, gocv.BorderConstant, color.RGBA{})
+	return aligned
+}
+
+// alignCapture aligns a frame found inside a larger picture. The markers
+// cannot tell which way is up, so when the probe does not read back the
+// other three quarter turns are tried.
+func alignCapture(frame, gray gocv.Mat, l layout) (gocv.Mat, bool) {
+	centers, ok := findBullseyes(gray)
+	if !ok {
+		return gocv.Mat{}, false
+	}
+	var first gocv.Mat
+	for turn := 0; turn < 4; turn++ {
+		aligned := warpToLayout(frame, centers, l)
+		data, _ := aligned.DataPtrUint8()
+		if data != nil && l.readProbe(data).ok {
+			if turn > 0 {
+				first.Close()
+			}
+			return aligned, true
+		}
+		if turn == 0 {
+			first = aligned
+		} else {
+			aligned.Close()
+		}
+		centers = rotateCorners(centers)
+	}
+	// Without a readable probe the upright guess is as good as any
+	return first, true
+}
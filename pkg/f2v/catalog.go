@@ -0,0 +1,493 @@
+package f2v
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// catalog is a JSON index of the videos produced by the encoder. Once frozen
+// it becomes append-only: every new entry carries the hash of the one before
+// it, so replacing or altering any historical video breaks the chain.
+type catalog struct {
+	Frozen   bool               `json:"frozen,omitempty"`
+	Entries  []catalogEntry     `json:"entries"`
+	Profiles map[string]profile `json:"profiles,omitempty"`
+	Runs     []runRecord        `json:"runs,omitempty"` // see stats.go
+
+	path string
+}
+
+type catalogEntry struct {
+	Video     string    `json:"video"` // relative to the catalog's directory when possible
+	Source    string    `json:"source"`
+	Size      int64     `json:"size"`
+	VideoHash string    `json:"video_sha256"`
+	Created   time.Time `json:"created"`
+	Owner     string    `json:"owner,omitempty"` // user that created the entry in server mode
+	VideoSize int64     `json:"video_size,omitempty"`
+	Backend   string    `json:"backend,omitempty"` // where the video is stored; empty means local disk
+	URLs      []string  `json:"urls,omitempty"`    // where it was uploaded, as locate found
+	PrevHash  string    `json:"prev_hash,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+
+	Timestamp *timestampRecord `json:"timestamp,omitempty"`
+	// the regular files of a -pack tar archive, for restoring single ones
+	Files []catalogFile `json:"files,omitempty"`
+}
+
+// catalogFile is a file inside an archive video: its name in the archive
+// and the byte range of its data in the decoded archive.
+type catalogFile struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// chainHash covers the identifying fields of an entry together with the
+// previous entry's hash.
+func (e catalogEntry) chainHash() string {
+	fields := []string{e.PrevHash, e.Video, e.Source, strconv.FormatInt(e.Size, 10), e.VideoHash, e.Created.UTC().Format(time.RFC3339Nano)}
+	if e.Owner != "" {
+		// Only hashed when set, so chains from before ownership still verify
+		fields = append(fields, e.Owner)
+	}
+	h := sha256.New()
+	for _, field := range fields {
+		io.WriteString(h, field)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadCatalog reads the catalog at path. A missing file yields an empty catalog.
+func loadCatalog(path string) (*catalog, error) {
+	c := &catalog{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog: %w", err)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("failed to parse catalog %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// save writes the catalog atomically so an interrupted run never leaves a
+// truncated index behind.
+func (c *catalog) save() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode catalog: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return fmt.Errorf("failed to create catalog directory: %w", err)
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+	return nil
+}
+
+// relPath expresses a video path relative to the catalog's directory so the
+// catalog keeps working when the whole backup folder is moved.
+func (c *catalog) relPath(video string) string {
+	abs, err := filepath.Abs(video)
+	if err != nil {
+		return video
+	}
+	dir, err := filepath.Abs(filepath.Dir(c.path))
+	if err != nil {
+		return video
+	}
+	if rel, err := filepath.Rel(dir, abs); err == nil {
+		return rel
+	}
+	return abs
+}
+
+// resolve turns a recorded video path back into one usable from the
+// current working directory.
+func (c *catalog) resolve(video string) string {
+	if filepath.IsAbs(video) {
+		return video
+	}
+	return filepath.Join(filepath.Dir(c.path), video)
+}
+
+func (c *catalog) find(video string) int {
+	rel := c.relPath(video)
+	for i, e := range c.Entries {
+		if e.Video == rel {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkWritable refuses to overwrite a video that a frozen catalog already
+// records; historical videos in a frozen chain are read-only.
+func (c *catalog) checkWritable(video string) error {
+	if c.Frozen && c.find(video) >= 0 {
+		return fmt.Errorf("%s is recorded in frozen catalog %s and cannot be overwritten", video, c.path)
+	}
+	return nil
+}
+
+// record adds an entry for a freshly encoded video of source.
+func (c *catalog) record(source, video string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("failed to stat source: %w", err)
+	}
+	return c.add(catalogEntry{Source: source, Size: info.Size()}, video)
+}
+
+// add completes e with the details of video and adds it to the catalog.
+// Unfrozen catalogs replace an existing entry for the same video; frozen
+// ones only append.
+func (c *catalog) add(e catalogEntry, video string) error {
+	videoHash, err := hashFile(video)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(video)
+	if err != nil {
+		return fmt.Errorf("failed to stat video: %w", err)
+	}
+	e.Video = c.relPath(video)
+	e.VideoHash = videoHash
+	e.VideoSize = info.Size()
+	e.Created = time.Now().UTC()
+
+	if c.Frozen {
+		if err := c.checkWritable(video); err != nil {
+			return err
+		}
+		if n := len(c.Entries); n > 0 {
+			e.PrevHash = c.Entries[n-1].Hash
+		}
+		e.Hash = e.chainHash()
+		c.Entries = append(c.Entries, e)
+		return nil
+	}
+
+	if i := c.find(video); i >= 0 {
+		c.Entries[i] = e
+	} else {
+		c.Entries = append(c.Entries, e)
+	}
+	return nil
+}
+
+// timestamp obtains an RFC 3161 token for the entry recorded for video. In a
+// frozen catalog the token covers the chain hash, vouching for the entire
+// history up to that entry; otherwise it covers the video hash.
+func (c *catalog) timestamp(video, tsaURL string) error {
+	i := c.find(video)
+	if i < 0 {
+		return fmt.Errorf("%s is not recorded in the catalog", video)
+	}
+	e := &c.Entries[i]
+	imprint := e.VideoHash
+	if e.Hash != "" {
+		imprint = e.Hash
+	}
+	digest, err := hex.DecodeString(imprint)
+	if err != nil {
+		return fmt.Errorf("invalid hash in catalog entry: %w", err)
+	}
+	record, err := requestTimestamp(tsaURL, digest)
+	if err != nil {
+		return err
+	}
+	e.Timestamp = record
+	return nil
+}
+
+// freeze links every existing entry into a hash chain and marks the catalog
+// append-only. Freezing an already frozen catalog is a no-op.
+func (c *catalog) freeze() {
+	if c.Frozen {
+		return
+	}
+	prev := ""
+	for i := range c.Entries {
+		c.Entries[i].PrevHash = prev
+		c.Entries[i].Hash = c.Entries[i].chainHash()
+		prev = c.Entries[i].Hash
+	}
+	c.Frozen = true
+}
+
+// profile looks up a saved profile; it is safe to call on a nil catalog.
+func (c *catalog) profile(name string) (profile, bool) {
+	if c == nil {
+		return profile{}, false
+	}
+	p, ok := c.Profiles[name]
+	return p, ok
+}
+
+func (c *catalog) setProfile(name string, p profile) {
+	if c.Profiles == nil {
+		c.Profiles = make(map[string]profile)
+	}
+	c.Profiles[name] = p
+}
+
+// storageBackend names the backend an entry's video is stored on.
+func (e catalogEntry) storageBackend() string {
+	if e.Backend == "" {
+		return "local"
+	}
+	return e.Backend
+}
+
+// usageTotals counts archives, encoded source bytes and stored video bytes.
+type usageTotals struct {
+	Archives int   `json:"archives"`
+	Encoded  int64 `json:"encoded_bytes"`
+	Stored   int64 `json:"stored_bytes"`
+}
+
+// describe sums up the totals in u's units.
+func (t usageTotals) describe(u units) string {
+	return fmt.Sprintf("%s archives, %s encoded, %s stored", u.count(int64(t.Archives)), u.bytes(t.Encoded), u.bytes(t.Stored))
+}
+
+func (u *usageTotals) add(e catalogEntry) {
+	u.Archives++
+	u.Encoded += e.Size
+	u.Stored += e.VideoSize
+}
+
+// usage sums the catalog per owner and per storage backend. Entries
+// recorded before video sizes were tracked are measured on disk.
+func (c *catalog) usage() (byOwner, byBackend map[string]usageTotals) {
+	byOwner, byBackend = make(map[string]usageTotals), make(map[string]usageTotals)
+	for _, e := range c.Entries {
+		if e.VideoSize == 0 && e.storageBackend() == "local" {
+			if info, err := os.Stat(c.resolve(e.Video)); err == nil {
+				e.VideoSize = info.Size()
+			}
+		}
+		u := byOwner[e.Owner]
+		u.add(e)
+		byOwner[e.Owner] = u
+		u = byBackend[e.storageBackend()]
+		u.add(e)
+		byBackend[e.storageBackend()] = u
+	}
+	return byOwner, byBackend
+}
+
+// ownerUsage returns the usage of a single owner.
+func (c *catalog) ownerUsage(owner string) usageTotals {
+	var u usageTotals
+	for _, e := range c.Entries {
+		if e.Owner == owner {
+			u.add(e)
+		}
+	}
+	return u
+}
+
+func printUsage(w io.Writer, title string, byKey map[string]usageTotals, empty string) {
+	fmt.Fprintf(w, "%s:\n", title)
+	keys := slices.Sorted(maps.Keys(byKey))
+	for _, k := range keys {
+		u := byKey[k]
+		name := k
+		if name == "" {
+			name = empty
+		}
+		fmt.Fprintf(w, "  %-20s %s\n", name, u.describe(display))
+	}
+}
+
+// merge adds the entries and profiles of other that c does not have yet and
+// reports how many of each were added. Entries match on video path and hash;
+// profiles on name, with existing profiles left untouched. An empty catalog
+// adopts other's entries and chain as they are. A frozen catalog appends the
+// new entries to its own chain, dropping time-stamps that covered the old
+// chain position since they can no longer be checked.
+func (c *catalog) merge(other *catalog) (entries, profiles int, skipped []string) {
+	if len(c.Entries) == 0 {
+		wasFrozen := c.Frozen
+		c.Entries = append(c.Entries, other.Entries...)
+		c.Frozen = other.Frozen
+		if wasFrozen {
+			c.freeze()
+		}
+		entries = len(other.Entries)
+	} else {
+		for _, e := range other.Entries {
+			if slices.ContainsFunc(c.Entries, func(have catalogEntry) bool {
+				return have.Video == e.Video && have.VideoHash == e.VideoHash
+			}) {
+				continue
+			}
+			if c.Frozen {
+				if e.Timestamp != nil && e.Timestamp.Imprint != e.VideoHash {
+					e.Timestamp = nil
+				}
+				e.PrevHash = c.Entries[len(c.Entries)-1].Hash
+				e.Hash = e.chainHash()
+			} else {
+				e.PrevHash, e.Hash = "", ""
+			}
+			c.Entries = append(c.Entries, e)
+			entries++
+		}
+	}
+
+	for name, p := range other.Profiles {
+		if have, ok := c.Profiles[name]; ok {
+			if have != p {
+				skipped = append(skipped, name)
+			}
+			continue
+		}
+		c.setProfile(name, p)
+		profiles++
+	}
+	slices.Sort(skipped)
+	return entries, profiles, skipped
+}
+
+// verify re-hashes every recorded video and, for frozen catalogs, checks
+// the chain links. It returns one problem description per failure.
+func (c *catalog) verify() []string {
+	var problems []string
+	prev := ""
+	for i, e := range c.Entries {
+		if c.Frozen {
+			if e.PrevHash != prev {
+				problems = append(problems, fmt.Sprintf("entry %d (%s): chain broken, previous hash does not match", i, e.Video))
+			}
+			if e.Hash != e.chainHash() {
+				problems = append(problems, fmt.Sprintf("entry %d (%s): entry was modified after it was recorded", i, e.Video))
+			}
+			prev = e.Hash
+		}
+
+		if e.Timestamp != nil {
+			if err := e.Timestamp.check(e.VideoHash, e.Hash); err != nil {
+				problems = append(problems, fmt.Sprintf("entry %d (%s): %v", i, e.Video, err))
+			}
+		}
+
+		got, err := hashFile(c.resolve(e.Video))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("entry %d (%s): %v", i, e.Video, err))
+			continue
+		}
+		if got != e.VideoHash {
+			problems = append(problems, fmt.Sprintf("entry %d (%s): video was replaced or altered", i, e.Video))
+		}
+	}
+	return problems
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// runCatalog implements the catalog maintenance commands.
+func runCatalog(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: catalog freeze|verify|usage <catalog.json> or catalog export|import <catalog.json> <file.json>")
+	}
+	c, err := loadCatalog(args[1])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "freeze":
+		c.freeze()
+		if err := c.save(); err != nil {
+			return err
+		}
+		summarize(os.Stdout, "Froze %s with %d entries", c.path, len(c.Entries))
+	case "verify":
+		problems := c.verify()
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("catalog verification failed with %d problem(s)", len(problems))
+		}
+		summarize(os.Stdout, "Verified %d entries in %s", len(c.Entries), c.path)
+		if n := len(c.Entries); c.Frozen && n > 0 {
+			fmt.Printf("Chain head: %s\n", c.Entries[n-1].Hash)
+		}
+	case "usage":
+		byOwner, byBackend := c.usage()
+		printUsage(os.Stdout, "By user", byOwner, "(no owner)")
+		printUsage(os.Stdout, "By backend", byBackend, "")
+	case "export":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: catalog export <catalog.json> <file.json>")
+		}
+		// Video paths stay relative to the backup folder, so the export
+		// works wherever that folder ends up.
+		out := *c
+		out.path = args[2]
+		if err := out.save(); err != nil {
+			return err
+		}
+		summarize(os.Stdout, "Exported %d entries and %d profiles to %s", len(c.Entries), len(c.Profiles), args[2])
+	case "import":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: catalog import <catalog.json> <file.json>")
+		}
+		if _, err := os.Stat(args[2]); err != nil {
+			return fmt.Errorf("failed to read import file: %w", err)
+		}
+		other, err := loadCatalog(args[2])
+		if err != nil {
+			return err
+		}
+		entries, profiles, skipped := c.merge(other)
+		if err := c.save(); err != nil {
+			return err
+		}
+		summarize(os.Stdout, "Imported %d entries and %d profiles into %s", entries, profiles, c.path)
+		for _, name := range skipped {
+			slog.Warn("Kept the existing profile, which differs from the imported one", "profile", name)
+		}
+	default:
+		return fmt.Errorf("unknown catalog command %q", args[0])
+	}
+	return nil
+}
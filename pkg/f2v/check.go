@@ -0,0 +1,172 @@
+package f2v
+
+import (
+	"fmt"
+	"io"
+	"slices"
+)
+
+// frameDamage describes a frame whose data could not be recovered.
+type frameDamage struct {
+	seq    uint32 // sequence number the frame should carry
+	index  int    // position in the video, or -1 when it is missing entirely
+	reason string
+}
+
+// checkReport summarizes the integrity of a video without decoding it to disk.
+type checkReport struct {
+	frames     int // frames read, including duplicates
+	duplicates int
+	capacity   int // data bytes per full frame
+	damage     []frameDamage
+	complete   bool   // the final frame was seen intact
+	dataSize   int64  // total data bytes, known when complete
+	next       uint32 // sequence number expected after the last frame read
+	probes     probeStats
+	layout     layout
+	table      *segmentTable // set for segmented videos
+
+	// Set by checkRecovery when the video has a recovery volume
+	recovery     string
+	recoveryErr  error
+	unrepairable []int // stripes with more damage than the volume can rebuild
+}
+
+// checkVideo scans every frame of a video and validates the frame checksums
+// and sequence numbers. A damaged frame is assumed to hold the next expected
+// sequence number; if an intact copy of that number turns up later (the bad
+// frame was a platform duplicate) the damage is withdrawn.
+func checkVideo(input string, l layout) (*checkReport, error) {
+	cap, cleanup, err := openVideo(input, l)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	r := &checkReport{layout: l}
+	var next uint32
+	err = scanFrames(cap, l, func(f scannedFrame) (bool, error) {
+		if f.err == nil && f.header.index() {
+			return false, nil // past the data, whose final frame never came
+		}
+		r.frames++
+		r.probes.add(f.probe)
+		r.capacity = f.capacity
+		r.table = f.table
+
+		if f.err != nil {
+			r.damage = append(r.damage, frameDamage{seq: next, index: f.index, reason: f.err.Error()})
+			next++
+			return true, nil
+		}
+
+		seq := f.header.seq
+		switch {
+		case seq < next:
+			if i := slices.IndexFunc(r.damage, func(d frameDamage) bool { return d.seq == seq }); i >= 0 {
+				r.damage = slices.Delete(r.damage, i, i+1)
+			} else {
+				r.duplicates++
+			}
+		case seq > next:
+			for missing := next; missing < seq; missing++ {
+				r.damage = append(r.damage, frameDamage{seq: missing, index: -1, reason: "frame missing"})
+			}
+			fallthrough
+		default:
+			next = seq + 1
+		}
+
+		if f.header.last() {
+			r.complete = true
+			r.dataSize = int64(seq)*int64(f.capacity) + int64(len(f.data))
+			if r.table != nil {
+				_, r.dataSize = r.table.byteRange(seq)
+			}
+			// Damage assumed past the final frame was never part of the data
+			r.damage = slices.DeleteFunc(r.damage, func(d frameDamage) bool { return d.seq > seq })
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.next = next
+	return r, nil
+}
+
+// checkRecovery works out whether the recovery volume at path can rebuild
+// the damage found in the report.
+func (r *checkReport) checkRecovery(path string, l layout) {
+	r.recovery = path
+	v, err := readRecoveryVolume(path, l)
+	if err != nil {
+		r.recoveryErr = err
+		return
+	}
+	r.unrepairable = v.unrepairable(r)
+}
+
+// byteRange returns the span of the original file held by the frame with
+// sequence number seq. end is exclusive.
+func (r *checkReport) byteRange(seq uint32) (start, end int64) {
+	if r.table != nil {
+		return r.table.byteRange(seq)
+	}
+	start = int64(seq) * int64(r.capacity)
+	end = start + int64(r.capacity)
+	if r.complete && end > r.dataSize {
+		end = r.dataSize
+	}
+	return start, end
+}
+
+func (r *checkReport) ok() bool {
+	return r.complete && len(r.damage) == 0
+}
+
+// failure sums up what is wrong with the video, nil if nothing is.
+func (r *checkReport) failure() error {
+	switch {
+	case len(r.damage) > 0:
+		return fmt.Errorf("%d damaged frames", len(r.damage))
+	case !r.complete:
+		return fmt.Errorf("video ends before its final frame")
+	}
+	return nil
+}
+
+func (r *checkReport) print(w io.Writer, name string) {
+	fmt.Fprintf(w, "Checked %s: %d frames read, %d damaged, %d duplicated\n", name, r.frames, len(r.damage), r.duplicates)
+	for _, d := range r.damage {
+		start, end := r.byteRange(d.seq)
+		where := fmt.Sprintf("frame %d", d.index)
+		if d.index < 0 {
+			where = "missing frame"
+		}
+		fmt.Fprintf(w, "  sequence %d (%s): %s, bytes %s-%s\n", d.seq, where, d.reason, display.count(start), display.count(end-1))
+	}
+	if !r.complete {
+		lost := int64(r.frames-r.duplicates) * int64(r.capacity)
+		if r.table != nil {
+			lost, _ = r.table.byteRange(r.next)
+		}
+		fmt.Fprintf(w, "  video is truncated: the final frame was not found, data after byte %s is lost\n", display.count(lost))
+	}
+	if r.complete {
+		fmt.Fprintf(w, "Data size: %s\n", display.bytes(r.dataSize))
+	}
+	r.probes.print(w, r.layout)
+	switch {
+	case r.ok():
+	case r.recovery == "":
+		fmt.Fprintln(w, "Parity: none available, the damaged ranges cannot be repaired")
+	case r.recoveryErr != nil:
+		fmt.Fprintf(w, "Parity: recovery volume %s is unusable: %v\n", r.recovery, r.recoveryErr)
+	case len(r.unrepairable) > 0:
+		fmt.Fprintf(w, "Parity: stripes %v of %s have more damage than the parity can rebuild\n", r.unrepairable, r.recovery)
+	default:
+		fmt.Fprintf(w, "Parity: all damage can be rebuilt with `repair` using %s\n", r.recovery)
+	}
+}
@@ -0,0 +1,90 @@
+package f2v
+
+import (
+	"io"
+	"math/bits"
+)
+
+// -dedup splits the files of an f2v archive at content-defined boundaries
+// and stores each distinct chunk once; entries list their chunks by hash.
+// Boundaries follow the content, not offsets, so an edit early in a file
+// only changes the chunks around it, and copies of a file, or files that
+// share long runs, share chunks wherever they sit. Boundaries come from a
+// gear hash of the last 64 bytes, as in FastCDC: a stricter mask before the
+// average chunk size and a looser one after it keeps chunk sizes close to
+// the average, between chunkMin and chunkMax.
+
+const (
+	chunkMin = 8 << 10
+	chunkAvg = 32 << 10
+	chunkMax = 128 << 10
+)
+
+var (
+	// The gear hash shifts left, so its top bits depend on the most bytes
+	chunkMaskStrict = ^uint64(0) << (64 - (bits.Len(chunkAvg) + 1))
+	chunkMaskLoose  = ^uint64(0) << (64 - (bits.Len(chunkAvg) - 3))
+)
+
+// gearTable maps each byte to a fixed random 64-bit value, here from
+// SplitMix64, so that boundaries are the same for every build.
+var gearTable = func() (t [256]uint64) {
+	x := uint64(0x6f2f5e3b2c1d4a59)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// chunkCut returns the length of the chunk data starts with. data holds
+// chunkMax bytes unless it is the end of the input.
+func chunkCut(data []byte) int {
+	n := len(data)
+	if n <= chunkMin {
+		return n
+	}
+	n = min(n, chunkMax)
+	var h uint64
+	i := chunkMin
+	for ; i < min(n, chunkAvg); i++ {
+		if h = h<<1 + gearTable[data[i]]; h&chunkMaskStrict == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		if h = h<<1 + gearTable[data[i]]; h&chunkMaskLoose == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// splitChunks reads r to its end and calls fn with each chunk in turn. The
+// slice is only valid during the call.
+func splitChunks(r io.Reader, fn func(chunk []byte) error) error {
+	buf := make([]byte, chunkMax)
+	n, eof := 0, false
+	for {
+		if !eof {
+			m, err := io.ReadFull(r, buf[n:])
+			n += m
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		cut := chunkCut(buf[:n])
+		if err := fn(buf[:cut]); err != nil {
+			return err
+		}
+		n = copy(buf, buf[cut:n])
+	}
+}
@@ -0,0 +1,1168 @@
+package f2v
+
+// The command line tool: the flags and operations of Main, each run on the
+// rest of the package.
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// isVideoName reports whether path names a video rather than a folder to
+// write videos into.
+func isVideoName(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".mkv" || ext == ".mp4"
+}
+
+// runEncode encodes a single file, or every file in a directory, into outputPath.
+func runEncode(inputPath, outputPath string, opts encodeOptions) {
+	start := time.Now()
+	opts.layout.tally = &resultTally{}
+	opts.report.counts(opts.layout.tally, start)
+	defer func() { summarize(os.Stdout, "Wrote %s", opts.layout.tally.result(start).describe(display)) }()
+	if summarizing() {
+		opts.tuned = func(source string, a *inputAnalysis) { a.print(os.Stdout, source) }
+		opts.layers = func(source string, plan capacityPlan) { plan.printLayers(os.Stdout, source) }
+	}
+	if opts.bar != nil {
+		opts.progress = opts.bar.report
+		opts.bar.file(inputPath, 0)
+		defer opts.bar.finish()
+	}
+
+	if opts.inputCmd != "" {
+		outputVideo, err := encodeCommand(opts.inputCmd, inputPath, outputPath, opts)
+		opts.report.file(inputPath, outputVideo, "", start, err)
+		if err != nil {
+			fatalf("Encoding failed: %v", err)
+		}
+		opts.log().Info("Encoded", "command", opts.inputCmd, "video", encodedAs(outputVideo, opts))
+		return
+	}
+
+	if inputPath == "-" {
+		outputVideo, name := opts.videoPath(outputPath, "stdin"), "stdin"
+		if isVideoName(outputPath) {
+			outputVideo = outputPath
+			name = strings.TrimSuffix(filepath.Base(outputPath), filepath.Ext(outputPath))
+		}
+		opts.bar.file("standard input", 0)
+		err := encodeStream("standard input", name, os.Stdin, outputVideo, opts)
+		opts.report.file("-", encodedAs(outputVideo, opts), "", start, err)
+		if err != nil {
+			for _, path := range writtenPaths(outputVideo, opts) {
+				os.Remove(path)
+			}
+			fatalf("Encoding failed: %v", err)
+		}
+		opts.log().Info("Encoded", "file", "-", "video", encodedAs(outputVideo, opts))
+		return
+	}
+
+	if opts.pack != "" {
+		outputVideo, err := encodePacked(inputPath, opts.pack, outputPath, opts)
+		opts.report.file(inputPath, outputVideo, "", start, err)
+		if err != nil {
+			fatalf("Encoding failed: %v", err)
+		}
+		opts.log().Info("Encoded", "file", inputPath, "video", encodedAs(outputVideo, opts))
+		return
+	}
+
+	fileInfo, err := os.Stat(inputPath)
+	if err != nil {
+		fatalf("Error accessing input path: %v", err)
+	}
+
+	if fileInfo.IsDir() {
+		if err := encodeTree(inputPath, outputPath, opts); err != nil {
+			fatalf("Error encoding directory: %v", err)
+		}
+	} else {
+		// Process single file
+		outputVideo := opts.videoPath(outputPath, filepath.Base(inputPath))
+		written, err := encodeFile(inputPath, outputVideo, opts)
+		opts.report.file(inputPath, written, inputPath, start, err)
+		if err != nil {
+			fatalf("Encoding failed: %v", err)
+		}
+		opts.log().Info("Encoded", "file", inputPath, "video", written)
+	}
+}
+
+// runDecode decodes a single video, a URL, or every .mkv in a directory, into outputPath.
+func runDecode(inputPath, outputPath string, opts decodeOptions) {
+	start, report := time.Now(), os.Stdout
+	if outputPath == "-" {
+		report = os.Stderr
+	}
+	opts.layout.tally = &resultTally{}
+	opts.report.counts(opts.layout.tally, start)
+	defer func() { summarize(report, "Read %s", opts.layout.tally.result(start).describe(display)) }()
+	if opts.bar != nil {
+		opts.progress = opts.bar.report
+		opts.bar.file(inputPath, 0)
+		defer opts.bar.finish()
+	}
+
+	if outputPath == "-" {
+		if info, err := os.Stat(inputPath); err == nil && info.IsDir() && !isFrameSequence(inputPath) {
+			fatalf("A folder of videos decodes into a folder, not -")
+		}
+		opts.output = os.Stdout
+		if err := videoToFile(inputPath, decodedName(inputPath), opts); err != nil {
+			fatalf("Decoding failed: %v", err)
+		}
+		opts.log().Info("Decoded", "video", inputPath, "file", "-")
+		return
+	}
+
+	// Decode workflow: handle folder or a single file/URL
+	fileInfo, err := os.Stat(inputPath)
+	if err != nil && !isURL(inputPath) {
+		// If not a URL and stat failed, it's an error
+		fatalf("Error accessing input path: %v", err)
+	}
+
+	if err == nil && fileInfo.IsDir() && !isFrameSequence(inputPath) {
+		if err := decodeTree(inputPath, outputPath, opts); err != nil {
+			fatalf("Error decoding directory: %v", err)
+		}
+	} else {
+		// Process single file or URL
+		if isURL(inputPath) {
+			// If input is a URL, decode directly from the URL
+			outputFile := filepath.Join(outputPath, "youtube.decoded")
+			if u, err := url.Parse(inputPath); err == nil && !isYouTubeURL(inputPath) && strings.HasSuffix(u.Path, ".mkv") {
+				outputFile = filepath.Join(outputPath, decodedName(u.Path))
+			}
+			opts.log().Info("Decoding", "video", inputPath)
+			outputFile, err := decodeNamed(inputPath, outputFile, opts)
+			opts.report.file(inputPath, outputFile, outputFile, start, err)
+			if err != nil {
+				fatalf("Decoding failed from URL %s: %v", inputPath, err)
+			}
+			opts.log().Info("Decoded", "video", inputPath, "file", outputFile)
+		} else {
+			// Process single local mkv file
+			outputFile := filepath.Join(outputPath, decodedName(inputPath))
+			opts.log().Info("Decoding", "video", inputPath)
+			outputFile, err := decodeNamed(inputPath, outputFile, opts)
+			opts.report.file(inputPath, outputFile, outputFile, start, err)
+			if err != nil {
+				fatalf("Decoding failed: %v", err)
+			}
+			opts.log().Info("Decoded", "video", inputPath, "file", outputFile)
+		}
+	}
+}
+
+// Main runs the command line tool on os.Args, exiting on failure.
+func Main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	applyEnvStandins()
+	operation := os.Args[1]
+
+	args := os.Args[2:]
+	if operation == "-h" || operation == "-help" || operation == "--help" {
+		usage()
+		return
+	}
+	asked := operation == "help"
+	if asked {
+		if len(args) == 0 {
+			usage()
+			return
+		}
+		operation, args = args[0], []string{"-h"}
+	}
+	cmd, ok := lookupCommand(operation)
+	if !ok {
+		if !asked {
+			fmt.Printf("Unknown command %q.\n\n", operation)
+		}
+		usage()
+		if asked {
+			return
+		}
+		os.Exit(1)
+	}
+	operation = cmd.name
+
+	// Every flag is defined here once; the command parses the ones it takes
+	flags := flag.NewFlagSet(operation, flag.ExitOnError)
+	modeName := flags.String("mode", "raw", "frame mode: raw, block, dct, barcode or lsb")
+	blockSize := flags.Int("block", 4, "block edge in pixels for block mode, cell edge for barcode mode")
+	bitsPerChannel := flags.Int("bits", 2, "bits per channel per block for block mode, per pixel for lsb mode")
+	coefficients := flags.Int("coeffs", 6, "DCT coefficients carrying a bit per 8x8 block for dct mode")
+	catalogPath := flags.String("catalog", "", "catalog file recording encoded videos")
+	tsaURL := flags.String("tsa", "", "RFC 3161 time-stamp authority URL")
+	tunePlatform := flags.String("auto-tune", "", "pick block or dct settings that survive this platform's re-encoding")
+	fpsFlag := flags.Int("fps", 30, "frame rate of written videos and of transmit")
+	resolution := flags.String("resolution", "640x480", "width and height of written frames, as WxH")
+	width := flags.Int("width", 0, "width of written frames in pixels, in place of the width -resolution gives")
+	height := flags.Int("height", 0, "height of written frames in pixels, in place of the height -resolution gives")
+	backendName := flags.String("backend", "opencv", "what writes and reads videos: opencv, png for a folder of PNG frames per video, or <plugin> for the program f2v-<plugin>")
+	codecName := flags.String("codec", "", "codec of written videos, ffv1 or h264; by default H.264 for .mp4 names and FFV1 otherwise")
+	loops := flags.Int("loops", 0, "passes over the file, 0 to repeat until a key is pressed")
+	parity := flags.Int("parity", 0, "recovery volume parity in percent of the data frames")
+	tune := flags.Bool("tune", false, "pick compression, density and parity from a first pass over each file")
+	compressSpec := flags.String("compress", "", "compress the data first with zstd (levels 1-22, default 3), gzip (1-9, 6), lz4 (0-9, 0) or brotli (0-11, 6), as ALGORITHM[:LEVEL]; decoding needs no flag")
+	compressMode := flags.String("compress-mode", "solid", "with -pack f2v, compress the archive whole (solid) or each file on its own (per-file), so that single files extract without decompressing the rest")
+	encrypt := flags.Bool("encrypt", false, "encrypt the data with AES-256-GCM under -key or -password, or to -age-recipient or -pgp-recipient")
+	keyPath := flags.String("key", "", "key file for -encrypt and for decoding encrypted videos")
+	password := flags.Bool("password", false, "prompt for a password to encrypt with, or to decrypt with")
+	argonTime := flags.Int("argon-time", defaultArgonTime, "Argon2id passes for -password")
+	argonMemory := flags.Int("argon-memory", defaultArgonMemory>>10, "Argon2id memory in MiB for -password")
+	argonThreads := flags.Int("argon-threads", defaultArgonThreads, "Argon2id threads for -password")
+	inputCmd := flags.String("input-cmd", "", "encode the stdout of this shell command, named after the input argument")
+	outputCmd := flags.String("output-cmd", "", "feed the decoded data to the stdin of this shell command; no output folder needed")
+	dedup := flags.Bool("dedup", false, "with -pack f2v, store files as content-defined chunks, each distinct chunk once")
+	basePath := flags.String("base", "", "with -pack f2v, store only the chunks this earlier archive video does not hold, referring to it for the rest")
+	pack := flags.String("pack", "", "encode the input as one tar, zip or f2v archive, streamed as it is walked")
+	robustHead := flags.Int("robust-head", 0, "write this many leading bytes in robust dct frames")
+	profileName := flags.String("profile", "", "apply encoding settings saved in the catalog or the config file, or built in: archive, youtube-safe, max-density or camera-transfer")
+	configPath := flags.String("config", "", "config file holding profiles of your own and how uploads are described (default f2v/config.json in the user config folder)")
+	saveProfile := flags.String("save-profile", "", "save the effective encoding settings to the catalog under this name")
+	crfs := flags.String("crf", "18,23,28,35", "comma-separated H.264 CRF values")
+	resize := flags.String("resize", "", "comma-separated WxH sizes to scale to")
+	rates := flags.String("rate", "", "comma-separated frame rates to convert to")
+	addr := flags.String("addr", ":8080", "listen address")
+	usersPath := flags.String("users", "", "users file with token hashes")
+	dataDir := flags.String("data", "f2v-data", "directory for uploads, videos and the default catalog")
+	screenPath := flags.String("screen", "", "JSON rules that uploads must pass before they are encoded")
+	var ageRecipients []age.Recipient
+	flags.Func("age-recipient", "encrypt to this age public key instead of -key or -password; repeatable", func(value string) error {
+		r, err := parseAgeRecipient(value)
+		if err == nil {
+			ageRecipients = append(ageRecipients, r)
+		}
+		return err
+	})
+	var ageIdentities []age.Identity
+	flags.Func("age-identity", "age key file to decrypt videos encrypted to age recipients; repeatable", func(path string) error {
+		ids, err := loadAgeIdentities(path)
+		if err == nil {
+			ageIdentities = append(ageIdentities, ids...)
+		}
+		return err
+	})
+	var pgpRecipients, pgpKeyring openpgp.EntityList
+	flags.Func("pgp-recipient", "encrypt to the OpenPGP public keys in this file instead of -key or -password; repeatable", func(path string) error {
+		keys, err := loadPGPKeys(path)
+		if err == nil {
+			pgpRecipients = append(pgpRecipients, keys...)
+		}
+		return err
+	})
+	flags.Func("pgp-keyring", "OpenPGP secret key file to decrypt videos encrypted to OpenPGP keys; repeatable", func(path string) error {
+		keys, err := loadPGPKeys(path)
+		if err == nil && len(keys.DecryptionKeys()) == 0 {
+			err = fmt.Errorf("%s holds no secret keys; export them with gpg --export-secret-keys", path)
+		}
+		if err == nil {
+			pgpKeyring = append(pgpKeyring, keys...)
+		}
+		return err
+	})
+	hiddenPath := flags.String("hidden", "", "file to hide in the padding of an -encrypt video under -hidden-key or -hidden-password")
+	hiddenKeyPath := flags.String("hidden-key", "", "key file for -hidden")
+	hiddenPassword := flags.Bool("hidden-password", false, "prompt for a password for -hidden")
+	var padTo int64
+	flags.Func("pad-to", "pad the encrypted data of -encrypt videos to at least this size, e.g. 1GB", func(value string) (err error) {
+		padTo, err = parseBytes(value)
+		return err
+	})
+	var maxVideoSize int64
+	flags.Func("max-video-size", "split files into numbered part videos of at most this size, e.g. 2GB", func(value string) (err error) {
+		maxVideoSize, err = parseBytes(value)
+		return err
+	})
+	maxFramesFlag := flags.Int64("max-frames", 0, "split files into numbered part videos of at most this many frames")
+	maxDuration := flags.Duration("max-duration", 0, "split files into numbered part videos of at most this length, e.g. 1h")
+	manifest := flags.Bool("manifest", false, "also write a manifest video listing the parts of split files, which decodes into the whole file")
+	targetName := flags.String("target", "", "platform the videos are for, youtube: write frames it serves as they are and split files under its upload limits")
+	partURL := flags.String("part-url", "", "with -manifest, list the parts under this URL prefix, where they will be uploaded")
+	shareSpec := flags.String("shares", "", "K/N: encrypt under a random key split across N videos, any K of which decrypt")
+	var sharePaths []string
+	flags.Func("share", "another video of a -shares set, whose key share to use; repeatable", func(path string) error {
+		sharePaths = append(sharePaths, path)
+		return nil
+	})
+	filter := &pathFilter{}
+	flags.Func("include", "when encoding a folder, only take files matching this .gitignore-style pattern; repeatable", filter.addInclude)
+	flags.Func("exclude", "when encoding a folder, leave out files and folders matching this .gitignore-style pattern; repeatable", filter.addExclude)
+	flags.Func("exclude-from", "read -exclude patterns from this .gitignore-style file; repeatable", filter.addExcludeFile)
+	var alsoSpecs []string
+	flags.Func("also", "also write an output name[:mode=...,block=...,bits=...,coeffs=...] from the same pass; repeatable", func(spec string) error {
+		alsoSpecs = append(alsoSpecs, spec)
+		return nil
+	})
+	var hooks []decodeHook
+	flags.Func("hook", "run decoded files through a built-in hook; repeatable", func(name string) error {
+		h, err := lookupDecodeHook(name)
+		if err == nil {
+			hooks = append(hooks, h)
+		}
+		return err
+	})
+	flags.Func("filter", "pipe decoded files through a shell command whose output replaces them; repeatable", func(command string) error {
+		hooks = append(hooks, commandHook(command, false))
+		return nil
+	})
+	flags.Func("scan", "pipe decoded files through a shell command that must succeed for them to be kept; repeatable", func(command string) error {
+		hooks = append(hooks, commandHook(command, true))
+		return nil
+	})
+	discard := flags.Bool("discard", false, "run the hooks but do not write the decoded files")
+	var byteRange *[2]int64
+	flags.Func("range", "decode only bytes START-END of the data, END exclusive and left out for the end, e.g. 4GB-5GB", func(value string) error {
+		from, to, ok := strings.Cut(value, "-")
+		r := [2]int64{}
+		var err error
+		if r[0], err = parseBytes(from); err == nil && to != "" {
+			r[1], err = parseBytes(to)
+		}
+		if err == nil && (!ok || to != "" && r[1] <= r[0]) {
+			err = fmt.Errorf("invalid range %q; give START-END with END past START, or START-", value)
+		}
+		byteRange = &r
+		return err
+	})
+	follow := flags.Bool("follow", false, "keep reading a video that is still being written until its final frame")
+	idle := flags.Duration("idle", 0, "with -follow, give up after this long without new frames, 0 to wait forever")
+	raw := flags.Bool("raw", false, "print sizes, counts and durations as plain numbers of bytes and seconds")
+	dryRun := flags.Bool("dry-run", false, "print the files, frames, sizes and destinations the run would take and write, without writing anything")
+	jsonFlag := flags.Bool("json", false, "write the events of the run and a final result object as JSON lines to stdout, and the rest to stderr")
+	quiet := flags.Bool("q", false, "log only errors, and leave out what the run came to")
+	verbose := flags.Bool("v", false, "also log each file encoded or decoded")
+	veryVerbose := flags.Bool("vv", false, "also log each file, every frame written and read and every chunk checked")
+	lenient := flags.Bool("lenient", false, "leave holes for unreadable frames instead of failing and write a gap map")
+	coverPath := flags.String("cover", "", "hide the data in this video's own frames instead of frames of its own, in dct or lsb mode")
+	stego := flags.Bool("stego", false, "read a video made with -cover: no sync markers, frames at the video's own size")
+	asOf := flags.String("as-of", "", "restore the files as they were at this time, 2006-01-02 or RFC 3339")
+	planOnly := flags.Bool("plan", false, "print the restore plan without restoring anything")
+	noHeader := flags.Bool("no-header", false, "ignore frame headers and take every frame's data in the order read")
+	cold := flags.Bool("cold", false, "cold storage: scrub what identifies the encoder from written videos, name them by random IDs and pick a common frame rate")
+	macKeyPath := flags.String("mac-key", "", "key file to append an integrity tag to unencrypted videos with, and to check tags with when decoding")
+	newKeyPath := flags.String("new-key", "", "key file to re-encrypt with")
+	newPassword := flags.Bool("new-password", false, "prompt for a password to re-encrypt with")
+	mergeOutput := flags.String("o", "", "video to write the merged archive to")
+	flags = cmd.flagSet(flags)
+	if asked {
+		flags.SetOutput(os.Stdout)
+	}
+	parseArgs(flags, args)
+	if err := applyFlagEnv(flags); err != nil {
+		fatalf("Invalid environment: %v", err)
+	}
+	display.raw = *raw
+	level, err := verbosity(*quiet, *verbose, *veryVerbose)
+	if err != nil {
+		fatalf("Invalid flags: %v", err)
+	}
+	cliLevel = level
+	slog.SetLogLoggerLevel(level)
+	if *jsonFlag {
+		if flags.Arg(1) == "-" {
+			fatalf("-json writes to standard output; decode to a folder instead of -")
+		}
+		jsonOut = startJSON(operation, level)
+	}
+	// A progress bar only gets in the way of logging every frame, and with
+	// -json the events stand in for it
+	showProgress := !*veryVerbose && !*quiet && !*jsonFlag
+
+	wantArgs := map[string]int{"encode": 2, "decode": 2, "verify": 1, "inspect": 1, "stress": 1, "repair": 3, "fill": 2, "receive": 2, "transmit": 1, "index": 1, "ls": 1, "extract": 2, "append": 2, "merge": 2, "estimate": 1, "capacity": 1, "recover": 2, "restore": 2, "rekey": 2, "serve": 0, "catalog": 2, "stats": 1, "locate": 2}[operation]
+	if operation == "decode" && *outputCmd != "" && flags.NArg() == 1 {
+		wantArgs = 1
+	}
+	if operation == "extract" && flags.NArg() == 3 {
+		wantArgs = 3
+	}
+	if (operation == "append" || operation == "merge") && flags.NArg() > 2 || operation == "catalog" && flags.NArg() == 3 {
+		wantArgs = flags.NArg()
+	}
+	if flags.NArg() != wantArgs || operation == "merge" && *mergeOutput == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	inputPath := flags.Arg(0)
+
+	if operation == "catalog" {
+		if err := runCatalog(flags.Args()); err != nil {
+			fatalf("Catalog: %v", err)
+		}
+		return
+	}
+	if operation == "stats" {
+		if err := runStats(inputPath); err != nil {
+			fatalf("Stats: %v", err)
+		}
+		return
+	}
+
+	if operation == "serve" && *catalogPath == "" {
+		*catalogPath = filepath.Join(*dataDir, "catalog.json")
+	}
+
+	var cat *catalog
+	if *catalogPath != "" {
+		var err error
+		if cat, err = loadCatalog(*catalogPath); err != nil {
+			fatalf("Error loading catalog: %v", err)
+		}
+	}
+
+	// Start from the defaults or the named profile, then apply any flags
+	// given explicitly on the command line.
+	l := defaultLayout()
+	fps, wantParity := defaultFPS, *parity
+	if *profileName != "" {
+		config, err := loadUserConfig(*configPath)
+		if err != nil {
+			fatalf("Error loading config: %v", err)
+		}
+		p, err := findProfile(*profileName, cat, config)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if l, fps, err = p.settings(); err != nil {
+			fatalf("Invalid profile %q: %v", *profileName, err)
+		}
+		wantParity = p.Parity
+	}
+	var flagErr error
+	fpsGiven, bitsGiven, resolutionGiven := false, false, false
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "parity":
+			wantParity = *parity
+		case "mode":
+			l.mode, flagErr = parseFrameMode(*modeName)
+		case "block":
+			l.blockSize = *blockSize
+		case "bits":
+			l.bitsPerChannel, bitsGiven = *bitsPerChannel, true
+		case "coeffs":
+			l.coefficients = *coefficients
+		case "fps":
+			fps, fpsGiven = *fpsFlag, true
+		case "resolution":
+			l.width, l.height, flagErr = parseResolution(*resolution)
+			resolutionGiven = true
+		case "backend":
+			l.backend, flagErr = parseCodecBackend(*backendName)
+		case "codec":
+			l.codec, flagErr = parseCodec(*codecName)
+		case "cold":
+			l.cold = *cold
+		}
+	})
+	if flagErr != nil {
+		fatalf("Invalid flags: %v", flagErr)
+	}
+	*parity = wantParity
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "width":
+			l.width, resolutionGiven = *width, true
+		case "height":
+			l.height, resolutionGiven = *height, true
+		}
+	})
+	l.markers = l.mode.hasMarkers()
+	if fps <= 0 {
+		fatalf("-fps must be positive")
+	}
+	if resolutionGiven && (*coverPath != "" || *stego) {
+		fatalf("-resolution does not combine with -cover, whose frames keep the cover video's size")
+	}
+	if *coverPath != "" {
+		if l.mode != modeDCT && l.mode != modeLSB {
+			fatalf("-cover needs -mode dct or lsb")
+		}
+		if *parity > 0 || *robustHead > 0 || *tune || *tunePlatform != "" || len(alsoSpecs) > 0 {
+			fatalf("-cover does not combine with -parity, -robust-head, -tune, -auto-tune or -also")
+		}
+		width, height, coverFPS, err := probeCover(l.codecBackend(), *coverPath)
+		if err != nil {
+			fatalf("Invalid -cover: %v", err)
+		}
+		l.width, l.height, l.cover = width, height, *coverPath
+		if !fpsGiven {
+			fps = coverFPS
+		}
+	}
+	if *coverPath != "" || *stego {
+		l.markers = false
+	}
+	if l.cold && !fpsGiven && *coverPath == "" && (operation == "encode" || operation == "serve") {
+		fps = coldRate()
+	}
+	var target *volumeTarget
+	if *targetName != "" {
+		if *coverPath != "" || *stego {
+			fatalf("-target does not combine with -cover, whose frames keep the cover video's size")
+		}
+		t, err := lookupTarget(*targetName)
+		if err != nil {
+			fatalf("Invalid -target: %v", err)
+		}
+		l, fps = t.fit(*targetName, l, fps)
+		target = &t
+	}
+	if l.mode == modeLSB && *coverPath == "" && (operation == "encode" || operation == "estimate") {
+		fatalf("-mode lsb hides data in a video given with -cover")
+	}
+	if err := l.validate(); err != nil {
+		fatalf("Invalid flags: %v", err)
+	}
+	if operation == "encode" {
+		if err := fitCodec(l.codecFor(flags.Arg(1)), l.width, l.height, fps); err != nil {
+			fatalf("Invalid flags: %v", err)
+		}
+	}
+
+	if operation == "estimate" {
+		size, name := int64(0), inputPath
+		if info, err := os.Stat(inputPath); err == nil && !info.IsDir() {
+			size = info.Size()
+		} else if size, err = parseBytes(inputPath); err != nil {
+			fatalf("Estimate: %v", err)
+		}
+		opts := planOptions{parity: *parity, encrypt: *encrypt, mac: *macKeyPath != "", name: filepath.Base(name), padTo: padTo}
+		if *shareSpec != "" {
+			_, n, err := parseShareSpec(*shareSpec)
+			if err != nil {
+				fatalf("Invalid -shares: %v", err)
+			}
+			opts.shares = n
+		}
+		plan, err := planCapacity(size, profileFromLayout(l, fps), opts)
+		if err != nil {
+			fatalf("Estimate: %v", err)
+		}
+		plan.print(os.Stdout, name)
+		return
+	}
+
+	if *tunePlatform != "" {
+		var err error
+		if l, err = autoTune(*tunePlatform, l, fps, os.Stdout); err != nil {
+			fatalf("Auto-tune failed: %v", err)
+		}
+		summarize(os.Stdout, "Using %s", l.describe())
+	}
+
+	var sec *secret
+	if *keyPath != "" {
+		var err error
+		if sec, err = loadKeyFile(*keyPath); err != nil {
+			fatalf("Invalid -key: %v", err)
+		}
+	}
+	if *password {
+		if *keyPath != "" && operation == "encode" {
+			fatalf("give -key or -password to encrypt with, not both")
+		}
+		if *argonTime < 1 || *argonTime > maxArgonTime || *argonMemory < 1 || *argonMemory > maxArgonMemory>>10 || *argonThreads < 1 || *argonThreads > 255 {
+			fatalf("Argon2id costs must be 1-%d passes, 1-%d MiB and 1-255 threads", maxArgonTime, maxArgonMemory>>10)
+		}
+		pw, err := readPassword("Password", operation == "encode")
+		if err != nil {
+			fatalf("Password: %v", err)
+		}
+		if sec == nil {
+			sec = &secret{}
+		}
+		sec.password = pw
+		sec.argonTime, sec.argonMemory, sec.argonThreads = uint32(*argonTime), uint32(*argonMemory)<<10, uint8(*argonThreads)
+	}
+	if len(ageRecipients) > 0 || len(ageIdentities) > 0 || len(pgpRecipients) > 0 || len(pgpKeyring) > 0 {
+		toAge, toPGP := len(ageRecipients) > 0, len(pgpRecipients) > 0
+		if toAge && toPGP || (toAge || toPGP) && sec != nil && operation == "encode" {
+			fatalf("give one of -age-recipient, -pgp-recipient, -key or -password to encrypt with")
+		}
+		if (toAge || toPGP) && !*encrypt && operation != "rekey" {
+			fatalf("-age-recipient and -pgp-recipient only apply with -encrypt")
+		}
+		if sec == nil {
+			sec = &secret{}
+		}
+		sec.ageRecipients, sec.ageIdentities = ageRecipients, ageIdentities
+		sec.pgpRecipients, sec.pgpKeyring = pgpRecipients, pgpKeyring
+	}
+	if *encrypt && sec == nil {
+		fatalf("-encrypt requires -key, -password, -age-recipient or -pgp-recipient")
+	}
+	var tagWith []byte
+	if *macKeyPath != "" {
+		if *encrypt || *shareSpec != "" {
+			fatalf("-mac-key is for unencrypted videos; encryption already detects tampering")
+		}
+		mac, err := loadKeyFile(*macKeyPath)
+		if err != nil {
+			fatalf("Invalid -mac-key: %v", err)
+		}
+		tagWith = macKey(mac.keyFile)
+		if sec == nil {
+			sec = &secret{}
+		}
+		sec.macKey = tagWith
+	}
+	for _, path := range sharePaths {
+		share, err := readVideoShare(path, l)
+		if err != nil {
+			fatalf("Invalid -share: %v", err)
+		}
+		sec = sec.withShare(share)
+	}
+	withEnvelope := *encrypt && sec != nil && (sec.keyFile != nil || sec.password != nil) && len(ageRecipients) == 0 && len(pgpRecipients) == 0 && *shareSpec == ""
+	if *hiddenPath != "" {
+		if !withEnvelope {
+			fatalf("-hidden only applies with -encrypt under -key or -password")
+		}
+		hidden := &hiddenVolume{path: *hiddenPath}
+		switch {
+		case *hiddenKeyPath != "" && *hiddenPassword:
+			fatalf("give -hidden-key or -hidden-password, not both")
+		case *hiddenKeyPath != "":
+			var err error
+			if hidden.secret, err = loadKeyFile(*hiddenKeyPath); err != nil {
+				fatalf("Invalid -hidden-key: %v", err)
+			}
+		case *hiddenPassword:
+			pw, err := readPassword("Hidden password", true)
+			if err != nil {
+				fatalf("Hidden password: %v", err)
+			}
+			hidden.secret = &secret{password: pw}
+		default:
+			fatalf("-hidden requires -hidden-key or -hidden-password")
+		}
+		if hidden.secret.keyFile != nil && bytes.Equal(hidden.secret.keyFile, sec.keyFile) || hidden.secret.password != nil && bytes.Equal(hidden.secret.password, sec.password) {
+			fatalf("-hidden needs a different secret from the one the video is encrypted with")
+		}
+		sec.hidden = hidden
+	} else if *hiddenKeyPath != "" || *hiddenPassword {
+		fatalf("-hidden-key and -hidden-password only apply with -hidden")
+	}
+	if padTo > 0 {
+		if !withEnvelope {
+			fatalf("-pad-to only applies with -encrypt under -key or -password")
+		}
+		sec.padTo = padTo
+	}
+
+	if *saveProfile != "" {
+		if cat == nil {
+			fatalf("-save-profile requires -catalog to store the profile")
+		}
+		p := profileFromLayout(l, fps)
+		p.Parity = *parity
+		cat.setProfile(*saveProfile, p)
+		if err := cat.save(); err != nil {
+			fatalf("Error saving profile: %v", err)
+		}
+		summarize(os.Stdout, "Saved profile %q to %s", *saveProfile, cat.path)
+	}
+
+	if operation == "serve" {
+		if *usersPath == "" {
+			fatalf("serve requires -users")
+		}
+		users, err := loadUsers(*usersPath)
+		if err != nil {
+			fatalf("Error loading users: %v", err)
+		}
+		var screen screenRules
+		if *screenPath != "" {
+			if screen, err = loadScreenRules(*screenPath); err != nil {
+				fatalf("Error loading screening rules: %v", err)
+			}
+		}
+		srv, err := newServer(*dataDir, cat, users, screen, l, fps)
+		if err != nil {
+			fatalf("Error starting server: %v", err)
+		}
+		summarize(os.Stderr, "Serving on %s with %d users, catalog %s", *addr, len(users), cat.path)
+		fatalf("Serving failed: %v", http.ListenAndServe(*addr, srv.routes()))
+	}
+
+	if operation == "verify" {
+		logCheck := func(err error) {
+			if cat == nil {
+				return
+			}
+			cat.logRun("check", inputPath, 0, err)
+			if err := cat.save(); err != nil {
+				slog.Warn("Recording the check failed", "err", err)
+			}
+		}
+		report, err := checkVideo(inputPath, l)
+		if err != nil {
+			logCheck(err)
+			fatalf("Check failed: %v", err)
+		}
+		if volume := recoveryPath(inputPath); !report.ok() && !isURL(inputPath) {
+			if _, err := os.Stat(volume); err == nil {
+				report.checkRecovery(volume, l)
+			}
+		}
+		report.print(os.Stdout, inputPath)
+		logCheck(report.failure())
+		if !report.ok() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if operation == "inspect" {
+		in, err := inspectVideo(inputPath, l)
+		if err != nil {
+			fatalf("Inspect failed: %v", err)
+		}
+		in.print(os.Stdout, inputPath)
+		return
+	}
+
+	if operation == "stress" {
+		cases, err := parseStressCases(*crfs, *resize, *rates)
+		if err != nil {
+			fatalf("Invalid flags: %v", err)
+		}
+		results, err := runStress(inputPath, cases, l)
+		if err != nil {
+			fatalf("Stress test failed: %v", err)
+		}
+		printStressResults(os.Stdout, inputPath, results)
+		for _, r := range results {
+			if !r.decodes() {
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	if operation == "index" {
+		idx, err := buildSeekIndex(inputPath, l)
+		if err != nil {
+			fatalf("Indexing failed: %v", err)
+		}
+		if err := idx.save(indexPath(inputPath)); err != nil {
+			fatalf("Indexing failed: %v", err)
+		}
+		if summarizing() {
+			idx.print(os.Stdout)
+		}
+		summarize(os.Stdout, "Wrote %s", indexPath(inputPath))
+		return
+	}
+
+	if operation == "ls" {
+		d, err := readArchiveDirectory(inputPath, decodeOptions{layout: l, secret: sec})
+		if err != nil {
+			fatalf("Listing failed: %v", err)
+		}
+		d.print(os.Stdout, display)
+		return
+	}
+
+	if operation == "extract" {
+		dir := "."
+		if flags.NArg() == 3 {
+			dir = flags.Arg(2)
+		}
+		out, err := extractEntry(inputPath, flags.Arg(1), dir, decodeOptions{layout: l, secret: sec})
+		if err != nil {
+			fatalf("Extracting failed: %v", err)
+		}
+		summarize(os.Stdout, "Extracted %s into %s", flags.Arg(1), out)
+		return
+	}
+
+	if operation == "append" || operation == "merge" {
+		var compressWith *compression
+		if *compressSpec != "" {
+			perFile, err := parseCompressMode(*compressMode)
+			if err != nil {
+				fatalf("%v", err)
+			}
+			if !perFile {
+				fatalf("%s only compresses with -compress-mode per-file", operation)
+			}
+			c, err := parseCompression(*compressSpec)
+			if err != nil {
+				fatalf("Invalid -compress: %v", err)
+			}
+			compressWith = &c
+		}
+		if operation == "merge" {
+			entries, shared, err := mergeArchives(flags.Args(), *mergeOutput, encodeOptions{layout: l, compress: compressWith, perFile: compressWith != nil}, decodeOptions{layout: l, secret: sec})
+			if err != nil {
+				fatalf("Merging failed: %v", err)
+			}
+			summarize(os.Stdout, "Merged %d videos into %s: %s entries, %s of chunks they share stored once", flags.NArg(), *mergeOutput, display.count(int64(entries)), display.bytes(shared))
+			return
+		}
+		added, unchanged, err := appendArchive(inputPath, flags.Args()[1:], encodeOptions{layout: l, filter: filter, dedup: *dedup, compress: compressWith, perFile: compressWith != nil})
+		if err != nil {
+			fatalf("Appending failed: %v", err)
+		}
+		summarize(os.Stdout, "Appended %d entries to %s, %d already in it unchanged", added, inputPath, unchanged)
+		return
+	}
+
+	if operation == "receive" {
+		if err := receiveFile(inputPath, flags.Arg(1), l, sec); err != nil {
+			fatalf("Receive failed: %v", err)
+		}
+		return
+	}
+
+	if operation == "transmit" {
+		if err := transmitFile(inputPath, l, fps, *loops); err != nil {
+			fatalf("Transmit failed: %v", err)
+		}
+		return
+	}
+
+	if operation == "fill" {
+		if err := fillGaps(inputPath, flags.Arg(1), l); err != nil {
+			fatalf("Fill failed: %v", err)
+		}
+		return
+	}
+
+	if operation == "capacity" {
+		depths := []int{1, 2, 3, 4}
+		if bitsGiven {
+			depths = []int{l.bitsPerChannel}
+		}
+		report, err := coverCapacity(inputPath, l, depths)
+		if err != nil {
+			fatalf("Capacity: %v", err)
+		}
+		report.print(os.Stdout, inputPath)
+		return
+	}
+
+	if operation == "locate" {
+		if cat == nil {
+			fatalf("locate records what it finds in a catalog; give -catalog")
+		}
+		urls, err := runLocate(context.Background(), cat, inputPath, flags.Arg(1))
+		if err != nil {
+			fatalf("Locate failed: %v", err)
+		}
+		for _, u := range urls {
+			fmt.Println(u)
+		}
+		summarize(os.Stderr, "Recorded %d uploads of %s in %s", len(urls), inputPath, cat.path)
+		return
+	}
+
+	if operation == "restore" {
+		if cat == nil {
+			fatalf("restore needs -catalog")
+		}
+		var when time.Time
+		if *asOf != "" {
+			var err error
+			if when, err = parseAsOf(*asOf); err != nil {
+				fatalf("Invalid -as-of: %v", err)
+			}
+		}
+		wanted, err := readWantList(inputPath)
+		if err != nil {
+			fatalf("Restore failed: %v", err)
+		}
+		plan, err := planRestore(cat, wanted, when, l)
+		if err != nil {
+			fatalf("Restore failed: %v", err)
+		}
+		// The plan is what -plan asks for; otherwise it is said beforehand
+		if *planOnly || summarizing() {
+			fmt.Printf("Restore plan from %s:\n", cat.path)
+			plan.print(os.Stdout)
+		}
+		if !*planOnly {
+			if err := plan.run(cat, flags.Arg(1), decodeOptions{layout: l, secret: sec}); err != nil {
+				fatalf("Restore failed: %v", err)
+			}
+		}
+		if len(plan.missing) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if operation == "recover" {
+		if err := runRecover(inputPath, flags.Arg(1), l, *noHeader); err != nil {
+			fatalf("Recover failed: %v", err)
+		}
+		return
+	}
+
+	if operation == "rekey" {
+		if *stego {
+			fatalf("rekey does not rewrite videos made with -cover")
+		}
+		next := &secret{ageRecipients: ageRecipients, pgpRecipients: pgpRecipients}
+		given := 0
+		for _, set := range []bool{*newKeyPath != "", *newPassword, len(ageRecipients) > 0, len(pgpRecipients) > 0} {
+			if set {
+				given++
+			}
+		}
+		if given != 1 {
+			fatalf("rekey needs one of -new-key, -new-password, -age-recipient or -pgp-recipient to encrypt with")
+		}
+		if *newKeyPath != "" {
+			var err error
+			if next, err = loadKeyFile(*newKeyPath); err != nil {
+				fatalf("Invalid -new-key: %v", err)
+			}
+		}
+		if *newPassword {
+			if *argonTime < 1 || *argonTime > maxArgonTime || *argonMemory < 1 || *argonMemory > maxArgonMemory>>10 || *argonThreads < 1 || *argonThreads > 255 {
+				fatalf("Argon2id costs must be 1-%d passes, 1-%d MiB and 1-255 threads", maxArgonTime, maxArgonMemory>>10)
+			}
+			pw, err := readPassword("New password", true)
+			if err != nil {
+				fatalf("New password: %v", err)
+			}
+			next.password = pw
+			next.argonTime, next.argonMemory, next.argonThreads = uint32(*argonTime), uint32(*argonMemory)<<10, uint8(*argonThreads)
+		}
+		if err := runRekey(inputPath, flags.Arg(1), l, fps, sec, next, cat); err != nil {
+			fatalf("Rekey failed: %v", err)
+		}
+		return
+	}
+
+	if operation == "repair" {
+		if err := runRepair(inputPath, flags.Arg(1), flags.Arg(2), l, fps, sec); err != nil {
+			fatalf("Repair failed: %v", err)
+		}
+		return
+	}
+
+	outputPath := flags.Arg(1)
+
+	// Create output directory if it doesn't exist
+	outputDir := outputPath
+	if operation == "encode" && inputPath == "-" && isVideoName(outputPath) {
+		outputDir = filepath.Dir(outputPath)
+	}
+	if outputDir != "" && outputDir != "-" && !isURL(outputDir) && !*dryRun {
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			fatalf("Error creating output directory: %v", err)
+		}
+	}
+
+	// Ctrl-C stops the encode or decode cleanly; a second one kills it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	switch operation {
+	case "encode":
+		if cat != nil && isURL(outputPath) {
+			fatalf("-catalog records videos on the local disk, not under %s", outputPath)
+		}
+		if outputPath == "-" {
+			fatalf("Videos are written to files; only decode writes to standard output")
+		}
+		if inputPath == "-" && (*inputCmd != "" || *pack != "") {
+			fatalf("Standard input does not combine with -input-cmd or -pack")
+		}
+		if *tsaURL != "" && cat == nil {
+			fatalf("-tsa requires -catalog to store the time-stamp tokens")
+		}
+		if *parity < 0 || *parity > 100 {
+			fatalf("-parity must be between 0 and 100")
+		}
+		if *robustHead < 0 {
+			fatalf("-robust-head must not be negative")
+		}
+		if *robustHead > 0 && *parity > 0 {
+			fatalf("-parity does not support segmented videos made with -robust-head")
+		}
+		if *robustHead > 0 && *encrypt {
+			fatalf("-robust-head is no use with -encrypt: an encrypted file only decrypts whole")
+		}
+		var compressWith *compression
+		if *compressSpec != "" {
+			c, err := parseCompression(*compressSpec)
+			if err != nil {
+				fatalf("Invalid -compress: %v", err)
+			}
+			if *tune {
+				fatalf("-tune picks its own compression; leave out -compress")
+			}
+			if *robustHead > 0 {
+				fatalf("-robust-head is no use with -compress: compressed data only decompresses whole")
+			}
+			compressWith = &c
+		}
+		if *pack != "" && !slices.Contains(packFormats, *pack) {
+			fatalf("-pack must be tar, zip or f2v")
+		}
+		if (*dedup || *basePath != "") && *pack != "f2v" {
+			fatalf("-dedup and -base only work with -pack f2v")
+		}
+		perFile, err := parseCompressMode(*compressMode)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if perFile && (compressWith == nil || *pack != "f2v") {
+			fatalf("-compress-mode per-file needs -compress and -pack f2v")
+		}
+		if *pack != "" && *inputCmd != "" {
+			fatalf("-pack and -input-cmd both choose the input; give one")
+		}
+		var encryptWith *secret
+		if *encrypt {
+			encryptWith = sec
+		}
+		var shares []int
+		if *shareSpec != "" {
+			k, n, err := parseShareSpec(*shareSpec)
+			if err != nil {
+				fatalf("Invalid -shares: %v", err)
+			}
+			if *encrypt {
+				fatalf("-shares makes its own key; leave out -encrypt")
+			}
+			if *tune || *parity > 0 || *robustHead > 0 || len(alsoSpecs) > 0 {
+				fatalf("-shares does not combine with -tune, -parity, -robust-head or -also")
+			}
+			shares = []int{k, n}
+		}
+		splitGiven := maxVideoSize > 0 || *maxFramesFlag > 0 || *maxDuration > 0
+		if target != nil {
+			// The platform's limits hold whatever is given
+			if maxVideoSize == 0 || target.maxSize < maxVideoSize {
+				maxVideoSize = target.maxSize
+			}
+			if *maxDuration == 0 || target.maxDuration < *maxDuration {
+				*maxDuration = target.maxDuration
+			}
+		}
+		maxFrames, err := maxPartFrames(maxVideoSize, *maxFramesFlag, *maxDuration, l, fps)
+		if err != nil {
+			fatalf("Invalid flags: %v", err)
+		}
+		if splitGiven {
+			switch {
+			case *tune || *parity > 0 || *robustHead > 0 || shares != nil || len(alsoSpecs) > 0 || *coverPath != "":
+				fatalf("-max-video-size, -max-frames and -max-duration do not combine with -tune, -parity, -robust-head, -shares, -also or -cover")
+			case *pack != "" || *inputCmd != "":
+				fatalf("only files can be split into parts, not -pack or -input-cmd streams, whose size is not known ahead")
+			case compressWith != nil:
+				fatalf("-compress does not combine with splitting into parts: how far a part compresses is not known ahead")
+			case *encrypt && !withEnvelope || *hiddenPath != "":
+				fatalf("split files can only be encrypted under -key or -password, without -hidden")
+			}
+		}
+		if *manifest && maxFrames == 0 {
+			fatalf("-manifest lists the parts of split files; give -max-video-size, -max-frames, -max-duration or -target")
+		}
+		if *partURL != "" && !*manifest {
+			fatalf("-part-url only applies with -manifest")
+		}
+		var extra []outputSpec
+		for _, spec := range alsoSpecs {
+			o, err := parseOutputSpec(spec, l)
+			if err != nil {
+				fatalf("Invalid -also: %v", err)
+			}
+			extra = append(extra, o)
+		}
+		opts := encodeOptions{layout: l, fps: fps, catalog: cat, tsaURL: *tsaURL, parity: *parity, head: *robustHead, tune: *tune, compress: compressWith, extra: extra, secret: encryptWith, macKey: tagWith, shares: shares, pack: *pack, filter: filter, dedup: *dedup, perFile: perFile, base: *basePath, maxFrames: maxFrames, manifest: *manifest, partURL: *partURL, inputCmd: *inputCmd, ctx: ctx}
+		if *dryRun {
+			plan, err := planEncode(inputPath, outputPath, opts)
+			if err != nil {
+				fatalf("Dry run failed: %v", err)
+			}
+			plan.print(os.Stdout)
+			plan.record(jsonOut)
+			break
+		}
+		if showProgress {
+			opts.bar = logProgress("Encoding")
+		}
+		opts.report = jsonOut
+		var describe *parsedUpload
+		if isURL(outputPath) {
+			config, err := loadUserConfig(*configPath)
+			if err != nil {
+				fatalf("Error loading config: %v", err)
+			}
+			if config.Upload != nil {
+				if describe, err = config.Upload.parse(); err != nil {
+					fatalf("Invalid config: %v", err)
+				}
+			}
+		}
+		uploaded, err := stageBackends(ctx, inputPath, outputPath, false, describe, func(input, output string) { runEncode(input, output, opts) })
+		if err != nil {
+			fatalf("Encoding failed: %v", err)
+		}
+		reportUploads(uploaded)
+		jsonOut.uploaded(uploaded)
+	case "decode":
+		if byteRange != nil && (*follow || *lenient) {
+			fatalf("-range does not combine with -follow or -lenient")
+		}
+		if inputPath == "-" {
+			fatalf("Videos are read from files or URLs; only encode reads standard input")
+		}
+		if outputPath == "-" && *outputCmd != "" {
+			fatalf("-output-cmd does not combine with decoding to standard output")
+		}
+		opts := decodeOptions{layout: l, hooks: hooks, discard: *discard, lenient: *lenient, follow: *follow, idle: *idle, secret: sec, outputCmd: *outputCmd, byteRange: byteRange, ctx: ctx}
+		if *dryRun {
+			plan, err := planDecode(inputPath, outputPath, opts)
+			if err != nil {
+				fatalf("Dry run failed: %v", err)
+			}
+			plan.print(os.Stdout)
+			plan.record(jsonOut)
+			break
+		}
+		if showProgress {
+			opts.bar = logProgress("Decoding")
+		}
+		opts.report = jsonOut
+		uploaded, err := stageBackends(ctx, inputPath, outputPath, true, nil, func(input, output string) { runDecode(input, output, opts) })
+		if err != nil {
+			fatalf("Decoding failed: %v", err)
+		}
+		reportUploads(uploaded)
+		jsonOut.uploaded(uploaded)
+	}
+	if jsonOut != nil {
+		jsonOut.finish(nil)
+	}
+}
@@ -0,0 +1,108 @@
+package f2v
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Frames are written to videos and read back from them through a
+// CodecBackend, so what holds the frames, OpenCV's video I/O by default, is
+// one implementation among others and the packing, checking and assembling
+// of frames never depends on it. Frames cross the interface as packed 8-bit
+// BGR pixels, row by row, the layout OpenCV keeps them in.
+
+// A CodecBackend writes the videos frames are carried in and reads them
+// back.
+type CodecBackend interface {
+	// Create starts a video at path of width by height frames at fps,
+	// written with the codec of the fourcc codec where the backend has a
+	// choice of codecs.
+	Create(path, codec string, fps float64, width, height int) (VideoWriter, error)
+	// Open opens the video at path for reading.
+	Open(path string) (VideoReader, error)
+}
+
+// A VideoWriter appends frames to a video.
+type VideoWriter interface {
+	// WriteFrame appends a frame of width*height*3 bytes of BGR pixels.
+	WriteFrame(bgr []byte) error
+	// Close finishes the video.
+	Close() error
+}
+
+// VideoInfo is what a VideoReader knows about its video; fields it does not
+// know are 0.
+type VideoInfo struct {
+	Width, Height int
+	FPS           float64
+	Frames        int64
+}
+
+// A VideoReader reads the frames of a video in order.
+type VideoReader interface {
+	Info() VideoInfo
+	// ReadFrame returns the next frame in the form WriteFrame takes, with
+	// its size, or io.EOF after the last one. The bytes are only valid
+	// until the next call.
+	ReadFrame() (bgr []byte, width, height int, err error)
+	// SeekFrame makes frame the next one read. Readers that cannot seek fail
+	// with an error wrapping errors.ErrUnsupported.
+	SeekFrame(frame int64) error
+	Close() error
+}
+
+// codecBackend returns the backend videos of the layout are written and
+// read with.
+func (l layout) codecBackend() CodecBackend {
+	if l.backend == nil {
+		return OpenCV{}
+	}
+	return l.backend
+}
+
+// parseCodecBackend returns the backend called name, opencv, png or that of
+// a plugin; the default, OpenCV, is nil.
+func parseCodecBackend(name string) (CodecBackend, error) {
+	switch strings.ToLower(name) {
+	case "opencv":
+		return nil, nil
+	case "png":
+		return PNGSequence{}, nil
+	}
+	if havePlugin(name) {
+		return PluginBackend{Name: name}, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q; use opencv, png or a plugin, a program called %s on the PATH", name, pluginProgram(name))
+}
+
+// capture reads a video through its backend as Mats, the frameSource
+// scanFrames takes.
+type capture struct {
+	VideoReader
+}
+
+func openCapture(b CodecBackend, path string) (*capture, error) {
+	r, err := b.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &capture{VideoReader: r}, nil
+}
+
+// Read reads the next frame into m, reporting whether there was one.
+func (c *capture) Read(m *mat) bool {
+	if r, ok := c.VideoReader.(interface{ readMat(*mat) bool }); ok {
+		return r.readMat(m)
+	}
+	data, width, height, err := c.ReadFrame()
+	if err != nil {
+		return false // the end of the video, or as far as it can be read
+	}
+	return readBGR(m, data, width, height)
+}
+
+// fps returns the frame rate of the video, rounded, or 0 if not known.
+func (c *capture) fps() int {
+	return int(math.Round(c.Info().FPS))
+}
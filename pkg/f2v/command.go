@@ -0,0 +1,104 @@
+package f2v
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Encoding can read its input from a command's stdout and decoding can feed
+// its output to a command's stdin, so a backup or restore is one invocation:
+//
+//	go run . encode -input-cmd "pg_dump mydb" mydb.sql backups/
+//	go run . decode -output-cmd "psql mydb" backups/mydb.sql.mkv
+//
+// Commands run with sh -c and get the entry's name in F2V_NAME.
+
+func shellCommand(command, name string) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), "F2V_NAME="+name)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// encodeCommand encodes the output of a command into outputPath under name.
+// A command that fails has produced a partial dump, so its videos are
+// removed rather than left looking complete.
+func encodeCommand(command, name, outputPath string, opts encodeOptions) (string, error) {
+	outputVideo := opts.videoPath(outputPath, filepath.Base(name))
+	cmd := shellCommand(command, name)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to start %q: %w", command, err)
+	}
+	err = encodeStream(command, filepath.Base(name), stdout, outputVideo, opts)
+	if err != nil {
+		cmd.Process.Kill()
+	}
+	if waitErr := cmd.Wait(); waitErr != nil && err == nil {
+		err = fmt.Errorf("%q failed: %w", command, waitErr)
+	}
+	if err != nil {
+		for _, path := range writtenPaths(outputVideo, opts) {
+			os.Remove(path)
+		}
+		return "", err
+	}
+	return outputVideo, nil
+}
+
+// commandSink feeds decoded data to a command's stdin.
+type commandSink struct {
+	command string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	done    bool
+}
+
+func startCommandSink(command, name string) (*commandSink, error) {
+	cmd := shellCommand(command, name)
+	cmd.Stdout = os.Stdout
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %q: %w", command, err)
+	}
+	return &commandSink{command: command, cmd: cmd, stdin: stdin}, nil
+}
+
+func (s *commandSink) Write(p []byte) (int, error) {
+	n, err := s.stdin.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("%q stopped reading: %w", s.command, err)
+	}
+	return n, nil
+}
+
+// finish ends the input and waits for the command to succeed.
+func (s *commandSink) finish() error {
+	s.done = true
+	s.stdin.Close()
+	if err := s.cmd.Wait(); err != nil {
+		return fmt.Errorf("%q failed: %w", s.command, err)
+	}
+	return nil
+}
+
+// abort kills the command unless it finished, so a restore never sees a
+// cleanly ended but incomplete stream.
+func (s *commandSink) abort() {
+	if s.done {
+		return
+	}
+	s.done = true
+	s.cmd.Process.Kill()
+	s.stdin.Close()
+	s.cmd.Wait()
+}
@@ -0,0 +1,253 @@
+package f2v
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// The tool is a set of subcommands, go run . <command> [flags] <arguments>,
+// each taking only the flags that mean something to it and with help of its
+// own: go run . help <command>, or the command with -h. Main defines every
+// flag once and hands each command the ones it takes.
+
+// command is one subcommand of the tool.
+type command struct {
+	name    string
+	aliases []string // older names it still goes by
+	usages  []string // the arguments it takes, one form a line
+	summary string
+	note    string   // more on its arguments, if there is more to say
+	flags   []string // what it takes beyond commonFlags
+}
+
+// commonFlags are the flags every command takes: how videos are laid out,
+// which catalog and profile to use and how the tool reports.
+var commonFlags = []string{"mode", "block", "bits", "coeffs", "backend", "target", "catalog", "profile", "config", "save-profile", "raw", "q", "v", "vv"}
+
+// openFlags are the flags of the secrets that open encrypted or tagged
+// videos.
+var openFlags = []string{"key", "password", "age-identity", "pgp-keyring", "mac-key", "share"}
+
+var commands = []command{
+	{
+		name:    "encode",
+		aliases: []string{"-e"},
+		usages:  []string{"<input_file_or_folder> <output_folder>", "-input-cmd <cmd> <name> <output_folder>", "- <output_video.mkv|output_folder>"},
+		summary: "Encode a file, a folder, standard input or the output of a command into videos.",
+		note:    "Inputs and outputs may be s3://bucket/key, http(s) URLs or <plugin>:// locations too; a remote folder ends in /.",
+		flags: []string{
+			"fps", "resolution", "width", "height", "codec", "cold", "parity", "tsa", "auto-tune", "tune", "compress", "compress-mode",
+			"encrypt", "key", "password", "argon-time", "argon-memory", "argon-threads", "age-recipient", "pgp-recipient",
+			"hidden", "hidden-key", "hidden-password", "pad-to", "mac-key", "shares", "robust-head", "input-cmd",
+			"pack", "dedup", "base", "max-video-size", "max-frames", "max-duration", "manifest", "part-url",
+			"include", "exclude", "exclude-from", "also", "cover", "dry-run", "json",
+		},
+	},
+	{
+		name:    "decode",
+		aliases: []string{"-d"},
+		usages:  []string{"<video_or_folder_or_url> <output_folder>", "-output-cmd <cmd> <video>", "<video> -"},
+		summary: "Decode videos back into the files they hold, or to standard output.",
+		note:    "Videos may be s3://bucket/key, http(s) URLs or <plugin>:// locations too; a remote folder ends in /.",
+		flags:   append([]string{"stego", "output-cmd", "hook", "filter", "scan", "discard", "range", "follow", "idle", "lenient", "dry-run", "json"}, openFlags...),
+	},
+	{
+		name:    "verify",
+		aliases: []string{"check"},
+		usages:  []string{"<video>"},
+		summary: "Check every frame of a video without decoding it, listing damaged and missing frames and whether its recovery volume can rebuild them.",
+		flags:   []string{"stego"},
+	},
+	{
+		name:    "inspect",
+		usages:  []string{"<video>"},
+		summary: "Print what a video is and holds, from its first frames and its index frame, without reading the frames between.",
+		flags:   []string{"stego"},
+	},
+	{
+		name:    "repair",
+		usages:  []string{"<video> <recovery.par.mkv> <output_file_or.mkv>"},
+		summary: "Rebuild the damaged frames of a video from its recovery volume, into the file it holds or a repaired video.",
+		flags:   append([]string{"fps"}, openFlags...),
+	},
+	{
+		name:    "stress",
+		usages:  []string{"<video>"},
+		summary: "Re-encode a video the ways a platform might and report which copies still decode.",
+		flags:   []string{"crf", "resize", "rate"},
+	},
+	{
+		name:    "fill",
+		usages:  []string{"<partial_file> <other_copy_of_video>"},
+		summary: "Fill the holes a -lenient decode left from another copy of the video.",
+	},
+	{
+		name:    "receive",
+		usages:  []string{"<camera_device> <output_file>"},
+		summary: "Read a file from a camera pointed at a screen playing its video on a loop.",
+		flags:   openFlags,
+	},
+	{
+		name:    "transmit",
+		usages:  []string{"<input_file>"},
+		summary: "Show a file's frames on screen on a loop, for receive to read.",
+		flags:   []string{"fps", "loops"},
+	},
+	{
+		name:    "index",
+		usages:  []string{"<video.mkv>"},
+		summary: "Build a seek index of where the frames of a video are, beside it.",
+	},
+	{
+		name:    "ls",
+		usages:  []string{"<video>"},
+		summary: "List the entries of an f2v archive video.",
+		flags:   openFlags,
+	},
+	{
+		name:    "extract",
+		usages:  []string{"<video> <path_in_archive> [output_folder]"},
+		summary: "Take one file out of an f2v archive video.",
+		flags:   openFlags,
+	},
+	{
+		name:    "append",
+		usages:  []string{"<video> <input_folder_or_file>..."},
+		summary: "Add files to an f2v archive video.",
+		flags:   []string{"compress", "compress-mode", "dedup", "include", "exclude", "exclude-from"},
+	},
+	{
+		name:    "merge",
+		usages:  []string{"<a.mkv> <b.mkv>... -o <combined.mkv>"},
+		summary: "Combine f2v archive videos into one, storing the chunks they share once.",
+		note:    "Where two videos have an entry of the same name, the later one's is kept.",
+		flags:   append([]string{"o", "compress", "compress-mode"}, openFlags...),
+	},
+	{
+		name:    "estimate",
+		usages:  []string{"<input_file_or_size, e.g. 50GB>"},
+		summary: "Work out how many frames, videos and how long an encode will take, without encoding.",
+		flags:   []string{"fps", "resolution", "width", "height", "parity", "encrypt", "key", "password", "age-recipient", "pgp-recipient", "mac-key", "pad-to", "shares", "cover"},
+	},
+	{
+		name:    "capacity",
+		usages:  []string{"<cover_video>"},
+		summary: "Measure how much a cover video can hide with -cover.",
+	},
+	{
+		name:    "recover",
+		usages:  []string{"<video> <output_folder>"},
+		summary: "Carve whatever files can still be read out of a broken video.",
+		flags:   []string{"stego", "no-header"},
+	},
+	{
+		name:    "restore",
+		usages:  []string{"-catalog <catalog.json> <wanted_list> <output_folder>"},
+		summary: "Bring back the files a list names from the videos a catalog records, as they were at a time.",
+		flags:   append([]string{"as-of", "plan"}, openFlags...),
+	},
+	{
+		name:    "rekey",
+		usages:  []string{"-new-key <file>|-new-password|-age-recipient <key>|-pgp-recipient <file> <video> <output.mkv>"},
+		summary: "Re-encrypt a video under a new secret, without decoding its data.",
+		flags:   append([]string{"stego", "fps", "new-key", "new-password", "age-recipient", "pgp-recipient", "argon-time", "argon-memory", "argon-threads"}, openFlags...),
+	},
+	{
+		name:    "serve",
+		usages:  []string{"-users <users.json>"},
+		summary: "Run the server, which encodes uploads and serves videos to its users.",
+		flags:   []string{"fps", "cold", "addr", "users", "data", "screen"},
+	},
+	{
+		name:    "catalog",
+		usages:  []string{"freeze|verify|usage <catalog.json>", "export|import <catalog.json> <file.json>"},
+		summary: "Freeze a catalog, check its chain, total its usage, or export and import its entries.",
+	},
+	{
+		name:    "locate",
+		usages:  []string{"-catalog <catalog.json> <video|video_sha256> <location>"},
+		summary: "Find where a cataloged video was uploaded, by the hash its description names, and record it in the catalog.",
+		note:    "The location is s3://bucket/prefix, a <plugin>:// location, or https://www.youtube.com/ for the channel whose OAuth access token is in F2V_YOUTUBE_TOKEN.",
+	},
+	{
+		name:    "stats",
+		usages:  []string{"<catalog.json>"},
+		summary: "Show what a catalog holds and how its videos have fared.",
+	},
+}
+
+// lookupCommand returns the command called name, or by one of its aliases.
+func lookupCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name || slices.Contains(c.aliases, name) {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// flagSet returns a flag set of the flags of all that c takes, parsing into
+// the same variables, that shows c's help for -h.
+func (c command) flagSet(all *flag.FlagSet) *flag.FlagSet {
+	flags := flag.NewFlagSet(c.name, flag.ExitOnError)
+	all.VisitAll(func(f *flag.Flag) {
+		if slices.Contains(commonFlags, f.Name) || slices.Contains(c.flags, f.Name) {
+			flags.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	flags.Usage = func() { c.help(flags.Output(), flags) }
+	return flags
+}
+
+// parseArgs parses args with flags, which may come after the arguments as
+// well as before them, and leaves the arguments in flags.Args(). Everything
+// after -- is an argument.
+func parseArgs(flags *flag.FlagSet, args []string) {
+	var positional []string
+	for {
+		flags.Parse(args)
+		rest := flags.Args()
+		if parsed := len(args) - len(rest); parsed > 0 && args[parsed-1] == "--" {
+			positional = append(positional, rest...)
+			break
+		}
+		if len(rest) == 0 {
+			break
+		}
+		positional, args = append(positional, rest[0]), rest[1:]
+	}
+	flags.Parse(append([]string{"--"}, positional...))
+}
+
+// help writes c's usage, what it does and its flags to w.
+func (c command) help(w io.Writer, flags *flag.FlagSet) {
+	for i, args := range c.usages {
+		lead := "Usage:"
+		if i > 0 {
+			lead = "      "
+		}
+		fmt.Fprintf(w, "%s go run . %s [flags] %s\n", lead, c.name, args)
+	}
+	fmt.Fprintf(w, "\n%s\n", c.summary)
+	if c.note != "" {
+		fmt.Fprintln(w, c.note)
+	}
+	if len(c.aliases) > 0 {
+		fmt.Fprintf(w, "Also run as %s.\n", strings.Join(c.aliases, " or "))
+	}
+	fmt.Fprintln(w, "\nFlags, each of which can also be set as F2V_<NAME>, such as F2V_MAX_VIDEO_SIZE=2GB:")
+	flags.SetOutput(w)
+	flags.PrintDefaults()
+}
+
+func usage() {
+	fmt.Println("Usage: go run . <command> [flags] <arguments>")
+	fmt.Println("\nCommands:")
+	for _, c := range commands {
+		fmt.Printf("  %-9s %s\n", c.name, c.summary)
+	}
+	fmt.Println("\nRun go run . help <command>, or a command with -h, for its arguments and flags.")
+}
@@ -0,0 +1,278 @@
+package f2v
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// -compress shrinks the data before it is laid out in frames, which for
+// most files saves more video, and upload time, than any frame mode can.
+// zstd suits most data; lz4 is the fastest, gzip the most widely readable
+// and brotli the smallest at its top levels, if slow. The frames of a
+// compressed video carry frameFlagCompress, and the stream they hold starts
+// with a byte naming the algorithm, so decoding needs no flag to undo it.
+// Compression comes first, then encryption and the integrity tag; decoding
+// undoes them in the opposite order. Inputs that would hardly shrink, such
+// as media and archives, are left as they are.
+
+// Algorithms, as named by the first byte of a compressed stream.
+const (
+	compressZstd   = 1
+	compressGzip   = 2
+	compressLZ4    = 3
+	compressBrotli = 4
+)
+
+// compressAlgorithm is what -compress can use: its levels, and how to
+// compress and decompress with it.
+type compressAlgorithm struct {
+	name               string
+	minLevel, maxLevel int
+	defaultLevel       int
+	newWriter          func(w io.Writer, level int) (io.WriteCloser, error)
+	newReader          func(r io.Reader) (io.ReadCloser, error)
+}
+
+var compressAlgorithms = map[byte]compressAlgorithm{
+	compressZstd: {"zstd", 1, 22, 3,
+		func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		},
+		func(r io.Reader) (io.ReadCloser, error) {
+			zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return zr.IOReadCloser(), nil
+		}},
+	compressGzip: {"gzip", 1, 9, 6,
+		func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		}},
+	// lz4 level 0 is its fast mode; 1-9 trade speed for size
+	compressLZ4: {"lz4", 0, 9, 0,
+		func(w io.Writer, level int) (io.WriteCloser, error) {
+			zw := lz4.NewWriter(w)
+			option := lz4.CompressionLevelOption(lz4.Fast)
+			if level > 0 {
+				option = lz4.CompressionLevelOption(lz4.CompressionLevel(1 << (8 + level)))
+			}
+			return zw, zw.Apply(option)
+		},
+		func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(lz4.NewReader(r)), nil
+		}},
+	compressBrotli: {"brotli", 0, 11, 6,
+		func(w io.Writer, level int) (io.WriteCloser, error) {
+			return brotli.NewWriterLevel(w, level), nil
+		},
+		func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(brotli.NewReader(r)), nil
+		}},
+}
+
+// compressProbeSize is how much of an input -compress looks at to decide
+// whether compressing it is worth the time.
+const compressProbeSize = 4 << 20
+
+// compressedFormats are the signatures of formats that are compressed
+// already, at the offset they appear at.
+var compressedFormats = []struct {
+	kind   string
+	offset int
+	magic  string
+}{
+	{"zip", 0, "PK\x03\x04"},
+	{"gzip", 0, "\x1f\x8b"},
+	{"zstd", 0, "\x28\xb5\x2f\xfd"},
+	{"xz", 0, "\xfd7zXZ\x00"},
+	{"bzip2", 0, "BZh"},
+	{"7z", 0, "7z\xbc\xaf\x27\x1c"},
+	{"rar", 0, "Rar!\x1a\x07"},
+	{"lz4", 0, "\x04\x22\x4d\x18"},
+	{"jpg", 0, "\xff\xd8\xff"},
+	{"png", 0, "\x89PNG\r\n\x1a\n"},
+	{"gif", 0, "GIF8"},
+	{"webp", 8, "WEBP"},
+	{"mp4", 4, "ftyp"},
+	{"mkv", 0, "\x1a\x45\xdf\xa3"},
+	{"mp3", 0, "ID3"},
+	{"ogg", 0, "OggS"},
+	{"flac", 0, "fLaC"},
+}
+
+// skipCompression returns why data starting with head is not worth
+// compressing, or "" if it is: a compressed format, or data that looks
+// random or does not deflate by tuneMinSaving.
+func skipCompression(head []byte) string {
+	for _, f := range compressedFormats {
+		if len(head) >= f.offset+len(f.magic) && string(head[f.offset:f.offset+len(f.magic)]) == f.magic {
+			return "it is " + f.kind + " data, which is compressed already"
+		}
+	}
+	if len(head) == 0 {
+		return ""
+	}
+	if byteEntropy(head) >= tuneMaxEntropy {
+		return "its data looks random"
+	}
+	if ratio := deflateRatio(head); ratio > 1-tuneMinSaving {
+		return fmt.Sprintf("a sample only shrinks to %s", display.percent(ratio, 0))
+	}
+	return ""
+}
+
+// compression is an algorithm and level for -compress.
+type compression struct {
+	algorithm byte
+	level     int
+}
+
+// parseCompression parses -compress: an algorithm, optionally with a level
+// after a colon, e.g. zstd:19.
+func parseCompression(spec string) (compression, error) {
+	name, levelSpec, hasLevel := strings.Cut(spec, ":")
+	for id, a := range compressAlgorithms {
+		if a.name != name {
+			continue
+		}
+		c := compression{algorithm: id, level: a.defaultLevel}
+		if hasLevel {
+			level, err := strconv.Atoi(levelSpec)
+			if err != nil || level < a.minLevel || level > a.maxLevel {
+				return c, fmt.Errorf("invalid %s level %q, want %d-%d", name, levelSpec, a.minLevel, a.maxLevel)
+			}
+			c.level = level
+		}
+		return c, nil
+	}
+	return compression{}, fmt.Errorf("unknown algorithm %q, want zstd, gzip, lz4 or brotli", name)
+}
+
+func (c compression) String() string {
+	return fmt.Sprintf("%s level %d", compressAlgorithms[c.algorithm].name, c.level)
+}
+
+func (c compression) name() string {
+	return compressAlgorithms[c.algorithm].name
+}
+
+// newCompressor returns a writer compressing into dst, after the byte
+// naming the algorithm; Close finishes the stream but leaves dst open.
+func (c compression) newCompressor(dst io.Writer) (io.WriteCloser, error) {
+	if _, err := dst.Write([]byte{c.algorithm}); err != nil {
+		return nil, err
+	}
+	return compressAlgorithms[c.algorithm].newWriter(dst, c.level)
+}
+
+// compressReader returns the compression of what r yields, made as it is
+// read. Closing the result stops the compression early.
+func compressReader(r io.Reader, c compression) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := c.newCompressor(pw)
+		if err == nil {
+			if _, err = io.Copy(w, r); err == nil {
+				err = w.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// compressBytes compresses a whole input.
+func compressBytes(data []byte, c compression) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := c.newCompressor(&buf)
+	if err == nil {
+		if _, err = w.Write(data); err == nil {
+			err = w.Close()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress input: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressor decompresses the compressed stream written to it into dst,
+// in whichever algorithm its first byte names.
+type decompressor struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newDecompressor(dst io.Writer) *decompressor {
+	pr, pw := io.Pipe()
+	d := &decompressor{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := decompressStream(dst, pr)
+		pr.CloseWithError(err)
+		d.done <- err
+	}()
+	return d
+}
+
+// decompressStream copies the decompression of the stream r yields to dst.
+func decompressStream(dst io.Writer, r io.Reader) error {
+	var algorithm [1]byte
+	if _, err := io.ReadFull(r, algorithm[:]); err != nil {
+		return malformed("compressed data ends before it starts")
+	}
+	a, ok := compressAlgorithms[algorithm[0]]
+	if !ok {
+		return malformed("data compressed with unknown algorithm %d", algorithm[0])
+	}
+	zr, err := a.newReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	_, err = io.Copy(dst, zr)
+	return err
+}
+
+func (d *decompressor) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+// Close ends the stream and reports whether it decompressed cleanly.
+func (d *decompressor) Close() error {
+	d.pw.Close()
+	if err := <-d.done; err != nil {
+		return fmt.Errorf("failed to decompress data: %w", err)
+	}
+	return nil
+}
+
+func (d *decompressor) abort(err error) {
+	d.pw.CloseWithError(err)
+	<-d.done
+}
+
+// decompress decompresses a whole compressed stream.
+func decompress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	d := newDecompressor(&buf)
+	if _, err := d.Write(data); err != nil {
+		d.abort(err)
+		return nil, fmt.Errorf("failed to decompress data: %w", err)
+	}
+	if err := d.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
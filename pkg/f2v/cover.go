@@ -0,0 +1,293 @@
+package f2v
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A cover video hides the data in ordinary footage instead of frames of its
+// own. In lsb mode the data replaces the low bits of every channel of every
+// pixel, which changes nothing the eye can see but only survives lossless
+// codecs. In dct mode the coefficients of every 8x8 block are pushed to the
+// signs that carry the data, and the colour, brightness and everything but
+// those few low frequencies are left as they were. The coefficients are set
+// on the luma, so the same change goes to all three channels and the hue is
+// untouched; the amplitude is a fraction of a gray dct frame's, enough to
+// survive lossless and high quality re-encoding but not the heavy
+// compression plain dct frames do. Either way frames keep the cover's size
+// and have no sync markers, which would give them away. Whatever of the
+// cover is left after the data follows unchanged, so the video runs as long
+// as the cover did, and its sound track is copied in with ffmpeg if that is
+// on the PATH.
+
+// coverAmplitude is the least magnitude of an embedded coefficient, a
+// fraction of a gray dct frame's at the default -coeffs.
+const coverAmplitude = 30
+
+// coverPasses bounds how often a block is adjusted to fit the data; a pass
+// undoes what clipping to 0-255 and rounding did to the last one.
+const coverPasses = 12
+
+// coverVideo reads the frames of a cover video to embed data in.
+type coverVideo struct {
+	path   string
+	output string // the video being written
+	cap    VideoReader
+	read   int
+}
+
+// probeCover returns the frame size and rate of a cover video read with b.
+func probeCover(b CodecBackend, path string) (width, height, fps int, err error) {
+	cap, err := b.Open(path)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to open cover video: %w", err)
+	}
+	defer cap.Close()
+	info := cap.Info()
+	width, height = info.Width, info.Height
+	fps = int(math.Round(info.FPS))
+	if width <= 0 || height <= 0 {
+		return 0, 0, 0, fmt.Errorf("cover video %s has no frames", path)
+	}
+	return width, height, max(fps, 1), nil
+}
+
+func openCover(b CodecBackend, path, output string) (*coverVideo, error) {
+	cap, err := b.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cover video: %w", err)
+	}
+	return &coverVideo{path: path, output: output, cap: cap}, nil
+}
+
+// next copies the cover's next frame into frameData.
+func (c *coverVideo) next(frameData []byte) error {
+	data, width, height, err := c.cap.ReadFrame()
+	if err == io.EOF {
+		return fmt.Errorf("the cover video %s ends after %d frames, before the data does; use a longer one or more -coeffs", c.path, c.read)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read frame %d of the cover video: %w", c.read, err)
+	}
+	if len(data) != len(frameData) {
+		return fmt.Errorf("frame %d of the cover video is %dx%d, not like the first", c.read, width, height)
+	}
+	copy(frameData, data)
+	c.read++
+	return nil
+}
+
+// finish appends the rest of the cover to w as it is.
+func (c *coverVideo) finish(w VideoWriter) error {
+	for {
+		data, _, _, err := c.cap.ReadFrame()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read frame %d of the cover video: %w", c.read, err)
+		}
+		if err := w.WriteFrame(data); err != nil {
+			return fmt.Errorf("error writing cover frame %d: %w", c.read, err)
+		}
+		c.read++
+	}
+}
+
+// muxAudio copies the cover's sound track, if it has one, into the finished
+// output video.
+func (c *coverVideo) muxAudio() error {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		slog.Warn("ffmpeg is not on the PATH, so the video has no sound track", "video", c.output)
+		return nil
+	}
+	dir, base := filepath.Split(c.output)
+	temp := filepath.Join(dir, ".audio-"+base)
+	cmd := exec.Command(ffmpeg, "-v", "error", "-y", "-i", c.output, "-i", c.path, "-map", "0:v", "-map", "1:a?", "-c", "copy", temp)
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(temp)
+		// The video is fine without sound; the cover's codec may not fit its container
+		slog.Warn("Copying the cover's sound track failed, so the video has none", "video", c.output, "err", err, "output", strings.TrimSpace(string(msg)))
+		return nil
+	}
+	return os.Rename(temp, c.output)
+}
+
+func (c *coverVideo) Close() error {
+	return c.cap.Close()
+}
+
+// embedDCT embeds payload in the cover frame in frameData, so that
+// unpackDCT reads it back: every coefficient packDCT would set ends up with
+// its sign and at least the cover amplitude. Blocks too close to black or
+// white to take the change are pulled towards mid-gray until they do.
+func (l layout) embedDCT(frameData, payload []byte) {
+	amp := float64(coverAmplitude)
+	br := bitReader{data: payload}
+	var block [dctSize * dctSize][3]float64
+	var signs [len(dctPositions)]float64
+	for by := 0; by < l.blocksY(); by++ {
+		for bx := 0; bx < l.blocksX(); bx++ {
+			for y := 0; y < dctSize; y++ {
+				row := (l.band() + by*dctSize + y) * l.width * 3
+				for x := 0; x < dctSize; x++ {
+					offset := row + (bx*dctSize+x)*3
+					for ch := range 3 {
+						block[y*dctSize+x][ch] = float64(frameData[offset+ch])
+					}
+				}
+			}
+			for c := 0; c < l.coefficients; c++ {
+				signs[c] = -1
+				if br.read(1) == 1 {
+					signs[c] = 1
+				}
+			}
+
+			for pass := 0; pass < coverPasses; pass++ {
+				short := false
+				for c := 0; c < l.coefficients; c++ {
+					short = short || coverCoefficient(&block, c)*signs[c] < amp
+				}
+				if !short {
+					break
+				}
+				if pass >= coverPasses/3 {
+					for i := range block {
+						for ch := range 3 {
+							block[i][ch] += (128 - block[i][ch]) / 4
+						}
+					}
+				}
+				for c := 0; c < l.coefficients; c++ {
+					// Aim past the amplitude so rounding does not undo it
+					if sum := coverCoefficient(&block, c); sum*signs[c] < amp {
+						d := signs[c]*amp*1.1 - sum
+						for i, b := range dctBasis[c] {
+							for ch := range 3 {
+								block[i][ch] += d * b
+							}
+						}
+					}
+				}
+				for i := range block {
+					for ch := range 3 {
+						block[i][ch] = math.Round(min(255, max(0, block[i][ch])))
+					}
+				}
+			}
+
+			for y := 0; y < dctSize; y++ {
+				row := (l.band() + by*dctSize + y) * l.width * 3
+				for x := 0; x < dctSize; x++ {
+					offset := row + (bx*dctSize+x)*3
+					for ch := range 3 {
+						frameData[offset+ch] = byte(block[y*dctSize+x][ch])
+					}
+				}
+			}
+		}
+	}
+}
+
+// coverCoefficient returns the dct coefficient c of a block's luma, as
+// unpackDCT measures it.
+func coverCoefficient(block *[dctSize * dctSize][3]float64, c int) float64 {
+	sum := 0.0
+	for i, b := range dctBasis[c] {
+		sum += (block[i][0] + block[i][1] + block[i][2]) / 3 * b
+	}
+	return sum
+}
+
+// packLSB puts payload in the low bitsPerChannel bits of every channel of
+// the frame in frameData, MSB first.
+func (l layout) packLSB(frameData, payload []byte) {
+	if l.cover == "" {
+		clear(frameData)
+	}
+	br := bitReader{data: payload}
+	mask := byte(1)<<l.bitsPerChannel - 1
+	for i := range l.width * l.dataRows() * 3 {
+		frameData[i] = frameData[i]&^mask | byte(br.read(l.bitsPerChannel))
+	}
+}
+
+func (l layout) unpackLSB(frameData []byte) []byte {
+	bw := bitWriter{data: make([]byte, 0, l.capacity()+1)}
+	mask := byte(1)<<l.bitsPerChannel - 1
+	for _, v := range frameData[:l.width*l.dataRows()*3] {
+		bw.write(int(v&mask), l.bitsPerChannel)
+	}
+	return bw.data[:l.capacity()]
+}
+
+// coverReport is how much a cover video can hold in each of the layouts
+// that embed data in one.
+type coverReport struct {
+	width, height, fps int
+	frames             int64
+	layouts            []layout
+}
+
+// coverCapacity measures the cover video at path for lsb mode at each of
+// depths bits per channel and for dct mode at l's coefficients.
+func coverCapacity(path string, l layout, depths []int) (*coverReport, error) {
+	width, height, fps, err := probeCover(l.codecBackend(), path)
+	if err != nil {
+		return nil, err
+	}
+	frames, err := countCoverFrames(l.codecBackend(), path)
+	if err != nil {
+		return nil, err
+	}
+	r := &coverReport{width: width, height: height, fps: fps, frames: frames}
+	for _, bits := range depths {
+		r.layouts = append(r.layouts, layout{width: width, height: height, mode: modeLSB, bitsPerChannel: bits})
+	}
+	r.layouts = append(r.layouts, layout{width: width, height: height, mode: modeDCT, coefficients: l.coefficients})
+	for _, c := range r.layouts {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("cover video %s: %w", path, err)
+		}
+	}
+	return r, nil
+}
+
+// countCoverFrames returns the number of frames in a video, counting them
+// when the container does not say.
+func countCoverFrames(b CodecBackend, path string) (int64, error) {
+	cap, err := b.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open cover video: %w", err)
+	}
+	defer cap.Close()
+	if n := cap.Info().Frames; n > 0 {
+		return n, nil
+	}
+	var n int64
+	for {
+		if _, _, _, err := cap.ReadFrame(); err != nil {
+			return n, nil
+		}
+		n++
+	}
+}
+
+func (r *coverReport) print(w io.Writer, name string) {
+	length := time.Duration(float64(r.frames) / float64(r.fps) * float64(time.Second))
+	fmt.Fprintf(w, "%s: %dx%d at %d fps, %s frames (%s)\n", name, r.width, r.height, r.fps, display.count(r.frames), display.duration(length))
+	for _, l := range r.layouts {
+		perFrame := int64(l.capacity() - frameHeaderSize)
+		fmt.Fprintf(w, "  %-22s %s per frame, %s in all\n", l.describe()+":", display.bytes(perFrame), display.bytes(perFrame*r.frames))
+	}
+	fmt.Fprintln(w, "Encryption takes a few percent more; estimate -cover gives the frames a file needs.")
+}
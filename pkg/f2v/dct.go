@@ -0,0 +1,122 @@
+package f2v
+
+import "math"
+
+// DCT mode works on 8x8 blocks of a gray frame. Every block carries one bit
+// in the sign of each of its first few low-frequency coefficients (in zigzag
+// order, DC excluded); the DC term stays at mid-gray. Lossy encoders
+// quantize these coefficients but rarely flip their sign, so the bits
+// survive compression that wipes out pixel-level detail.
+
+const dctSize = 8
+
+// dctPositions lists the (u, v) frequencies used for data, in the order
+// bits are assigned to them.
+var dctPositions = [...][2]int{
+	{0, 1}, {1, 0}, {1, 1}, {0, 2}, {2, 0}, {2, 1}, {1, 2}, {2, 2},
+	{0, 3}, {3, 0}, {3, 1}, {1, 3}, {3, 2}, {2, 3}, {3, 3},
+}
+
+// dctBasis holds the orthonormal 2-D DCT-II basis image of every entry of
+// dctPositions, indexed by y*dctSize+x.
+var dctBasis [len(dctPositions)][dctSize * dctSize]float64
+
+func init() {
+	scale := func(k int) float64 {
+		if k == 0 {
+			return math.Sqrt(1.0 / dctSize)
+		}
+		return math.Sqrt(2.0 / dctSize)
+	}
+	for i, p := range dctPositions {
+		u, v := p[0], p[1]
+		for y := 0; y < dctSize; y++ {
+			for x := 0; x < dctSize; x++ {
+				dctBasis[i][y*dctSize+x] = scale(u) * scale(v) *
+					math.Cos(float64(2*x+1)*float64(u)*math.Pi/(2*dctSize)) *
+					math.Cos(float64(2*y+1)*float64(v)*math.Pi/(2*dctSize))
+			}
+		}
+	}
+}
+
+// dctAmplitude returns the coefficient magnitude used for each bit. It is
+// as large as possible without letting any block leave the 0-255 range
+// when every sign lines up against it.
+func (l layout) dctAmplitude() float64 {
+	peak := 0.0
+	for i := 0; i < l.coefficients; i++ {
+		m := 0.0
+		for _, b := range dctBasis[i] {
+			m = max(m, math.Abs(b))
+		}
+		peak += m
+	}
+	return 120 / peak
+}
+
+func (l layout) packDCT(frameData, payload []byte) {
+	clear(frameData)
+	defer l.drawMarkers(frameData)
+
+	amp := l.dctAmplitude()
+	br := bitReader{data: payload}
+	var block [dctSize * dctSize]float64
+	for by := 0; by < l.blocksY(); by++ {
+		for bx := 0; bx < l.blocksX(); bx++ {
+			for i := range block {
+				block[i] = 128
+			}
+			for c := 0; c < l.coefficients; c++ {
+				sign := -amp
+				if br.read(1) == 1 {
+					sign = amp
+				}
+				for i, b := range dctBasis[c] {
+					block[i] += sign * b
+				}
+			}
+			for y := 0; y < dctSize; y++ {
+				row := (l.band() + by*dctSize + y) * l.width * 3
+				for x := 0; x < dctSize; x++ {
+					v := byte(math.Round(min(255, max(0, block[y*dctSize+x]))))
+					offset := row + (bx*dctSize+x)*3
+					frameData[offset], frameData[offset+1], frameData[offset+2] = v, v, v
+				}
+			}
+		}
+	}
+}
+
+func (l layout) unpackDCT(frameData []byte) []byte {
+	bw := bitWriter{data: make([]byte, 0, l.capacity())}
+	var block [dctSize * dctSize]float64
+	for by := 0; by < l.blocksY(); by++ {
+		for bx := 0; bx < l.blocksX(); bx++ {
+			for y := 0; y < dctSize; y++ {
+				row := (l.band() + by*dctSize + y) * l.width * 3
+				for x := 0; x < dctSize; x++ {
+					offset := row + (bx*dctSize+x)*3
+					block[y*dctSize+x] = float64(int(frameData[offset])+int(frameData[offset+1])+int(frameData[offset+2])) / 3
+				}
+			}
+			// The basis images are orthogonal to the flat DC term, so any
+			// brightness shift drops out of the projection
+			for c := 0; c < l.coefficients; c++ {
+				sum := 0.0
+				for i, b := range dctBasis[c] {
+					sum += block[i] * b
+				}
+				bit := 0
+				if sum > 0 {
+					bit = 1
+				}
+				bw.write(bit, 1)
+			}
+		}
+	}
+	for len(bw.data) < l.capacity() {
+		bw.data = append(bw.data, 0)
+	}
+	return bw.data[:l.capacity()]
+}
@@ -0,0 +1,190 @@
+package f2v
+
+import (
+	"context"
+	"fmt"
+)
+
+// openVideo opens a local video for reading with l's backend, downloading it
+// first when the input is a URL, from YouTube, over HTTP or from S3.
+// cleanup closes the capture and removes any temporary file.
+func openVideo(input string, l layout) (cap *capture, cleanup func(), err error) {
+	return openVideoContext(context.Background(), input, l)
+}
+
+// openVideoContext is openVideo with the download abandoned once ctx is done.
+func openVideoContext(ctx context.Context, input string, l layout) (cap *capture, cleanup func(), err error) {
+	path := input
+	removeTemp := func() {}
+	if isURL(input) {
+		src, name, err := SourceFor(input)
+		if err != nil {
+			return nil, nil, err
+		}
+		if path, removeTemp, err = fetch(ctx, l.log(), src, name); err != nil {
+			return nil, nil, fmt.Errorf("failed to download video: %w", err)
+		}
+	}
+
+	cap, err = openCapture(l.codecBackend(), path)
+	if err != nil {
+		removeTemp()
+		return nil, nil, fmt.Errorf("failed to open video: %w", err)
+	}
+	return cap, func() {
+		cap.Close()
+		removeTemp()
+	}, nil
+}
+
+// scannedFrame is one frame read from a video. When the frame fails
+// validation err is set and header and data are unusable.
+type scannedFrame struct {
+	index    int // position in the video, counting duplicates
+	header   frameHeader
+	data     []byte
+	capacity int // data bytes a full frame of this layout holds
+	probe    probeReading
+	table    *segmentTable // segments of the video, once its table was read
+	raw      []byte        // everything after the header, in the layout it opened with or else the likeliest
+	err      error
+}
+
+// frameSource is where scanFrames reads frames from: a video capture, or a
+// followSource for a video that is still growing.
+type frameSource interface {
+	Read(m *mat) bool
+}
+
+// scanFrames reads every frame of a video, validates its header and passes
+// it to fn, which returns false to stop early. Segmented videos are read in
+// the layout their table gives for each frame; l only needs the right mode
+// for videos without a table.
+func scanFrames(cap frameSource, l layout, fn func(scannedFrame) (bool, error)) error {
+	s := newFrameScanner(cap, l)
+	defer s.Close()
+	for {
+		f, ok, err := s.next()
+		if err != nil || !ok {
+			return err
+		}
+		if more, err := fn(f); err != nil || !more {
+			return err
+		}
+	}
+}
+
+// frameScanner reads the frames of a video one at a time, as scanFrames
+// does.
+type frameScanner struct {
+	cap   frameSource
+	l     layout
+	frame mat
+	table *segmentTable
+	seq   uint32 // sequence number expected next
+	i     int
+}
+
+func newFrameScanner(cap frameSource, l layout) *frameScanner {
+	return &frameScanner{cap: cap, l: l, frame: l.pool.mat()}
+}
+
+// next returns the next frame, or false after the last one.
+func (s *frameScanner) next() (scannedFrame, bool, error) {
+	i := s.i
+	if ok := s.cap.Read(&s.frame); !ok || s.frame.Empty() {
+		return scannedFrame{}, false, nil
+	}
+	s.i++
+
+	f, fl, err := scanMat(s.frame, s.l, i, s.table, s.seq)
+	if err != nil {
+		return scannedFrame{}, false, err
+	}
+	if f.err == nil {
+		if f.header.table() && s.table == nil {
+			if s.table, err = parseSegmentTable(f.data, fl); err != nil {
+				return scannedFrame{}, false, fmt.Errorf("frame %d: %w", i, err)
+			}
+		}
+		s.seq = f.header.seq + 1
+	}
+	f.table = s.table
+	return f, true, nil
+}
+
+// scanMat reads frame i of a video, in the layouts table offers for it
+// with the one that holds sequence number next first, and returns it with
+// the layout its pixels were read in.
+func scanMat(frame mat, l layout, i int, table *segmentTable, next uint32) (scannedFrame, layout, error) {
+	frameData, fl, release, err := readFrameData(frame, l, i)
+	if err != nil {
+		return scannedFrame{}, fl, err
+	}
+	defer release()
+	f := scannedFrame{index: i, probe: fl.readProbe(frameData)}
+	// Report why the most likely layout failed, not the last one tried
+	var firstErr error
+	for _, c := range table.candidates(fl, next) {
+		payload := c.unpack(frameData)
+		f.capacity = len(payload) - frameHeaderSize
+		if f.header, f.data, f.err = openFrame(payload); f.err == nil {
+			f.capacity = len(payload) - f.header.size()
+			f.raw = payload[f.header.size():]
+			break
+		}
+		if firstErr == nil {
+			firstErr = f.err
+			f.raw = payload[min(frameHeaderSize, len(payload)):]
+		}
+	}
+	if f.err != nil {
+		f.err = firstErr
+	}
+	f.table = table
+	return f, fl, nil
+}
+
+func (s *frameScanner) Close() error {
+	return s.l.pool.putMat(s.frame)
+}
+
+// readFrameData returns the pixels of one decoded frame and the layout they
+// fit; release frees them. Frames with sync markers are first realigned onto
+// the layout's grid; frames without them are read at whatever size the video
+// has.
+func readFrameData(frame mat, l layout, index int) ([]byte, layout, func(), error) {
+	release := func() {}
+	if l.markers {
+		aligned, found := alignFrame(frame, l)
+		release = func() { aligned.Close() }
+		if !found {
+			l.log().Warn("Sync markers not found, stretching the frame", "frame", index, "width", l.width, "height", l.height)
+		}
+		frame = aligned
+	} else {
+		l.width, l.height = frame.Cols(), frame.Rows()
+	}
+
+	frameData, _ := frame.DataPtrUint8()
+	if frameData == nil {
+		release()
+		return nil, l, nil, fmt.Errorf("failed to get frame data pointer from decoded frame")
+	}
+	if len(frameData) < l.width*l.height*3 || l.capacity() <= frameHeaderSize {
+		release()
+		return nil, l, nil, malformed("frame %d is %dx%d with %d channels, too small for %s", index, frame.Cols(), frame.Rows(), frame.Channels(), l.describe())
+	}
+	return frameData, l, release, nil
+}
+
+// readFramePayload extracts the payload bytes from one decoded frame and
+// measures its probe.
+func readFramePayload(frame mat, l layout, index int) ([]byte, probeReading, error) {
+	frameData, l, release, err := readFrameData(frame, l, index)
+	if err != nil {
+		return nil, probeReading{}, err
+	}
+	defer release()
+	return l.unpack(frameData), l.readProbe(frameData), nil
+}
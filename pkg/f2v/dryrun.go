@@ -0,0 +1,276 @@
+package f2v
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// With -dry-run, encode and decode walk their inputs as they would and
+// print the plan: every file or video taken, the frames and bytes it comes
+// to and the paths it would be written to, without writing a video or a
+// file, or creating the output folder. Encodes work the frames out as
+// estimate does; decodes read them from each video's first frames and index
+// frame, as inspect does.
+
+// dryRunFile is one file or video of a plan.
+type dryRunFile struct {
+	input   string
+	size    int64 // of the input for an encode, of the data for a decode; -1 when not known
+	frames  int64 // written for an encode, read for a decode; -1 when not known
+	fps     float64
+	outputs []string // the first is the file or video itself, the rest written beside it
+	note    string
+}
+
+// dryRun is the plan of an encode or decode run.
+type dryRun struct {
+	verb  string // "encode" or "decode"
+	files []dryRunFile
+}
+
+// randomName stands for the random ID an encrypted or -cold video is named
+// by, which is only drawn when it is written.
+const randomName = "<random ID>.mkv"
+
+// planVideoPath returns where videoPath would put the video for name in dir.
+func (opts encodeOptions) planVideoPath(dir, name string) string {
+	if opts.secret == nil && opts.shares == nil && !opts.layout.cold {
+		return opts.videoPath(dir, name)
+	}
+	return filepath.Join(dir, randomName)
+}
+
+// planEncode works out what encoding inputPath into outputPath would write.
+func planEncode(inputPath, outputPath string, opts encodeOptions) (*dryRun, error) {
+	if inputPath == "-" || opts.inputCmd != "" {
+		return nil, fmt.Errorf("-dry-run needs a file or folder to walk, not standard input or -input-cmd")
+	}
+	if isURL(inputPath) {
+		return nil, fmt.Errorf("-dry-run walks local files and folders, not %s", inputPath)
+	}
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	// Remote outputs are planned as paths under them
+	root := outputPath
+	if isURL(outputPath) {
+		root = ""
+	}
+	files, total := []treeFile{{input: inputPath, output: filepath.Join(root, filepath.Base(inputPath)), size: info.Size()}}, info.Size()
+	if info.IsDir() {
+		if files, total, err = encodeTreeFiles(inputPath, root, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	plan := &dryRun{verb: "encode"}
+	if opts.pack != "" {
+		name := filepath.Base(filepath.Clean(inputPath)) + "." + opts.pack
+		f := opts.planFile(inputPath, total, opts.planVideoPath(root, name), name)
+		f.note = joinNotes(f.note, fmt.Sprintf("%d files packed, archive headers aside", len(files)))
+		plan.files = []dryRunFile{f}
+	} else {
+		for _, t := range files {
+			name := filepath.Base(t.input)
+			plan.files = append(plan.files, opts.planFile(t.input, t.size, opts.planVideoPath(filepath.Dir(t.output), name), name))
+		}
+	}
+	if root != outputPath {
+		for i := range plan.files {
+			for j, p := range plan.files[i].outputs {
+				plan.files[i].outputs[j] = joinLocation(outputPath, filepath.ToSlash(p))
+			}
+		}
+	}
+	return plan, nil
+}
+
+// planFile works out the frames size bytes named name take and the paths
+// encoding them into video writes, as encodeFile would.
+func (opts encodeOptions) planFile(input string, size int64, video, name string) dryRunFile {
+	f := dryRunFile{input: input, size: size, fps: float64(opts.fps)}
+	po := planOptions{parity: opts.parity, encrypt: opts.secret != nil, mac: opts.macKey != nil, name: name}
+	if opts.secret != nil {
+		po.padTo = opts.secret.padTo
+	}
+	if opts.shares != nil {
+		po.encrypt, po.shares = false, opts.shares[1]
+	}
+	p := profileFromLayout(opts.layout, opts.fps)
+
+	parts, partBytes := 1, size
+	if opts.maxFrames > 0 {
+		var err error
+		if partBytes, parts, err = splitPlan(size, name, opts); err != nil {
+			f.frames, f.note = -1, err.Error()
+			return f
+		}
+		if why := splitConflict(opts); parts > 1 && why != "" {
+			f.frames, f.note = -1, fmt.Sprintf("needs %d parts to stay under the limits, and %s does not split", parts, why)
+			return f
+		}
+	}
+	if parts == 1 {
+		plan, err := planCapacity(size, p, po)
+		if err != nil {
+			f.frames, f.note = -1, err.Error()
+			return f
+		}
+		f.frames = plan.Frames
+		f.outputs = writtenPaths(video, opts)
+		if opts.parity == 0 {
+			f.outputs = f.outputs[:len(f.outputs)-1] // no recovery volume
+		}
+	} else {
+		for i := 1; i <= parts; i++ {
+			plan, err := planCapacity(min(partBytes, size-int64(i-1)*partBytes), p, po)
+			if err != nil {
+				f.frames, f.note = -1, err.Error()
+				return f
+			}
+			f.frames += plan.Frames
+			f.outputs = append(f.outputs, partPath(video, i, parts))
+		}
+		if opts.manifest {
+			f.outputs = append(f.outputs, manifestPath(video))
+		}
+		f.note = fmt.Sprintf("split into %d parts", parts)
+	}
+	if len(opts.extra) > 0 {
+		f.note = joinNotes(f.note, "frames counted for the first layout only")
+	}
+	if opts.compress != nil || opts.tune {
+		f.note = joinNotes(f.note, "at most; compression may take fewer frames")
+	}
+	return f
+}
+
+// planDecode works out what decoding inputPath into outputPath would write.
+func planDecode(inputPath, outputPath string, opts decodeOptions) (*dryRun, error) {
+	if strings.HasSuffix(inputPath, "/") && isURL(inputPath) {
+		return nil, fmt.Errorf("-dry-run reads videos on the local disk or at a URL, not the folder %s", inputPath)
+	}
+	videos := []treeFile{{input: inputPath, output: filepath.Join(outputPath, decodedName(inputPath))}}
+	if isURL(inputPath) {
+		// Named as runDecode names what a URL decodes into
+		videos[0].output = filepath.Join(outputPath, "youtube.decoded")
+		if u, err := url.Parse(inputPath); err == nil && !isYouTubeURL(inputPath) && strings.HasSuffix(u.Path, ".mkv") {
+			videos[0].output = filepath.Join(outputPath, decodedName(u.Path))
+		}
+	}
+	if info, err := os.Stat(inputPath); err != nil && !isURL(inputPath) {
+		return nil, err
+	} else if err == nil && info.IsDir() && !isFrameSequence(inputPath) {
+		if videos, _, err = decodeTreeFiles(inputPath, outputPath); err != nil {
+			return nil, err
+		}
+	}
+
+	plan := &dryRun{verb: "decode"}
+	for _, v := range videos {
+		f := dryRunFile{input: v.input, size: -1, frames: -1, outputs: []string{v.output}}
+		switch {
+		case outputPath == "-":
+			f.outputs = []string{"standard output"}
+		case opts.outputCmd != "":
+			f.outputs = []string{"| " + opts.outputCmd}
+		case opts.discard:
+			f.outputs = nil
+		}
+		in, err := inspectVideo(v.input, opts.layout)
+		switch {
+		case err != nil:
+			f.note = err.Error()
+		case in.first == nil:
+			f.note = fmt.Sprintf("no intact frame in the first %d; give the -mode and flags it was encoded with", inspectFrames)
+		default:
+			f.frames, f.fps = in.info.Frames, in.info.FPS
+			h := in.first.header
+			flags := h.flags & dataFlags
+			if in.index != nil {
+				f.size, flags = int64(in.index.dataSize), in.index.flags
+			}
+			if t := dataTreatment(flags); t != "as it was" {
+				f.note = "stored " + t
+			}
+			if (frameHeader{flags: flags}).encrypted() && len(f.outputs) > 0 && f.outputs[0] == v.output {
+				f.note = joinNotes(f.note, "renamed to the name sealed inside once decrypted")
+			}
+			if h.parts > 0 {
+				f.note = joinNotes(f.note, fmt.Sprintf("part %d of %d; the other parts come along", h.part, h.parts))
+			}
+			if h.parity() {
+				f.note = joinNotes(f.note, "a recovery volume, not data")
+			}
+		}
+		plan.files = append(plan.files, f)
+	}
+	return plan, nil
+}
+
+// joinNotes adds note to notes.
+func joinNotes(notes, note string) string {
+	if notes == "" {
+		return note
+	}
+	return notes + "; " + note
+}
+
+// print writes the plan for people, or as plain numbers with -raw.
+func (d *dryRun) print(w io.Writer) {
+	var size, frames int64
+	outputs := 0
+	for _, f := range d.files {
+		fmt.Fprintf(w, "%s\n", f.input)
+		var what []string
+		if f.size >= 0 {
+			what = append(what, display.bytes(f.size))
+			size += f.size
+		}
+		if f.frames >= 0 {
+			what = append(what, display.count(f.frames)+" frames")
+			frames += f.frames
+			if f.fps > 0 {
+				what = append(what, display.duration(time.Duration(float64(f.frames)/f.fps*float64(time.Second))))
+			}
+		}
+		if f.note != "" {
+			what = append(what, f.note)
+		}
+		if len(what) > 0 {
+			fmt.Fprintf(w, "  %s\n", strings.Join(what, ", "))
+		}
+		for _, o := range f.outputs {
+			fmt.Fprintf(w, "  -> %s\n", o)
+		}
+		outputs += len(f.outputs)
+	}
+	noun := "files"
+	if d.verb == "decode" {
+		noun = "videos"
+	}
+	fmt.Fprintf(w, "Dry run: would %s %s %s, %s and %s frames, into %s outputs; nothing written\n", d.verb, display.count(int64(len(d.files))), noun, display.bytes(size), display.count(frames), display.count(int64(outputs)))
+}
+
+// record adds the plan to r.
+func (d *dryRun) record(r *jsonReport) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.res.DryRun = true
+	for _, f := range d.files {
+		jf := jsonFile{Input: f.input, Size: max(f.size, 0), Frames: max(f.frames, 0), Note: f.note}
+		if len(f.outputs) > 0 {
+			jf.Output, jf.Also = f.outputs[0], f.outputs[1:]
+		}
+		r.res.Files = append(r.res.Files, jf)
+	}
+}
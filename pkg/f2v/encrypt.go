@@ -0,0 +1,382 @@
+package f2v
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+// An encrypted video's data starts with an envelope header:
+//
+//	magic   [3]byte "FVE"
+//	version uint8
+//	kdf     uint8    how the key is derived from the secret
+//	time    uint32   KDF passes, for KDFs that take them
+//	memory  uint32   KDF memory in KiB, for KDFs that take it
+//	threads uint8    KDF parallelism, for KDFs that take it
+//	salt    [16]byte
+//	nonce   [12]byte
+//
+// followed by the AES-256-GCM ciphertext of the file name (uint16 length,
+// then the name) and the file data, with the header as additional data so
+// none of its fields can be changed unnoticed. Version 2 seals the plaintext
+// in chunks so it can be checked and passed on as it streams in, and
+// version 3 also pads it to hide its size (see seal.go); version 4 pads
+// with random slack that can hold a hidden volume (see hidden.go). Version
+// 1, one GCM message over all of it, and versions 2 and 3 are still read.
+// Nothing else about the file is left in the clear: the header only holds
+// KDF parameters, and encrypted videos are named by a random ID (see
+// videoPath).
+// Compressed data is compressed before it is encrypted. Frames of an
+// encrypted video carry frameFlagEncrypt; data encrypted to age or OpenPGP
+// recipients is an age file or OpenPGP message instead of an envelope (see
+// age.go and pgp.go).
+const envelopeHeaderSize = 42
+
+const envelopeVersion = 4
+
+var envelopeMagic = [3]byte{'F', 'V', 'E'}
+
+const (
+	// kdfKeyFile derives the key from the contents of a key file with
+	// HKDF-SHA256; the file is expected to hold random bytes already.
+	kdfKeyFile = 1
+	// kdfArgon2id derives the key from a password with Argon2id, using the
+	// time, memory and threads of the header.
+	kdfArgon2id = 2
+	// kdfShares derives the key with HKDF-SHA256 from a random key split
+	// into Shamir shares, one ahead of each video's envelope (see shamir.go).
+	kdfShares = 3
+)
+
+const minKeyFileSize = 16
+
+// Argon2id costs: the defaults follow RFC 9106's second recommendation; the
+// limits keep a crafted header from making the decoder allocate or spin
+// without bound.
+const (
+	defaultArgonTime    = 3
+	defaultArgonMemory  = 64 << 10 // KiB
+	defaultArgonThreads = 4
+	maxArgonTime        = 64
+	maxArgonMemory      = 1 << 20 // KiB, 1 GiB
+)
+
+type envelopeHeader struct {
+	version uint8
+	kdf     uint8
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    [16]byte
+	nonce   [12]byte
+}
+
+func (h envelopeHeader) marshal() []byte {
+	buf := make([]byte, envelopeHeaderSize)
+	copy(buf, envelopeMagic[:])
+	buf[3] = h.version
+	buf[4] = h.kdf
+	binary.BigEndian.PutUint32(buf[5:], h.time)
+	binary.BigEndian.PutUint32(buf[9:], h.memory)
+	buf[13] = h.threads
+	copy(buf[14:30], h.salt[:])
+	copy(buf[30:42], h.nonce[:])
+	return buf
+}
+
+func parseEnvelopeHeader(buf []byte) (envelopeHeader, error) {
+	var h envelopeHeader
+	if len(buf) < envelopeHeaderSize || !bytes.Equal(buf[:3], envelopeMagic[:]) {
+		return h, malformed("missing encryption header")
+	}
+	if buf[3] < 1 || buf[3] > envelopeVersion {
+		return h, unsupported("unsupported encryption version %d", buf[3])
+	}
+	h.version = buf[3]
+	h.kdf = buf[4]
+	h.time = binary.BigEndian.Uint32(buf[5:])
+	h.memory = binary.BigEndian.Uint32(buf[9:])
+	h.threads = buf[13]
+	copy(h.salt[:], buf[14:30])
+	copy(h.nonce[:], buf[30:42])
+	return h, nil
+}
+
+// secret is what the user holds to encrypt and decrypt videos: a key file,
+// a password, age or OpenPGP keys, or several of them. Encrypting goes to
+// the age or OpenPGP recipients when there are any, and otherwise uses the
+// key file when there is one.
+type secret struct {
+	keyFile  []byte
+	password []byte
+	// Argon2id costs for encrypting with the password
+	argonTime, argonMemory uint32
+	argonThreads           uint8
+	ageRecipients          []age.Recipient
+	ageIdentities          []age.Identity
+	pgpRecipients          openpgp.EntityList
+	pgpKeyring             openpgp.EntityList
+	// The random key split into shares when encoding, and the shares
+	// collected when decoding
+	shareKey []byte
+	shares   []keyShare
+	// What the slack of envelopes sealed under the secret holds and how
+	// long they are padded to at least
+	hidden *hiddenVolume
+	padTo  int64
+	// The key the integrity tags of unencrypted videos are checked with
+	macKey []byte
+}
+
+func loadKeyFile(path string) (*secret, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if len(data) < minKeyFileSize {
+		return nil, fmt.Errorf("key file %s holds %d bytes, want at least %d random bytes", path, len(data), minKeyFileSize)
+	}
+	return &secret{keyFile: data}, nil
+}
+
+// readPassword asks for a password on the terminal with prompt, twice when
+// confirm is set. When stdin is not a terminal the first line of it is the
+// password, so scripts can pipe one in without putting it on the command
+// line.
+func readPassword(prompt string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		var line []byte
+		b := make([]byte, 1)
+		for {
+			n, err := os.Stdin.Read(b)
+			if n == 0 || b[0] == '\n' {
+				if len(line) == 0 && err != nil {
+					return nil, fmt.Errorf("no password on stdin")
+				}
+				return bytes.TrimSuffix(line, []byte("\r")), nil
+			}
+			line = append(line, b[0])
+		}
+	}
+	fmt.Fprint(os.Stderr, prompt+": ")
+	pw, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password: %w", err)
+	}
+	if len(pw) == 0 {
+		return nil, fmt.Errorf("empty password")
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat "+strings.ToLower(prompt)+": ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password: %w", err)
+		}
+		if !bytes.Equal(pw, again) {
+			return nil, fmt.Errorf("passwords do not match")
+		}
+	}
+	return pw, nil
+}
+
+// newHeader picks fresh KDF parameters for encrypting with s.
+func (s *secret) newHeader() (envelopeHeader, error) {
+	h := envelopeHeader{version: envelopeVersion, kdf: kdfKeyFile}
+	if s.shareKey != nil {
+		h.kdf = kdfShares
+	} else if s.keyFile == nil {
+		h = envelopeHeader{version: envelopeVersion, kdf: kdfArgon2id, time: s.argonTime, memory: s.argonMemory, threads: s.argonThreads}
+	}
+	if _, err := rand.Read(h.salt[:]); err != nil {
+		return h, err
+	}
+	if _, err := rand.Read(h.nonce[:]); err != nil {
+		return h, err
+	}
+	return h, nil
+}
+
+// key derives the AES-256 key for an envelope.
+func (s *secret) key(h envelopeHeader) ([]byte, error) {
+	switch h.kdf {
+	case kdfKeyFile:
+		if s.keyFile == nil {
+			return nil, fmt.Errorf("the video was encrypted with a key file; give it with -key")
+		}
+		return hkdfSHA256(s.keyFile, h.salt[:], []byte("f2v payload key")), nil
+	case kdfArgon2id:
+		if s.password == nil {
+			return nil, fmt.Errorf("the video was encrypted with a password; give -password")
+		}
+		if h.time == 0 || h.time > maxArgonTime || h.memory < 8*uint32(h.threads) || h.memory > maxArgonMemory || h.threads == 0 {
+			return nil, fmt.Errorf("refusing Argon2id costs of %d passes, %d KiB and %d threads", h.time, h.memory, h.threads)
+		}
+		return argon2.IDKey(s.password, h.salt[:], h.time, h.memory, h.threads, 32), nil
+	case kdfShares:
+		key := s.shareKey
+		if key == nil {
+			var err error
+			if key, err = combineShares(s.shares); err != nil {
+				return nil, err
+			}
+		}
+		return hkdfSHA256(key, h.salt[:], []byte("f2v payload key")), nil
+	}
+	return nil, fmt.Errorf("unknown key derivation %d", h.kdf)
+}
+
+// hkdfSHA256 is HKDF (RFC 5869) with SHA-256, producing one 32-byte block.
+func hkdfSHA256(secret, salt, info []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptPayload seals a file's name and data into an envelope, or into an
+// age file or OpenPGP message for recipient keys.
+func encryptPayload(data []byte, name string, s *secret) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := newSealer(&buf, name, s)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decryptPayload opens an envelope, age file or OpenPGP message, returning
+// the file name and data.
+func decryptPayload(data []byte, s *secret) (string, []byte, error) {
+	if bytes.HasPrefix(data, keyShareMagic[:]) {
+		share, err := parseKeyShare(data)
+		if err != nil {
+			return "", nil, err
+		}
+		s, data = s.withShare(share), data[keyShareSize:]
+	}
+	if s == nil {
+		if _, err := parseEnvelopeHeader(data); err != nil && !bytes.HasPrefix(data, ageMagic) && !isPGPMessage(data) {
+			return "", nil, err
+		}
+		return "", nil, fmt.Errorf("the video is encrypted; give -key, -password, -age-identity or -pgp-keyring")
+	}
+	var plain []byte
+	var err error
+	switch {
+	case bytes.HasPrefix(data, ageMagic):
+		plain, err = ageDecrypt(data, s.ageIdentities)
+	case isPGPMessage(data):
+		plain, err = pgpDecrypt(data, s.pgpKeyring)
+	default:
+		plain, err = s.openEnvelope(data)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if len(plain) < 2 || int(binary.BigEndian.Uint16(plain))+2 > len(plain) {
+		return "", nil, malformed("invalid encrypted payload")
+	}
+	n := int(binary.BigEndian.Uint16(plain))
+	return string(plain[2 : 2+n]), plain[2+n:], nil
+}
+
+// openEnvelope checks and decrypts an FVE envelope.
+func (s *secret) openEnvelope(data []byte) ([]byte, error) {
+	h, err := parseEnvelopeHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if h.version >= 2 {
+		var plain bytes.Buffer
+		e, err := s.newEnvelopeOpener(&plain, h)
+		if err == nil {
+			if _, err = e.Write(data[envelopeHeaderSize:]); err == nil {
+				err = e.Close()
+			}
+		}
+		if err != nil && h.version >= 4 {
+			var hidden bytes.Buffer
+			found, hiddenErr := s.openHidden(bytes.NewReader(data), int64(len(data)), h, &hidden)
+			if found {
+				return hidden.Bytes(), hiddenErr
+			}
+		}
+		return plain.Bytes(), err
+	}
+	key, err := s.key(h)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, h.nonce[:], data[envelopeHeaderSize:], data[:envelopeHeaderSize])
+	if err != nil {
+		return nil, mismatched("decryption failed: wrong key, or the data was altered")
+	}
+	return plain, nil
+}
+
+// unwrapPayload undoes what the frame flags say was done to a whole data
+// stream: checking its integrity tag, decryption, then decompression. The
+// name sealed with encrypted data is logged to log.
+func unwrapPayload(data []byte, flags uint8, s *secret, log *slog.Logger) ([]byte, error) {
+	var err error
+	if flags&frameFlagMAC != 0 {
+		if data, err = checkMAC(data, s.mac(), log); err != nil {
+			return nil, err
+		}
+	}
+	if flags&frameFlagEncrypt != 0 {
+		var name string
+		if name, data, err = decryptPayload(data, s); err != nil {
+			return nil, err
+		}
+		log.Info("Decrypted", "name", name)
+	}
+	if flags&frameFlagDeflate != 0 {
+		if data, err = inflate(data); err != nil {
+			return nil, err
+		}
+	}
+	if flags&frameFlagCompress != 0 {
+		if data, err = decompress(data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
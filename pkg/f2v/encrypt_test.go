@@ -0,0 +1,153 @@
+package f2v
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// testKeySecret returns a secret holding a fresh random key file.
+func testKeySecret(t *testing.T) *secret {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return &secret{keyFile: key}
+}
+
+// testPasswordSecret returns a secret holding password, with Argon2id costs
+// low enough for tests.
+func testPasswordSecret(password string) *secret {
+	return &secret{password: []byte(password), argonTime: 1, argonMemory: 64, argonThreads: 1}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	for _, s := range []*secret{testKeySecret(t), testPasswordSecret("correct horse")} {
+		for _, n := range []int{0, 1, envelopeChunkSize - 2, envelopeChunkSize, 3*envelopeChunkSize + 7} {
+			data := randomBytes(t, n)
+			sealed, err := encryptPayload(data, "report.pdf", s)
+			if err != nil {
+				t.Fatalf("sealing %d bytes: %v", n, err)
+			}
+			if h, err := parseEnvelopeHeader(sealed); err != nil || h.version != envelopeVersion {
+				t.Fatalf("sealed %d bytes under header %+v, %v", n, h, err)
+			}
+			if want := envelopeLength(int64(len(namePrefix("report.pdf"))+n), 0); int64(len(sealed)) != want {
+				t.Errorf("%d bytes sealed into %d, want %d", n, len(sealed), want)
+			}
+			name, got, err := decryptPayload(sealed, s)
+			if err != nil {
+				t.Fatalf("opening %d bytes: %v", n, err)
+			}
+			if name != "report.pdf" || !bytes.Equal(got, data) {
+				t.Errorf("%d bytes came back as %q and %d bytes", n, name, len(got))
+			}
+		}
+	}
+}
+
+func TestEnvelopeWrongKey(t *testing.T) {
+	data := randomBytes(t, 2*envelopeChunkSize)
+	for _, c := range []struct {
+		what       string
+		seal, open *secret
+	}{
+		{"another key file", testKeySecret(t), testKeySecret(t)},
+		{"another password", testPasswordSecret("right"), testPasswordSecret("wrong")},
+	} {
+		sealed, err := encryptPayload(data, "f", c.seal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := decryptPayload(sealed, c.open); !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("%s: opened with %v, want a checksum mismatch", c.what, err)
+		}
+	}
+
+	sealed, _ := encryptPayload(data, "f", testKeySecret(t))
+	if _, _, err := decryptPayload(sealed, testPasswordSecret("pw")); err == nil {
+		t.Error("a password opened data sealed under a key file")
+	}
+	if _, _, err := decryptPayload(sealed, nil); err == nil {
+		t.Error("opened encrypted data without a secret")
+	}
+}
+
+func TestEnvelopeTamper(t *testing.T) {
+	s := testKeySecret(t)
+	data := randomBytes(t, 2*envelopeChunkSize+100)
+	sealed, err := encryptPayload(data, "f", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := envelopeHeaderSize + chunksSize(int64(len(namePrefix("f"))+len(data)))
+	for _, at := range []struct {
+		what string
+		i    int64
+	}{
+		{"KDF parameters", 6},
+		{"salt", 20},
+		{"nonce", 35},
+		{"first chunk", envelopeHeaderSize + 10},
+		{"second chunk", envelopeHeaderSize + envelopeChunkSize + 100},
+		{"boundary chunk's tag", used - 1},
+	} {
+		altered := bytes.Clone(sealed)
+		altered[at.i] ^= 0x40
+		if _, _, err := decryptPayload(altered, s); err == nil {
+			t.Errorf("opened with its %s altered", at.what)
+		}
+	}
+}
+
+func TestParseEnvelopeHeader(t *testing.T) {
+	h := envelopeHeader{version: envelopeVersion, kdf: kdfArgon2id, time: 3, memory: 1024, threads: 2}
+	h.salt[0], h.nonce[11] = 7, 9
+	if got, err := parseEnvelopeHeader(h.marshal()); err != nil || got != h {
+		t.Errorf("header came back as %+v, %v", got, err)
+	}
+	for _, c := range []struct {
+		what string
+		buf  []byte
+		want error
+	}{
+		{"short", h.marshal()[:envelopeHeaderSize-1], ErrCorruptFrame},
+		{"no magic", append([]byte("FVX"), h.marshal()[3:]...), ErrCorruptFrame},
+		{"version 0", append([]byte("FVE\x00"), h.marshal()[4:]...), ErrUnsupportedVersion},
+		{"version 5", append([]byte("FVE\x05"), h.marshal()[4:]...), ErrUnsupportedVersion},
+	} {
+		if _, err := parseEnvelopeHeader(c.buf); !errors.Is(err, c.want) {
+			t.Errorf("%s header: %v, want %v", c.what, err, c.want)
+		}
+	}
+}
+
+func TestArgonHeaderLimits(t *testing.T) {
+	s := testPasswordSecret("pw")
+	for _, h := range []envelopeHeader{
+		{time: 0, memory: 64, threads: 1},
+		{time: maxArgonTime + 1, memory: 64, threads: 1},
+		{time: 1, memory: maxArgonMemory + 1, threads: 1},
+		{time: 1, memory: 64, threads: 0},
+		{time: 1, memory: 8*4 - 1, threads: 4},
+	} {
+		h.version, h.kdf = envelopeVersion, kdfArgon2id
+		if _, err := s.key(h); err == nil {
+			t.Errorf("derived a key for %d passes, %d KiB and %d threads", h.time, h.memory, h.threads)
+		}
+	}
+
+	// A crafted header is refused before anything is allocated for it
+	sealed, err := encryptPayload([]byte("data"), "f", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := parseEnvelopeHeader(sealed)
+	h.memory = 1 << 31
+	crafted := append(h.marshal(), sealed[envelopeHeaderSize:]...)
+	if _, _, err := decryptPayload(crafted, s); err == nil {
+		t.Error("opened an envelope asking for 2 TiB of Argon2id memory")
+	}
+}
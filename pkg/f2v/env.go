@@ -0,0 +1,85 @@
+package f2v
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Containers and CI jobs configure the tool through its environment rather
+// than wrapper scripts. Every flag can be set as F2V_ and its name in
+// capitals, dashes as underscores: F2V_MODE=block, F2V_MAX_VIDEO_SIZE=2GB,
+// F2V_ENCRYPT=true. A flag given on the command line wins over its
+// variable, and a variable over a profile. Beside the flags:
+//
+//	F2V_TMPDIR                where temporary files go, in place of TMPDIR
+//	F2V_PROXY                 the proxy for downloads, uploads and S3, in place of HTTPS_PROXY and HTTP_PROXY
+//	F2V_HTTP_TOKEN            a bearer token sent with every request for an http(s) video or file
+//	F2V_YOUTUBE_TOKEN         an OAuth access token for the YouTube channel locate searches
+//	F2V_S3_ACCESS_KEY_ID      S3 credentials, region and endpoint, in place of
+//	F2V_S3_SECRET_ACCESS_KEY  the matching AWS_ variables
+//	F2V_S3_SESSION_TOKEN
+//	F2V_S3_REGION
+//	F2V_S3_ENDPOINT_URL
+
+// envStandins maps variables of the tool onto the standard ones they stand
+// in for.
+var envStandins = []struct {
+	name     string
+	standard []string
+}{
+	{"F2V_TMPDIR", []string{tempDirVariable()}},
+	{"F2V_PROXY", []string{"HTTPS_PROXY", "HTTP_PROXY"}},
+	{"F2V_S3_ACCESS_KEY_ID", []string{"AWS_ACCESS_KEY_ID"}},
+	{"F2V_S3_SECRET_ACCESS_KEY", []string{"AWS_SECRET_ACCESS_KEY"}},
+	{"F2V_S3_SESSION_TOKEN", []string{"AWS_SESSION_TOKEN"}},
+	{"F2V_S3_REGION", []string{"AWS_REGION"}},
+	{"F2V_S3_ENDPOINT_URL", []string{"AWS_ENDPOINT_URL_S3"}},
+}
+
+// tempDirVariable names the variable os.TempDir reads.
+func tempDirVariable() string {
+	if runtime.GOOS == "windows" {
+		return "TMP"
+	}
+	return "TMPDIR"
+}
+
+// applyEnvStandins sets the standard variables from the tool's own, before
+// anything reads them.
+func applyEnvStandins() {
+	for _, s := range envStandins {
+		if v, ok := os.LookupEnv(s.name); ok {
+			for _, name := range s.standard {
+				os.Setenv(name, v)
+			}
+		}
+	}
+}
+
+// flagEnvName is the variable the flag called name is set by.
+func flagEnvName(name string) string {
+	return "F2V_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyFlagEnv sets every flag of flags whose variable is set to its value,
+// as if it were given, once the command line is parsed. Flags the command
+// line gave are left alone, so a repeatable flag does not gather values
+// from both.
+func applyFlagEnv(flags *flag.FlagSet) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(flagEnvName(f.Name))
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		if serr := flags.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("%s=%q: %w", flagEnvName(f.Name), v, serr)
+		}
+	})
+	return err
+}
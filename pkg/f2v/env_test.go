@@ -0,0 +1,58 @@
+package f2v
+
+import (
+	"flag"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestApplyFlagEnv(t *testing.T) {
+	newFlags := func() (*flag.FlagSet, *[]string, *[]string, *string) {
+		flags := flag.NewFlagSet("encode", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		var include, exclude []string
+		flags.Func("include", "", func(v string) error { include = append(include, v); return nil })
+		flags.Func("exclude", "", func(v string) error { exclude = append(exclude, v); return nil })
+		mode := flags.String("mode", "pixel", "")
+		return flags, &include, &exclude, mode
+	}
+	t.Setenv("F2V_INCLUDE", "*.env")
+	t.Setenv("F2V_EXCLUDE", "*.tmp")
+	t.Setenv("F2V_MODE", "block")
+
+	flags, include, exclude, mode := newFlags()
+	parseArgs(flags, []string{"in", "-include", "*.go", "out", "-include", "*.md", "-mode", "dct"})
+	if err := applyFlagEnv(flags); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(*include, []string{"*.go", "*.md"}) {
+		t.Errorf("-include took %q, want only the command line's", *include)
+	}
+	if !slices.Equal(*exclude, []string{"*.tmp"}) {
+		t.Errorf("-exclude took %q, want the variable's", *exclude)
+	}
+	if *mode != "dct" {
+		t.Errorf("-mode is %q, want the command line's", *mode)
+	}
+	if !slices.Equal(flags.Args(), []string{"in", "out"}) {
+		t.Errorf("arguments %q", flags.Args())
+	}
+
+	flags, include, _, mode = newFlags()
+	parseArgs(flags, []string{"in", "out"})
+	if err := applyFlagEnv(flags); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(*include, []string{"*.env"}) || *mode != "block" {
+		t.Errorf("with no flags given, -include took %q and -mode %q, want the variables'", *include, *mode)
+	}
+
+	flags, _, _, _ = newFlags()
+	flags.Int("parity", 0, "")
+	t.Setenv("F2V_PARITY", "ten")
+	parseArgs(flags, nil)
+	if err := applyFlagEnv(flags); err == nil {
+		t.Error("took F2V_PARITY=ten")
+	}
+}
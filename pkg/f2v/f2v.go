@@ -0,0 +1,423 @@
+// Package f2v encodes files into videos whose frames carry their bytes, and
+// decodes such videos back into the files. An Encoder writes a file into a
+// video and a Decoder reads it out again; both take the frame layout the
+// command line tool's -mode, -block, -bits and -coeffs flags set, and a
+// video only decodes with the mode it was encoded with. Main runs the
+// command line tool itself.
+package f2v
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Layout is how data is laid out in the pixels of a frame. Zero fields take
+// the defaults of the command line tool.
+type Layout struct {
+	Mode           string // raw, block, dct, barcode or lsb; "" for raw
+	BlockSize      int    // edge length of a block in pixels, for block and barcode mode
+	BitsPerChannel int    // bits each channel of a block, or pixel, carries, for block and lsb mode
+	Coefficients   int    // DCT coefficients carrying a bit per block, for dct mode
+}
+
+// layout turns lo into the layout frames are written and read with.
+func (lo Layout) layout() (layout, error) {
+	return lo.sized(0, 0, "")
+}
+
+// sized is layout for frames of width by height pixels written with codec,
+// where zero values keep the defaults.
+func (lo Layout) sized(width, height int, codec string) (layout, error) {
+	l := defaultLayout()
+	if width != 0 || height != 0 {
+		l.width, l.height = width, height
+	}
+	if codec != "" {
+		var err error
+		if l.codec, err = parseCodec(codec); err != nil {
+			return l, err
+		}
+	}
+	if lo.Mode != "" {
+		var err error
+		if l.mode, err = parseFrameMode(lo.Mode); err != nil {
+			return l, err
+		}
+	}
+	if lo.BlockSize != 0 {
+		l.blockSize = lo.BlockSize
+	}
+	if lo.BitsPerChannel != 0 {
+		l.bitsPerChannel = lo.BitsPerChannel
+	}
+	if lo.Coefficients != 0 {
+		l.coefficients = lo.Coefficients
+	}
+	l.markers = l.mode.hasMarkers()
+	return l, l.validate()
+}
+
+// Encoder encodes files into videos. The zero Encoder writes raw 640x480
+// frames at the command line tool's default frame rate, uncompressed, with
+// the codec the output's extension asks for: H.264 for .mp4, FFV1 otherwise.
+// NewEncoder builds one from options instead.
+//
+// An Encoder can be reused for any number of encodes, and run by several
+// goroutines at once; between encodes it keeps the frame buffers it used,
+// so a long-lived one does not allocate them again for every file. Progress
+// and Logger are called from every encode running. An Encoder must not be
+// copied once used.
+type Encoder struct {
+	Layout
+	Width, Height int // frame size in pixels; 0 for 640x480
+	FPS           int // frames per second; 0 for 30
+	// Codec names the codec to write videos with, ffv1 or h264; "" to pick
+	// it by the output's extension. Raw mode needs ffv1
+	Codec string
+	// Compress names the algorithm to compress the data with first, zstd,
+	// gzip, lz4 or brotli, optionally with a level after a colon as in
+	// "zstd:19"; "" to leave it as it is
+	Compress string
+	// Parity, if not 0, is the percentage of parity a recovery volume
+	// written next to the video carries, up to 100
+	Parity int
+	// Progress, if set, is called after every frame written; each part of
+	// a split file counts on its own
+	Progress Progress
+	// Backend writes the videos; nil for OpenCV
+	Backend CodecBackend
+	// Logger is told what the encode does, each frame written at Debug
+	// level; nil for slog.Default()
+	Logger *slog.Logger
+
+	pool framePool
+}
+
+// An Option sets up an Encoder built by NewEncoder.
+type Option func(*Encoder) error
+
+// NewEncoder returns an Encoder set up by opts, in order, or the first error
+// an option or the combination of them gives.
+func NewEncoder(opts ...Option) (*Encoder, error) {
+	e := &Encoder{}
+	for _, opt := range opts {
+		if err := opt(e); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := e.options(context.Background()); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// WithLayout lays data out in frames as lo says.
+func WithLayout(lo Layout) Option {
+	return func(e *Encoder) error {
+		e.Layout = lo
+		return nil
+	}
+}
+
+// WithResolution writes frames of width by height pixels.
+func WithResolution(width, height int) Option {
+	return func(e *Encoder) error {
+		if width <= 0 || height <= 0 {
+			return fmt.Errorf("invalid frame size %dx%d", width, height)
+		}
+		e.Width, e.Height = width, height
+		return nil
+	}
+}
+
+// WithFPS writes videos at fps frames per second.
+func WithFPS(fps int) Option {
+	return func(e *Encoder) error {
+		if fps <= 0 {
+			return fmt.Errorf("invalid frame rate %d", fps)
+		}
+		e.FPS = fps
+		return nil
+	}
+}
+
+// WithCodec writes videos with the codec called name, ffv1 or h264.
+func WithCodec(name string) Option {
+	return func(e *Encoder) error {
+		if _, err := parseCodec(name); err != nil {
+			return err
+		}
+		e.Codec = name
+		return nil
+	}
+}
+
+// WithBackend writes videos with b rather than OpenCV.
+func WithBackend(b CodecBackend) Option {
+	return func(e *Encoder) error {
+		e.Backend = b
+		return nil
+	}
+}
+
+// WithLogger tells log what encodes do.
+func WithLogger(log *slog.Logger) Option {
+	return func(e *Encoder) error {
+		e.Logger = log
+		return nil
+	}
+}
+
+// WithCompression compresses the data with alg first, as Encoder.Compress
+// names it.
+func WithCompression(alg string) Option {
+	return func(e *Encoder) error {
+		if _, err := parseCompression(alg); err != nil {
+			return fmt.Errorf("invalid compression: %w", err)
+		}
+		e.Compress = alg
+		return nil
+	}
+}
+
+// WithFEC also writes a recovery volume with percent parity, which repairs
+// up to that share of damaged frames.
+func WithFEC(percent int) Option {
+	return func(e *Encoder) error {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("parity must be between 0 and 100, got %d", percent)
+		}
+		e.Parity = percent
+		return nil
+	}
+}
+
+// options turns e into the options of an encode cancelled by ctx.
+func (e *Encoder) options(ctx context.Context) (encodeOptions, error) {
+	l, err := e.sized(e.Width, e.Height, e.Codec)
+	if err != nil {
+		return encodeOptions{}, err
+	}
+	l.backend, l.logger, l.pool, l.tally = e.Backend, e.Logger, &e.pool, &resultTally{}
+	if l.mode == modeLSB {
+		return encodeOptions{}, fmt.Errorf("lsb mode hides data in a cover video, which only the command line tool takes")
+	}
+	if e.FPS < 0 {
+		return encodeOptions{}, fmt.Errorf("invalid frame rate %d", e.FPS)
+	}
+	if e.Parity < 0 || e.Parity > 100 {
+		return encodeOptions{}, fmt.Errorf("parity must be between 0 and 100, got %d", e.Parity)
+	}
+	opts := encodeOptions{layout: l, fps: e.FPS, parity: e.Parity, ctx: ctx, progress: e.Progress}
+	if opts.fps == 0 {
+		opts.fps = defaultFPS
+	}
+	if err := fitCodec(l.codec, l.width, l.height, opts.fps); err != nil {
+		return opts, err
+	}
+	if e.Compress != "" {
+		c, err := parseCompression(e.Compress)
+		if err != nil {
+			return opts, fmt.Errorf("invalid compression: %w", err)
+		}
+		opts.compress = &c
+	}
+	return opts, nil
+}
+
+// EncodeFile encodes the file at input into the video at output and returns
+// what it wrote, as far as it got if it failed. Once ctx is done the encode
+// stops and removes the video it was writing.
+func (e *Encoder) EncodeFile(ctx context.Context, input, output string) (Result, error) {
+	start := time.Now()
+	opts, err := e.options(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	_, err = encodeFile(input, output, opts)
+	return opts.layout.tally.result(start), err
+}
+
+// Encode encodes what r yields, up to EOF, into the video at output. The
+// data is encoded as it is read, never held whole, so r may be a pipe or a
+// network connection of any length. ctx cancels it, and the Result tells
+// what was written, as for EncodeFile.
+func (e *Encoder) Encode(ctx context.Context, r io.Reader, output string) (Result, error) {
+	start := time.Now()
+	opts, err := e.options(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	name := strings.TrimSuffix(filepath.Base(output), filepath.Ext(output))
+	err = encodeStream(output, name, r, output, opts)
+	return opts.layout.tally.result(start), err
+}
+
+// EncodeObject encodes the object called name in src into the video called
+// video in dst, with its recovery volume and any other video the encode
+// writes next to it. The video is written to a temporary file first, as
+// OpenCV only writes to disk, and appears in dst once it is complete. The
+// Result is as for EncodeFile.
+func (e *Encoder) EncodeObject(ctx context.Context, src Source, name string, dst Sink, video string) (Result, error) {
+	start := time.Now()
+	opts, err := e.options(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	err = encodeObject(ctx, src, name, dst, video, opts)
+	return opts.layout.tally.result(start), err
+}
+
+// encodeObject does the work of EncodeObject.
+func encodeObject(ctx context.Context, src Source, name string, dst Sink, video string, opts encodeOptions) error {
+	r, err := src.Open(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	dir, err := os.MkdirTemp("", "f2v-encode-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, path.Base(video))
+	if err := encodeStream(name, path.Base(name), r, local, opts); err != nil {
+		return err
+	}
+	for _, p := range writtenPaths(local, opts) {
+		if _, err := os.Stat(p); err != nil {
+			continue // not written by this encode
+		}
+		if err := upload(ctx, dst, p, path.Join(path.Dir(video), filepath.Base(p)), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decoder decodes videos written by an Encoder, or by the command line
+// tool, whose Layout must match the one they were encoded with. The frame
+// size is taken from the video itself. Like an Encoder, a Decoder can be
+// reused and run by several goroutines at once, keeps the frame buffers
+// and Mats of finished decodes for the next ones, and must not be copied
+// once used.
+type Decoder struct {
+	Layout
+	Progress Progress     // called after every frame read, if set
+	Backend  CodecBackend // reads the videos; nil for OpenCV
+	Logger   *slog.Logger // told what the decode does; nil for slog.Default()
+
+	pool framePool
+}
+
+// options turns d into the options of a decode cancelled by ctx.
+func (d *Decoder) options(ctx context.Context) (decodeOptions, error) {
+	l, err := d.layout()
+	if err != nil {
+		return decodeOptions{}, err
+	}
+	l.backend, l.logger, l.pool, l.tally = d.Backend, d.Logger, &d.pool, &resultTally{}
+	return decodeOptions{layout: l, ctx: ctx, progress: d.Progress}, nil
+}
+
+// DecodeFile decodes the video at video, a local file or an http or https
+// URL, into the file at output, whose folder must exist. A video of an f2v
+// archive is unpacked into that folder instead. Once ctx is done the decode
+// stops, downloads included, and leaves nothing at output. The Result tells
+// what was read and decoded, as far as it got if it failed.
+func (d *Decoder) DecodeFile(ctx context.Context, video, output string) (Result, error) {
+	start := time.Now()
+	opts, err := d.options(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	err = videoToFile(video, output, opts)
+	return opts.layout.tally.result(start), err
+}
+
+// Decode decodes the video at video, a local file or an http or https URL,
+// into w as its frames are read. The data is written as the video holds it:
+// an f2v archive comes out as the archive, not unpacked. ctx cancels it
+// before the next frame, and the Result is as for DecodeFile.
+func (d *Decoder) Decode(ctx context.Context, video string, w io.Writer) (Result, error) {
+	start := time.Now()
+	opts, err := d.options(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	err = decodeVideo(video, w, opts, nil)
+	return opts.layout.tally.result(start), err
+}
+
+// ReadRange returns length bytes of the file in video, a local file or a URL
+// as DecodeFile takes, from offset on, or fewer if the file ends first. It
+// reads only the frames that hold them, seeking the video to them through
+// its index frame, so a piece of a huge archive comes back without decoding
+// the rest. Only files stored as they were, not compressed, encrypted or
+// tagged, read in pieces. A URL is downloaded once first.
+func (d *Decoder) ReadRange(ctx context.Context, video string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length <= 0 {
+		return nil, fmt.Errorf("invalid range of %d bytes at byte %d", length, offset)
+	}
+	opts, err := d.options(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if isURL(video) {
+		src, name, err := SourceFor(video)
+		if err != nil {
+			return nil, err
+		}
+		local, cleanup, err := fetch(ctx, opts.log(), src, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download video: %w", err)
+		}
+		defer cleanup()
+		video = local
+	}
+	var buf bytes.Buffer
+	if err := decodeRange(video, &buf, opts, offset, offset+length); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeObject decodes the video called video in src into the object called
+// name in dst, which appears only once the decode succeeds. The video is
+// downloaded to a temporary file first, as OpenCV only reads from disk, and
+// the data is written as Decode writes it. The Result is as for DecodeFile.
+func (d *Decoder) DecodeObject(ctx context.Context, src Source, video string, dst Sink, name string) (Result, error) {
+	start := time.Now()
+	opts, err := d.options(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	err = decodeObject(ctx, src, video, dst, name, opts)
+	return opts.layout.tally.result(start), err
+}
+
+// decodeObject does the work of DecodeObject.
+func decodeObject(ctx context.Context, src Source, video string, dst Sink, name string, opts decodeOptions) error {
+	local, cleanup, err := fetch(ctx, opts.log(), src, video)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	w, err := dst.Create(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := decodeVideo(local, w, opts, nil); err != nil {
+		return err
+	}
+	return w.Finalize()
+}
@@ -0,0 +1,201 @@
+package f2v
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// An encode can write extra copies of each file next to the main video, each
+// with its own layout and container, from the same prepared data: a lossless
+// FFV1 master to keep and a robust H.264 copy to upload, say. The input is
+// read, tuned and compressed once, and every output is written at the same
+// time.
+
+// outputSpec describes one extra output, written to the main video's name
+// with .mkv replaced by "." + name.
+type outputSpec struct {
+	name   string
+	layout layout
+}
+
+// videoCodec picks the codec for a video file from its extension: H.264 for
+// .mp4, which platforms take as is, and lossless FFV1 for anything else.
+func videoCodec(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".mp4") {
+		return "avc1"
+	}
+	return "FFV1"
+}
+
+// videoCodecs maps the names -codec takes to the fourccs OpenCV writes them
+// with.
+var videoCodecs = map[string]string{"ffv1": "FFV1", "h264": "avc1"}
+
+// codecName returns the name -codec takes for the fourcc codec, "" for "".
+func codecName(codec string) string {
+	for name, fourcc := range videoCodecs {
+		if fourcc == codec {
+			return name
+		}
+	}
+	return ""
+}
+
+// parseCodec returns the fourcc of the codec called name, ffv1 or h264.
+func parseCodec(name string) (string, error) {
+	codec, ok := videoCodecs[strings.ToLower(name)]
+	if !ok {
+		return "", fmt.Errorf("unknown codec %q; use ffv1 or h264", name)
+	}
+	return codec, nil
+}
+
+// H.264's highest level, 6.2, holds frames of up to this many 16x16
+// macroblocks, no edge longer than h264MaxEdge pixels, and no more
+// macroblocks a second than h264MaxMacroblockRate.
+const (
+	h264MaxFrameMacroblocks = 139264
+	h264MaxEdge             = 16 * 1055 // sqrt(8 * h264MaxFrameMacroblocks) macroblocks
+	h264MaxMacroblockRate   = 16711680
+)
+
+// fitCodec checks that codec, a fourcc as parseCodec returns, can write
+// frames of width by height pixels at fps frames a second. FFV1 takes any
+// size. H.264 keeps colour for 2x2 pixels at a time, so it takes even sizes
+// only, and no more macroblocks a frame or a second than its highest level
+// holds, or no player could play the video.
+func fitCodec(codec string, width, height, fps int) error {
+	if codec != "avc1" {
+		return nil
+	}
+	if width%2 != 0 || height%2 != 0 {
+		return fmt.Errorf("h264 needs an even width and height, not %dx%d", width, height)
+	}
+	macroblocks := ((width + 15) / 16) * ((height + 15) / 16)
+	if macroblocks > h264MaxFrameMacroblocks || width > h264MaxEdge || height > h264MaxEdge {
+		return fmt.Errorf("%dx%d frames are larger than h264 allows", width, height)
+	}
+	if macroblocks*fps > h264MaxMacroblockRate {
+		return fmt.Errorf("h264 cannot carry %dx%d frames at %d fps; lower the size or the frame rate", width, height, fps)
+	}
+	return nil
+}
+
+// codecFor returns the codec a video at path is written with: the layout's
+// own if it has one, else the one its extension asks for.
+func (l layout) codecFor(path string) string {
+	if l.codec != "" {
+		return l.codec
+	}
+	return videoCodec(path)
+}
+
+// parseOutputSpec parses name[:key=value,...], where the keys are the layout
+// flags mode, block, bits and coeffs; anything not given is taken from base.
+func parseOutputSpec(spec string, base layout) (outputSpec, error) {
+	name, settings, _ := strings.Cut(spec, ":")
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return outputSpec{}, fmt.Errorf("invalid output name %q", name)
+	}
+	o := outputSpec{name: name, layout: base}
+	for _, setting := range strings.Split(settings, ",") {
+		if setting == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return outputSpec{}, fmt.Errorf("invalid setting %q in output %s, want key=value", setting, name)
+		}
+		var err error
+		switch key {
+		case "mode":
+			o.layout.mode, err = parseFrameMode(value)
+		case "block":
+			o.layout.blockSize, err = strconv.Atoi(value)
+		case "bits":
+			o.layout.bitsPerChannel, err = strconv.Atoi(value)
+		case "coeffs":
+			o.layout.coefficients, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown setting %q", key)
+		}
+		if err != nil {
+			return outputSpec{}, fmt.Errorf("output %s: %w", name, err)
+		}
+	}
+	o.layout.markers = o.layout.mode.hasMarkers()
+	if err := o.layout.validate(); err != nil {
+		return outputSpec{}, fmt.Errorf("output %s: %w", name, err)
+	}
+	if o.layout.mode == modeRaw && o.layout.codecFor(name) != "FFV1" {
+		return outputSpec{}, fmt.Errorf("output %s: raw mode needs a lossless codec; use a .mkv name or another mode", name)
+	}
+	return o, nil
+}
+
+// path returns where the output goes for the main video mainVideo.
+func (o outputSpec) path(mainVideo string) string {
+	return strings.TrimSuffix(mainVideo, ".mkv") + "." + o.name
+}
+
+// writeOutputs runs one write per output concurrently and returns the first
+// error.
+func writeOutputs(n int, write func(i int) error) error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = write(i)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamOutputs encodes r into every output as it is read, without holding
+// the data, and returns the number of bytes read. Output i starts with
+// heads[i], if heads is given.
+func streamOutputs(r io.Reader, outputs []string, layouts []layout, fps int, flags uint8, heads [][]byte) (int64, error) {
+	withHead := func(i int, r io.Reader) io.Reader {
+		if heads == nil {
+			return r
+		}
+		return io.MultiReader(bytes.NewReader(heads[i]), r)
+	}
+	if len(outputs) == 1 {
+		return streamToVideo(withHead(0, r), outputs[0], layouts[0], fps, flags)
+	}
+	readers := make([]*io.PipeReader, len(outputs))
+	writers := make([]io.Writer, len(outputs))
+	for i := range outputs {
+		pr, pw := io.Pipe()
+		readers[i], writers[i] = pr, pw
+	}
+	copied := make(chan int64, 1)
+	go func() {
+		n, err := io.Copy(io.MultiWriter(writers...), r)
+		for _, w := range writers {
+			w.(*io.PipeWriter).CloseWithError(err)
+		}
+		copied <- n
+	}()
+	err := writeOutputs(len(outputs), func(i int) error {
+		_, err := streamToVideo(withHead(i, readers[i]), outputs[i], layouts[i], fps, flags)
+		// A failed output stops the copy for the others too
+		readers[i].CloseWithError(err)
+		return err
+	})
+	return <-copied, err
+}
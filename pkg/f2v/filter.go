@@ -0,0 +1,139 @@
+package f2v
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// -include and -exclude pick the files a folder encode takes, whether into
+// a video each or into one -pack archive. Patterns follow .gitignore: one
+// without a slash matches a file or folder name at any depth, one with a
+// slash matches the path from the top of the folder, a trailing slash only
+// matches folders and a leading **/ matches at any depth. A file is taken
+// when it matches no exclude pattern and, if any include pattern is given,
+// it or a folder it is in matches one. Excluded folders are not entered.
+
+// pathPattern is one parsed -include or -exclude pattern.
+type pathPattern struct {
+	glob     string
+	anchored bool // matched from the top of the folder
+	dirOnly  bool
+}
+
+func parsePathPattern(s string) (pathPattern, error) {
+	p := pathPattern{}
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly, s = true, strings.TrimRight(s, "/")
+	}
+	if rest, ok := strings.CutPrefix(s, "**/"); ok {
+		s = rest
+	} else if rest, ok := strings.CutPrefix(s, "/"); ok {
+		p.anchored, s = true, rest
+	} else {
+		p.anchored = strings.Contains(s, "/")
+	}
+	if s == "" {
+		return p, fmt.Errorf("empty pattern")
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return p, fmt.Errorf("invalid pattern %q: %w", s, err)
+	}
+	p.glob = s
+	return p, nil
+}
+
+// match reports whether rel, a slash-separated path from the top of the
+// folder, or a folder it is in matches p.
+func (p pathPattern) match(rel string, isDir bool) bool {
+	segs := strings.Split(rel, "/")
+	for end := len(segs); end >= 1; end-- {
+		if p.dirOnly && end == len(segs) && !isDir {
+			continue
+		}
+		start := 0
+		if !p.anchored {
+			start = end - 1
+		}
+		// Unanchored patterns with a slash, from a leading **/, may start
+		// at any folder
+		for ; start >= 0; start-- {
+			if ok, _ := path.Match(p.glob, strings.Join(segs[start:end], "/")); ok {
+				return true
+			}
+			if p.anchored {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// pathFilter is the -include and -exclude patterns of an encode.
+type pathFilter struct {
+	include, exclude []pathPattern
+}
+
+func (f *pathFilter) addInclude(s string) error {
+	p, err := parsePathPattern(s)
+	if err == nil {
+		f.include = append(f.include, p)
+	}
+	return err
+}
+
+func (f *pathFilter) addExclude(s string) error {
+	p, err := parsePathPattern(s)
+	if err == nil {
+		f.exclude = append(f.exclude, p)
+	}
+	return err
+}
+
+// addExcludeFile adds the patterns of a .gitignore-style file, one per
+// line, skipping blank lines and # comments.
+func (f *pathFilter) addExcludeFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("failed to read exclude file: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "!") {
+			return fmt.Errorf("%s:%d: negated patterns are not supported; use -include", name, n)
+		}
+		if err := f.addExclude(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// skip reports whether the entry at rel is left out. Includes only apply to
+// files, so that folders are entered to look for them.
+func (f *pathFilter) skip(rel string, isDir bool) bool {
+	if f == nil || rel == "." {
+		return false
+	}
+	for _, p := range f.exclude {
+		if p.match(rel, isDir) {
+			return true
+		}
+	}
+	if isDir || len(f.include) == 0 {
+		return false
+	}
+	for _, p := range f.include {
+		if p.match(rel, false) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package f2v
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// A live archive is a video that is still being written, locally or on a
+// share or stream the decoder can reach, with no end known in advance. The
+// decoder follows it the way tail -f follows a log: when it runs out of
+// frames it waits, reopens the source past the frames it has already read
+// and carries on, writing data out as it arrives. The frame flagged as the
+// last one is the end-of-archive marker that stops it.
+
+const followPoll = time.Second
+
+// followSource reads frames from a video that may still be growing.
+type followSource struct {
+	path    string
+	backend CodecBackend
+	log     *slog.Logger
+	cap     *capture
+	read    int           // frames returned so far
+	idle    time.Duration // give up after this long without a new frame, 0 never
+	ctx     context.Context
+	waits   int
+}
+
+func (s *followSource) Read(m *mat) bool {
+	since := time.Now()
+	for {
+		if s.cap != nil && s.cap.Read(m) && !m.Empty() {
+			s.read++
+			return true
+		}
+		if s.idle > 0 && time.Since(since) >= s.idle {
+			s.log.Warn("No new frames, giving up", "video", s.path, "idle", display.duration(s.idle))
+			return false
+		}
+		if s.waits++; s.waits == 1 {
+			s.log.Info("Waiting for more frames", "video", s.path)
+		}
+		select {
+		case <-s.ctx.Done():
+			return false
+		case <-time.After(followPoll):
+		}
+		s.reopen()
+	}
+}
+
+// reopen opens the source again and, where it can seek, skips the frames
+// already read. Sources that cannot seek, like live streams, just resume;
+// any frame seen twice is dropped by its sequence number.
+func (s *followSource) reopen() {
+	if s.cap != nil {
+		s.cap.Close()
+		s.cap = nil
+	}
+	cap, err := openCapture(s.backend, s.path)
+	if err != nil {
+		return // not there yet, or caught mid-write
+	}
+	if s.read > 0 {
+		cap.SeekFrame(int64(s.read))
+	}
+	s.cap = cap
+}
+
+func (s *followSource) Close() {
+	if s.cap != nil {
+		s.cap.Close()
+	}
+}
+
+// followVideo decodes a live archive into w until its final frame arrives.
+func followVideo(inputVideo string, w io.Writer, opts decodeOptions, gaps *gapMap) error {
+	src := &followSource{path: inputVideo, backend: opts.layout.codecBackend(), log: opts.log(), idle: opts.idle, ctx: opts.context()}
+	defer src.Close()
+	src.reopen()
+	return decodeFrames(src, inputVideo, w, opts, gaps)
+}
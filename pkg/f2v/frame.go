@@ -0,0 +1,185 @@
+package f2v
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Every frame's payload area starts with a small header:
+//
+//	magic   [2]byte "FV"
+//	version uint8
+//	flags   uint8
+//	seq     uint32  frame sequence number, starting at 0
+//	length  uint32  data bytes carried by this frame
+//	crc     uint32  CRC-32 (IEEE) of the preceding header fields and the data
+//
+// All integers are big-endian. The sequence number lets the decoder drop
+// frames that a platform duplicated while changing the frame rate and notice
+// frames that went missing; the checksum makes sure a damaged frame is never
+// mistaken for a valid one.
+//
+// Frames of a video that is one part of a split encode (see split.go) are
+// version 2, whose header goes on after the checksum with
+//
+//	part    uint16  this video's part number, from 1
+//	parts   uint16  how many parts there are
+//
+// which the checksum covers too.
+const frameHeaderSize = 16
+
+// framePartSize is what a version 2 header adds.
+const framePartSize = 4
+
+const (
+	frameVersion      = 1
+	frameVersionParts = 2
+)
+
+var frameMagic = [2]byte{'F', 'V'}
+
+const (
+	// frameFlagLast marks the final frame of a video.
+	frameFlagLast = 1 << iota
+	// frameFlagParity marks frames of a recovery volume rather than data.
+	frameFlagParity
+	// frameFlagInfo marks a recovery volume's descriptor frame, or without
+	// frameFlagParity, the index frame after a data video's final frame.
+	frameFlagInfo
+	// frameFlagTable marks the segment table of a segmented video.
+	frameFlagTable
+	// frameFlagDeflate marks data frames that together hold a deflate
+	// stream rather than the file itself.
+	frameFlagDeflate
+	// frameFlagEncrypt marks data frames that together hold an encrypted
+	// envelope (see encrypt.go).
+	frameFlagEncrypt
+	// frameFlagMAC marks data frames whose data ends with an integrity tag
+	// (see mac.go).
+	frameFlagMAC
+	// frameFlagCompress marks data frames that together hold a compressed
+	// stream led by a byte naming the algorithm (see compress.go).
+	frameFlagCompress
+)
+
+// dataFlags are the flags that say what was done to the data, which every
+// data frame of a video carries alike.
+const dataFlags = frameFlagDeflate | frameFlagEncrypt | frameFlagMAC | frameFlagCompress
+
+type frameHeader struct {
+	flags       uint8
+	seq         uint32
+	length      uint32
+	part, parts uint16 // of a split encode; parts is 0 otherwise
+}
+
+// size is how many bytes the header takes up.
+func (h frameHeader) size() int {
+	if h.parts > 0 {
+		return frameHeaderSize + framePartSize
+	}
+	return frameHeaderSize
+}
+
+func (h frameHeader) last() bool {
+	return h.flags&frameFlagLast != 0
+}
+
+func (h frameHeader) parity() bool {
+	return h.flags&frameFlagParity != 0
+}
+
+// index reports whether the frame is a data video's index frame (see
+// index.go).
+func (h frameHeader) index() bool {
+	return h.flags&(frameFlagInfo|frameFlagParity) == frameFlagInfo
+}
+
+func (h frameHeader) table() bool {
+	return h.flags&frameFlagTable != 0
+}
+
+func (h frameHeader) deflated() bool {
+	return h.flags&frameFlagDeflate != 0
+}
+
+func (h frameHeader) encrypted() bool {
+	return h.flags&frameFlagEncrypt != 0
+}
+
+func (h frameHeader) tagged() bool {
+	return h.flags&frameFlagMAC != 0
+}
+
+func (h frameHeader) compressed() bool {
+	return h.flags&frameFlagCompress != 0
+}
+
+// sealFrame fills buf, which must be a whole frame's payload area, with the
+// header followed by data and zero padding.
+func sealFrame(buf []byte, h frameHeader, data []byte) {
+	h.length = uint32(len(data))
+	buf[0], buf[1] = frameMagic[0], frameMagic[1]
+	buf[2] = frameVersion
+	buf[3] = h.flags
+	binary.BigEndian.PutUint32(buf[4:], h.seq)
+	binary.BigEndian.PutUint32(buf[8:], h.length)
+	if h.parts > 0 {
+		buf[2] = frameVersionParts
+		binary.BigEndian.PutUint16(buf[16:], h.part)
+		binary.BigEndian.PutUint16(buf[18:], h.parts)
+	}
+
+	body := buf[h.size():]
+	copy(body, data)
+	clear(body[len(data):])
+
+	crc := crc32.NewIEEE()
+	crc.Write(buf[:12])
+	crc.Write(buf[frameHeaderSize:h.size()])
+	crc.Write(body[:len(data)])
+	binary.BigEndian.PutUint32(buf[12:], crc.Sum32())
+}
+
+// openFrame validates the header at the start of a frame's payload area and
+// returns it together with the data bytes it describes.
+func openFrame(buf []byte) (frameHeader, []byte, error) {
+	var h frameHeader
+	if len(buf) < frameHeaderSize {
+		return h, nil, malformed("frame too small for a header")
+	}
+	if buf[0] != frameMagic[0] || buf[1] != frameMagic[1] {
+		return h, nil, malformed("missing frame header")
+	}
+	switch buf[2] {
+	case frameVersion:
+	case frameVersionParts:
+		if len(buf) < frameHeaderSize+framePartSize {
+			return h, nil, malformed("frame too small for a header")
+		}
+		h.part = binary.BigEndian.Uint16(buf[16:])
+		h.parts = binary.BigEndian.Uint16(buf[18:])
+		if h.parts == 0 || h.part < 1 || h.part > h.parts {
+			return h, nil, malformed("frame claims to be part %d of %d", h.part, h.parts)
+		}
+	default:
+		return h, nil, unsupported("unsupported frame version %d", buf[2])
+	}
+	h.flags = buf[3]
+	h.seq = binary.BigEndian.Uint32(buf[4:])
+	h.length = binary.BigEndian.Uint32(buf[8:])
+
+	body := buf[h.size():]
+	if int64(h.length) > int64(len(body)) {
+		return h, nil, malformed("frame claims %d bytes but holds at most %d", h.length, len(body))
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(buf[:12])
+	crc.Write(buf[frameHeaderSize:h.size()])
+	crc.Write(body[:h.length])
+	if got, want := crc.Sum32(), binary.BigEndian.Uint32(buf[12:]); got != want {
+		return h, nil, mismatched("checksum mismatch")
+	}
+	return h, body[:h.length], nil
+}
@@ -0,0 +1,41 @@
+package f2v
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzOpenFrame(f *testing.F) {
+	for _, h := range []frameHeader{
+		{seq: 7},
+		{flags: frameFlagLast | frameFlagEncrypt, seq: 1 << 20},
+		{seq: 3, part: 2, parts: 5},
+	} {
+		for _, data := range [][]byte{nil, []byte("frame data"), bytes.Repeat([]byte{0xff}, 200)} {
+			buf := make([]byte, frameHeaderSize+framePartSize+250)
+			sealFrame(buf, h, data)
+			f.Add(buf)
+			f.Add(buf[:h.size()+len(data)])
+		}
+	}
+	f.Add([]byte{})
+	f.Add([]byte{frameMagic[0], frameMagic[1], frameVersionParts, 0})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		h, data, err := openFrame(buf)
+		if err != nil {
+			return
+		}
+		if len(data) != int(h.length) || h.size()+len(data) > len(buf) {
+			t.Fatalf("frame of %d bytes opened with %d bytes of data", len(buf), len(data))
+		}
+		if h.parts > 0 && (h.part < 1 || h.part > h.parts) {
+			t.Fatalf("opened part %d of %d", h.part, h.parts)
+		}
+		if len(data) > 0 {
+			if _, _, err := openFrame(buf[:h.size()+len(data)-1]); err == nil {
+				t.Fatal("opened a frame cut short of its data")
+			}
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package f2v
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// FramePayload is one frame of a video as a FrameReader reads it.
+type FramePayload struct {
+	Frame int    // position in the video, from 0, duplicated frames included
+	Seq   uint32 // sequence number the frame was written with, from 0
+	// Data is what the frame carries, as the video stores it: still
+	// compressed, encrypted or tagged if the video is
+	Data []byte
+	// Raw is the frame's payload area after its header, padding included;
+	// for a frame that failed its checks, what it holds laid out as the
+	// video's frames most likely are
+	Raw         []byte
+	Last        bool // the final frame of the data
+	Info        bool // the index frame after the final one, or a recovery volume's descriptor
+	Parity      bool // a frame of a recovery volume
+	Table       bool // the segment table of a video whose frames change layout
+	Part, Parts int  // of a split file; Parts is 0 otherwise
+}
+
+// FrameReader reads the frames of a video one at a time, checked but
+// otherwise as they are, for callers that store, check or repair frames
+// themselves rather than decoding the file they make up. Decoder.Frames
+// opens one.
+type FrameReader struct {
+	ctx     context.Context
+	scanner *frameScanner
+	cleanup func()
+}
+
+// Frames opens the frames of video, a local file or a URL as DecodeFile
+// takes. Once ctx is done, NextFrame fails with its error. The FrameReader
+// must be closed.
+func (d *Decoder) Frames(ctx context.Context, video string) (*FrameReader, error) {
+	opts, err := d.options(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cap, cleanup, err := openVideoContext(opts.context(), video, opts.layout)
+	if err != nil {
+		return nil, err
+	}
+	return &FrameReader{ctx: opts.context(), scanner: newFrameScanner(cap, opts.layout), cleanup: cleanup}, nil
+}
+
+// NextFrame returns the next frame of the video, or io.EOF after the last
+// one. A frame that fails its checks comes with an error wrapping
+// ErrCorruptFrame, ErrChecksumMismatch or ErrUnsupportedVersion, and with
+// its Frame and Raw set; NextFrame goes on with the frame after it when
+// called again. Any other error ends the frames.
+func (r *FrameReader) NextFrame() (FramePayload, error) {
+	if err := r.ctx.Err(); err != nil {
+		return FramePayload{}, err
+	}
+	f, ok, err := r.scanner.next()
+	if err != nil {
+		return FramePayload{}, err
+	}
+	if !ok {
+		return FramePayload{}, io.EOF
+	}
+	p := FramePayload{Frame: f.index, Raw: f.raw}
+	if f.err != nil {
+		return p, fmt.Errorf("frame %d: %w", f.index, f.err)
+	}
+	h := f.header
+	p.Seq, p.Data = h.seq, f.data
+	p.Last, p.Parity, p.Table = h.last(), h.parity(), h.table()
+	p.Info = h.flags&frameFlagInfo != 0
+	p.Part, p.Parts = int(h.part), int(h.parts)
+	return p, nil
+}
+
+// Close closes the video, removing its download if it was one.
+func (r *FrameReader) Close() error {
+	err := r.scanner.Close()
+	r.cleanup()
+	return err
+}
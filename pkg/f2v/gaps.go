@@ -0,0 +1,248 @@
+package f2v
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// A lenient decode keeps going past frames it cannot read, leaving holes in
+// their place so the rest of the file stays at the right offsets; the output
+// is written sparse where the file system allows, so the holes read as zeros
+// without taking up space. The gap map lists where the holes are, so the
+// salvaged file can be used with care, and fill can later take just the
+// missing frames from another copy of the video.
+
+type dataGap struct {
+	Offset     int64  `json:"offset"`
+	Length     int64  `json:"length"`
+	FirstFrame uint32 `json:"first_frame"` // sequence number
+	Frames     int    `json:"frames"`
+}
+
+type gapMap struct {
+	Size      int64     `json:"size"`       // bytes written, holes included
+	Truncated bool      `json:"truncated"`  // the final frame never arrived, so data past Size is missing
+	NextFrame uint32    `json:"next_frame"` // sequence number the missing end starts at
+	Gaps      []dataGap `json:"gaps"`
+}
+
+// gapMapPath returns where the gap map of a decoded file is kept.
+func gapMapPath(output string) string {
+	return output + ".gaps.json"
+}
+
+// add records frames from seq on as missing, merging with a gap that ends
+// where this one starts.
+func (m *gapMap) add(offset, length int64, seq uint32, frames int) {
+	if n := len(m.Gaps); n > 0 {
+		g := &m.Gaps[n-1]
+		if g.Offset+g.Length == offset && g.FirstFrame+uint32(g.Frames) == seq {
+			g.Length += length
+			g.Frames += frames
+			return
+		}
+	}
+	m.Gaps = append(m.Gaps, dataGap{Offset: offset, Length: length, FirstFrame: seq, Frames: frames})
+}
+
+func (m *gapMap) empty() bool {
+	return len(m.Gaps) == 0 && !m.Truncated
+}
+
+func (m *gapMap) lost() int64 {
+	var n int64
+	for _, g := range m.Gaps {
+		n += g.Length
+	}
+	return n
+}
+
+func loadGapMap(path string) (*gapMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gap map: %w", err)
+	}
+	m := &gapMap{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid gap map %s: %w", path, err)
+	}
+	return m, nil
+}
+
+func (m *gapMap) save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write gap map: %w", err)
+	}
+	return nil
+}
+
+func (m *gapMap) print(w io.Writer) {
+	fmt.Fprintf(w, "Salvaged %s, %s of it missing in %d gaps\n", display.bytes(m.Size), display.bytes(m.lost()), len(m.Gaps))
+	for _, g := range m.Gaps {
+		fmt.Fprintf(w, "  bytes %s-%s: frames %d-%d unreadable\n", display.count(g.Offset), display.count(g.Offset+g.Length-1), g.FirstFrame, g.FirstFrame+uint32(g.Frames)-1)
+	}
+	if m.Truncated {
+		fmt.Fprintf(w, "  bytes %s-: the video ended before its final frame\n", display.count(m.Size))
+	}
+}
+
+// writeZeros writes n zero bytes to w, or leaves a hole if w is a file.
+func writeZeros(w io.Writer, n int64) error {
+	if tw, ok := w.(tallyWriter); ok {
+		tw.t.addPayload(n)
+		return writeZeros(tw.w, n)
+	}
+	if f, ok := w.(*os.File); ok {
+		_, err := f.Seek(n, io.SeekCurrent)
+		return err
+	}
+	zeros := make([]byte, min(n, 1<<20))
+	for n > 0 {
+		k, err := w.Write(zeros[:min(n, int64(len(zeros)))])
+		if err != nil {
+			return err
+		}
+		n -= int64(k)
+	}
+	return nil
+}
+
+// writeSparse writes the size bytes of data to path, leaving the gaps as
+// holes.
+func writeSparse(path string, data io.ReaderAt, size int64, m *gapMap) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	defer f.Close()
+	var pos int64
+	for _, g := range append(m.Gaps, dataGap{Offset: size}) {
+		if _, err := io.Copy(io.NewOffsetWriter(f, pos), io.NewSectionReader(data, pos, g.Offset-pos)); err != nil {
+			return fmt.Errorf("failed to write output file: %w", err)
+		}
+		pos = g.Offset + g.Length
+	}
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	return f.Close()
+}
+
+// frameOffset returns where in the original data frame seq starts.
+func frameOffset(f scannedFrame) int64 {
+	if f.table != nil {
+		start, _ := f.table.byteRange(f.header.seq)
+		return start
+	}
+	return int64(f.header.seq) * int64(f.capacity)
+}
+
+// fillGaps reads another copy of a video and writes the frames a partial
+// decode is missing into it, in place, then updates or removes its gap map.
+func fillGaps(partial, video string, l layout) error {
+	m, err := loadGapMap(gapMapPath(partial))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(partial, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open partial file: %w", err)
+	}
+	defer f.Close()
+	cap, cleanup, err := openVideo(video, l)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	filled, tagged := 0, false
+	tail := make(map[uint32]scannedFrame) // frames past a truncated end, held until they join up
+	final := int64(-1)
+	done := func() bool {
+		return len(m.Gaps) == 0 && (!m.Truncated || (final >= 0 && int64(len(tail)) == final-int64(m.NextFrame)+1))
+	}
+	err = scanFrames(cap, l, func(sf scannedFrame) (bool, error) {
+		if sf.err != nil || sf.header.parity() || sf.header.table() || sf.header.index() {
+			return true, nil
+		}
+		tagged = tagged || sf.header.tagged()
+		seq := sf.header.seq
+		if m.Truncated && seq >= m.NextFrame {
+			if _, ok := tail[seq]; !ok {
+				sf.data = bytes.Clone(sf.data)
+				tail[seq] = sf
+			}
+			if sf.header.last() {
+				final = int64(seq)
+			}
+			return !done(), nil
+		}
+		i := slices.IndexFunc(m.Gaps, func(g dataGap) bool { return seq >= g.FirstFrame && seq < g.FirstFrame+uint32(g.Frames) })
+		if i < 0 {
+			return true, nil
+		}
+		offset := frameOffset(sf)
+		if _, err := f.WriteAt(sf.data, offset); err != nil {
+			return false, fmt.Errorf("failed to write partial file: %w", err)
+		}
+		filled++
+
+		// Split the gap around the frame
+		g := m.Gaps[i]
+		var rest []dataGap
+		if seq > g.FirstFrame {
+			rest = append(rest, dataGap{Offset: g.Offset, Length: offset - g.Offset, FirstFrame: g.FirstFrame, Frames: int(seq - g.FirstFrame)})
+		}
+		if end := offset + int64(len(sf.data)); seq+1 < g.FirstFrame+uint32(g.Frames) {
+			rest = append(rest, dataGap{Offset: end, Length: g.Offset + g.Length - end, FirstFrame: seq + 1, Frames: int(g.FirstFrame + uint32(g.Frames) - seq - 1)})
+		}
+		m.Gaps = slices.Replace(m.Gaps, i, i+1, rest...)
+		return !done(), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Extend a truncated file with the frames that continue it
+	for m.Truncated {
+		sf, ok := tail[m.NextFrame]
+		if !ok {
+			break
+		}
+		offset := frameOffset(sf)
+		if _, err := f.WriteAt(sf.data, offset); err != nil {
+			return fmt.Errorf("failed to write partial file: %w", err)
+		}
+		filled++
+		m.Size = offset + int64(len(sf.data))
+		m.NextFrame++
+		m.Truncated = !sf.header.last()
+	}
+	if m.empty() && tagged {
+		// The integrity tag came along with the final frames
+		if err := f.Truncate(max(0, m.Size-macSize)); err != nil {
+			return fmt.Errorf("failed to write partial file: %w", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write partial file: %w", err)
+	}
+
+	summarize(os.Stdout, "Filled %d frames of %s from %s", filled, partial, video)
+	if m.empty() {
+		summarize(os.Stdout, "%s is complete", partial)
+		return os.Remove(gapMapPath(partial))
+	}
+	if summarizing() {
+		m.print(os.Stdout)
+	}
+	return m.save(gapMapPath(partial))
+}
@@ -0,0 +1,168 @@
+package f2v
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// The slack of a version 4 envelope can hold a second, independently keyed
+// file, so that a video decrypts to an innocuous file with one secret and
+// to the real one with another. Slack is random bytes either way, and
+// nothing in the clear says which, so whoever holds only the outer secret
+// cannot tell that there is anything more to find. A hidden volume sits at
+// the end of the slack:
+//
+//	random    the rest of the slack
+//	chunks    the hidden file's name and data, sealed as version 4 chunks
+//	salt      [16]byte
+//	nonce     [12]byte
+//	count     [24]byte  the sealed number of data chunks ahead of the boundary chunk
+//
+// It is keyed like an envelope whose header is the trailer's salt and nonce
+// with the outer header's Argon2id costs (the defaults if the outer secret is
+// a key file), and that header is the chunks' additional data. Decoding
+// tries the hidden volume when the outer envelope does not open.
+const hiddenTrailerSize = 16 + 12 + 8 + 16
+
+// hiddenVolume is the file to hide in an encrypted video's slack and the
+// secret it is encrypted under.
+type hiddenVolume struct {
+	path   string
+	secret *secret
+}
+
+// hiddenHeaders returns the envelope headers a hidden volume under s could
+// be keyed with, given the outer header and the volume's salt and nonce.
+func (s *secret) hiddenHeaders(outer envelopeHeader, salt [16]byte, nonce [12]byte) []envelopeHeader {
+	var hs []envelopeHeader
+	if s.keyFile != nil {
+		hs = append(hs, envelopeHeader{version: envelopeVersion, kdf: kdfKeyFile, salt: salt, nonce: nonce})
+	}
+	if s.password != nil {
+		h := envelopeHeader{version: envelopeVersion, kdf: kdfArgon2id, time: defaultArgonTime, memory: defaultArgonMemory, threads: defaultArgonThreads, salt: salt, nonce: nonce}
+		if outer.kdf == kdfArgon2id {
+			h.time, h.memory, h.threads = outer.time, outer.memory, outer.threads
+		}
+		hs = append(hs, h)
+	}
+	return hs
+}
+
+// hiddenCountNonce is the nonce of the trailer's chunk count, one no chunk
+// can have.
+func hiddenCountNonce(h envelopeHeader) []byte {
+	return chunkNonce(h.nonce, math.MaxUint64, chunkFinal)
+}
+
+// writeSlack pads an envelope of used bytes so far, hiding s.hidden in the
+// padding if it is set.
+func (s *secret) writeSlack(dst io.Writer, outer envelopeHeader, used int64) error {
+	slack := max(padmeLength(used+hiddenTrailerSize), s.padTo) - used
+	if s.hidden == nil {
+		_, err := io.CopyN(dst, rand.Reader, slack)
+		return err
+	}
+	return s.hidden.write(dst, outer, slack)
+}
+
+func (v *hiddenVolume) write(dst io.Writer, outer envelopeHeader, slack int64) error {
+	f, err := os.Open(v.path)
+	if err != nil {
+		return fmt.Errorf("failed to open hidden file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open hidden file: %w", err)
+	}
+	prefix := namePrefix(filepath.Base(v.path))
+	need := chunksSize(int64(len(prefix))+info.Size()) + hiddenTrailerSize
+	if need > slack {
+		return fmt.Errorf("the hidden file needs %s of the video's padding, which holds %s; make room with -pad-to", display.bytes(need), display.bytes(slack))
+	}
+	if _, err := io.CopyN(dst, rand.Reader, slack-need); err != nil {
+		return err
+	}
+
+	var salt [16]byte
+	var nonce [12]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return fmt.Errorf("failed to generate salt and nonce: %w", err)
+	}
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return fmt.Errorf("failed to generate salt and nonce: %w", err)
+	}
+	h := v.secret.hiddenHeaders(outer, salt, nonce)[0]
+	key, err := v.secret.key(h)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	e := newChunkSealer(dst, aead, h)
+	if _, err := e.Write(prefix); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(e, f, info.Size()); err != nil {
+		return fmt.Errorf("failed to read hidden file: %w", err)
+	}
+	if err := e.Close(); err != nil {
+		return err
+	}
+
+	trailer := append(salt[:], nonce[:]...)
+	count := binary.BigEndian.AppendUint64(nil, uint64(max(e.written-1, 0)/envelopeChunkSize))
+	_, err = dst.Write(aead.Seal(trailer, hiddenCountNonce(h), count, h.marshal()))
+	return err
+}
+
+// openHidden looks for a hidden volume under s in the size bytes of an
+// envelope in r and decrypts it into dst. It reports false when there is
+// none to open, and an error when there is one but it does not decrypt.
+func (s *secret) openHidden(r io.ReaderAt, size int64, outer envelopeHeader, dst io.Writer) (bool, error) {
+	if s == nil || size < envelopeHeaderSize+hiddenTrailerSize {
+		return false, nil
+	}
+	trailer := make([]byte, hiddenTrailerSize)
+	if _, err := r.ReadAt(trailer, size-hiddenTrailerSize); err != nil {
+		return false, err
+	}
+	var salt [16]byte
+	var nonce [12]byte
+	copy(salt[:], trailer[:16])
+	copy(nonce[:], trailer[16:28])
+	for _, h := range s.hiddenHeaders(outer, salt, nonce) {
+		key, err := s.key(h)
+		if err != nil {
+			continue
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return false, err
+		}
+		count, err := aead.Open(nil, hiddenCountNonce(h), trailer[28:], h.marshal())
+		if err != nil {
+			continue
+		}
+		sealed := uint64(envelopeChunkSize + aead.Overhead())
+		chunks := binary.BigEndian.Uint64(count)
+		end := size - hiddenTrailerSize
+		if chunks > uint64(end)/sealed || int64(chunks*sealed+sealed+4) > end-envelopeHeaderSize {
+			return true, malformed("invalid encrypted payload")
+		}
+		length := int64(chunks*sealed + sealed + 4)
+		e := newChunkOpener(dst, aead, h)
+		if _, err := io.Copy(e, io.NewSectionReader(r, end-length, length)); err != nil {
+			return true, err
+		}
+		return true, e.Close()
+	}
+	return false, nil
+}
@@ -0,0 +1,142 @@
+package f2v
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Decode hooks process each decoded file on its way to disk: scanning it,
+// transforming it or handing it to another system. A hook reads the file
+// from in and writes whatever should continue down the chain to out; hooks
+// run concurrently with the decoder, connected by pipes, so nothing is held
+// back until the whole file is known. A hook that fails rejects the file.
+type decodeHook func(name string, in io.Reader, out io.Writer) error
+
+// decodeHooks holds the Go hooks that -hook can select. Add more from an
+// init function in another file of the package with registerDecodeHook.
+var decodeHooks = map[string]decodeHook{}
+
+func registerDecodeHook(name string, h decodeHook) {
+	decodeHooks[name] = h
+}
+
+func init() {
+	registerDecodeHook("gunzip", func(name string, in io.Reader, out io.Writer) error {
+		z, err := gzip.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("%s is not gzip data: %w", name, err)
+		}
+		_, err = io.Copy(out, z)
+		return err
+	})
+	registerDecodeHook("sha256", func(name string, in io.Reader, out io.Writer) error {
+		h := sha256.New()
+		if _, err := io.Copy(out, io.TeeReader(in, h)); err != nil {
+			return err
+		}
+		slog.Info("SHA-256", "file", name, "sha256", fmt.Sprintf("%x", h.Sum(nil)))
+		return nil
+	})
+}
+
+func lookupDecodeHook(name string) (decodeHook, error) {
+	h, ok := decodeHooks[name]
+	if !ok {
+		var known []string
+		for n := range decodeHooks {
+			known = append(known, n)
+		}
+		slices.Sort(known)
+		return nil, fmt.Errorf("unknown hook %q (known: %s)", name, strings.Join(known, ", "))
+	}
+	return h, nil
+}
+
+// commandHook runs a shell command as a hook, with the file's name in
+// F2V_NAME. A filter's output replaces the data; a scan gets a copy of the
+// data, its output goes to the log and the data passes on unchanged.
+func commandHook(command string, scan bool) decodeHook {
+	return func(name string, in io.Reader, out io.Writer) error {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(os.Environ(), "F2V_NAME="+name)
+		cmd.Stderr = os.Stderr
+		cmd.Stdin, cmd.Stdout = in, out
+		if scan {
+			cmd.Stdin, cmd.Stdout = io.TeeReader(in, out), os.Stderr
+		}
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%q rejected %s: %w", command, name, err)
+		}
+		if scan {
+			// Pass on whatever the scanner did not read
+			_, err := io.Copy(out, in)
+			return err
+		}
+		return nil
+	}
+}
+
+// hookChain feeds what is written to it through a list of hooks into dst.
+type hookChain struct {
+	in   *io.PipeWriter
+	wg   sync.WaitGroup
+	errs []error
+}
+
+// newHookChain starts the hooks, which must not be empty.
+func newHookChain(name string, hooks []decodeHook, dst io.Writer) *hookChain {
+	c := &hookChain{errs: make([]error, len(hooks))}
+	next := dst
+	for i := len(hooks) - 1; i >= 0; i-- {
+		pr, pw := io.Pipe()
+		out := next
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			err := hooks[i](name, pr, out)
+			if w, ok := out.(*io.PipeWriter); ok {
+				w.CloseWithError(err)
+			}
+			if err == nil {
+				// Keep the upstream side from blocking on a hook that stopped early
+				io.Copy(io.Discard, pr)
+			}
+			pr.CloseWithError(err)
+			c.errs[i] = err
+		}()
+		next = pw
+	}
+	c.in = next.(*io.PipeWriter)
+	return c
+}
+
+func (c *hookChain) Write(p []byte) (int, error) {
+	return c.in.Write(p)
+}
+
+// Close ends the input and waits for every hook, returning the first error
+// along the chain.
+func (c *hookChain) Close() error {
+	c.in.Close()
+	c.wg.Wait()
+	for _, err := range c.errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abort stops the hooks after decoding failed.
+func (c *hookChain) abort(err error) {
+	c.in.CloseWithError(err)
+	c.wg.Wait()
+}
@@ -0,0 +1,187 @@
+package f2v
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// -base makes an incremental f2v archive: files are chunked as for -dedup,
+// but chunks the base video already holds are not stored again; the
+// directory lists them as kept in the base. Files unchanged since the base,
+// by size, mode and modification time, are not even read again. A base may
+// itself be incremental, so each backup only adds what changed since the
+// one before, and the directory lists the whole chain of videos it needs.
+// Decoding, ls, extract and append look for those videos next to the
+// archive video, under the names they had, and check every chunk read from
+// them against its hash.
+
+// loadBase reads the directory of the base video for an archive to be
+// encoded into outputVideo, and returns the name the archive refers to it
+// by.
+func loadBase(base, outputVideo string, opts encodeOptions) (string, *archiveDirectory, error) {
+	d, err := readArchiveDirectory(base, decodeOptions{layout: opts.layout, secret: opts.secret})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read base %s: %w", base, err)
+	}
+	if len(d.Chunks) == 0 {
+		return "", nil, fmt.Errorf("base %s was not packed with -dedup or -base, so it has no chunks to refer to", base)
+	}
+	baseAbs, _ := filepath.Abs(base)
+	outAbs, _ := filepath.Abs(outputVideo)
+	if filepath.Dir(baseAbs) != filepath.Dir(outAbs) {
+		opts.log().Warn("Keep a copy of the base next to the video: decoding looks for it there", "base", filepath.Base(base), "video", outputVideo)
+	}
+	return filepath.Base(base), d, nil
+}
+
+// setBase makes a refer to the chunks of the archive video name, whose
+// directory is d, instead of storing them.
+func (a *archiveWriter) setBase(name string, d *archiveDirectory) {
+	a.dedup = true
+	a.dir.Bases = append([]string{name}, d.Bases...)
+	a.baseChunks = make(map[string]archiveChunk, len(d.Chunks))
+	for _, c := range d.Chunks {
+		c.Base++
+		a.baseChunks[c.SHA256] = c
+	}
+	a.baseEntries = make(map[string]archiveEntry, len(d.Entries))
+	for _, e := range d.Entries {
+		a.baseEntries[e.Name] = e
+	}
+}
+
+// archiveReader reads entries' data from an f2v archive video: from the
+// archive decoded whole, or else from the frames holding it, and from the
+// videos it is based on.
+type archiveReader struct {
+	dir   *archiveDirectory
+	video string
+	opts  decodeOptions
+	data  io.ReaderAt // the whole archive, or nil to read frames
+	size  int64       // of data
+	per   int64       // data bytes per frame, for reading frames
+	bases map[int]*archiveReader
+}
+
+// openArchive reads the directory of the archive in video, from its last
+// frames if it is a plain archive and otherwise by decoding it whole.
+func openArchive(video string, opts decodeOptions) (*archiveReader, error) {
+	r := &archiveReader{video: video, opts: opts}
+	t, err := readArchiveTail(video, opts.layout)
+	switch {
+	case err == nil:
+		r.dir, r.per = t.dir, t.per
+	case errors.Is(err, errNoTail):
+		var data []byte
+		if r.dir, data, err = decodeArchive(video, opts); err == nil {
+			r.data, r.size = bytes.NewReader(data), int64(len(data))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// read returns the data of the regular file e.
+func (r *archiveReader) read(e archiveEntry) ([]byte, error) {
+	spans := r.dir.spans(e)
+	parts := make([][]byte, len(spans))
+	// Read the spans in each video in one go, so frames are read once
+	byBase := make(map[int][]int)
+	for i, sp := range spans {
+		byBase[sp.base] = append(byBase[sp.base], i)
+	}
+	for base, idx := range byBase {
+		src := r
+		if base > 0 {
+			var err error
+			if src, err = r.base(base); err != nil {
+				return nil, err
+			}
+		}
+		local := make([][2]int64, len(idx))
+		for j, i := range idx {
+			local[j] = [2]int64{spans[i].offset, spans[i].length()}
+		}
+		got, err := src.readLocal(local)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range idx {
+			if spans[i].stored > 0 {
+				if got[j], err = decompress(got[j]); err != nil {
+					return nil, fmt.Errorf("%s: %w", e.Name, err)
+				}
+				if int64(len(got[j])) != spans[i].size {
+					return nil, malformed("%s decompresses to %d bytes, not %d", e.Name, len(got[j]), spans[i].size)
+				}
+			}
+			parts[i] = got[j]
+			if sum := sha256.Sum256(got[j]); base > 0 && hex.EncodeToString(sum[:]) != spans[i].sha256 {
+				return nil, mismatched("chunk %s of %s does not match in %s; is it the video this archive was based on?", spans[i].sha256, e.Name, src.video)
+			} else if base > 0 {
+				r.opts.log().Debug("Chunk verified", "chunk", spans[i].sha256, "file", e.Name, "video", src.video)
+			}
+		}
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	out := make([]byte, 0, e.Size)
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out, nil
+}
+
+// readLocal returns the data at each span of r's own archive.
+func (r *archiveReader) readLocal(spans [][2]int64) ([][]byte, error) {
+	out := make([][]byte, len(spans))
+	if r.data != nil {
+		for i, sp := range spans {
+			if sp[0] < 0 || sp[1] < 0 || sp[0] > r.size-sp[1] {
+				return nil, malformed("%s is too short for the chunks read from it", r.video)
+			}
+			out[i] = make([]byte, sp[1])
+			if _, err := io.ReadFull(io.NewSectionReader(r.data, sp[0], sp[1]), out[i]); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", r.video, err)
+			}
+		}
+		return out, nil
+	}
+	data, err := readArchiveSpans(r.video, r.opts.layout, r.per, spans)
+	if err != nil {
+		return nil, err
+	}
+	for i, sp := range spans {
+		out[i], data = data[:sp[1]], data[sp[1]:]
+	}
+	return out, nil
+}
+
+// base opens the archive Bases[n-1] refers to, next to r's video.
+func (r *archiveReader) base(n int) (*archiveReader, error) {
+	if b, ok := r.bases[n]; ok {
+		return b, nil
+	}
+	dir := filepath.Dir(r.video)
+	if isURL(r.video) {
+		dir = "."
+	}
+	video := filepath.Join(dir, r.dir.Bases[n-1])
+	b, err := openArchive(video, r.opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open base %s: %w", video, err)
+	}
+	if r.bases == nil {
+		r.bases = make(map[int]*archiveReader)
+	}
+	r.bases[n] = b
+	return b, nil
+}
@@ -0,0 +1,253 @@
+package f2v
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Every streamed video ends with an index frame after its final frame,
+// flagged frameFlagInfo without frameFlagParity, which decoding stops short
+// of. It says how much data the video holds, in 64 bits, and how it is laid
+// out, so that a range of the data can be read by seeking straight to the
+// frames holding it: byte offset o is in the frame with sequence number
+// o/frameBytes, which is its position in the video unless a platform
+// dropped or repeated frames. It holds:
+//
+//	magic       [4]byte "FVIX"
+//	version     uint8
+//	flags       uint8    the data flags of every data frame
+//	dataSize    uint64   bytes the data frames hold together
+//	dataFrames  uint64
+//	frameBytes  uint32   data bytes per full data frame
+const (
+	videoIndexSize    = 26
+	videoIndexVersion = 1
+)
+
+var videoIndexMagic = [4]byte{'F', 'V', 'I', 'X'}
+
+type videoIndex struct {
+	flags      uint8
+	dataSize   uint64
+	dataFrames uint64
+	frameBytes uint32
+}
+
+func (vi videoIndex) marshal() []byte {
+	buf := make([]byte, videoIndexSize)
+	copy(buf, videoIndexMagic[:])
+	buf[4] = videoIndexVersion
+	buf[5] = vi.flags
+	binary.BigEndian.PutUint64(buf[6:], vi.dataSize)
+	binary.BigEndian.PutUint64(buf[14:], vi.dataFrames)
+	binary.BigEndian.PutUint32(buf[22:], vi.frameBytes)
+	return buf
+}
+
+func parseVideoIndex(buf []byte) (videoIndex, error) {
+	var vi videoIndex
+	if len(buf) != videoIndexSize || !bytes.Equal(buf[:4], videoIndexMagic[:]) {
+		return vi, malformed("invalid index frame")
+	}
+	if buf[4] != videoIndexVersion {
+		return vi, unsupported("unsupported index frame version %d", buf[4])
+	}
+	vi.flags = buf[5]
+	vi.dataSize = binary.BigEndian.Uint64(buf[6:])
+	vi.dataFrames = binary.BigEndian.Uint64(buf[14:])
+	vi.frameBytes = binary.BigEndian.Uint32(buf[22:])
+	if vi.flags&^dataFlags != 0 {
+		return vi, malformed("index frame lists flags %#x", vi.flags)
+	}
+	if vi.frameBytes == 0 || vi.dataFrames != uint64(dataFrames(int64(vi.dataSize), int64(vi.frameBytes))) {
+		return vi, malformed("index frame lists %d bytes in %d frames of %d", vi.dataSize, vi.dataFrames, vi.frameBytes)
+	}
+	return vi, nil
+}
+
+// readVideoIndex reads the index frame at the end of a video, or returns
+// nil if the video has none, as videos made before it do not.
+func readVideoIndex(video string, l layout) (*videoIndex, error) {
+	cap, cleanup, err := openVideo(video, l)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	// One frame more than the index and the final frame covers a frame
+	// count that is one off
+	if n := cap.Info().Frames; n > 3 {
+		cap.SeekFrame(n - 3)
+	}
+	var vi *videoIndex
+	err = scanFrames(cap, l, func(f scannedFrame) (bool, error) {
+		if f.err != nil || !f.header.index() {
+			return true, nil
+		}
+		parsed, err := parseVideoIndex(f.data)
+		if err != nil {
+			return false, err
+		}
+		if uint64(f.header.seq) != parsed.dataFrames {
+			return false, malformed("index frame %d follows %d data frames", f.header.seq, parsed.dataFrames)
+		}
+		vi = &parsed
+		return false, nil
+	})
+	return vi, err
+}
+
+// rangeChunk is about how much data decodeRange reads at a time.
+const rangeChunk = 64 << 20
+
+// decodeRange writes bytes [start, end) of the data of a video to w, end
+// 0 for its end, reading only the frames that hold them, found through its
+// index frame. Only data as the file was, not compressed, encrypted or
+// tagged, reads in pieces.
+func decodeRange(video string, w io.Writer, opts decodeOptions, start, end int64) error {
+	vi, err := readVideoIndex(video, opts.layout)
+	if err != nil {
+		return err
+	}
+	if vi == nil {
+		return fmt.Errorf("%s has no index frame to find the range by; decode it whole", video)
+	}
+	if vi.flags != 0 {
+		return fmt.Errorf("%s holds compressed, encrypted or tagged data, which only decodes whole", video)
+	}
+	size, per := int64(vi.dataSize), int64(vi.frameBytes)
+	if end == 0 || end > size {
+		end = size
+	}
+	if start >= end {
+		return fmt.Errorf("range starts at byte %d, but %s holds %d bytes", start, video, size)
+	}
+	step := max(1, rangeChunk/per)
+	for first := start / per; first*per < end; first += step {
+		if err := opts.context().Err(); err != nil {
+			return err
+		}
+		last := min(first+step, (end+per-1)/per) - 1
+		data, err := readFrameSpan(video, opts.layout, first, last)
+		if err != nil {
+			return err
+		}
+		lo, hi := max(start, first*per)-first*per, min(end, (last+1)*per)-first*per
+		if int64(len(data)) < hi {
+			return malformed("frames %d-%d of %s hold %d bytes, not %d", first, last, video, len(data), hi)
+		}
+		if _, err := w.Write(data[lo:hi]); err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
+		}
+	}
+	return nil
+}
+
+// videoIndexFrame returns the index frame of a video whose data frames came
+// to dataSize bytes in frames of frameBytes with flags; ok is false when its
+// frames are too small to hold one.
+func videoIndexFrame(dataSize int64, frameBytes int, flags uint8) (frameHeader, []byte, bool) {
+	if frameBytes < videoIndexSize {
+		return frameHeader{}, nil, false
+	}
+	vi := videoIndex{flags: flags & dataFlags, dataSize: uint64(dataSize), dataFrames: uint64(dataFrames(dataSize, int64(frameBytes))), frameBytes: uint32(frameBytes)}
+	return frameHeader{flags: frameFlagInfo, seq: uint32(vi.dataFrames)}, vi.marshal(), true
+}
+
+// A seek index lists the independently decodable units of a video file:
+// runs of clusters starting at a keyframe, so every unit begins a GOP. To
+// read part of a remote video a client fetches bytes [0, header_size) once,
+// then the byte ranges of the units covering the frames it wants; each unit
+// appended to the header forms a video that decodes on its own. FFV1 makes
+// every frame a keyframe, so every cluster of a video written by the encoder
+// is a unit; re-encoded videos only break at their keyframes.
+
+// seekUnit is one GOP-aligned stretch of the video file.
+type seekUnit struct {
+	FirstFrame int   `json:"first_frame"`
+	Frames     int   `json:"frames"`
+	Offset     int64 `json:"offset"`
+	Length     int64 `json:"length"`
+	DataStart  int64 `json:"data_start"` // original file bytes held, assuming no duplicated frames
+	DataEnd    int64 `json:"data_end"`
+}
+
+type seekIndex struct {
+	Video      string     `json:"video"`
+	Size       int64      `json:"size"`
+	HeaderSize int64      `json:"header_size"`
+	FrameBytes int        `json:"frame_bytes"` // data bytes per frame in the layout given
+	Units      []seekUnit `json:"units"`
+}
+
+// indexPath returns where the seek index of a video is kept.
+func indexPath(video string) string {
+	return video + ".idx.json"
+}
+
+// buildSeekIndex scans a Matroska video and groups its clusters into units
+// that start at a keyframe.
+func buildSeekIndex(video string, l layout) (*seekIndex, error) {
+	info, err := os.Stat(video)
+	if err != nil {
+		return nil, err
+	}
+	headerSize, clusters, err := scanMatroska(video)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &seekIndex{Video: video, Size: info.Size(), HeaderSize: headerSize, FrameBytes: l.capacity() - frameHeaderSize}
+	dataSize := int64(-1)
+	if vi, err := readVideoIndex(video, l); err == nil && vi != nil {
+		idx.FrameBytes, dataSize = int(vi.frameBytes), int64(vi.dataSize)
+	}
+	frame := 0
+	for _, c := range clusters {
+		if n := len(idx.Units); n > 0 && !c.keyStart {
+			// Frames that depend on the previous cluster stay with it
+			u := &idx.Units[n-1]
+			u.Frames += c.frames
+			u.Length = c.offset + c.length - u.Offset
+		} else {
+			idx.Units = append(idx.Units, seekUnit{FirstFrame: frame, Frames: c.frames, Offset: c.offset, Length: c.length})
+		}
+		frame += c.frames
+	}
+	for i := range idx.Units {
+		u := &idx.Units[i]
+		u.DataStart = int64(u.FirstFrame) * int64(idx.FrameBytes)
+		u.DataEnd = int64(u.FirstFrame+u.Frames) * int64(idx.FrameBytes)
+		if dataSize >= 0 {
+			// The index frame after the data holds none
+			u.DataStart, u.DataEnd = min(u.DataStart, dataSize), min(u.DataEnd, dataSize)
+		}
+	}
+	return idx, nil
+}
+
+func (idx *seekIndex) save(path string) error {
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return nil
+}
+
+func (idx *seekIndex) print(w io.Writer) {
+	frames := 0
+	for _, u := range idx.Units {
+		frames += u.Frames
+	}
+	fmt.Fprintf(w, "Indexed %s: %d frames in %d decodable units, %s of headers\n", idx.Video, frames, len(idx.Units), display.bytes(idx.HeaderSize))
+	for _, u := range idx.Units {
+		fmt.Fprintf(w, "  frames %d-%d: bytes %s-%s (data %s-%s)\n",
+			u.FirstFrame, u.FirstFrame+u.Frames-1, display.count(u.Offset), display.count(u.Offset+u.Length-1), display.count(u.DataStart), display.count(u.DataEnd-1))
+	}
+}
@@ -0,0 +1,26 @@
+package f2v
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzParseVideoIndex(f *testing.F) {
+	f.Add(videoIndex{dataSize: 1000, dataFrames: 1, frameBytes: 9000}.marshal())
+	f.Add(videoIndex{flags: frameFlagEncrypt | frameFlagCompress, dataSize: 1 << 40, dataFrames: 1<<40/9000 + 1, frameBytes: 9000}.marshal())
+	f.Add(videoIndex{dataFrames: 1, frameBytes: 1}.marshal())
+	f.Add(videoIndexMagic[:])
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		vi, err := parseVideoIndex(buf)
+		if err != nil {
+			return
+		}
+		if got := vi.marshal(); !bytes.Equal(got, buf) {
+			t.Fatalf("index %x parsed into one marshalling as %x", buf, got)
+		}
+		if _, err := parseVideoIndex(buf[:len(buf)-1]); err == nil {
+			t.Fatal("parsed an index cut short")
+		}
+	})
+}
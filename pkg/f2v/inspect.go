@@ -0,0 +1,119 @@
+package f2v
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// inspectFrames is how many frames inspect reads into a video looking for
+// an intact one before giving up on its header.
+const inspectFrames = 30
+
+// inspection is what inspect makes of a video from its first frames and its
+// index frame, without reading the frames between.
+type inspection struct {
+	info     VideoInfo
+	layout   layout
+	first    *scannedFrame // first intact frame, nil if none was found
+	index    *videoIndex   // nil for videos without one
+	recovery string        // the video's recovery volume, if it has one beside it
+}
+
+// inspectVideo reads what inspect prints about a video.
+func inspectVideo(input string, l layout) (*inspection, error) {
+	cap, cleanup, err := openVideo(input, l)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	in := &inspection{info: cap.Info(), layout: l}
+	err = scanFrames(cap, l, func(f scannedFrame) (bool, error) {
+		if f.err == nil {
+			in.first = &f
+			return false, nil
+		}
+		return f.index+1 < inspectFrames, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if in.first != nil && !in.first.header.parity() {
+		// As readVideoIndex does, but with the video already open
+		if n := in.info.Frames; n > 3 {
+			cap.SeekFrame(n - 3)
+		}
+		err = scanFrames(cap, l, func(f scannedFrame) (bool, error) {
+			if f.err != nil || !f.header.index() {
+				return true, nil
+			}
+			vi, err := parseVideoIndex(f.data)
+			if err != nil {
+				return false, err
+			}
+			in.index = &vi
+			return false, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if volume := recoveryPath(input); !isURL(input) {
+		if _, err := os.Stat(volume); err == nil {
+			in.recovery = volume
+		}
+	}
+	return in, nil
+}
+
+// dataTreatment says what was done to data carrying flags, "as it was" if
+// nothing.
+func dataTreatment(flags uint8) string {
+	var done []string
+	h := frameHeader{flags: flags}
+	if h.compressed() || h.deflated() {
+		done = append(done, "compressed")
+	}
+	if h.encrypted() {
+		done = append(done, "encrypted")
+	}
+	if h.tagged() {
+		done = append(done, "tagged")
+	}
+	if len(done) == 0 {
+		return "as it was"
+	}
+	return strings.Join(done, ", ")
+}
+
+func (in *inspection) print(w io.Writer, name string) {
+	fmt.Fprintf(w, "Inspected %s: %dx%d at %g fps, %s frames\n", name, in.info.Width, in.info.Height, in.info.FPS, display.count(in.info.Frames))
+	if in.first == nil {
+		fmt.Fprintf(w, "  no intact frame in the first %d read in %s layout; give the -mode and flags it was encoded with\n", inspectFrames, in.layout.describe())
+		return
+	}
+	h := in.first.header
+	fmt.Fprintf(w, "Layout: %s, %s a frame\n", in.layout.describe(), display.bytes(int64(in.first.capacity)))
+	switch {
+	case h.parity():
+		fmt.Fprintln(w, "Kind: recovery volume, parity frames for another video")
+	case in.first.table != nil:
+		fmt.Fprintln(w, "Kind: segmented, with a robust head in its own layout")
+	default:
+		fmt.Fprintln(w, "Kind: data")
+	}
+	if h.parts > 0 {
+		fmt.Fprintf(w, "Part: %d of %d\n", h.part, h.parts)
+	}
+	switch {
+	case in.index != nil:
+		fmt.Fprintf(w, "Data: %s in %s frames, %s\n", display.bytes(int64(in.index.dataSize)), display.count(int64(in.index.dataFrames)), dataTreatment(in.index.flags))
+	case !h.parity():
+		fmt.Fprintf(w, "Data: %s; no index frame, so run verify for its size\n", dataTreatment(h.flags&dataFlags))
+	}
+	if in.recovery != "" {
+		fmt.Fprintf(w, "Recovery volume: %s\n", in.recovery)
+	}
+}
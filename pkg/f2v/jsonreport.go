@@ -0,0 +1,156 @@
+package f2v
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// With -json, encode and decode write only JSON to stdout, a line for each
+// thing: the slog events of the run, each with "type":"event", and last a
+// single "type":"result" object with every file taken, what it was written
+// to, its size, SHA-256 and time, any error, and what the run added up to.
+// What the tool prints for people goes to stderr instead, so scripts can
+// read stdout line by line whether the run worked or not.
+
+// jsonFile is what became of one file or video of a run.
+type jsonFile struct {
+	Input  string `json:"input"`
+	Output string `json:"output,omitempty"`
+	// Size and SHA256 are of the data: the file read for an encode, the
+	// file written for a decode. They are left out when there is no such
+	// file to hash, as for standard input or an unpacked archive.
+	Size            int64   `json:"size,omitempty"`
+	SHA256          string  `json:"sha256,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Error           string  `json:"error,omitempty"`
+	// With -dry-run: the frames it would take, what else would be written
+	// beside the output and anything more to know
+	Frames int64    `json:"frames,omitempty"`
+	Also   []string `json:"also,omitempty"`
+	Note   string   `json:"note,omitempty"`
+}
+
+// jsonResult is the object a -json run ends with.
+type jsonResult struct {
+	Type            string     `json:"type"` // always "result"
+	Command         string     `json:"command"`
+	OK              bool       `json:"ok"`
+	DryRun          bool       `json:"dry_run,omitempty"`
+	Error           string     `json:"error,omitempty"`
+	Files           []jsonFile `json:"files"`
+	Uploaded        []string   `json:"uploaded,omitempty"`
+	Frames          int64      `json:"frames"`
+	PayloadBytes    int64      `json:"payload_bytes"`
+	FrameBytes      int64      `json:"frame_bytes"`
+	ParityBytes     int64      `json:"parity_bytes,omitempty"`
+	Overhead        float64    `json:"overhead"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	Throughput      float64    `json:"throughput"` // payload bytes per second
+}
+
+// jsonReport gathers the result of a -json run. A nil jsonReport gathers
+// nothing.
+type jsonReport struct {
+	w     io.Writer
+	mu    sync.Mutex
+	res   jsonResult
+	tally *resultTally
+	start time.Time
+}
+
+// jsonOut is the report of the running command, nil without -json.
+var jsonOut *jsonReport
+
+// startJSON makes stdout a stream of JSON for command: events logged at
+// level and above go there, and everything else printed to stdout goes to
+// stderr.
+func startJSON(command string, level slog.Level) *jsonReport {
+	r := &jsonReport{w: os.Stdout, res: jsonResult{Type: "result", Command: command, Files: []jsonFile{}}, start: time.Now()}
+	h := slog.NewJSONHandler(r.w, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(h.WithAttrs([]slog.Attr{slog.String("type", "event")})))
+	os.Stdout = os.Stderr
+	return r
+}
+
+// counts has the report take the run's totals from t, for a run started
+// at start.
+func (r *jsonReport) counts(t *resultTally, start time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tally, r.start = t, start
+}
+
+// file records input, written to output, taking start until now. hashed is
+// the file holding the data, to give its size and SHA-256, or "" for none.
+func (r *jsonReport) file(input, output, hashed string, start time.Time, err error) {
+	if r == nil {
+		return
+	}
+	f := jsonFile{Input: input, Output: output, DurationSeconds: time.Since(start).Seconds()}
+	if err != nil {
+		f.Error = err.Error()
+	} else if hashed != "" {
+		if info, serr := os.Stat(hashed); serr == nil && info.Mode().IsRegular() {
+			f.Size = info.Size()
+			f.SHA256, _ = hashFile(hashed)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.res.Files = append(r.res.Files, f)
+}
+
+// uploaded records what stageBackends uploaded.
+func (r *jsonReport) uploaded(locations []string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.res.Uploaded = append(r.res.Uploaded, locations...)
+}
+
+// finish writes the result object, failed with err if it is not nil. The
+// run failed too if any of its files did.
+func (r *jsonReport) finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := r.res
+	res.OK = err == nil
+	if err != nil {
+		res.Error = err.Error()
+	}
+	for _, f := range res.Files {
+		if f.Error != "" {
+			res.OK = false
+		}
+	}
+	if r.tally != nil {
+		t := r.tally.result(r.start)
+		res.Frames, res.PayloadBytes, res.FrameBytes, res.ParityBytes = t.Frames, t.PayloadBytes, t.FrameBytes, t.ParityBytes
+		res.Overhead, res.Throughput = t.Overhead, t.Throughput
+	}
+	res.DurationSeconds = time.Since(r.start).Seconds()
+	if werr := json.NewEncoder(r.w).Encode(res); werr != nil {
+		fmt.Fprintf(os.Stderr, "Writing the result failed: %v\n", werr)
+	}
+}
+
+// fatalf ends the command with the error format describes, logged as an
+// error and, with -json, given in a failed result object.
+func fatalf(format string, args ...any) {
+	err := fmt.Errorf(format, args...)
+	slog.Error(err.Error())
+	if jsonOut != nil {
+		jsonOut.finish(err)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,506 @@
+package f2v
+
+import (
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// frameMode selects how payload bytes are mapped onto the pixels of a frame.
+type frameMode int
+
+const (
+	// modeRaw stores one byte in each BGR channel of every pixel. It has the
+	// highest density but only survives lossless codecs such as FFV1.
+	modeRaw frameMode = iota
+	// modeBlock quantizes a few bits per channel into solid square blocks so
+	// the data survives lossy re-encoding by hosting platforms.
+	modeBlock
+	// modeDCT carries bits in the signs of low-frequency DCT coefficients of
+	// 8x8 luma blocks, the domain lossy encoders quantize in, so it survives
+	// much heavier compression than either spatial mode.
+	modeDCT
+	// modeBarcode paints eight-color cells with in-frame palette references
+	// and Reed-Solomon error correction, between block mode's density and
+	// the robustness of a QR code.
+	modeBarcode
+	// modeLSB replaces the low bits of every channel of a cover video's
+	// pixels, which is invisible to the eye but like raw mode only survives
+	// lossless codecs.
+	modeLSB
+)
+
+func (m frameMode) String() string {
+	switch m {
+	case modeRaw:
+		return "raw"
+	case modeBlock:
+		return "block"
+	case modeDCT:
+		return "dct"
+	case modeBarcode:
+		return "barcode"
+	case modeLSB:
+		return "lsb"
+	}
+	return fmt.Sprintf("frameMode(%d)", int(m))
+}
+
+func parseFrameMode(name string) (frameMode, error) {
+	switch strings.ToLower(name) {
+	case "raw":
+		return modeRaw, nil
+	case "block":
+		return modeBlock, nil
+	case "dct":
+		return modeDCT, nil
+	case "barcode":
+		return modeBarcode, nil
+	case "lsb":
+		return modeLSB, nil
+	}
+	return 0, fmt.Errorf("unknown frame mode %q", name)
+}
+
+// hasMarkers reports whether frames of the mode carry sync markers: all but
+// raw and lsb, which only survive codecs that keep every pixel in place.
+func (m frameMode) hasMarkers() bool {
+	return m != modeRaw && m != modeLSB
+}
+
+// markerSize is the edge length in pixels of the sync markers drawn in the
+// corners of every frame when markers are enabled.
+const markerSize = 16
+
+// layout describes how payload bytes are arranged inside a frame.
+type layout struct {
+	width, height  int
+	mode           frameMode
+	blockSize      int          // edge length of a block in pixels (block and barcode mode)
+	bitsPerChannel int          // bits carried by each channel of a block (block mode) or pixel (lsb mode)
+	coefficients   int          // DCT coefficients carrying one bit each per block (dct mode)
+	markers        bool         // reserve top and bottom bands for corner sync markers
+	cover          string       // video to embed dct frames in instead of gray, when encoding
+	cold           bool         // scrub identifying metadata from written videos
+	codec          string       // fourcc of the codec written videos use, "" to pick it by file extension
+	backend        CodecBackend // writes and reads the videos, nil for OpenCV
+	logger         *slog.Logger // told what encodes and decodes do, nil for slog.Default()
+	pool           *framePool   // reuses frame buffers and Mats from video to video, nil for none
+	tally          *resultTally // counts what the run writes and reads, nil for nothing
+	part, parts    int          // of a split encode, stamped on every frame written; parts is 0 otherwise
+}
+
+// writtenLike returns c with the settings of l that are about the videos
+// written rather than how frames lay out data.
+func (l layout) writtenLike(c layout) layout {
+	c.cold, c.codec, c.backend, c.logger, c.pool, c.tally = l.cold, l.codec, l.backend, l.logger, l.pool, l.tally
+	return c
+}
+
+// defaultFPS is the frame rate videos are written at unless told otherwise.
+const defaultFPS = 30
+
+// defaultLayout is the layout frames are written and read with unless told
+// otherwise.
+func defaultLayout() layout {
+	return layout{width: 640, height: 480, mode: modeRaw, blockSize: 4, bitsPerChannel: 2, coefficients: 6}
+}
+
+// parseResolution parses a frame size given as WxH, such as 1280x720.
+func parseResolution(s string) (int, int, error) {
+	w, h, ok := strings.Cut(strings.ToLower(s), "x")
+	width, werr := strconv.Atoi(w)
+	height, herr := strconv.Atoi(h)
+	if !ok || werr != nil || herr != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid resolution %q; use WxH, such as 1280x720", s)
+	}
+	return width, height, nil
+}
+
+func (l layout) validate() error {
+	if l.width <= 0 || l.height <= 0 {
+		return fmt.Errorf("invalid frame size %dx%d", l.width, l.height)
+	}
+	if l.mode == modeBlock || l.mode == modeBarcode {
+		if l.blockSize < 1 || l.blockSize > l.width || l.blockSize > l.height {
+			return fmt.Errorf("block size %d does not fit a %dx%d frame", l.blockSize, l.width, l.height)
+		}
+	}
+	if l.mode == modeBlock || l.mode == modeLSB {
+		if l.bitsPerChannel < 1 || l.bitsPerChannel > 4 {
+			return fmt.Errorf("bits per channel must be between 1 and 4, got %d", l.bitsPerChannel)
+		}
+	}
+	if l.mode == modeDCT && (l.coefficients < 1 || l.coefficients > len(dctPositions)) {
+		return fmt.Errorf("DCT coefficients per block must be between 1 and %d, got %d", len(dctPositions), l.coefficients)
+	}
+	if l.markers && (l.width < 2*markerSize || l.dataRows() < l.cell()) {
+		return fmt.Errorf("a %dx%d frame is too small for sync markers", l.width, l.height)
+	}
+	if l.capacity() <= frameHeaderSize {
+		return fmt.Errorf("a %dx%d frame is too small to hold any data", l.width, l.height)
+	}
+	if (l.mode == modeRaw || l.mode == modeLSB) && l.codec != "" && l.codec != "FFV1" {
+		return fmt.Errorf("%s mode needs a lossless codec such as ffv1", l.mode)
+	}
+	return nil
+}
+
+// describe names the mode and its density settings, e.g. "block 4, 2 bits".
+func (l layout) describe() string {
+	switch l.mode {
+	case modeBlock:
+		return fmt.Sprintf("block %d, %d bits", l.blockSize, l.bitsPerChannel)
+	case modeDCT:
+		return fmt.Sprintf("dct, %d coefficients", l.coefficients)
+	case modeBarcode:
+		return fmt.Sprintf("barcode %d", l.blockSize)
+	case modeLSB:
+		return fmt.Sprintf("lsb, %d bits", l.bitsPerChannel)
+	}
+	return l.mode.String()
+}
+
+// cell returns the edge length of the squares data is laid out in: the block
+// size in block and barcode mode, the 8x8 transform block in dct mode and
+// single pixels in raw mode.
+func (l layout) cell() int {
+	switch l.mode {
+	case modeBlock, modeBarcode:
+		return l.blockSize
+	case modeDCT:
+		return dctSize
+	}
+	return 1
+}
+
+// band returns the height of the reserved bands at the top and bottom of the
+// frame, which hold the sync markers, rounded up to whole cells.
+func (l layout) band() int {
+	if !l.markers {
+		return 0
+	}
+	return (markerSize + l.cell() - 1) / l.cell() * l.cell()
+}
+
+// dataRows returns the number of pixel rows between the marker bands.
+func (l layout) dataRows() int {
+	return l.height - 2*l.band()
+}
+
+// levels returns the number of distinct values a block channel can take.
+func (l layout) levels() int {
+	return 1 << l.bitsPerChannel
+}
+
+func (l layout) blocksX() int { return l.width / l.cell() }
+func (l layout) blocksY() int { return l.dataRows() / l.cell() }
+
+// dataBytes is how many data bytes a frame written in l holds after its
+// header.
+func (l layout) dataBytes() int {
+	if l.parts > 0 {
+		return l.capacity() - frameHeaderSize - framePartSize
+	}
+	return l.capacity() - frameHeaderSize
+}
+
+// capacity returns the number of payload bytes a single frame can carry.
+func (l layout) capacity() int {
+	switch l.mode {
+	case modeBlock:
+		return l.blocksX() * l.blocksY() * 3 * l.bitsPerChannel / 8
+	case modeDCT:
+		return l.blocksX() * l.blocksY() * l.coefficients / 8
+	case modeBarcode:
+		return l.barcodeCapacity()
+	case modeLSB:
+		return l.width * l.dataRows() * 3 * l.bitsPerChannel / 8
+	}
+	return l.width * l.dataRows() * 3
+}
+
+// pack writes exactly capacity() payload bytes into BGR frame data.
+func (l layout) pack(frameData, payload []byte) {
+	switch l.mode {
+	case modeDCT:
+		if l.cover != "" {
+			l.embedDCT(frameData, payload)
+			return
+		}
+		l.packDCT(frameData, payload)
+		return
+	case modeBarcode:
+		l.packBarcode(frameData, payload)
+		return
+	case modeLSB:
+		l.packLSB(frameData, payload)
+		return
+	}
+	top := l.band() * l.width * 3
+	if l.mode != modeBlock {
+		clear(frameData[:top])
+		copy(frameData[top:], payload)
+		clear(frameData[top+len(payload):])
+		l.drawMarkers(frameData)
+		return
+	}
+
+	// Pixels outside the block grid carry no data
+	clear(frameData)
+	defer l.drawMarkers(frameData)
+
+	br := bitReader{data: payload}
+	maxLevel := l.levels() - 1
+	var values [3]byte
+	for by := 0; by < l.blocksY(); by++ {
+		for bx := 0; bx < l.blocksX(); bx++ {
+			for c := 0; c < 3; c++ {
+				symbol := br.read(l.bitsPerChannel)
+				values[c] = byte(symbol * 255 / maxLevel)
+			}
+			for y := l.band() + by*l.blockSize; y < l.band()+(by+1)*l.blockSize; y++ {
+				row := y * l.width * 3
+				for x := bx * l.blockSize; x < (bx+1)*l.blockSize; x++ {
+					offset := row + x*3
+					frameData[offset] = values[0]   // Blue
+					frameData[offset+1] = values[1] // Green
+					frameData[offset+2] = values[2] // Red
+				}
+			}
+		}
+	}
+}
+
+// unpack recovers the payload bytes stored in BGR frame data by pack.
+func (l layout) unpack(frameData []byte) []byte {
+	switch l.mode {
+	case modeDCT:
+		return l.unpackDCT(frameData)
+	case modeBarcode:
+		return l.unpackBarcode(frameData)
+	case modeLSB:
+		return l.unpackLSB(frameData)
+	}
+	if l.mode != modeBlock {
+		out := make([]byte, l.capacity())
+		copy(out, frameData[l.band()*l.width*3:])
+		return out
+	}
+
+	samples := l.sampleBlocks(frameData)
+
+	// Cutoffs are derived from this frame's own level distribution, one
+	// channel at a time, so brightness or contrast drift introduced by a
+	// re-encode shifts the thresholds along with the data.
+	var thresholds [3][]float64
+	for c := 0; c < 3; c++ {
+		var hist [256]int
+		for i := c; i < len(samples); i += 3 {
+			hist[samples[i]]++
+		}
+		thresholds[c] = adaptiveThresholds(&hist, l.levels())
+	}
+
+	bw := bitWriter{data: make([]byte, 0, l.capacity())}
+	for i, v := range samples {
+		symbol := 0
+		for _, t := range thresholds[i%3] {
+			if float64(v) > t {
+				symbol++
+			}
+		}
+		bw.write(symbol, l.bitsPerChannel)
+	}
+	return bw.data[:l.capacity()]
+}
+
+// sampleBlocks averages the centre of every block, per channel, ignoring the
+// edges where chroma subsampling and ringing from neighbouring blocks bleed in.
+// The result holds three values (B, G, R) per block in grid order.
+func (l layout) sampleBlocks(frameData []byte) []byte {
+	inset := l.blockSize / 4
+	samples := make([]byte, 0, l.blocksX()*l.blocksY()*3)
+	for by := 0; by < l.blocksY(); by++ {
+		for bx := 0; bx < l.blocksX(); bx++ {
+			var sums [3]int
+			count := 0
+			for y := l.band() + by*l.blockSize + inset; y < l.band()+(by+1)*l.blockSize-inset; y++ {
+				row := y * l.width * 3
+				for x := bx*l.blockSize + inset; x < (bx+1)*l.blockSize-inset; x++ {
+					offset := row + x*3
+					sums[0] += int(frameData[offset])
+					sums[1] += int(frameData[offset+1])
+					sums[2] += int(frameData[offset+2])
+					count++
+				}
+			}
+			for c := 0; c < 3; c++ {
+				samples = append(samples, byte((sums[c]+count/2)/count))
+			}
+		}
+	}
+	return samples
+}
+
+// markerPattern returns the markerSize x markerSize grayscale sync marker: a
+// bullseye of alternating 2-pixel rings starting with a white quiet zone, so
+// it stands out against the black bands around it.
+func markerPattern() []byte {
+	pattern := make([]byte, markerSize*markerSize)
+	modules := markerSize / 2
+	for y := 0; y < markerSize; y++ {
+		for x := 0; x < markerSize; x++ {
+			i, j := y/2, x/2
+			ring := min(i, j, modules-1-i, modules-1-j)
+			if ring%2 == 0 {
+				pattern[y*markerSize+x] = 255
+			}
+		}
+	}
+	return pattern
+}
+
+// markerOrigins returns the top-left corner of each sync marker in
+// top-left, top-right, bottom-left, bottom-right order.
+func (l layout) markerOrigins() [4]image.Point {
+	return [4]image.Point{
+		image.Pt(0, 0),
+		image.Pt(l.width-markerSize, 0),
+		image.Pt(0, l.height-markerSize),
+		image.Pt(l.width-markerSize, l.height-markerSize),
+	}
+}
+
+// drawMarkers draws the sync markers and the probe strip between them.
+func (l layout) drawMarkers(frameData []byte) {
+	if !l.markers {
+		return
+	}
+	defer l.drawProbe(frameData)
+	pattern := markerPattern()
+	for _, origin := range l.markerOrigins() {
+		for y := 0; y < markerSize; y++ {
+			row := (origin.Y + y) * l.width * 3
+			for x := 0; x < markerSize; x++ {
+				v := pattern[y*markerSize+x]
+				offset := row + (origin.X+x)*3
+				frameData[offset], frameData[offset+1], frameData[offset+2] = v, v, v
+			}
+		}
+	}
+}
+
+// adaptiveThresholds clusters the observed values of one channel into n
+// levels with a 1-D k-means and returns the n-1 cutoffs halfway between
+// neighbouring cluster centres. The centres are seeded evenly across the
+// observed range so that a compressed or shifted range still maps every level
+// to its own cluster; frames with too little spread to tell (mostly padding)
+// fall back to the nominal levels.
+func adaptiveThresholds(hist *[256]int, n int) []float64 {
+	lo, hi := 0.0, 255.0
+	if l, h := histPercentile(hist, 0.005), histPercentile(hist, 0.995); h-l >= 128 {
+		lo, hi = float64(l), float64(h)
+	}
+	centers := make([]float64, n)
+	for i := range centers {
+		centers[i] = lo + float64(i)*(hi-lo)/float64(n-1)
+	}
+
+	sums := make([]float64, n)
+	counts := make([]int, n)
+	for iter := 0; iter < 16; iter++ {
+		clear(sums)
+		clear(counts)
+		for v, count := range hist {
+			if count == 0 {
+				continue
+			}
+			nearest := 0
+			for i := 1; i < n; i++ {
+				if math.Abs(float64(v)-centers[i]) < math.Abs(float64(v)-centers[nearest]) {
+					nearest = i
+				}
+			}
+			sums[nearest] += float64(v * count)
+			counts[nearest] += count
+		}
+
+		moved := false
+		for i := range centers {
+			if counts[i] == 0 {
+				continue
+			}
+			if c := sums[i] / float64(counts[i]); c != centers[i] {
+				centers[i] = c
+				moved = true
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+
+	thresholds := make([]float64, n-1)
+	for i := range thresholds {
+		thresholds[i] = (centers[i] + centers[i+1]) / 2
+	}
+	return thresholds
+}
+
+// histPercentile returns the smallest value below which at least the given
+// fraction of the histogram's samples fall.
+func histPercentile(hist *[256]int, fraction float64) int {
+	total := 0
+	for _, count := range hist {
+		total += count
+	}
+	target := int(math.Ceil(fraction * float64(total)))
+	seen := 0
+	for v, count := range hist {
+		seen += count
+		if seen >= target && seen > 0 {
+			return v
+		}
+	}
+	return 255
+}
+
+// bitReader reads MSB-first groups of bits from a byte slice, returning
+// zeros once the data is exhausted.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (r *bitReader) read(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		bit := 0
+		if idx := r.pos / 8; idx < len(r.data) {
+			bit = int(r.data[idx]>>(7-r.pos%8)) & 1
+		}
+		v = v<<1 | bit
+		r.pos++
+	}
+	return v
+}
+
+// bitWriter appends MSB-first groups of bits to a byte slice.
+type bitWriter struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (w *bitWriter) write(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte((v>>i)&1) << (7 - w.pos%8)
+		w.pos++
+	}
+}
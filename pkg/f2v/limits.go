@@ -0,0 +1,93 @@
+package f2v
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+)
+
+// Everything read from a video is untrusted: the server decodes whatever
+// it is sent, and a damaged or crafted video can hold any bytes at all.
+// Parsers check every length against what is actually there before using
+// it, allocate by what they have read rather than by what a header claims,
+// and report bad input as a formatError rather than panicking.
+
+const (
+	// maxEBMLElement bounds a Matroska element read into memory: a
+	// Tracks element or a block group, frame data included.
+	maxEBMLElement = 64 << 20
+	// maxSeqJump is how far past the expected frame a sequence number may
+	// be for the frames in between to count as lost; further than that,
+	// a frame that passes its checksum is taken to be garbage.
+	maxSeqJump = 1 << 24
+)
+
+// Errors are wrapped on their way out, so callers of the package can tell
+// failures apart with errors.Is whatever was added to the message.
+var (
+	// ErrCorruptFrame is what bad input is: a frame, or a table, header,
+	// descriptor or directory read from the frames, that is malformed or
+	// does not fit the rest of the video.
+	ErrCorruptFrame = errors.New("corrupt frame")
+	// ErrUnsupportedVersion is input in a format version this build does
+	// not read, most likely written by a newer one.
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	// ErrChecksumMismatch is data that fails its check: a frame's CRC, an
+	// integrity tag, the hash of a file or part, or the authentication of
+	// encrypted data, which also fails with the wrong key.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrCodecUnavailable is a video that cannot be written for want of a
+	// codec, in OpenCV's build or as ffmpeg on the PATH.
+	ErrCodecUnavailable = errors.New("codec unavailable")
+)
+
+// formatError reports input that is not what it claims to be: a frame,
+// table, descriptor, header or container that is malformed or does not fit
+// the rest of the video, in a version not supported, or failing its check.
+type formatError struct {
+	kind error // ErrCorruptFrame, ErrUnsupportedVersion or ErrChecksumMismatch
+	msg  string
+}
+
+func (e *formatError) Error() string {
+	return e.msg
+}
+
+func (e *formatError) Unwrap() error {
+	return e.kind
+}
+
+// malformed returns a formatError with a message formatted as by
+// fmt.Sprintf.
+func malformed(format string, args ...any) error {
+	return &formatError{kind: ErrCorruptFrame, msg: fmt.Sprintf(format, args...)}
+}
+
+// unsupported is malformed for input in a version not supported.
+func unsupported(format string, args ...any) error {
+	return &formatError{kind: ErrUnsupportedVersion, msg: fmt.Sprintf(format, args...)}
+}
+
+// mismatched is malformed for data that fails its checksum, hash or tag.
+func mismatched(format string, args ...any) error {
+	return &formatError{kind: ErrChecksumMismatch, msg: fmt.Sprintf(format, args...)}
+}
+
+// isMalformed reports whether err, or an error it wraps, is a formatError.
+func isMalformed(err error) bool {
+	var f *formatError
+	return errors.As(err, &f)
+}
+
+// safely runs fn, turning a panic into an error, so that in server mode a
+// bug one input triggers fails that request or job instead of the server.
+func safely(fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("Recovered from a panic", "panic", p, "stack", string(debug.Stack()))
+			err = fmt.Errorf("internal error: %v", p)
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,283 @@
+package f2v
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// locate finds where the video of a catalog entry was uploaded when the
+// catalog no longer says: it searches a host for uploads whose title,
+// description or tags hold the entry's video hash, which the descriptions
+// of uploads name (see uploadmeta.go), and records them as the entry's
+// URLs. Every part of a split encode names the hash of its -manifest video,
+// so locating the manifest finds the whole archive; the parts found along
+// the way that have entries of their own get their upload recorded there
+// too.
+
+// A Finder is a Source that can search what was uploaded to it by what the
+// uploads say of themselves.
+type Finder interface {
+	// Find returns the uploads under prefix whose title, description or
+	// tags hold text.
+	Find(ctx context.Context, prefix, text string) ([]FoundUpload, error)
+}
+
+// FoundUpload is an upload a Finder found, by its location and as it is
+// described.
+type FoundUpload struct {
+	Location string
+	UploadMetadata
+}
+
+// mentions reports whether the upload's title, description or tags hold
+// text.
+func (f FoundUpload) mentions(text string) bool {
+	return text != "" && (strings.Contains(f.Title, text) || strings.Contains(f.Description, text) ||
+		slices.ContainsFunc(f.Tags, func(tag string) bool { return strings.Contains(tag, text) }))
+}
+
+// lookup returns the entry ref names: its video, as find takes it, or its
+// video hash or a prefix of at least 8 characters that only it has.
+func (c *catalog) lookup(ref string) (int, error) {
+	if i := c.find(ref); i >= 0 {
+		return i, nil
+	}
+	found := -1
+	if len(ref) >= 8 {
+		for i, e := range c.Entries {
+			if !strings.HasPrefix(e.VideoHash, strings.ToLower(ref)) {
+				continue
+			}
+			if found >= 0 && c.Entries[found].VideoHash != e.VideoHash {
+				return 0, fmt.Errorf("%s is the start of more than one video hash", ref)
+			}
+			found = i
+		}
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("no entry of %s is for the video %s", c.path, ref)
+	}
+	return found, nil
+}
+
+// locate searches the uploads under prefix of f for those of the entry i,
+// records them as its URLs and those of the entries of any parts found,
+// and returns them. The caller saves the catalog.
+func (c *catalog) locate(ctx context.Context, i int, f Finder, prefix string) ([]string, error) {
+	sum := c.Entries[i].VideoHash
+	found, err := f.Find(ctx, prefix, sum)
+	if err != nil {
+		return nil, err
+	}
+	// Hosts search loosely; only uploads that do name the hash count
+	found = slices.DeleteFunc(found, func(u FoundUpload) bool { return !u.mentions(sum) })
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no upload mentions %s", sum)
+	}
+	var urls []string
+	for _, u := range found {
+		urls = append(urls, u.Location)
+	}
+	slices.Sort(urls)
+	c.Entries[i].URLs = slices.Compact(urls)
+	for j := range c.Entries {
+		e := &c.Entries[j]
+		if j == i || e.VideoHash == sum {
+			continue
+		}
+		for _, u := range found {
+			if u.mentions(e.VideoHash) && !slices.Contains(e.URLs, u.Location) {
+				e.URLs = append(e.URLs, u.Location)
+			}
+		}
+		slices.Sort(e.URLs)
+	}
+	return c.Entries[i].URLs, nil
+}
+
+// runLocate locates the uploads under where of the entry of c that ref
+// names, saves what it found in c and returns it.
+func runLocate(ctx context.Context, c *catalog, ref, where string) ([]string, error) {
+	i, err := c.lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+	src, prefix, err := SourceFor(where)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := src.(Finder)
+	if !ok {
+		return nil, fmt.Errorf("searching %s: %w", where, errors.ErrUnsupported)
+	}
+	urls, err := c.locate(ctx, i, f, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", where, err)
+	}
+	return urls, c.save()
+}
+
+// Find lists the objects under prefix and returns those whose metadata,
+// as CreateDescribed stores it, holds text. Every object is asked for its
+// metadata in turn, so a prefix narrowing the search down saves time.
+func (s *S3) Find(ctx context.Context, prefix, text string) ([]FoundUpload, error) {
+	keys, err := s.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var found []FoundUpload
+	for _, key := range keys {
+		resp, err := s.do(ctx, http.MethodHead, key, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		u := FoundUpload{Location: "s3://" + s.Bucket + "/" + key, UploadMetadata: s.readMetadata(resp.Header)}
+		if u.mentions(text) {
+			found = append(found, u)
+		}
+	}
+	return found, nil
+}
+
+// readMetadata undoes metadataHeader.
+func (s *S3) readMetadata(h http.Header) UploadMetadata {
+	var d mime.WordDecoder
+	get := func(name string) string {
+		v := h.Get(name)
+		if decoded, err := d.DecodeHeader(v); err == nil {
+			v = decoded
+		}
+		return v
+	}
+	if s.isArchiveOrg() {
+		get = func(name string) string {
+			v := h.Get(name)
+			if inner, ok := strings.CutPrefix(v, "uri("); ok && strings.HasSuffix(inner, ")") {
+				if unescaped, err := url.PathUnescape(strings.TrimSuffix(inner, ")")); err == nil {
+					v = unescaped
+				}
+			}
+			return v
+		}
+		m := UploadMetadata{Title: get("X-Archive-Meta-Title"), Description: get("X-Archive-Meta-Description")}
+		for i := 1; h.Get(fmt.Sprintf("X-Archive-Meta%02d-Subject", i)) != ""; i++ {
+			m.Tags = append(m.Tags, get(fmt.Sprintf("X-Archive-Meta%02d-Subject", i)))
+		}
+		return m
+	}
+	m := UploadMetadata{Title: get("X-Amz-Meta-Title"), Description: get("X-Amz-Meta-Description"), Visibility: get("X-Amz-Meta-Visibility")}
+	if tags := get("X-Amz-Meta-Tags"); tags != "" {
+		m.Tags = strings.Split(tags, ",")
+	}
+	return m
+}
+
+// Find runs f2v-Name find with prefix and text, which writes a JSON object
+// a line for every upload it finds, with its "location", "title",
+// "description" and "tags".
+func (p Plugin) Find(ctx context.Context, prefix, text string) ([]FoundUpload, error) {
+	out, err := p.command(ctx, "find", prefix, text).Output()
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s failed to search %s: %w", p.Name, prefix, err)
+	}
+	var found []FoundUpload
+	lines := bufio.NewScanner(strings.NewReader(string(out)))
+	lines.Buffer(nil, 1<<20)
+	for lines.Scan() {
+		if strings.TrimSpace(lines.Text()) == "" {
+			continue
+		}
+		var u struct {
+			Location    string   `json:"location"`
+			Title       string   `json:"title"`
+			Description string   `json:"description"`
+			Tags        []string `json:"tags"`
+		}
+		if err := json.Unmarshal(lines.Bytes(), &u); err != nil {
+			return nil, fmt.Errorf("plugin %s found %q: %w", p.Name, lines.Text(), err)
+		}
+		found = append(found, FoundUpload{Location: u.Location, UploadMetadata: UploadMetadata{Title: u.Title, Description: u.Description, Tags: u.Tags}})
+	}
+	return found, lines.Err()
+}
+
+// youtubeAPI is where the YouTube Data API is.
+const youtubeAPI = "https://www.googleapis.com/youtube/v3/"
+
+// Find goes through the uploads of the channel Token is for, whatever the
+// prefix, and returns those whose title or description holds text.
+func (y YouTube) Find(ctx context.Context, prefix, text string) ([]FoundUpload, error) {
+	if y.Token == "" {
+		return nil, fmt.Errorf("searching YouTube needs an OAuth access token for the channel in F2V_YOUTUBE_TOKEN")
+	}
+	h := HTTP{Client: y.Client, Header: http.Header{"Authorization": {"Bearer " + y.Token}}}
+	var channels struct {
+		Items []struct {
+			ContentDetails struct {
+				RelatedPlaylists struct {
+					Uploads string `json:"uploads"`
+				} `json:"relatedPlaylists"`
+			} `json:"contentDetails"`
+		} `json:"items"`
+	}
+	if err := h.getJSON(ctx, youtubeAPI+"channels?part=contentDetails&mine=true", &channels); err != nil {
+		return nil, err
+	}
+	if len(channels.Items) == 0 {
+		return nil, fmt.Errorf("the YouTube token is for no channel")
+	}
+	query := url.Values{"part": {"snippet"}, "maxResults": {"50"}, "playlistId": {channels.Items[0].ContentDetails.RelatedPlaylists.Uploads}}
+	var found []FoundUpload
+	for {
+		var page struct {
+			Items []struct {
+				Snippet struct {
+					Title       string `json:"title"`
+					Description string `json:"description"`
+					ResourceID  struct {
+						VideoID string `json:"videoId"`
+					} `json:"resourceId"`
+				} `json:"snippet"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := h.getJSON(ctx, youtubeAPI+"playlistItems?"+query.Encode(), &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			u := FoundUpload{
+				Location:       "https://www.youtube.com/watch?v=" + item.Snippet.ResourceID.VideoID,
+				UploadMetadata: UploadMetadata{Title: item.Snippet.Title, Description: item.Snippet.Description},
+			}
+			if u.mentions(text) {
+				found = append(found, u)
+			}
+		}
+		if page.NextPageToken == "" {
+			return found, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// getJSON decodes the JSON at the URL name into v.
+func (h HTTP) getJSON(ctx context.Context, name string, v any) error {
+	resp, err := h.do(ctx, http.MethodGet, name, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package f2v
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeFinder finds what it holds, however loosely it matches.
+type fakeFinder []FoundUpload
+
+func (f fakeFinder) Find(ctx context.Context, prefix, text string) ([]FoundUpload, error) {
+	return f, nil
+}
+
+func hashOf(c byte) string { return strings.Repeat(string(c), 64) }
+
+func TestLocateRecordsArchiveUploads(t *testing.T) {
+	manifest, part1, part2, other := hashOf('a'), hashOf('b'), hashOf('c'), hashOf('d')
+	c := &catalog{path: filepath.Join(t.TempDir(), "catalog.json"), Entries: []catalogEntry{
+		{Video: "disk.img.part1of2.mkv", VideoHash: part1},
+		{Video: "disk.img.part2of2.mkv", VideoHash: part2},
+		{Video: "disk.img.manifest.mkv", VideoHash: manifest, URLs: []string{"https://gone.example.com/disk.img.manifest.mkv"}},
+		{Video: "notes.txt.mkv", VideoHash: other},
+	}}
+	describe := func(own string) string {
+		return fmt.Sprintf("f2v video, SHA-256 %s, manifest SHA-256 %s", own, manifest)
+	}
+	f := fakeFinder{
+		{Location: "s3://b/disk.img.manifest.mkv", UploadMetadata: UploadMetadata{Description: describe(manifest)}},
+		{Location: "s3://b/disk.img.part1of2.mkv", UploadMetadata: UploadMetadata{Description: describe(part1)}},
+		{Location: "s3://b/disk.img.part2of2.mkv", UploadMetadata: UploadMetadata{Tags: []string{manifest}, Description: "SHA-256 " + part2}},
+		{Location: "s3://b/notes.txt.mkv", UploadMetadata: UploadMetadata{Title: other}},
+	}
+
+	i, err := c.lookup(filepath.Join(filepath.Dir(c.path), "disk.img.manifest.mkv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, err := c.locate(context.Background(), i, f, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"s3://b/disk.img.manifest.mkv", "s3://b/disk.img.part1of2.mkv", "s3://b/disk.img.part2of2.mkv"}; !slices.Equal(urls, want) {
+		t.Errorf("found %q, want %q", urls, want)
+	}
+	if !slices.Equal(c.Entries[2].URLs, urls) {
+		t.Errorf("the manifest's entry records %q", c.Entries[2].URLs)
+	}
+	if want := []string{"s3://b/disk.img.part1of2.mkv"}; !slices.Equal(c.Entries[0].URLs, want) {
+		t.Errorf("part 1 records %q, want %q", c.Entries[0].URLs, want)
+	}
+	if c.Entries[3].URLs != nil {
+		t.Errorf("an unrelated entry records %q", c.Entries[3].URLs)
+	}
+
+	if _, err := c.locate(context.Background(), 3, fakeFinder{f[0]}, ""); err == nil {
+		t.Error("located a video no upload mentions")
+	}
+}
+
+func TestCatalogLookup(t *testing.T) {
+	c := &catalog{path: "catalog.json", Entries: []catalogEntry{
+		{Video: "a.mkv", VideoHash: "0123456789" + hashOf('a')[10:]},
+		{Video: "b.mkv", VideoHash: "0123456799" + hashOf('b')[10:]},
+	}}
+	for ref, want := range map[string]int{"b.mkv": 1, "012345678": 0, "0123456799": 1, "01234567": -1, "0123": -1, "nowhere.mkv": -1} {
+		i, err := c.lookup(ref)
+		if want < 0 && err == nil {
+			t.Errorf("%s names entry %d", ref, i)
+		} else if want >= 0 && (err != nil || i != want) {
+			t.Errorf("%s names entry %d, %v; want %d", ref, i, err, want)
+		}
+	}
+}
+
+func TestS3Find(t *testing.T) {
+	s := &S3{Bucket: "b", Endpoint: "https://s3.example.com", Client: &http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+		resp := okResponse(r)
+		switch {
+		case r.Method == http.MethodGet:
+			resp.Body = readCloser(`<ListBucketResult><Contents><Key>v/a.mkv</Key></Contents><Contents><Key>v/b.mkv</Key></Contents></ListBucketResult>`)
+		case strings.HasSuffix(r.URL.Path, "/a.mkv"):
+			resp.Header.Set("X-Amz-Meta-Title", "=?utf-8?q?Backup_=E2=80=93_a.mkv?=")
+			resp.Header.Set("X-Amz-Meta-Description", "SHA-256 "+hashOf('a'))
+			resp.Header.Set("X-Amz-Meta-Tags", "f2v,nightly")
+		}
+		return resp, nil
+	})}}
+	found, err := s.Find(context.Background(), "v/", hashOf('a'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Location != "s3://b/v/a.mkv" || found[0].Title != "Backup – a.mkv" || !slices.Equal(found[0].Tags, []string{"f2v", "nightly"}) {
+		t.Errorf("found %+v", found)
+	}
+}
+
+func TestYouTubeFind(t *testing.T) {
+	var auth []string
+	y := YouTube{Token: "tok", Client: &http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		resp := okResponse(r)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/channels"):
+			resp.Body = readCloser(`{"items": [{"contentDetails": {"relatedPlaylists": {"uploads": "UU1"}}}]}`)
+		case r.URL.Query().Get("pageToken") == "":
+			resp.Body = readCloser(`{"items": [{"snippet": {"title": "holiday", "resourceId": {"videoId": "v1"}}}], "nextPageToken": "p2"}`)
+		default:
+			resp.Body = readCloser(`{"items": [{"snippet": {"title": "part", "description": "SHA-256 ` + hashOf('e') + `", "resourceId": {"videoId": "v2"}}}]}`)
+		}
+		return resp, nil
+	})}}
+	found, err := y.Find(context.Background(), "", hashOf('e'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Location != "https://www.youtube.com/watch?v=v2" {
+		t.Errorf("found %+v", found)
+	}
+	if len(auth) != 3 || auth[0] != "Bearer tok" {
+		t.Errorf("sent %q", auth)
+	}
+	if _, err := (YouTube{}).Find(context.Background(), "", "x"); err == nil {
+		t.Error("searched YouTube without a token")
+	}
+}
@@ -0,0 +1,68 @@
+package f2v
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Encodes and decodes tell what they do as structured events on a
+// slog.Logger: Info for what they did, such as the files of a folder encoded,
+// Warn for what they worked around, such as a frame skipped or a download
+// retried, and Debug for every frame written or read and every chunk
+// checked. Encoder.Logger and Decoder.Logger pick the logger; without one,
+// and in the command line tool, events go to slog.Default().
+
+// log returns the logger the encodes and decodes of l tell what they do.
+func (l layout) log() *slog.Logger {
+	if l.logger == nil {
+		return slog.Default()
+	}
+	return l.logger
+}
+
+// log returns the logger of the encode.
+func (opts encodeOptions) log() *slog.Logger {
+	return opts.layout.log()
+}
+
+// log returns the logger of the decode.
+func (opts decodeOptions) log() *slog.Logger {
+	return opts.layout.log()
+}
+
+// The command line tool logs at the level -q, -v and -vv pick: with -q only
+// errors; by default warnings too, beside what the run came to; with -v
+// every file encoded or decoded as well, and with -vv every frame and chunk.
+
+// cliLevel is the level the command line tool logs at.
+var cliLevel = slog.LevelWarn
+
+// verbosity returns the level -q, -v and -vv ask for, at most one of them.
+func verbosity(quiet, verbose, veryVerbose bool) (slog.Level, error) {
+	switch {
+	case quiet && (verbose || veryVerbose) || verbose && veryVerbose:
+		return 0, fmt.Errorf("give one of -q, -v and -vv")
+	case quiet:
+		return slog.LevelError, nil
+	case verbose:
+		return slog.LevelInfo, nil
+	case veryVerbose:
+		return slog.LevelDebug, nil
+	}
+	return slog.LevelWarn, nil
+}
+
+// summarizing reports whether the command line tool prints what runs come
+// to, which -q turns off for errors only.
+func summarizing() bool {
+	return cliLevel <= slog.LevelWarn
+}
+
+// summarize writes what a run came to on w, the line it ends with, unless
+// -q asks for errors only.
+func summarize(w io.Writer, format string, args ...any) {
+	if summarizing() {
+		fmt.Fprintf(w, format+"\n", args...)
+	}
+}
@@ -0,0 +1,142 @@
+package f2v
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"log/slog"
+)
+
+// An unencrypted video can carry an integrity tag: HMAC-SHA256 over the
+// data as the frames hold it, compressed if it is, appended after it, with
+// frameFlagMAC on every data frame. Anyone with the key file can then tell
+// whether a publicly hosted video was tampered with, while anyone at all
+// can still decode it. Encrypted videos need no tag, since their envelope
+// already authenticates every chunk.
+
+const macSize = sha256.Size
+
+// macKey derives the HMAC key from a key file's contents, so that one key
+// file can serve for -key and -mac-key alike.
+func macKey(keyFile []byte) []byte {
+	return hkdfSHA256(keyFile, nil, []byte("f2v mac key"))
+}
+
+// mac returns the key to check integrity tags with, nil if none was given.
+func (s *secret) mac() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.macKey
+}
+
+// macReader passes r through and then appends the tag of what it read.
+type macReader struct {
+	r    io.Reader
+	h    hash.Hash
+	tail []byte
+	done bool
+}
+
+func newMACReader(r io.Reader, key []byte) *macReader {
+	return &macReader{r: r, h: hmac.New(sha256.New, key)}
+}
+
+func (m *macReader) Read(p []byte) (int, error) {
+	if !m.done {
+		n, err := m.r.Read(p)
+		m.h.Write(p[:n])
+		if err != io.EOF {
+			return n, err
+		}
+		m.done, m.tail = true, m.h.Sum(nil)
+		if n > 0 {
+			return n, nil
+		}
+	}
+	if len(m.tail) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, m.tail)
+	m.tail = m.tail[n:]
+	return n, nil
+}
+
+// appendMAC returns data with its tag appended.
+func appendMAC(data, key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(data)
+}
+
+// macChecker passes the data written to it on to dst, holding back the tag
+// at its end, which Close checks.
+type macChecker struct {
+	dst  io.Writer
+	key  []byte // nil to only strip the tag
+	log  *slog.Logger
+	h    hash.Hash
+	tail []byte
+}
+
+func newMACChecker(dst io.Writer, key []byte, log *slog.Logger) *macChecker {
+	return &macChecker{dst: dst, key: key, log: log, h: hmac.New(sha256.New, key)}
+}
+
+func (m *macChecker) Write(p []byte) (int, error) {
+	m.tail = append(m.tail, p...)
+	if len(m.tail) <= macSize {
+		return len(p), nil
+	}
+	out := m.tail[:len(m.tail)-macSize]
+	m.h.Write(out)
+	if _, err := m.dst.Write(out); err != nil {
+		return 0, err
+	}
+	m.tail = append(m.tail[:0], m.tail[len(out):]...)
+	return len(p), nil
+}
+
+// flush passes on what was held back as the tag, for data that broke off
+// before its end.
+func (m *macChecker) flush() error {
+	_, err := m.dst.Write(m.tail)
+	m.tail = nil
+	return err
+}
+
+// Close reports whether the tag matched.
+func (m *macChecker) Close() error {
+	return m.check(m.tail, m.h)
+}
+
+func (m *macChecker) check(tag []byte, h hash.Hash) error {
+	if len(tag) < macSize {
+		return malformed("the data ends before its integrity tag")
+	}
+	if m.key == nil {
+		m.log.Warn("The video carries an integrity tag; give -mac-key to check it")
+		return nil
+	}
+	if !hmac.Equal(h.Sum(nil), tag) {
+		return mismatched("integrity check failed: the data was altered, or -mac-key is not the key it was tagged with")
+	}
+	m.log.Info("Integrity tag checked")
+	return nil
+}
+
+// checkMAC checks the tag at the end of a whole data stream and returns the
+// data without it.
+func checkMAC(data, key []byte, log *slog.Logger) ([]byte, error) {
+	m := newMACChecker(io.Discard, key, log)
+	if len(data) < macSize {
+		return nil, m.check(data, m.h)
+	}
+	body := data[:len(data)-macSize]
+	m.h.Write(body)
+	if err := m.check(data[len(body):], m.h); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
@@ -0,0 +1,168 @@
+package f2v
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// -manifest writes, next to the parts of a split encode, a small video that
+// lists them: their file names, or with -part-url the URLs they are to be
+// uploaded under, and the size and SHA-256 of the data each holds. Decoding
+// the manifest fetches and decodes every part in turn, checking each against
+// its hash, so one small video is all it takes to get the whole file back.
+//
+// The manifest video holds manifestMagic followed by the JSON of a
+// spanManifest, encrypted or tagged like the parts.
+
+const manifestMagic = "F2VM"
+
+const manifestVersion = 1
+
+// spanManifest is what a manifest video holds.
+type spanManifest struct {
+	Version int            `json:"version"`
+	Name    string         `json:"name"`
+	Size    int64          `json:"size"`
+	SHA256  string         `json:"sha256"`
+	Parts   []manifestPart `json:"parts"`
+}
+
+// manifestPart is one part video of a manifest.
+type manifestPart struct {
+	Video  string `json:"video"` // URL, or file name next to the manifest
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// manifestPath names the manifest video of the parts of video.
+func manifestPath(video string) string {
+	ext := filepath.Ext(video)
+	return video[:len(video)-len(ext)] + ".manifest" + ext
+}
+
+func isManifestPath(video string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(video, filepath.Ext(video)), ".manifest")
+}
+
+// writeManifest encodes m into the manifest video of outputVideo, the way
+// the parts were encoded, and returns its path.
+func writeManifest(m *spanManifest, outputVideo string, opts encodeOptions) (string, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	path := manifestPath(outputVideo)
+	opts.maxFrames = 0
+	data := append([]byte(manifestMagic), body...)
+	if err := encodeStream(m.Name+" (manifest)", m.Name, bytes.NewReader(data), path, opts); err != nil {
+		return "", fmt.Errorf("manifest: %w", err)
+	}
+	return path, nil
+}
+
+// readManifest decodes video if it is named as a manifest and returns what
+// it lists, or nil when it is not a manifest after all.
+func readManifest(video string, opts decodeOptions) (*spanManifest, error) {
+	if !isManifestPath(video) {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := decodeVideo(video, &buf, opts, nil); err != nil {
+		return nil, err
+	}
+	body, ok := bytes.CutPrefix(buf.Bytes(), []byte(manifestMagic))
+	if !ok {
+		return nil, nil
+	}
+	m := &spanManifest{}
+	if err := json.Unmarshal(body, m); err != nil {
+		return nil, malformed("%s is not a valid manifest: %v", video, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, unsupported("%s has unsupported manifest version %d", video, m.Version)
+	}
+	if len(m.Parts) == 0 {
+		return nil, malformed("%s lists no parts", video)
+	}
+	return m, nil
+}
+
+// partRef is how a manifest lists the part video at path: its file name,
+// under prefix if one is given.
+func partRef(path, prefix string) string {
+	if prefix == "" {
+		return filepath.Base(path)
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + url.PathEscape(filepath.Base(path))
+}
+
+// partSource is where the decode finds a part the manifest at video lists:
+// an absolute URL as it is, anything else relative to the manifest.
+func partSource(video, part string) (string, error) {
+	if isURL(part) {
+		return part, nil
+	}
+	if isURL(video) {
+		base, err := url.Parse(video)
+		if err != nil {
+			return "", err
+		}
+		ref, err := url.Parse(part)
+		if err != nil {
+			return "", err
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+	return filepath.Join(filepath.Dir(video), filepath.FromSlash(part)), nil
+}
+
+// hashCounter hashes and counts what goes through it.
+type hashCounter struct {
+	w hash.Hash
+	n int64
+}
+
+func (h *hashCounter) Write(b []byte) (int, error) {
+	h.n += int64(len(b))
+	return h.w.Write(b)
+}
+
+// check reports whether what went through matches size and sum.
+func (h *hashCounter) check(size int64, sum string) error {
+	if got := hex.EncodeToString(h.w.Sum(nil)); h.n != size || got != sum {
+		return mismatched("holds %d bytes with SHA-256 %s, not %d bytes with %s", h.n, got, size, sum)
+	}
+	return nil
+}
+
+// decode decodes every part m lists, in order, into w, checking each part
+// and then the whole against their hashes. video is the manifest's own.
+func (m *spanManifest) decode(video string, w io.Writer, opts decodeOptions) error {
+	whole := &hashCounter{w: sha256.New()}
+	for i, p := range m.Parts {
+		src, err := partSource(video, p.Video)
+		if err != nil {
+			return fmt.Errorf("part %d of %d: %w", i+1, len(m.Parts), err)
+		}
+		opts.log().Info("Decoding part", "part", i+1, "parts", len(m.Parts), "video", src)
+		part := &hashCounter{w: sha256.New()}
+		if err := decodeVideo(src, io.MultiWriter(w, whole, part), opts, nil); err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+		if err := part.check(p.Size, p.SHA256); err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+	}
+	if err := whole.check(m.Size, m.SHA256); err != nil {
+		return fmt.Errorf("%s as joined from its parts: %w", m.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package f2v
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"sync"
+)
+
+// Memory is a CodecBackend that keeps videos in memory as their frames, by
+// path, for programs that turn frames into videos and back themselves, such
+// as a web page running the WebAssembly build, which has no OpenCV. A video
+// written to it appears once its writer is closed. Memory is safe for
+// concurrent use, and the zero Memory is empty and ready.
+type Memory struct {
+	mu     sync.Mutex
+	videos map[string]*MemoryVideo
+}
+
+// MemoryVideo is a video Memory holds.
+type MemoryVideo struct {
+	Width, Height int
+	FPS           float64
+	Frames        [][]byte // width*height*3 bytes of BGR pixels each, as WriteFrame takes them
+}
+
+// Put stores v at path, replacing any video there.
+func (m *Memory) Put(path string, v *MemoryVideo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.videos == nil {
+		m.videos = make(map[string]*MemoryVideo)
+	}
+	m.videos[path] = v
+}
+
+// Video returns the video at path, or nil if there is none.
+func (m *Memory) Video(path string) *MemoryVideo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.videos[path]
+}
+
+// Create starts a video at path; the codec is of no account.
+func (m *Memory) Create(path, codec string, fps float64, width, height int) (VideoWriter, error) {
+	return &memoryWriter{m: m, path: path, v: &MemoryVideo{Width: width, Height: height, FPS: fps}}, nil
+}
+
+// Open opens the video at path.
+func (m *Memory) Open(path string) (VideoReader, error) {
+	v := m.Video(path)
+	if v == nil {
+		return nil, fmt.Errorf("open %s: %w", path, fs.ErrNotExist)
+	}
+	return &memoryReader{v: v}, nil
+}
+
+type memoryWriter struct {
+	m    *Memory
+	path string
+	v    *MemoryVideo
+}
+
+func (w *memoryWriter) WriteFrame(bgr []byte) error {
+	if len(bgr) != w.v.Width*w.v.Height*3 {
+		return fmt.Errorf("frame of %d bytes does not fit a %dx%d video", len(bgr), w.v.Width, w.v.Height)
+	}
+	w.v.Frames = append(w.v.Frames, slices.Clone(bgr))
+	return nil
+}
+
+func (w *memoryWriter) Close() error {
+	w.m.Put(w.path, w.v)
+	return nil
+}
+
+type memoryReader struct {
+	v    *MemoryVideo
+	next int64
+}
+
+func (r *memoryReader) Info() VideoInfo {
+	return VideoInfo{Width: r.v.Width, Height: r.v.Height, FPS: r.v.FPS, Frames: int64(len(r.v.Frames))}
+}
+
+func (r *memoryReader) ReadFrame() ([]byte, int, int, error) {
+	if r.next >= int64(len(r.v.Frames)) {
+		return nil, 0, 0, io.EOF
+	}
+	r.next++
+	return r.v.Frames[r.next-1], r.v.Width, r.v.Height, nil
+}
+
+func (r *memoryReader) SeekFrame(frame int64) error {
+	r.next = max(frame, 0)
+	return nil
+}
+
+func (r *memoryReader) Close() error {
+	return nil
+}
@@ -0,0 +1,117 @@
+package f2v
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// merge combines f2v archive videos into one without unpacking them to
+// disk: each file is read from just the frames holding it, or from the
+// archive decoded in memory when it was encrypted or compressed whole, and
+// packed again in chunks as -dedup packs them, so chunks the archives share
+// are stored once. Entries keep the order of the videos given; where two
+// have an entry of the same name, the later video's is kept. The merged
+// archive holds the data of every file itself, even those an input kept in
+// a -base video. It is written at the frame rate of the first video and as
+// append writes archives: without encryption, a tag or solid compression,
+// and with -compress-mode per-file each new chunk compressed on its own. The
+// output is only kept once its directory reads back.
+
+// mergeArchives merges the archives in videos into one archive video at
+// output, and returns how many entries it lists and how many bytes of file
+// data it did not store again because a chunk was stored already.
+func mergeArchives(videos []string, output string, opts encodeOptions, dopts decodeOptions) (int, int64, error) {
+	outAbs, _ := filepath.Abs(output)
+	readers := make([]*archiveReader, len(videos))
+	kept := make(map[string]int) // the video whose entry of each name is kept
+	for i, video := range videos {
+		if abs, _ := filepath.Abs(video); abs == outAbs {
+			return 0, 0, fmt.Errorf("%s is read from; merge into another video", video)
+		}
+		r, err := openArchive(video, dopts)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to open %s: %w", video, err)
+		}
+		readers[i] = r
+		for _, e := range r.dir.Entries {
+			kept[e.Name] = i
+		}
+	}
+
+	fps, err := videoFPS(videos[0], dopts.layout)
+	if err != nil {
+		return 0, 0, err
+	}
+	pr, pw := io.Pipe()
+	a := newArchiveWriter(pw, &archiveDirectory{Version: archiveVersion}, 0, opts.layout.capacity()-frameHeaderSize)
+	a.dedup = true
+	if opts.perFile {
+		a.compress = opts.compress
+	}
+	go func() {
+		_, err := a.cw.Write(append(archiveMagic[:], archiveVersion))
+		for i, r := range readers {
+			for _, e := range r.dir.Entries {
+				if err != nil {
+					break
+				}
+				if kept[e.Name] == i {
+					if err = a.merge(r, e); err != nil {
+						err = fmt.Errorf("failed to merge %s from %s: %w", e.Name, videos[i], err)
+					}
+				}
+			}
+		}
+		if err == nil {
+			err = a.close()
+		}
+		pw.CloseWithError(err)
+	}()
+	_, err = streamToVideo(pr, output, opts.layout, fps, 0)
+	// Stop the packer if encoding gave up early
+	pr.CloseWithError(err)
+	if err == nil {
+		if _, err = readArchiveTail(output, opts.layout); err != nil {
+			err = fmt.Errorf("the merged video does not read back: %w", err)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(output)
+		return 0, 0, err
+	}
+	var files, stored int64
+	for _, e := range a.dir.Entries {
+		files += e.Size
+	}
+	for _, c := range a.dir.Chunks {
+		stored += c.Size
+	}
+	return len(a.dir.Entries), files - stored, nil
+}
+
+// merge adds e, whose data r reads, in chunks shared with the entries added
+// before it.
+func (a *archiveWriter) merge(r *archiveReader, e archiveEntry) error {
+	m := archiveEntry{Name: e.Name, Mode: e.Mode, Modified: e.Modified, Link: e.Link}
+	if e.Mode.IsRegular() {
+		data, err := r.read(e)
+		if err != nil {
+			return err
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != e.SHA256 {
+			return mismatched("%s does not match its hash in the archive directory", e.Name)
+		}
+		m.SHA256, m.Chunks = e.SHA256, []string{}
+		if err := splitChunks(bytes.NewReader(data), a.addChunk(&m)); err != nil {
+			return err
+		}
+	}
+	i, found := a.names[m.Name]
+	a.added++
+	return a.put(i, found, m)
+}
@@ -0,0 +1,115 @@
+package f2v
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// packTestArchive packs files, by name under a folder called dir, into an
+// f2v archive video in out and returns its path.
+func packTestArchive(t *testing.T, l layout, dir, out string, dedup bool, files map[string][]byte) string {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), dir)
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	video, err := encodePacked(src, "f2v", out, encodeOptions{layout: l, fps: defaultFPS, dedup: dedup})
+	if err != nil {
+		t.Fatalf("packing %s: %v", dir, err)
+	}
+	return video
+}
+
+func TestMergeArchivesSharingChunks(t *testing.T) {
+	l := defaultLayout()
+	l.backend = PNGSequence{}
+	shared := make([]byte, 200<<10)
+	rand.Read(shared)
+	out := t.TempDir()
+	a := packTestArchive(t, l, "a", out, true, map[string][]byte{"shared.bin": shared, "a.txt": []byte("from a\n")})
+	b := packTestArchive(t, l, "b", out, false, map[string][]byte{"copy.bin": shared, "docs/b.txt": []byte("only in b\n")})
+
+	merged := filepath.Join(out, "merged.mkv")
+	entries, saved, err := mergeArchives([]string{a, b}, merged, encodeOptions{layout: l}, decodeOptions{layout: l})
+	if err != nil {
+		t.Fatalf("mergeArchives: %v", err)
+	}
+	// a/, b/ and b/docs/ beside the four files
+	if entries != 7 {
+		t.Errorf("merged %d entries, want 7", entries)
+	}
+	if saved != int64(len(shared)) {
+		t.Errorf("%d bytes stored once for both archives, want %d", saved, len(shared))
+	}
+
+	r, err := openArchive(merged, decodeOptions{layout: l})
+	if err != nil {
+		t.Fatalf("opening the merged archive: %v", err)
+	}
+	var stored int64
+	for _, c := range r.dir.Chunks {
+		stored += c.Size
+	}
+	if want := int64(len(shared) + len("from a\n") + len("only in b\n")); stored != want {
+		t.Errorf("merged archive stores %d bytes of chunks, want %d", stored, want)
+	}
+	for name, want := range map[string][]byte{"a/shared.bin": shared, "a/a.txt": []byte("from a\n"), "b/copy.bin": shared, "b/docs/b.txt": []byte("only in b\n")} {
+		e, ok := r.dir.find(name)
+		if !ok {
+			t.Errorf("%s is not in the merged archive", name)
+			continue
+		}
+		got, err := r.read(e)
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s does not read back as it was packed", name)
+		}
+	}
+}
+
+func TestMergeArchivesKeepsLaterEntry(t *testing.T) {
+	l := defaultLayout()
+	l.backend = PNGSequence{}
+	first := packTestArchive(t, l, "docs", t.TempDir(), false, map[string][]byte{"notes.txt": []byte("old\n")})
+	second := packTestArchive(t, l, "docs", t.TempDir(), true, map[string][]byte{"notes.txt": []byte("new\n")})
+
+	merged := filepath.Join(t.TempDir(), "merged.mkv")
+	if _, _, err := mergeArchives([]string{first, second}, merged, encodeOptions{layout: l}, decodeOptions{layout: l}); err != nil {
+		t.Fatalf("mergeArchives: %v", err)
+	}
+	r, err := openArchive(merged, decodeOptions{layout: l})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.dir.Entries) != 2 {
+		t.Errorf("merged archive lists %d entries, want docs/ and docs/notes.txt once each", len(r.dir.Entries))
+	}
+	e, ok := r.dir.find("docs/notes.txt")
+	if !ok {
+		t.Fatal("docs/notes.txt is not in the merged archive")
+	}
+	if got, err := r.read(e); err != nil || string(got) != "new\n" {
+		t.Errorf("docs/notes.txt reads %q, %v; want the later video's", got, err)
+	}
+}
+
+func TestMergeArchivesRefusesInputAsOutput(t *testing.T) {
+	l := defaultLayout()
+	l.backend = PNGSequence{}
+	a := packTestArchive(t, l, "a", t.TempDir(), false, map[string][]byte{"x": []byte("x")})
+	if _, _, err := mergeArchives([]string{a, a}, a, encodeOptions{layout: l}, decodeOptions{layout: l}); err == nil {
+		t.Error("merged an archive into itself")
+	}
+	if _, err := openArchive(a, decodeOptions{layout: l}); err != nil {
+		t.Errorf("the input no longer opens: %v", err)
+	}
+}
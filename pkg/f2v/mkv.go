@@ -0,0 +1,331 @@
+package f2v
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Just enough of Matroska (EBML) to find where each cluster of a video sits
+// in the file, how many video frames it holds and whether it starts with a
+// keyframe. A cluster that starts with a keyframe can be decoded on its own,
+// given the bytes before the first cluster (EBML header, segment info and
+// tracks), which makes it the unit for range requests.
+
+const (
+	ebmlIDHeader      = 0x1A45DFA3
+	ebmlIDSegment     = 0x18538067
+	ebmlIDCluster     = 0x1F43B675
+	ebmlIDTracks      = 0x1654AE6B
+	ebmlIDTrackEntry  = 0xAE
+	ebmlIDTrackNumber = 0xD7
+	ebmlIDTrackType   = 0x83
+	ebmlIDSimpleBlock = 0xA3
+	ebmlIDBlockGroup  = 0xA0
+	ebmlIDBlock       = 0xA1
+	ebmlIDReference   = 0xFB
+
+	mkvTrackVideo = 1
+	ebmlUnknown   = -1
+)
+
+// mkvCluster is one cluster's span in the file and its video frames.
+type mkvCluster struct {
+	offset   int64 // of the cluster element's ID
+	length   int64 // whole element, header included
+	frames   int
+	keyStart bool // the first video frame is a keyframe
+}
+
+// ebmlReader reads EBML elements while tracking the file offset.
+type ebmlReader struct {
+	r   *bufio.Reader
+	pos int64
+	end int64 // of the file, which no element may run past
+}
+
+func (e *ebmlReader) byte() (byte, error) {
+	b, err := e.r.ReadByte()
+	if err == nil {
+		e.pos++
+	}
+	return b, err
+}
+
+// vint reads a variable-length integer. IDs keep their length marker; sizes
+// drop it, and an all-ones size means unknown.
+func (e *ebmlReader) vint(keepMarker bool) (int64, int, error) {
+	first, err := e.byte()
+	if err != nil {
+		return 0, 0, err
+	}
+	length := 1
+	for mask := byte(0x80); first&mask == 0; mask >>= 1 {
+		if length++; length > 8 {
+			return 0, 0, malformed("invalid EBML integer at offset %d", e.pos-1)
+		}
+	}
+	v := int64(first)
+	if !keepMarker {
+		v &= int64(0xFF >> length)
+	}
+	allOnes := v == int64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		b, err := e.byte()
+		if err != nil {
+			return 0, 0, err
+		}
+		v = v<<8 | int64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	if !keepMarker && allOnes {
+		return ebmlUnknown, length, nil
+	}
+	return v, length, nil
+}
+
+func (e *ebmlReader) header() (id, size int64, err error) {
+	start := e.pos
+	if id, _, err = e.vint(true); err != nil {
+		return 0, 0, err
+	}
+	if size, _, err = e.vint(false); err != nil {
+		return 0, 0, err
+	}
+	if size > e.end-e.pos {
+		return 0, 0, malformed("element %x at offset %d runs past the end of the file", id, start)
+	}
+	return id, size, nil
+}
+
+func (e *ebmlReader) skip(n int64) error {
+	if n < 0 {
+		return malformed("element of unknown size at offset %d", e.pos)
+	}
+	done, err := e.r.Discard(int(n))
+	e.pos += int64(done)
+	return err
+}
+
+// read reads an element body of n bytes into memory.
+func (e *ebmlReader) read(n int64) ([]byte, error) {
+	if n < 0 || n > maxEBMLElement {
+		return nil, malformed("element at offset %d is too large to read (%d bytes)", e.pos, n)
+	}
+	buf := make([]byte, n)
+	done, err := io.ReadFull(e.r, buf)
+	e.pos += int64(done)
+	return buf, err
+}
+
+// readHead reads the first bytes of an element body of n bytes, at most
+// max of them, and skips the rest.
+func (e *ebmlReader) readHead(n int64, max int) ([]byte, error) {
+	if n < 0 {
+		return nil, malformed("element of unknown size at offset %d", e.pos)
+	}
+	head, err := e.read(min(n, int64(max)))
+	if err != nil {
+		return nil, err
+	}
+	return head, e.skip(n - int64(len(head)))
+}
+
+func ebmlUint(buf []byte) int64 {
+	v := int64(0)
+	for _, b := range buf {
+		v = v<<8 | int64(b)
+	}
+	return v
+}
+
+// blockTrack returns the track number at the start of a block's payload.
+func blockTrack(buf []byte) int64 {
+	if len(buf) == 0 {
+		return -1
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && buf[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > len(buf) {
+		return -1
+	}
+	v := int64(buf[0] & (0xFF >> length))
+	for _, b := range buf[1:length] {
+		v = v<<8 | int64(b)
+	}
+	return v
+}
+
+// scanMatroska returns where the first cluster starts and every cluster of
+// the file's first video track.
+func scanMatroska(path string) (headerSize int64, clusters []mkvCluster, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to open video: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to open video: %w", err)
+	}
+	e := &ebmlReader{r: bufio.NewReaderSize(f, 1<<20), end: info.Size()}
+
+	id, size, err := e.header()
+	if err != nil || id != ebmlIDHeader || size == ebmlUnknown {
+		return 0, nil, malformed("%s is not a Matroska file", path)
+	}
+	if err := e.skip(size); err != nil {
+		return 0, nil, err
+	}
+	// A file cut short still holds its segment's start, so its size is
+	// left unchecked; the elements inside it are not
+	if id, _, err = e.vint(true); err == nil && id == ebmlIDSegment {
+		_, _, err = e.vint(false)
+	}
+	if err != nil || id != ebmlIDSegment {
+		return 0, nil, malformed("%s has no Matroska segment", path)
+	}
+
+	videoTrack := int64(-1)
+	headerSize = -1
+	for {
+		start := e.pos
+		id, size, err := e.header()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		switch id {
+		case ebmlIDTracks:
+			body, err := e.read(size)
+			if err != nil {
+				return 0, nil, err
+			}
+			videoTrack = findVideoTrack(body)
+		case ebmlIDCluster:
+			if size == ebmlUnknown {
+				return 0, nil, malformed("cluster at offset %d has an unknown size", start)
+			}
+			if headerSize < 0 {
+				headerSize = start
+			}
+			c, err := scanCluster(e, size, videoTrack)
+			if err != nil {
+				return 0, nil, err
+			}
+			c.offset, c.length = start, e.pos-start
+			clusters = append(clusters, c)
+		default:
+			if size == ebmlUnknown {
+				return 0, nil, malformed("element %x at offset %d has an unknown size", id, start)
+			}
+			if err := e.skip(size); err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+	if headerSize < 0 {
+		return 0, nil, malformed("%s has no clusters", path)
+	}
+	return headerSize, clusters, nil
+}
+
+// findVideoTrack returns the number of the first video track in a Tracks
+// element's body, or -1 to count every block.
+func findVideoTrack(body []byte) int64 {
+	for _, entry := range ebmlChildren(body, ebmlIDTrackEntry) {
+		number, kind := int64(-1), int64(0)
+		for _, child := range ebmlChildren(entry, ebmlIDTrackNumber) {
+			number = ebmlUint(child)
+		}
+		for _, child := range ebmlChildren(entry, ebmlIDTrackType) {
+			kind = ebmlUint(child)
+		}
+		if kind == mkvTrackVideo {
+			return number
+		}
+	}
+	return -1
+}
+
+// ebmlChildren returns the bodies of the direct children of an in-memory
+// element body that carry id.
+func ebmlChildren(body []byte, id int64) [][]byte {
+	var out [][]byte
+	e := &ebmlReader{r: bufio.NewReader(bytes.NewReader(body)), end: int64(len(body))}
+	for e.pos < int64(len(body)) {
+		childID, size, err := e.header()
+		if err != nil || size == ebmlUnknown {
+			break
+		}
+		if childID == id {
+			out = append(out, body[e.pos:e.pos+size])
+		}
+		if e.skip(size) != nil {
+			break
+		}
+	}
+	return out
+}
+
+func scanCluster(e *ebmlReader, size, videoTrack int64) (mkvCluster, error) {
+	var c mkvCluster
+	end := e.pos + size
+	for e.pos < end {
+		id, size, err := e.header()
+		if err != nil {
+			return c, err
+		}
+		var block []byte
+		key := false
+		switch id {
+		case ebmlIDSimpleBlock:
+			// The track number, timecode and flags are all that is needed
+			if block, err = e.readHead(size, 16); err != nil {
+				return c, err
+			}
+			key = blockFlags(block)&0x80 != 0
+		case ebmlIDBlockGroup:
+			body, err := e.read(size)
+			if err != nil {
+				return c, err
+			}
+			if blocks := ebmlChildren(body, ebmlIDBlock); len(blocks) > 0 {
+				block = blocks[0]
+			}
+			key = len(ebmlChildren(body, ebmlIDReference)) == 0
+		default:
+			if err := e.skip(size); err != nil {
+				return c, err
+			}
+			continue
+		}
+		if block == nil || (videoTrack >= 0 && blockTrack(block) != videoTrack) {
+			continue
+		}
+		if c.frames == 0 {
+			c.keyStart = key
+		}
+		c.frames++
+	}
+	return c, nil
+}
+
+// blockFlags returns the flags byte that follows a block's track number and
+// 16-bit timecode.
+func blockFlags(block []byte) byte {
+	length := 1
+	for mask := byte(0x80); length <= 8 && len(block) > 0 && block[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if len(block) <= length+2 {
+		return 0
+	}
+	return block[length+2]
+}
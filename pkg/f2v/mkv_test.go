@@ -0,0 +1,91 @@
+package f2v
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ebmlElement returns an element with id, which keeps its length marker,
+// and body, its size written in eight bytes.
+func ebmlElement(id uint32, body ...[]byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, id)
+	for out[0] == 0 {
+		out = out[1:]
+	}
+	var n int
+	for _, b := range body {
+		n += len(b)
+	}
+	out = append(out, 0x01)
+	out = append(out, binary.BigEndian.AppendUint64(nil, uint64(n))[1:]...)
+	for _, b := range body {
+		out = append(out, b...)
+	}
+	return out
+}
+
+// testMatroska returns a small Matroska file whose video track 1 has two
+// clusters, the first starting with a keyframe.
+func testMatroska() []byte {
+	block := func(track, flags byte) []byte {
+		return ebmlElement(ebmlIDSimpleBlock, []byte{0x80 | track, 0, 0, flags, 1, 2, 3})
+	}
+	tracks := ebmlElement(ebmlIDTracks,
+		ebmlElement(ebmlIDTrackEntry, ebmlElement(ebmlIDTrackNumber, []byte{2}), ebmlElement(ebmlIDTrackType, []byte{2})),
+		ebmlElement(ebmlIDTrackEntry, ebmlElement(ebmlIDTrackNumber, []byte{1}), ebmlElement(ebmlIDTrackType, []byte{mkvTrackVideo})))
+	segment := append([]byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, tracks...)
+	segment = append(segment, ebmlElement(ebmlIDCluster, block(1, 0x80), block(2, 0), block(1, 0))...)
+	segment = append(segment, ebmlElement(ebmlIDCluster,
+		ebmlElement(ebmlIDBlockGroup, ebmlElement(ebmlIDBlock, []byte{0x81, 0, 0, 0}), ebmlElement(ebmlIDReference, []byte{1})))...)
+	return append(ebmlElement(ebmlIDHeader, []byte{0x42, 0x86, 0x81, 0x01}), segment...)
+}
+
+func TestScanMatroska(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.mkv")
+	data := testMatroska()
+	os.WriteFile(path, data, 0644)
+	header, clusters, err := scanMatroska(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 || header != clusters[0].offset || clusters[0].frames != 2 || !clusters[0].keyStart || clusters[1].keyStart {
+		t.Errorf("scanned a header of %d bytes and clusters %+v", header, clusters)
+	}
+	os.WriteFile(path, data[:len(data)-1], 0644)
+	if _, _, err := scanMatroska(path); err == nil {
+		t.Error("scanned a file cut short inside a cluster")
+	}
+}
+
+func FuzzScanMatroska(f *testing.F) {
+	data := testMatroska()
+	f.Add(data)
+	f.Add(data[:40])
+	f.Add(ebmlElement(ebmlIDHeader))
+	f.Add([]byte{0x1a, 0x45, 0xdf, 0xa3, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	path := filepath.Join(f.TempDir(), "v.mkv")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		header, clusters, err := scanMatroska(path)
+		if err != nil {
+			return
+		}
+		for _, c := range clusters {
+			if c.offset < header || c.length <= 0 || c.offset+c.length > int64(len(data)) {
+				t.Fatalf("cluster at %d, %d bytes long, in a file of %d with a header of %d", c.offset, c.length, len(data), header)
+			}
+		}
+		last := clusters[len(clusters)-1]
+		if err := os.WriteFile(path, data[:last.offset+last.length-1], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := scanMatroska(path); err == nil {
+			t.Fatal("scanned a file cut short inside its last cluster")
+		}
+	})
+}
@@ -0,0 +1,96 @@
+//go:build js && wasm
+
+package f2v
+
+import (
+	"fmt"
+	"slices"
+)
+
+// A WebAssembly build has no OpenCV: frames are held as plain BGR bytes,
+// videos go through a backend such as Memory or PNGSequence, and what only
+// OpenCV can do, reading and writing real videos, finding sync markers in a
+// distorted frame and camera transfers, fails or is left out.
+
+// errNoOpenCV is what asking a WebAssembly build for OpenCV fails with.
+var errNoOpenCV = fmt.Errorf("%w: OpenCV is not available in a WebAssembly build; use another backend", ErrCodecUnavailable)
+
+// mat holds the pixels of a frame, 3 bytes a pixel row by row, as an OpenCV
+// Mat of them would.
+type mat struct {
+	data       []byte
+	rows, cols int
+}
+
+func newMat() mat {
+	return mat{}
+}
+
+// readBGR copies a frame of width by height BGR pixels into m, reporting
+// whether it could.
+func readBGR(m *mat, bgr []byte, width, height int) bool {
+	if len(bgr) < width*height*3 {
+		return false
+	}
+	m.data = append(m.data[:0], bgr[:width*height*3]...)
+	m.rows, m.cols = height, width
+	return true
+}
+
+func (m *mat) Empty() bool                    { return len(m.data) == 0 }
+func (m *mat) Rows() int                      { return m.rows }
+func (m *mat) Cols() int                      { return m.cols }
+func (m *mat) Channels() int                  { return 3 }
+func (m *mat) DataPtrUint8() ([]uint8, error) { return m.data, nil }
+func (m *mat) CopyTo(dst *mat)                { readBGR(dst, m.data, m.cols, m.rows) }
+
+func (m *mat) Close() error {
+	m.data = nil
+	return nil
+}
+
+// alignFrame takes a frame of the layout's size as it is, its markers where
+// they belong. Any other frame, cropped, scaled or shot on camera, cannot be
+// searched for its markers without OpenCV, so it is stretched to the size,
+// nearest pixel first, and found is false.
+func alignFrame(frame mat, l layout) (aligned mat, found bool) {
+	if frame.cols == l.width && frame.rows == l.height {
+		return mat{data: slices.Clone(frame.data), rows: frame.rows, cols: frame.cols}, true
+	}
+	aligned = mat{data: make([]byte, l.width*l.height*3), rows: l.height, cols: l.width}
+	if frame.Empty() {
+		return aligned, false
+	}
+	for y := range l.height {
+		sy := y * frame.rows / l.height
+		for x := range l.width {
+			sx := x * frame.cols / l.width
+			copy(aligned.data[(y*l.width+x)*3:][:3], frame.data[(sy*frame.cols+sx)*3:])
+		}
+	}
+	return aligned, false
+}
+
+// OpenCV stands in for the OpenCV backend, which a WebAssembly build does
+// not have.
+type OpenCV struct{}
+
+// Create fails: there is no OpenCV to write videos with.
+func (OpenCV) Create(path, codec string, fps float64, width, height int) (VideoWriter, error) {
+	return nil, errNoOpenCV
+}
+
+// Open fails: there is no OpenCV to read videos with.
+func (OpenCV) Open(path string) (VideoReader, error) {
+	return nil, errNoOpenCV
+}
+
+// receiveFile fails: there is no camera to read without OpenCV.
+func receiveFile(device, outputFilename string, l layout, s *secret) error {
+	return errNoOpenCV
+}
+
+// transmitFile fails: there is no window to show frames in without OpenCV.
+func transmitFile(inputFilename string, l layout, fps, loops int) error {
+	return errNoOpenCV
+}
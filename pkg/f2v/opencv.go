@@ -0,0 +1,124 @@
+//go:build !(js && wasm)
+
+package f2v
+
+import (
+	"fmt"
+	"io"
+
+	"gocv.io/x/gocv"
+)
+
+// Everywhere but in a WebAssembly build, frames are held in OpenCV Mats and
+// videos are written and read with OpenCV unless a backend says otherwise.
+
+// mat holds the pixels of a frame.
+type mat = gocv.Mat
+
+func newMat() mat {
+	return gocv.NewMat()
+}
+
+// readBGR copies a frame of width by height BGR pixels into m, reporting
+// whether it could.
+func readBGR(m *mat, bgr []byte, width, height int) bool {
+	frame, err := gocv.NewMatFromBytes(height, width, gocv.MatTypeCV8UC3, bgr)
+	if err != nil {
+		return false
+	}
+	defer frame.Close()
+	frame.CopyTo(m)
+	return true
+}
+
+// OpenCV writes and reads videos with OpenCV's own video I/O, which takes
+// any codec and container its build has.
+type OpenCV struct{}
+
+// Create starts a video OpenCV writes with the codec of fourcc codec.
+func (OpenCV) Create(path, codec string, fps float64, width, height int) (VideoWriter, error) {
+	writer, err := gocv.VideoWriterFile(path, codec, fps, width, height, true)
+	if err != nil {
+		return nil, err
+	}
+	if !writer.IsOpened() {
+		writer.Close()
+		return nil, fmt.Errorf("%w: OpenCV cannot write %s to %s", ErrCodecUnavailable, codec, path)
+	}
+	frame := gocv.NewMatWithSize(height, width, gocv.MatTypeCV8UC3)
+	data, _ := frame.DataPtrUint8()
+	if data == nil {
+		frame.Close()
+		writer.Close()
+		return nil, fmt.Errorf("failed to get frame data pointer")
+	}
+	return &opencvWriter{writer: writer, frame: frame, data: data}, nil
+}
+
+// Open opens a video OpenCV can read.
+func (OpenCV) Open(path string) (VideoReader, error) {
+	cap, err := gocv.VideoCaptureFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &opencvReader{cap: cap, frame: gocv.NewMat()}, nil
+}
+
+type opencvWriter struct {
+	writer *gocv.VideoWriter
+	frame  gocv.Mat
+	data   []byte // the frame's pixels
+}
+
+func (w *opencvWriter) WriteFrame(bgr []byte) error {
+	if len(bgr) != len(w.data) {
+		return fmt.Errorf("frame of %d bytes does not fit a %dx%d video", len(bgr), w.frame.Cols(), w.frame.Rows())
+	}
+	copy(w.data, bgr)
+	return w.writer.Write(w.frame)
+}
+
+func (w *opencvWriter) Close() error {
+	w.frame.Close()
+	return w.writer.Close()
+}
+
+type opencvReader struct {
+	cap   *gocv.VideoCapture
+	frame gocv.Mat
+}
+
+func (r *opencvReader) Info() VideoInfo {
+	return VideoInfo{
+		Width:  int(r.cap.Get(gocv.VideoCaptureFrameWidth)),
+		Height: int(r.cap.Get(gocv.VideoCaptureFrameHeight)),
+		FPS:    r.cap.Get(gocv.VideoCaptureFPS),
+		Frames: int64(r.cap.Get(gocv.VideoCaptureFrameCount)),
+	}
+}
+
+func (r *opencvReader) ReadFrame() ([]byte, int, int, error) {
+	if ok := r.cap.Read(&r.frame); !ok || r.frame.Empty() {
+		return nil, 0, 0, io.EOF
+	}
+	if r.frame.Channels() != 3 {
+		return nil, 0, 0, fmt.Errorf("frame has %d channels, not 3", r.frame.Channels())
+	}
+	data, err := r.frame.DataPtrUint8()
+	return data, r.frame.Cols(), r.frame.Rows(), err
+}
+
+// readMat reads the next frame into m as it is, sparing capture a copy.
+func (r *opencvReader) readMat(m *gocv.Mat) bool {
+	return r.cap.Read(m)
+}
+
+func (r *opencvReader) SeekFrame(frame int64) error {
+	r.cap.Set(gocv.VideoCapturePosFrames, float64(frame))
+	return nil
+}
+
+func (r *opencvReader) Close() error {
+	r.frame.Close()
+	return r.cap.Close()
+}
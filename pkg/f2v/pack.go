@@ -0,0 +1,223 @@
+package f2v
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// With -pack a directory is encoded as one tar, zip or f2v archive (see
+// archive.go) instead of a video per file. The archive is written straight into the encoder as the
+// directory is walked, never staged on disk, and the decoded file is an
+// ordinary archive that tar or unzip can extract; f2v archives are unpacked
+// as they are decoded. Entries are named
+// <dir>/<path>, as if packed from the directory's parent. The catalog
+// records where each regular file's data sits in a plain tar or f2v archive, so
+// that restore can read just the frames holding the files it wants.
+
+var packFormats = []string{"tar", "zip", "f2v"}
+
+// parseCompressMode parses -compress-mode, reporting whether files are
+// compressed one by one.
+func parseCompressMode(mode string) (bool, error) {
+	switch mode {
+	case "solid":
+		return false, nil
+	case "per-file":
+		return true, nil
+	}
+	return false, fmt.Errorf("-compress-mode must be solid or per-file")
+}
+
+// packDirectory writes dir to w as an archive in format, packed as ao says
+// for f2v. For tar and f2v it returns the regular files packed and where
+// their data starts in the archive.
+func packDirectory(dir, format string, filter *pathFilter, ao archiveOptions, w io.Writer) ([]catalogFile, error) {
+	switch format {
+	case "tar":
+		cw := &countingWriter{w: w}
+		tw := tar.NewWriter(cw)
+		var files []catalogFile
+		if err := walkPack(dir, filter, func(name, full string, info fs.FileInfo) error {
+			if err := packTarEntry(tw, name, full, info); err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				// The data follows the header blocks, which the tar writer
+				// has written by now, and is as long as the file was then
+				files = append(files, catalogFile{Name: name, Offset: cw.n - info.Size(), Size: info.Size()})
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		return files, tw.Close()
+	case "zip":
+		zw := zip.NewWriter(w)
+		if err := walkPack(dir, filter, func(name, full string, info fs.FileInfo) error {
+			return packZipEntry(zw, name, full, info)
+		}); err != nil {
+			return nil, err
+		}
+		return nil, zw.Close()
+	case "f2v":
+		return packArchive(dir, filter, ao, w)
+	}
+	return nil, fmt.Errorf("unknown pack format %q (known: tar, zip, f2v)", format)
+}
+
+// walkPack calls add for every entry under dir that filter takes, in
+// lexical order, with its archive name and its path on disk.
+func walkPack(dir string, filter *pathFilter, add func(name, full string, info fs.FileInfo) error) error {
+	base := filepath.Base(filepath.Clean(dir))
+	return filepath.WalkDir(dir, func(full string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, full)
+		if err != nil {
+			return err
+		}
+		if filter.skip(filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		name := path.Join(base, filepath.ToSlash(rel))
+		switch {
+		case info.IsDir():
+			name += "/"
+		case info.Mode().IsRegular(), info.Mode()&fs.ModeSymlink != 0:
+		default:
+			slog.Warn("Skipping what is not a regular file, directory or symlink", "path", full)
+			return nil
+		}
+		return add(name, full, info)
+	})
+}
+
+func packTarEntry(tw *tar.Writer, name, full string, info fs.FileInfo) error {
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(full); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	return copyFileTo(tw, full)
+}
+
+func packZipEntry(zw *zip.Writer, name, full string, info fs.FileInfo) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.Mode().IsRegular() {
+		hdr.Method = zip.Deflate
+	}
+	fw, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		// zip keeps a symlink's target as its content
+		link, err := os.Readlink(full)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(fw, link)
+		return err
+	case info.Mode().IsRegular():
+		return copyFileTo(fw, full)
+	}
+	return nil
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// encodePacked encodes a directory as one archive into outputPath.
+func encodePacked(dir, format, outputPath string, opts encodeOptions) (string, error) {
+	name := filepath.Base(filepath.Clean(dir)) + "." + format
+	outputVideo := opts.videoPath(outputPath, name)
+	ao := archiveOptions{frameBytes: opts.layout.capacity() - frameHeaderSize, dedup: opts.dedup}
+	if opts.perFile {
+		// The archive's own compression takes the place of the video's
+		ao.compress, opts.compress = opts.compress, nil
+	}
+	if opts.base != "" {
+		var err error
+		if ao.base, ao.baseDir, err = loadBase(opts.base, outputVideo, opts); err != nil {
+			return outputVideo, err
+		}
+	}
+	pr, pw := io.Pipe()
+	var files []catalogFile
+	go func() {
+		var err error
+		if files, err = packDirectory(dir, format, opts.filter, ao, pw); err != nil {
+			err = fmt.Errorf("failed to pack %s: %w", dir, err)
+		}
+		pw.CloseWithError(err)
+	}()
+	err := encodeStream(dir, name, pr, outputVideo, opts)
+	// Stop the packer if encoding gave up early
+	pr.CloseWithError(err)
+	if err != nil || opts.catalog == nil || files == nil {
+		return outputVideo, err
+	}
+	// Offsets into the archive only map onto frames when the video holds
+	// the archive as it is, in frames of one layout
+	if opts.secret != nil || opts.shares != nil || opts.tune || opts.compress != nil || opts.head > 0 {
+		return outputVideo, nil
+	}
+	i := opts.catalog.find(outputVideo)
+	if i < 0 {
+		return outputVideo, nil
+	}
+	opts.catalog.Entries[i].Files = files
+	return outputVideo, opts.catalog.save()
+}
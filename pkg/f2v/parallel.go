@@ -0,0 +1,205 @@
+package f2v
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// The data of a video stored as it was, not compressed, encrypted or tagged,
+// lies in its frames at places their sequence numbers give: frame s holds
+// bytes s*frameBytes on of it. Decoding such a video into an output that
+// takes writes anywhere, such as a file, needs no order, so decodeAt reads
+// the frames in one goroutine and unpacks, checks and writes each at its
+// offset in a worker per CPU, which is where the time of a decode goes. The
+// index frame says whether a video is one of these; others, segmented ones
+// and anything else decodeAt cannot place, decode in order.
+
+// writerAt is an output that takes writes anywhere, whose end is then sought
+// to as though the data had been written in order.
+type writerAt interface {
+	io.WriterAt
+	io.Seeker
+}
+
+// decodeAt decodes inputVideo into w as decodeVideo would, frames in
+// parallel. It reports false, having written nothing, when the video has to
+// be decoded in order instead.
+func decodeAt(inputVideo string, w writerAt, opts decodeOptions) (bool, error) {
+	if isURL(inputVideo) {
+		return false, nil // downloaded only once, by decodeVideo
+	}
+	base, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, nil
+	}
+	vi, err := readVideoIndex(inputVideo, opts.layout)
+	if err != nil || vi == nil || vi.flags != 0 || vi.frameBytes == 0 {
+		return false, nil // decodeVideo says what is wrong, if anything is
+	}
+	cap, cleanup, err := openVideoContext(opts.context(), inputVideo, opts.layout)
+	if err != nil {
+		return true, err
+	}
+	defer cleanup()
+	opts.frames = cap.Info().Frames
+	per, frames := int64(vi.frameBytes), int64(vi.dataFrames)
+
+	// A segment table comes first; its video is read in order
+	first := opts.layout.pool.mat()
+	if !cap.Read(&first) || first.Empty() {
+		opts.layout.pool.putMat(first)
+		return true, malformed("%s has no frames", inputVideo)
+	}
+	if f, _, err := scanMat(first, opts.layout, 0, nil, 0); err == nil && f.err == nil && f.header.table() {
+		opts.layout.pool.putMat(first)
+		return false, nil
+	}
+
+	ctx, cancel := context.WithCancel(opts.context())
+	defer cancel()
+	type job struct {
+		frame mat
+		index int
+	}
+	type result struct {
+		f   scannedFrame
+		err error
+	}
+	workers := runtime.GOMAXPROCS(0)
+	jobs := make(chan job, workers)
+	results := make(chan result, workers)
+	go func() {
+		defer close(jobs)
+		m := first
+		for i := 0; ; i++ {
+			select {
+			case jobs <- job{m, i}:
+			case <-ctx.Done():
+				opts.layout.pool.putMat(m)
+				return
+			}
+			m = opts.layout.pool.mat()
+			if !cap.Read(&m) || m.Empty() {
+				opts.layout.pool.putMat(m)
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				f, _, err := scanMat(j.frame, opts.layout, j.index, nil, 0)
+				opts.layout.pool.putMat(j.frame)
+				if err == nil && f.err == nil {
+					err = placeFrame(w, base, f, per, frames, inputVideo)
+				}
+				results <- result{f, err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	seen := make([]bool, frames)
+	var have, written int64
+	duplicates := 0
+	var probes probeStats
+	var damaged, failed error
+	for r := range results {
+		if failed != nil {
+			continue
+		}
+		if r.err != nil {
+			failed = r.err
+			cancel()
+			continue
+		}
+		f := r.f
+		opts.layout.tally.frame(f.capacity, 0)
+		probes.add(f.probe)
+		switch {
+		case f.err != nil:
+			if damaged == nil {
+				damaged = fmt.Errorf("frame %d: %w", f.index, f.err)
+			}
+		case f.header.index():
+		case seen[f.header.seq]:
+			duplicates++
+		default:
+			seen[f.header.seq] = true
+			have++
+			written += int64(len(f.data))
+			opts.log().Debug("Frame read", "video", inputVideo, "frame", f.index, "seq", f.header.seq, "bytes", len(f.data))
+			if opts.progress != nil {
+				opts.progress(have, opts.frames, written, int64(vi.dataSize))
+			}
+		}
+	}
+	if failed == nil {
+		failed = opts.context().Err()
+	}
+	if failed == nil && have < frames {
+		failed = damaged
+		if failed == nil {
+			for seq, ok := range seen {
+				if !ok {
+					failed = malformed("frame %d is missing", seq)
+					break
+				}
+			}
+		}
+	}
+	if failed != nil {
+		if class := probes.class(); class != "" && opts.context().Err() == nil {
+			failed = fmt.Errorf("%w (host processing looks %s; run check for details)", failed, class)
+		}
+		return true, failed
+	}
+	if written != int64(vi.dataSize) {
+		return true, malformed("%s holds %d bytes, but its index frame says %d", inputVideo, written, vi.dataSize)
+	}
+	if _, err := w.Seek(base+written, io.SeekStart); err != nil {
+		return true, fmt.Errorf("failed to write output: %w", err)
+	}
+	opts.layout.tally.addPayload(written)
+	if duplicates > 0 {
+		opts.log().Info("Skipped duplicated frames", "video", inputVideo, "frames", duplicates)
+	}
+	if class := probes.class(); class != "" && class != "bit-exact" {
+		opts.log().Info("Host processing detected; the video still decoded", "video", inputVideo, "class", class)
+	}
+	return true, nil
+}
+
+// placeFrame writes the data of the intact frame f of a video of frames
+// data frames of per bytes at its offset in w, past base. Anything but a
+// data frame is left out.
+func placeFrame(w io.WriterAt, base int64, f scannedFrame, per, frames int64, video string) error {
+	h := f.header
+	switch {
+	case h.parity():
+		return fmt.Errorf("%s is a recovery volume; use repair with its data video", video)
+	case h.index():
+		return nil
+	case h.table():
+		return malformed("frame %d of %s is a segment table, but the video does not start with one", f.index, video)
+	case h.flags&dataFlags != 0:
+		return malformed("frame %d of %s is flagged as compressed, encrypted or tagged, but its index frame is not", f.index, video)
+	case int64(h.seq) >= frames:
+		return malformed("frame %d claims sequence number %d, but the video has %d data frames", f.index, h.seq, frames)
+	case int64(len(f.data)) > per || int64(h.seq) < frames-1 && int64(len(f.data)) != per:
+		return malformed("frame %d holds %d bytes, not the %d of every frame but the last", f.index, len(f.data), per)
+	}
+	if _, err := w.WriteAt(f.data, base+int64(h.seq)*per); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package f2v
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// A recovery volume is a separate video holding Reed-Solomon parity for a
+// data video. The data frames are grouped into stripes of up to
+// recoveryStripe frames and every stripe gets the same number of parity
+// frames; any mix of damaged or missing frames in a stripe, up to that
+// number, can be rebuilt.
+//
+// The volume uses the data video's layout. Its first and last frames are
+// descriptors (frameFlagInfo) and the frames in between carry the parity,
+// numbered stripe by stripe. Each descriptor holds:
+//
+//	magic       [4]byte "FVRV"
+//	version     uint8
+//	stripe      uint16   data frames per stripe
+//	parity      uint16   parity frames per stripe
+//	dataFrames  uint32
+//	dataSize    uint64
+//	frameBytes  uint32   data bytes per full data frame
+//	sha256      [32]byte of the original data
+const recoveryStripe = 32
+
+const (
+	recoveryInfoSize = 57
+	recoveryVersion  = 1
+)
+
+var recoveryMagic = [4]byte{'F', 'V', 'R', 'V'}
+
+type recoveryInfo struct {
+	stripe     int
+	parity     int
+	dataFrames uint32
+	dataSize   uint64
+	frameBytes uint32
+	sha256     [32]byte
+}
+
+func (ri recoveryInfo) marshal() []byte {
+	buf := make([]byte, recoveryInfoSize)
+	copy(buf, recoveryMagic[:])
+	buf[4] = recoveryVersion
+	binary.BigEndian.PutUint16(buf[5:], uint16(ri.stripe))
+	binary.BigEndian.PutUint16(buf[7:], uint16(ri.parity))
+	binary.BigEndian.PutUint32(buf[9:], ri.dataFrames)
+	binary.BigEndian.PutUint64(buf[13:], ri.dataSize)
+	binary.BigEndian.PutUint32(buf[21:], ri.frameBytes)
+	copy(buf[25:], ri.sha256[:])
+	return buf
+}
+
+func parseRecoveryInfo(buf []byte) (recoveryInfo, error) {
+	var ri recoveryInfo
+	if len(buf) != recoveryInfoSize || !bytes.Equal(buf[:4], recoveryMagic[:]) {
+		return ri, malformed("invalid recovery volume descriptor")
+	}
+	if buf[4] != recoveryVersion {
+		return ri, unsupported("unsupported recovery volume version %d", buf[4])
+	}
+	ri.stripe = int(binary.BigEndian.Uint16(buf[5:]))
+	ri.parity = int(binary.BigEndian.Uint16(buf[7:]))
+	ri.dataFrames = binary.BigEndian.Uint32(buf[9:])
+	ri.dataSize = binary.BigEndian.Uint64(buf[13:])
+	ri.frameBytes = binary.BigEndian.Uint32(buf[21:])
+	copy(ri.sha256[:], buf[25:])
+	if ri.stripe == 0 || ri.parity == 0 || ri.stripe+ri.parity > 256 {
+		return ri, malformed("invalid recovery volume geometry %d+%d", ri.stripe, ri.parity)
+	}
+	if ri.frameBytes == 0 || uint64(ri.dataFrames) != max(1, (ri.dataSize+uint64(ri.frameBytes)-1)/uint64(ri.frameBytes)) {
+		return ri, malformed("recovery volume descriptor lists %d bytes in %d frames of %d", ri.dataSize, ri.dataFrames, ri.frameBytes)
+	}
+	return ri, nil
+}
+
+func (ri recoveryInfo) stripes() int {
+	return (int(ri.dataFrames) + ri.stripe - 1) / ri.stripe
+}
+
+// recoveryPath returns where the recovery volume of a data video is kept.
+func recoveryPath(video string) string {
+	return strings.TrimSuffix(video, ".mkv") + ".par.mkv"
+}
+
+func isRecoveryPath(path string) bool {
+	return strings.HasSuffix(path, ".par.mkv")
+}
+
+// writeRecoveryVolume writes the recovery volume for data, which must have
+// been encoded with the same layout. percent sets the parity frames per
+// stripe relative to its data frames, rounded up.
+func writeRecoveryVolume(data []byte, outputFilename string, l layout, fps, percent int) error {
+	frameBytes := l.capacity() - frameHeaderSize
+	if frameBytes < recoveryInfoSize {
+		return fmt.Errorf("frames of %d bytes are too small for a recovery volume", frameBytes)
+	}
+	dataFrames := max(1, (len(data)+frameBytes-1)/frameBytes)
+	stripe := min(recoveryStripe, dataFrames)
+	info := recoveryInfo{
+		stripe:     stripe,
+		parity:     max(1, (stripe*percent+99)/100),
+		dataFrames: uint32(dataFrames),
+		dataSize:   uint64(len(data)),
+		frameBytes: uint32(frameBytes),
+		sha256:     sha256.Sum256(data),
+	}
+
+	w, err := newFrameWriter(outputFilename, l, fps)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	descriptor := info.marshal()
+	if err := w.write(frameHeader{flags: frameFlagParity | frameFlagInfo}, descriptor); err != nil {
+		return err
+	}
+	var seq uint32
+	for s := 0; s < info.stripes(); s++ {
+		var shards [][]byte
+		for f := s * stripe; f < min((s+1)*stripe, dataFrames); f++ {
+			shards = append(shards, data[min(f*frameBytes, len(data)):min((f+1)*frameBytes, len(data))])
+		}
+		for _, p := range rsEncode(shards, info.parity, frameBytes) {
+			if err := w.write(frameHeader{flags: frameFlagParity, seq: seq}, p); err != nil {
+				return err
+			}
+			seq++
+		}
+	}
+	return w.write(frameHeader{flags: frameFlagParity | frameFlagInfo | frameFlagLast, seq: 1}, descriptor)
+}
+
+// recoveryVolume is the intact content read back from a recovery volume.
+type recoveryVolume struct {
+	info    recoveryInfo
+	parity  map[uint32][]byte // intact parity frames by sequence number
+	damaged int               // frames that failed validation
+}
+
+// stripeParity returns the parity frames of stripe s, nil where lost.
+func (v *recoveryVolume) stripeParity(s int) [][]byte {
+	rows := make([][]byte, v.info.parity)
+	for r := range rows {
+		rows[r] = v.parity[uint32(s*v.info.parity+r)]
+	}
+	return rows
+}
+
+func readRecoveryVolume(path string, l layout) (*recoveryVolume, error) {
+	cap, cleanup, err := openVideo(path, l)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	v := &recoveryVolume{parity: make(map[uint32][]byte)}
+	haveInfo := false
+	err = scanFrames(cap, l, func(f scannedFrame) (bool, error) {
+		if f.err != nil {
+			v.damaged++
+			return true, nil
+		}
+		if !f.header.parity() {
+			return false, fmt.Errorf("%s is a data video, not a recovery volume", path)
+		}
+		if f.header.flags&frameFlagInfo != 0 {
+			if !haveInfo {
+				info, err := parseRecoveryInfo(f.data)
+				if err != nil {
+					return false, err
+				}
+				if want := l.capacity() - frameHeaderSize; int(info.frameBytes) != want {
+					return false, malformed("%s was made for frames of %d bytes, not %d; give the data video's settings", path, info.frameBytes, want)
+				}
+				v.info, haveInfo = info, true
+			}
+			return !f.header.last(), nil
+		}
+		if _, ok := v.parity[f.header.seq]; !ok {
+			v.parity[f.header.seq] = f.data
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !haveInfo {
+		return nil, fmt.Errorf("recovery volume %s has no intact descriptor frame", path)
+	}
+	// Parity frames are always full; any other length would be read past
+	for seq, p := range v.parity {
+		if len(p) != int(v.info.frameBytes) {
+			delete(v.parity, seq)
+			v.damaged++
+		}
+	}
+	return v, nil
+}
+
+// Reed-Solomon coding over GF(2^8) with a Cauchy matrix: parity row r is
+// the sum over data frames c of cauchy(r, c) * frame c. Every square
+// submatrix of a Cauchy matrix is invertible, so any set of lost data
+// frames can be solved from as many surviving parity rows.
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c*src to dst; src may be shorter than dst.
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	lc := int(gfLog[c])
+	for i, b := range src {
+		if b != 0 {
+			dst[i] ^= gfExp[lc+int(gfLog[b])]
+		}
+	}
+}
+
+// cauchy returns the coefficient of data frame col in parity row row, out of
+// parity rows. Rows and columns use disjoint field elements.
+func cauchy(parity, row, col int) byte {
+	return gfInv(byte(row) ^ byte(parity+col))
+}
+
+// rsEncode computes parity rows of size bytes over the data shards; shorter
+// shards count as zero padded.
+func rsEncode(shards [][]byte, parity, size int) [][]byte {
+	out := make([][]byte, parity)
+	for r := range out {
+		out[r] = make([]byte, size)
+		for c, s := range shards {
+			gfMulAdd(out[r], s, cauchy(parity, r, c))
+		}
+	}
+	return out
+}
+
+// rsReconstruct fills the nil entries of shards from the surviving parity
+// rows (nil marks a lost one). Rebuilt shards are size bytes long.
+func rsReconstruct(shards, parity [][]byte, size int) error {
+	var missing, rows []int
+	for c, s := range shards {
+		if s == nil {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	for r, p := range parity {
+		if p != nil {
+			rows = append(rows, r)
+		}
+	}
+	if len(rows) < len(missing) {
+		return fmt.Errorf("%d frames lost but only %d parity frames left", len(missing), len(rows))
+	}
+	rows = rows[:len(missing)]
+
+	// Remove the known frames from each parity row, leaving the sum over
+	// the missing ones, then solve for them.
+	syndromes := make([][]byte, len(rows))
+	matrix := make([][]byte, len(rows))
+	for a, r := range rows {
+		syndromes[a] = bytes.Clone(parity[r])
+		for c, s := range shards {
+			if s != nil {
+				gfMulAdd(syndromes[a], s, cauchy(len(parity), r, c))
+			}
+		}
+		matrix[a] = make([]byte, len(missing))
+		for b, c := range missing {
+			matrix[a][b] = cauchy(len(parity), r, c)
+		}
+	}
+	inverse, err := gfInvert(matrix)
+	if err != nil {
+		return err
+	}
+	for b, c := range missing {
+		shard := make([]byte, size)
+		for a := range rows {
+			gfMulAdd(shard, syndromes[a], inverse[b][a])
+		}
+		shards[c] = shard
+	}
+	return nil
+}
+
+// gfInvert inverts a square matrix by Gauss-Jordan elimination.
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	a := make([][]byte, n)
+	for i := range m {
+		a[i] = make([]byte, 2*n)
+		copy(a[i], m[i])
+		a[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && a[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, fmt.Errorf("parity matrix is singular")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		inv := gfInv(a[col][col])
+		for k := range a[col] {
+			a[col][k] = gfMul(a[col][k], inv)
+		}
+		for r := 0; r < n; r++ {
+			if r != col {
+				gfMulAdd(a[r], a[col], a[r][col])
+			}
+		}
+	}
+	out := make([][]byte, n)
+	for i := range a {
+		out[i] = a[i][n:]
+	}
+	return out, nil
+}
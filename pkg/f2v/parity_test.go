@@ -0,0 +1,203 @@
+package f2v
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestReedSolomonReconstruct(t *testing.T) {
+	const size, parity = 100, 3
+	shards := make([][]byte, 10)
+	for i := range shards {
+		shards[i] = randomBytes(t, size)
+	}
+	// A short last shard counts as zero padded
+	shards[9] = shards[9][:40]
+	rows := rsEncode(shards, parity, size)
+
+	for _, lost := range [][]int{{0}, {9}, {2, 5}, {0, 4, 9}} {
+		damaged := slices.Clone(shards)
+		for _, i := range lost {
+			damaged[i] = nil
+		}
+		if err := rsReconstruct(damaged, rows, size); err != nil {
+			t.Errorf("losing shards %v: %v", lost, err)
+			continue
+		}
+		for _, i := range lost {
+			if !bytes.Equal(damaged[i][:len(shards[i])], shards[i]) {
+				t.Errorf("losing shards %v rebuilt shard %d wrong", lost, i)
+			}
+		}
+	}
+
+	// Lost parity rows only matter once they leave too few
+	damaged := slices.Clone(shards)
+	damaged[1], damaged[7] = nil, nil
+	if err := rsReconstruct(damaged, [][]byte{nil, rows[1], rows[2]}, size); err != nil || !bytes.Equal(damaged[7], shards[7]) {
+		t.Errorf("losing two shards and a parity row: %v", err)
+	}
+	damaged[1], damaged[7] = nil, nil
+	if err := rsReconstruct(damaged, [][]byte{nil, rows[1], nil}, size); err == nil {
+		t.Error("rebuilt two shards from one parity row")
+	}
+	damaged = slices.Clone(shards)
+	damaged[0], damaged[1], damaged[2], damaged[3] = nil, nil, nil, nil
+	if err := rsReconstruct(damaged, rows, size); err == nil {
+		t.Error("rebuilt four shards from three parity rows")
+	}
+}
+
+// smallLayout is a layout of small PNG frames, quick to write and read.
+func smallLayout() layout {
+	l := defaultLayout()
+	l.width, l.height, l.backend = 64, 48, PNGSequence{}
+	return l
+}
+
+// damageFrame overwrites frame i of the PNG sequence in dir with noise.
+func damageFrame(t *testing.T, dir string, i int) {
+	t.Helper()
+	frames, err := filepath.Glob(filepath.Join(dir, "*.png"))
+	if err != nil || i >= len(frames) {
+		t.Fatalf("%s has no frame %d", dir, i)
+	}
+	l := smallLayout()
+	img := image.NewRGBA(image.Rect(0, 0, l.width, l.height))
+	copy(img.Pix, randomBytes(t, len(img.Pix)))
+	f, err := os.Create(frames[i])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// removeFrame deletes frame i of the PNG sequence in dir.
+func removeFrame(t *testing.T, dir string, i int) {
+	t.Helper()
+	frames, err := filepath.Glob(filepath.Join(dir, "*.png"))
+	if err != nil || i >= len(frames) {
+		t.Fatalf("%s has no frame %d", dir, i)
+	}
+	if err := os.Remove(frames[i]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// encodeWithParity encodes data into a small video with a recovery volume
+// of parity percent and returns the video's path.
+func encodeWithParity(t *testing.T, data []byte, parity int) string {
+	t.Helper()
+	video := filepath.Join(t.TempDir(), "data.mkv")
+	if err := encodeStream("data.bin", "data.bin", bytes.NewReader(data), video, encodeOptions{layout: smallLayout(), fps: defaultFPS, parity: parity}); err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+func TestRepairVideo(t *testing.T) {
+	data := randomBytes(t, 50<<10)
+	video := encodeWithParity(t, data, 50)
+	volume := recoveryPath(video)
+	l := smallLayout()
+
+	v, err := readRecoveryVolume(volume, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.damaged != 0 || len(v.parity) != v.info.stripes()*v.info.parity || v.info.stripes() != 1 || v.info.parity != 3 {
+		t.Fatalf("read %d parity frames of %d+%d stripes, %d damaged", len(v.parity), v.info.stripe, v.info.parity, v.damaged)
+	}
+
+	// Two data frames lost, and the first descriptor and a parity frame
+	// corrupted
+	damageFrame(t, video, 1)
+	removeFrame(t, video, 3)
+	damageFrame(t, volume, 0)
+	damageFrame(t, volume, 1)
+
+	r, err := repairVideo(video, volume, l)
+	if err != nil {
+		t.Fatalf("repairing: %v", err)
+	}
+	if len(r.rebuilt) != 2 || r.damagedParity < 1 {
+		t.Errorf("rebuilt frames %v with %d damaged parity frames", r.rebuilt, r.damagedParity)
+	}
+	got, err := unwrapPayload(r.data, r.flags, nil, discardLog)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("repaired data of %d bytes, %v", len(got), err)
+	}
+
+	// A third lost frame is one more than the parity frames left
+	removeFrame(t, video, 0)
+	if _, err := repairVideo(video, volume, l); err == nil {
+		t.Error("repaired more lost frames than there are parity frames")
+	}
+	if _, err := repairVideo(volume, video, l); err == nil {
+		t.Error("repaired a recovery volume as a data video")
+	}
+}
+
+func TestRecoveryVolumeWithoutDescriptor(t *testing.T) {
+	video := encodeWithParity(t, randomBytes(t, 10<<10), 100)
+	volume := recoveryPath(video)
+	frames, _ := filepath.Glob(filepath.Join(volume, "*.png"))
+	damageFrame(t, volume, 0)
+	damageFrame(t, volume, len(frames)-1)
+	if _, err := readRecoveryVolume(volume, smallLayout()); err == nil {
+		t.Error("read a recovery volume with both descriptors damaged")
+	}
+	if _, err := readRecoveryVolume(video, smallLayout()); err == nil {
+		t.Error("read a data video as a recovery volume")
+	}
+}
+
+func TestParseRecoveryInfo(t *testing.T) {
+	ri := recoveryInfo{stripe: 32, parity: 4, dataFrames: 40, dataSize: 40*1000 - 5, frameBytes: 1000}
+	ri.sha256[0] = 1
+	if got, err := parseRecoveryInfo(ri.marshal()); err != nil || got != ri {
+		t.Errorf("descriptor came back as %+v, %v", got, err)
+	}
+	with := func(change func(*recoveryInfo)) []byte {
+		c := ri
+		change(&c)
+		return c.marshal()
+	}
+	for _, c := range []struct {
+		what string
+		buf  []byte
+		want error
+	}{
+		{"short", ri.marshal()[:recoveryInfoSize-1], ErrCorruptFrame},
+		{"no magic", append([]byte("FVRX"), ri.marshal()[4:]...), ErrCorruptFrame},
+		{"version 2", append([]byte("FVRV\x02"), ri.marshal()[5:]...), ErrUnsupportedVersion},
+		{"no parity", with(func(c *recoveryInfo) { c.parity = 0 }), ErrCorruptFrame},
+		{"stripes past 256 frames", with(func(c *recoveryInfo) { c.stripe, c.parity = 200, 57 }), ErrCorruptFrame},
+		{"empty frames", with(func(c *recoveryInfo) { c.frameBytes = 0 }), ErrCorruptFrame},
+		{"too many frames", with(func(c *recoveryInfo) { c.dataFrames = 41 }), ErrCorruptFrame},
+		{"too few frames", with(func(c *recoveryInfo) { c.dataFrames = 1 << 20; c.dataSize = 1 << 40 }), ErrCorruptFrame},
+	} {
+		if _, err := parseRecoveryInfo(c.buf); !errors.Is(err, c.want) {
+			t.Errorf("%s descriptor: %v, want %v", c.what, err, c.want)
+		}
+	}
+}
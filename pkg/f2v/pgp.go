@@ -0,0 +1,93 @@
+package f2v
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// Data can also be encrypted to OpenPGP public keys, for backup policies
+// that mandate PGP, and decrypted with a secret keyring exported from gpg.
+// The payload is then a binary OpenPGP message holding the same
+// name-prefixed plaintext. A packet's tag byte always has its top bit set,
+// which neither an FVE envelope nor an age header does, so that is what
+// marks it.
+
+func isPGPMessage(data []byte) bool {
+	return len(data) > 0 && data[0]&0x80 != 0
+}
+
+// loadPGPKeys reads every key in an armored or binary key file.
+func loadPGPKeys(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OpenPGP key file: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var keys openpgp.EntityList
+	if start, _ := r.Peek(10); bytes.Equal(start, []byte("-----BEGIN")) {
+		keys, err = openpgp.ReadArmoredKeyRing(r)
+	} else {
+		keys, err = openpgp.ReadKeyRing(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid OpenPGP key file %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// pgpConfig asks for AES-256 where the recipients' preferences allow it.
+var pgpConfig = &packet.Config{DefaultCipher: packet.CipherAES256}
+
+// pgpEncrypt returns a writer that encrypts to every recipient key into
+// dst.
+func pgpEncrypt(dst io.Writer, recipients openpgp.EntityList) (io.WriteCloser, error) {
+	w, err := openpgp.Encrypt(dst, recipients, nil, &openpgp.FileHints{IsBinary: true}, pgpConfig)
+	if err != nil {
+		return nil, fmt.Errorf("OpenPGP: %w", err)
+	}
+	return w, nil
+}
+
+// pgpDecrypt decrypts an OpenPGP message with a key from keyring, asking
+// for the passphrase of a protected key once.
+func pgpDecrypt(data []byte, keyring openpgp.EntityList) ([]byte, error) {
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("the video was encrypted to OpenPGP keys; give -pgp-keyring")
+	}
+	asked := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if asked || len(keys) == 0 {
+			return nil, fmt.Errorf("wrong passphrase for the OpenPGP key")
+		}
+		asked = true
+		pass, err := readPassword(fmt.Sprintf("Passphrase for OpenPGP key %X", keys[0].PublicKey.KeyId), false)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			k.PrivateKey.Decrypt(pass)
+		}
+		return nil, nil
+	}
+	md, err := openpgp.ReadMessage(bytes.NewReader(data), keyring, prompt, pgpConfig)
+	if errors.Is(err, pgperrors.ErrKeyIncorrect) {
+		return nil, fmt.Errorf("none of the -pgp-keyring keys is a recipient of the video")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("OpenPGP: %w", err)
+	}
+	plain, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, mismatched("decryption failed: the data was altered (%v)", err)
+	}
+	return plain, nil
+}
@@ -0,0 +1,321 @@
+package f2v
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Storage and video formats the tool has no code for plug in as programs,
+// so a proprietary store needs no fork: an executable called f2v-<name> on
+// the PATH handles locations of the form <name>://... and -backend <name>.
+// The tool runs it once for every object or video, with a verb and its
+// arguments, and the data goes over its standard input and output:
+//
+//	f2v-<name> open <location>     write the object to stdout
+//	f2v-<name> list <location>     write the locations of the objects under it, one a line
+//	f2v-<name> create <location>   store what stdin brings, once it ends, as the object
+//	f2v-<name> write <path> <codec> <fps> <width> <height>
+//	                               make a video of the frames stdin brings, width*height*3 BGR bytes each
+//	f2v-<name> read <path>         write "<width> <height> <fps> <frames>\n", then the frames, to stdout
+//
+// An object being created that an encode describes (see uploadmeta.go)
+// comes with its title, description, tags, comma separated, and visibility
+// in the variables F2V_UPLOAD_TITLE, F2V_UPLOAD_DESCRIPTION,
+// F2V_UPLOAD_TAGS and F2V_UPLOAD_VISIBILITY, for a plugin uploading to a
+// host such as YouTube to pass on.
+//
+// A plugin fails by exiting non-zero, with what went wrong on stderr, which
+// the tool passes through, and exits non-zero for verbs it does not take. An
+// object being created must not appear until the plugin exits 0: a plugin
+// killed before then is being told to abandon it.
+
+// pluginProgram names the program of the plugin called name.
+func pluginProgram(name string) string {
+	return "f2v-" + name
+}
+
+// pluginPaths caches where the programs of plugins were found, "" for not.
+var pluginPaths sync.Map
+
+// havePlugin reports whether the plugin called name is on the PATH.
+func havePlugin(name string) bool {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return false
+	}
+	if path, ok := pluginPaths.Load(name); ok {
+		return path != ""
+	}
+	path, err := exec.LookPath(pluginProgram(name))
+	if err != nil {
+		path = ""
+	}
+	pluginPaths.Store(name, path)
+	return path != ""
+}
+
+// pluginScheme returns the plugin location is handled by, if any: the
+// scheme of a <name>://... location that the tool has no code for and a
+// plugin is installed for.
+func pluginScheme(location string) (string, bool) {
+	scheme, _, ok := strings.Cut(location, "://")
+	if !ok || scheme == "http" || scheme == "https" || scheme == "s3" {
+		return "", false
+	}
+	for _, c := range scheme {
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '+' || c == '.') {
+			return "", false
+		}
+	}
+	return scheme, havePlugin(scheme)
+}
+
+// Plugin is a Source and Sink whose objects a plugin program, f2v-Name,
+// stores; names are the whole locations, name://...
+type Plugin struct {
+	Name string
+}
+
+func (p Plugin) command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, pluginProgram(p.Name), args...)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// Open opens the object at name.
+func (p Plugin) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	cmd := p.command(ctx, "open", name)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start plugin %s: %w", p.Name, err)
+	}
+	return &pluginReader{r: stdout, plugin: p.Name, cmd: cmd}, nil
+}
+
+// List returns the locations of the objects under prefix, sorted.
+func (p Plugin) List(ctx context.Context, prefix string) ([]string, error) {
+	out, err := p.command(ctx, "list", prefix).Output()
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s failed to list %s: %w", p.Name, prefix, err)
+	}
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// Create starts writing the object at name.
+func (p Plugin) Create(ctx context.Context, name string) (SinkWriter, error) {
+	return p.create(p.command(ctx, "create", name))
+}
+
+// CreateDescribed starts writing the object at name, telling the plugin m
+// in its environment.
+func (p Plugin) CreateDescribed(ctx context.Context, name string, m UploadMetadata) (SinkWriter, error) {
+	cmd := p.command(ctx, "create", name)
+	cmd.Env = append(os.Environ(),
+		"F2V_UPLOAD_TITLE="+m.Title,
+		"F2V_UPLOAD_DESCRIPTION="+m.Description,
+		"F2V_UPLOAD_TAGS="+strings.Join(m.Tags, ","),
+		"F2V_UPLOAD_VISIBILITY="+m.Visibility)
+	return p.create(cmd)
+}
+
+func (p Plugin) create(cmd *exec.Cmd) (SinkWriter, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start plugin %s: %w", p.Name, err)
+	}
+	return &pluginWriter{w: stdin, plugin: p.Name, cmd: cmd}, nil
+}
+
+// pluginReader reads what a plugin writes to its stdout, failing rather
+// than ending if the plugin does.
+type pluginReader struct {
+	r      io.Reader
+	plugin string
+	cmd    *exec.Cmd
+	waited bool
+	err    error // of the plugin, once it has exited
+}
+
+func (r *pluginReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		if werr := r.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (r *pluginReader) wait() error {
+	if !r.waited {
+		r.waited = true
+		if err := r.cmd.Wait(); err != nil {
+			r.err = fmt.Errorf("plugin %s failed: %w", r.plugin, err)
+		}
+	}
+	return r.err
+}
+
+// Close stops the plugin if it is not done yet.
+func (r *pluginReader) Close() error {
+	if !r.waited {
+		r.cmd.Process.Kill()
+		r.wait()
+		return nil
+	}
+	return r.err
+}
+
+// pluginWriter feeds a plugin's stdin.
+type pluginWriter struct {
+	w      io.WriteCloser
+	plugin string
+	cmd    *exec.Cmd
+	done   bool
+}
+
+func (w *pluginWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("plugin %s stopped reading: %w", w.plugin, err)
+	}
+	return n, nil
+}
+
+// Finalize ends the input and waits for the plugin to succeed.
+func (w *pluginWriter) Finalize() error {
+	w.done = true
+	w.w.Close()
+	if err := w.cmd.Wait(); err != nil {
+		return fmt.Errorf("plugin %s failed: %w", w.plugin, err)
+	}
+	return nil
+}
+
+// Close kills the plugin unless it finished, abandoning the object.
+func (w *pluginWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.cmd.Process.Kill()
+	w.w.Close()
+	w.cmd.Wait()
+	return nil
+}
+
+// PluginBackend is a CodecBackend whose videos a plugin program, f2v-Name,
+// writes and reads. Its videos are read in order only.
+type PluginBackend struct {
+	Name string
+}
+
+// Create starts the plugin writing a video at path.
+func (b PluginBackend) Create(path, codec string, fps float64, width, height int) (VideoWriter, error) {
+	cmd := Plugin(b).command(context.Background(), "write", path, codec, strconv.FormatFloat(fps, 'f', -1, 64), strconv.Itoa(width), strconv.Itoa(height))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%w: failed to start plugin %s: %w", ErrCodecUnavailable, b.Name, err)
+	}
+	return &pluginVideoWriter{pluginWriter: pluginWriter{w: stdin, plugin: b.Name, cmd: cmd}, size: width * height * 3}, nil
+}
+
+// Open starts the plugin reading the video at path.
+func (b PluginBackend) Open(path string) (VideoReader, error) {
+	cmd := Plugin(b).command(context.Background(), "read", path)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%w: failed to start plugin %s: %w", ErrCodecUnavailable, b.Name, err)
+	}
+	r := &pluginVideoReader{pluginReader: pluginReader{plugin: b.Name, cmd: cmd}}
+	br := bufio.NewReader(stdout)
+	r.pluginReader.r = br
+	line, err := br.ReadString('\n')
+	if err != nil {
+		err = r.wait()
+		r.Close()
+		if err == nil {
+			err = fmt.Errorf("plugin %s sent no video description for %s", b.Name, path)
+		}
+		return nil, err
+	}
+	var info VideoInfo
+	if _, err := fmt.Sscan(line, &info.Width, &info.Height, &info.FPS, &info.Frames); err != nil || info.Width <= 0 || info.Height <= 0 {
+		r.Close()
+		return nil, fmt.Errorf("plugin %s described %s as %q, not \"<width> <height> <fps> <frames>\"", b.Name, path, strings.TrimSpace(line))
+	}
+	r.info, r.frame = info, make([]byte, info.Width*info.Height*3)
+	return r, nil
+}
+
+type pluginVideoWriter struct {
+	pluginWriter
+	size int
+}
+
+func (w *pluginVideoWriter) WriteFrame(bgr []byte) error {
+	if len(bgr) != w.size {
+		return fmt.Errorf("frame of %d bytes does not fit the video's %d", len(bgr), w.size)
+	}
+	_, err := w.Write(bgr)
+	return err
+}
+
+// Close finishes the video.
+func (w *pluginVideoWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	return w.Finalize()
+}
+
+type pluginVideoReader struct {
+	pluginReader
+	info  VideoInfo
+	frame []byte
+}
+
+func (r *pluginVideoReader) Info() VideoInfo {
+	return r.info
+}
+
+func (r *pluginVideoReader) ReadFrame() ([]byte, int, int, error) {
+	if _, err := io.ReadFull(&r.pluginReader, r.frame); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("plugin %s sent part of a frame", r.plugin)
+		}
+		return nil, 0, 0, err
+	}
+	return r.frame, r.info.Width, r.info.Height, nil
+}
+
+func (r *pluginVideoReader) SeekFrame(frame int64) error {
+	return fmt.Errorf("plugin %s reads videos in order: %w", r.plugin, errors.ErrUnsupported)
+}
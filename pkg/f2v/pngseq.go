@@ -0,0 +1,167 @@
+package f2v
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PNGSequence writes each video as a folder of numbered PNG images, one a
+// frame, with the frame size and rate in a sequence.json beside them. It
+// needs nothing but Go, PNG is lossless so frames of every mode come back
+// exactly as written, and the frames are images any tool can look at. The
+// codec asked for is ignored.
+type PNGSequence struct{}
+
+// pngSequenceInfo names the file of a PNG sequence that describes it.
+const pngSequenceInfo = "sequence.json"
+
+// isFrameSequence reports whether path is the folder of a PNG sequence,
+// which is read as a video rather than walked as a folder of them.
+func isFrameSequence(path string) bool {
+	_, err := os.Stat(filepath.Join(path, pngSequenceInfo))
+	return err == nil
+}
+
+type pngSequenceHeader struct {
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	FPS    float64 `json:"fps"`
+	Frames int64   `json:"frames"`
+}
+
+// Create starts a sequence in the folder path, which is created if need be
+// and must hold no other sequence.
+func (PNGSequence) Create(path, codec string, fps float64, width, height int) (VideoWriter, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(path, pngSequenceInfo)); err == nil {
+		return nil, fmt.Errorf("%s already holds a frame sequence", path)
+	}
+	return &pngWriter{dir: path, info: pngSequenceHeader{Width: width, Height: height, FPS: fps}, img: image.NewRGBA(image.Rect(0, 0, width, height))}, nil
+}
+
+// Open opens the sequence in the folder path. One still being written reads
+// as far as its frames go.
+func (PNGSequence) Open(path string) (VideoReader, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &pngReader{dir: path}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".png") {
+			r.frames = append(r.frames, e.Name())
+		}
+	}
+	sort.Strings(r.frames)
+	if data, err := os.ReadFile(filepath.Join(path, pngSequenceInfo)); err == nil {
+		if err := json.Unmarshal(data, &r.info); err != nil {
+			return nil, fmt.Errorf("invalid %s in %s: %w", pngSequenceInfo, path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	r.info.Frames = int64(len(r.frames))
+	return r, nil
+}
+
+type pngWriter struct {
+	dir  string
+	info pngSequenceHeader
+	img  *image.RGBA
+}
+
+func (w *pngWriter) WriteFrame(bgr []byte) error {
+	if len(bgr) != w.info.Width*w.info.Height*3 {
+		return fmt.Errorf("frame of %d bytes does not fit a %dx%d sequence", len(bgr), w.info.Width, w.info.Height)
+	}
+	for i, j := 0, 0; i < len(bgr); i, j = i+3, j+4 {
+		w.img.Pix[j], w.img.Pix[j+1], w.img.Pix[j+2], w.img.Pix[j+3] = bgr[i+2], bgr[i+1], bgr[i], 0xff
+	}
+	f, err := os.Create(filepath.Join(w.dir, fmt.Sprintf("%08d.png", w.info.Frames)))
+	if err != nil {
+		return err
+	}
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := enc.Encode(f, w.img); err != nil {
+		f.Close()
+		return err
+	}
+	w.info.Frames++
+	return f.Close()
+}
+
+// Close writes sequence.json, which marks the sequence finished.
+func (w *pngWriter) Close() error {
+	data, err := json.MarshalIndent(w.info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(w.dir, pngSequenceInfo), data, 0644)
+}
+
+type pngReader struct {
+	dir    string
+	info   pngSequenceHeader
+	frames []string
+	next   int
+	bgr    []byte
+}
+
+func (r *pngReader) Info() VideoInfo {
+	return VideoInfo{Width: r.info.Width, Height: r.info.Height, FPS: r.info.FPS, Frames: r.info.Frames}
+}
+
+func (r *pngReader) ReadFrame() ([]byte, int, int, error) {
+	if r.next >= len(r.frames) {
+		return nil, 0, 0, io.EOF
+	}
+	f, err := os.Open(filepath.Join(r.dir, r.frames[r.next]))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("frame %s of %s: %w", r.frames[r.next], r.dir, err)
+	}
+	r.next++
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if n := width * height * 3; len(r.bgr) != n {
+		r.bgr = make([]byte, n)
+	}
+	rgba, fast := img.(*image.RGBA)
+	i := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if fast {
+				p := rgba.PixOffset(x, y)
+				r.bgr[i], r.bgr[i+1], r.bgr[i+2] = rgba.Pix[p+2], rgba.Pix[p+1], rgba.Pix[p]
+			} else {
+				cr, cg, cb, _ := img.At(x, y).RGBA()
+				r.bgr[i], r.bgr[i+1], r.bgr[i+2] = byte(cb>>8), byte(cg>>8), byte(cr>>8)
+			}
+			i += 3
+		}
+	}
+	return r.bgr, width, height, nil
+}
+
+func (r *pngReader) SeekFrame(frame int64) error {
+	r.next = int(min(max(frame, 0), int64(len(r.frames))))
+	return nil
+}
+
+func (r *pngReader) Close() error {
+	return nil
+}
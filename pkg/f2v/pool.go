@@ -0,0 +1,82 @@
+package f2v
+
+import (
+	"sync"
+)
+
+// framePool keeps the frame buffers and Mats of finished videos for the
+// next ones, so a long-lived Encoder, Decoder or server does not allocate
+// them again for every file. It is safe for concurrent use, and the zero
+// framePool is empty and ready; a nil one allocates afresh every time.
+type framePool struct {
+	mu   sync.Mutex
+	bufs map[int][][]byte // free buffers by length
+	mats []mat
+}
+
+// poolKeep is how many buffers of a length, and how many Mats, a pool
+// keeps; more are let go. It covers a handful of videos encoded or decoded
+// at once.
+const poolKeep = 8
+
+// buffer returns a zeroed buffer of n bytes.
+func (p *framePool) buffer(n int) []byte {
+	if p == nil {
+		return make([]byte, n)
+	}
+	p.mu.Lock()
+	free := p.bufs[n]
+	if len(free) == 0 {
+		p.mu.Unlock()
+		return make([]byte, n)
+	}
+	b := free[len(free)-1]
+	p.bufs[n] = free[:len(free)-1]
+	p.mu.Unlock()
+	clear(b)
+	return b
+}
+
+// putBuffer hands b back once nothing uses it any more.
+func (p *framePool) putBuffer(b []byte) {
+	if p == nil || b == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bufs == nil {
+		p.bufs = make(map[int][][]byte)
+	}
+	if len(p.bufs[len(b)]) < poolKeep {
+		p.bufs[len(b)] = append(p.bufs[len(b)], b)
+	}
+}
+
+// mat returns a Mat to read frames into.
+func (p *framePool) mat() mat {
+	if p == nil {
+		return newMat()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.mats) == 0 {
+		return newMat()
+	}
+	m := p.mats[len(p.mats)-1]
+	p.mats = p.mats[:len(p.mats)-1]
+	return m
+}
+
+// putMat hands m back, or closes it when the pool is full.
+func (p *framePool) putMat(m mat) error {
+	if p == nil {
+		return m.Close()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.mats) >= poolKeep {
+		return m.Close()
+	}
+	p.mats = append(p.mats, m)
+	return nil
+}
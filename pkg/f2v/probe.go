@@ -0,0 +1,228 @@
+package f2v
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+)
+
+// Frames with sync markers also carry a probe: a strip of known content in
+// the top band, between the markers. Comparing what comes back with what was
+// drawn tells how the host processed the video, which explains decode
+// failures better than a checksum mismatch alone.
+//
+// The strip starts with probeCodeBits coarse cells spelling out the probe
+// version and the frame mode, readable even after heavy compression. The
+// rest is split evenly into a one-pixel checkerboard (lost first when a host
+// blurs, rescales or compresses), a four-pixel checkerboard and a gray ramp
+// (which shows level shifts).
+
+const (
+	probeVersion  = 1
+	probeCodeBits = 8
+	probeCellSize = 8
+)
+
+// probeRect returns where the probe sits in the frame, or an empty rectangle
+// when the layout has no marker bands or they are too narrow for one.
+func (l layout) probeRect() image.Rectangle {
+	if !l.markers {
+		return image.Rectangle{}
+	}
+	r := image.Rect(2*markerSize, 2, l.width-2*markerSize, markerSize-2)
+	if r.Dx() < probeCodeBits*probeCellSize+48 {
+		return image.Rectangle{}
+	}
+	return r
+}
+
+func (l layout) probeCode() int {
+	return probeVersion<<4 | int(l.mode)
+}
+
+// probeRegion tells which part of the probe an x offset falls in.
+type probeRegion int
+
+const (
+	probeCodeRegion probeRegion = iota
+	probeFineRegion
+	probeCoarseRegion
+	probeRampRegion
+)
+
+func probeRegionAt(x, width int) (probeRegion, int) {
+	code := probeCodeBits * probeCellSize
+	if x < code {
+		return probeCodeRegion, x
+	}
+	third := (width - code) / 3
+	switch x -= code; {
+	case x < third:
+		return probeFineRegion, x
+	case x < 2*third:
+		return probeCoarseRegion, x - third
+	}
+	return probeRampRegion, x - 2*third
+}
+
+// probeValue returns the gray level drawn at offset (x, y) inside the probe.
+func (l layout) probeValue(x, y, width int) byte {
+	region, rx := probeRegionAt(x, width)
+	switch region {
+	case probeCodeRegion:
+		if l.probeCode()>>(probeCodeBits-1-rx/probeCellSize)&1 == 1 {
+			return 255
+		}
+		return 0
+	case probeFineRegion:
+		if (rx+y)%2 == 0 {
+			return 192
+		}
+		return 64
+	case probeCoarseRegion:
+		if (rx/4+y/4)%2 == 0 {
+			return 224
+		}
+		return 32
+	}
+	rampWidth := width - probeCodeBits*probeCellSize - 2*((width-probeCodeBits*probeCellSize)/3)
+	return byte(rx * 255 / max(1, rampWidth-1))
+}
+
+func (l layout) drawProbe(frameData []byte) {
+	r := l.probeRect()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			v := l.probeValue(x-r.Min.X, y-r.Min.Y, r.Dx())
+			offset := (y*l.width + x) * 3
+			frameData[offset], frameData[offset+1], frameData[offset+2] = v, v, v
+		}
+	}
+}
+
+// probeReading is what one frame's probe looked like after the host.
+type probeReading struct {
+	ok     bool    // the frame has a probe
+	exact  bool    // every probe pixel came back unchanged
+	error  float64 // mean absolute difference in gray levels, code cells excluded
+	detail float64 // fraction of the one-pixel checkerboard's contrast left
+	code   int     // probe version and frame mode read from the code cells
+}
+
+// readProbe measures the probe of an aligned frame.
+func (l layout) readProbe(frameData []byte) probeReading {
+	r := l.probeRect()
+	if r.Empty() {
+		return probeReading{}
+	}
+	p := probeReading{ok: true, exact: true}
+	var cells [probeCodeBits]int
+	diffSum, n := 0.0, 0
+	contrastSum, contrastN := 0.0, 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			offset := (y*l.width + x) * 3
+			got := (int(frameData[offset]) + int(frameData[offset+1]) + int(frameData[offset+2])) / 3
+			want := int(l.probeValue(x-r.Min.X, y-r.Min.Y, r.Dx()))
+			if got != want || frameData[offset] != frameData[offset+1] || frameData[offset] != frameData[offset+2] {
+				p.exact = false
+			}
+			region, rx := probeRegionAt(x-r.Min.X, r.Dx())
+			switch region {
+			case probeCodeRegion:
+				cells[rx/probeCellSize] += got
+				continue
+			case probeFineRegion:
+				if next, _ := probeRegionAt(x+1-r.Min.X, r.Dx()); next == probeFineRegion {
+					o := offset + 3
+					neighbour := (int(frameData[o]) + int(frameData[o+1]) + int(frameData[o+2])) / 3
+					contrastSum += math.Abs(float64(got - neighbour))
+					contrastN++
+				}
+			}
+			diffSum += math.Abs(float64(got - want))
+			n++
+		}
+	}
+	p.error = diffSum / float64(n)
+	if contrastN > 0 {
+		p.detail = min(1, contrastSum/float64(contrastN)/128)
+	}
+	cellPixels := probeCellSize * r.Dy()
+	for i, sum := range cells {
+		if sum/cellPixels >= 128 {
+			p.code |= 1 << (probeCodeBits - 1 - i)
+		}
+	}
+	// Videos made before probes existed have a plain band here
+	if p.code>>4 != probeVersion {
+		return probeReading{}
+	}
+	return p
+}
+
+// probeStats accumulates probe readings over a video.
+type probeStats struct {
+	frames    int
+	exact     int
+	errorSum  float64
+	detailSum float64
+	maxError  float64
+	codes     map[int]int
+}
+
+func (s *probeStats) add(p probeReading) {
+	if !p.ok {
+		return
+	}
+	if s.codes == nil {
+		s.codes = make(map[int]int)
+	}
+	s.frames++
+	if p.exact {
+		s.exact++
+	}
+	s.errorSum += p.error
+	s.detailSum += p.detail
+	s.maxError = max(s.maxError, p.error)
+	s.codes[p.code]++
+}
+
+// probeMildError is the mean error, in gray levels, up to which processing
+// still counts as mild.
+const probeMildError = 8
+
+// class summarizes what the host did: "bit-exact" when every probe came back
+// unchanged, "mild" for light compression that kept fine detail and levels,
+// "heavy" otherwise.
+func (s *probeStats) class() string {
+	switch {
+	case s.frames == 0:
+		return ""
+	case s.exact == s.frames:
+		return "bit-exact"
+	case s.errorSum/float64(s.frames) <= probeMildError:
+		return "mild"
+	}
+	return "heavy"
+}
+
+// print writes the diagnostics, including a warning when the frames say they
+// were made in another mode than the one used to decode.
+func (s *probeStats) print(w io.Writer, l layout) {
+	if s.frames == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Host processing: %s (%d of %d probes exact, mean error %.1f levels, worst %.1f, fine detail %.0f%% retained)\n",
+		s.class(), s.exact, s.frames, s.errorSum/float64(s.frames), s.maxError, 100*s.detailSum/float64(s.frames))
+	code, seen := 0, 0
+	for c, n := range s.codes {
+		if n > seen {
+			code, seen = c, n
+		}
+	}
+	if seen*2 > s.frames && code != l.probeCode() {
+		fmt.Fprintf(w, "  frames identify as %s mode, but were decoded as %s mode\n", frameMode(code&0xf), l.mode)
+	}
+}
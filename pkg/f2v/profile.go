@@ -0,0 +1,148 @@
+package f2v
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// profile is a named set of encoding settings, such as settings tuned for a
+// particular hosting platform. Profiles live in the catalog so they travel
+// with it when it is exported or checked into a repository, or in the
+// user's config file for every catalog, and a few are built in.
+type profile struct {
+	Mode           string `json:"mode"`
+	BlockSize      int    `json:"block_size,omitempty"`
+	BitsPerChannel int    `json:"bits_per_channel,omitempty"`
+	Coefficients   int    `json:"dct_coefficients,omitempty"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	FPS            int    `json:"fps"`
+	Codec          string `json:"codec,omitempty"`  // ffv1 or h264; by the video's extension if empty
+	Parity         int    `json:"parity,omitempty"` // recovery volume parity in percent
+	Cold           bool   `json:"cold,omitempty"`   // cold storage: scrubbed metadata, random names and frame rates
+}
+
+// builtinProfiles ship with the tool for the usual jobs. A profile of the
+// same name in the catalog or the config file takes the place of one.
+var builtinProfiles = map[string]profile{
+	// Lossless and dense, with parity against bit rot on the shelf
+	"archive": {Mode: "raw", Width: 1280, Height: 720, FPS: 30, Codec: "ffv1", Parity: 10},
+	// Blocks big enough to survive YouTube's re-encoding at a size it serves
+	// as uploaded, and parity for the frames that still come back damaged
+	"youtube-safe": {Mode: "block", BlockSize: 6, BitsPerChannel: 1, Width: 1280, Height: 720, FPS: 30, Codec: "h264", Parity: 20},
+	// As many bytes a frame as there are, for lossless storage only
+	"max-density": {Mode: "raw", Width: 1920, Height: 1080, FPS: 30, Codec: "ffv1"},
+	// Big error-corrected cells slow enough for a phone camera to catch
+	"camera-transfer": {Mode: "barcode", BlockSize: 8, Width: 1280, Height: 720, FPS: 10},
+}
+
+// userConfig is the user's config file, JSON of profiles of their own and
+// of how uploads are described (see uploadmeta.go):
+//
+//	{"profiles": {"nightly": {"mode": "block", "block_size": 4, ...}},
+//	 "upload": {"title": "{{.Name}}", ...}}
+type userConfig struct {
+	Profiles map[string]profile `json:"profiles,omitempty"`
+	Upload   *uploadTemplate    `json:"upload,omitempty"`
+}
+
+// defaultConfigPath is where the config file is unless -config says
+// otherwise: f2v/config.json in the user's config folder.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "f2v", "config.json")
+}
+
+// loadUserConfig reads the config file at path, or at the default path if
+// it is "", where no file is the same as an empty one.
+func loadUserConfig(path string) (*userConfig, error) {
+	c := &userConfig{}
+	explicit := path != ""
+	if !explicit {
+		if path = defaultConfigPath(); path == "" {
+			return c, nil
+		}
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// findProfile returns the profile called name from the catalog, else the
+// config file, else the built-in ones; either of the first two may be nil.
+func findProfile(name string, cat *catalog, config *userConfig) (profile, error) {
+	if p, ok := cat.profile(name); ok {
+		return p, nil
+	}
+	if config != nil {
+		if p, ok := config.Profiles[name]; ok {
+			return p, nil
+		}
+	}
+	if p, ok := builtinProfiles[name]; ok {
+		return p, nil
+	}
+	return profile{}, fmt.Errorf("profile %q not found in the catalog given by -catalog or the config file, and not built in (%s)", name, strings.Join(slices.Sorted(maps.Keys(builtinProfiles)), ", "))
+}
+
+func profileFromLayout(l layout, fps int) profile {
+	p := profile{Mode: l.mode.String(), Width: l.width, Height: l.height, FPS: fps, Codec: codecName(l.codec), Cold: l.cold}
+	switch l.mode {
+	case modeBlock:
+		p.BlockSize, p.BitsPerChannel = l.blockSize, l.bitsPerChannel
+	case modeDCT:
+		p.Coefficients = l.coefficients
+	case modeBarcode:
+		p.BlockSize = l.blockSize
+	case modeLSB:
+		p.BitsPerChannel = l.bitsPerChannel
+	}
+	return p
+}
+
+// settings returns the layout and frame rate described by the profile.
+func (p profile) settings() (layout, int, error) {
+	mode, err := parseFrameMode(p.Mode)
+	if err != nil {
+		return layout{}, 0, err
+	}
+	l := layout{
+		width:          p.Width,
+		height:         p.Height,
+		mode:           mode,
+		blockSize:      p.BlockSize,
+		bitsPerChannel: p.BitsPerChannel,
+		coefficients:   p.Coefficients,
+		markers:        mode.hasMarkers(),
+		cold:           p.Cold,
+	}
+	if p.FPS <= 0 {
+		return layout{}, 0, fmt.Errorf("invalid frame rate %d", p.FPS)
+	}
+	if p.Codec != "" {
+		if l.codec, err = parseCodec(p.Codec); err != nil {
+			return layout{}, 0, err
+		}
+	}
+	if p.Parity < 0 || p.Parity > 100 {
+		return layout{}, 0, fmt.Errorf("parity must be between 0 and 100, got %d", p.Parity)
+	}
+	return l, p.FPS, l.validate()
+}
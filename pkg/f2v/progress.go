@@ -0,0 +1,56 @@
+package f2v
+
+import "io"
+
+// An encode or decode given a Progress callback calls it after every frame
+// it writes or reads. Encodes count frames by the data they have taken in,
+// and know their totals only when the size of the input is known and it is
+// not compressed on the way; decodes know the frames in the video but not
+// the bytes it holds. Unknown totals are 0.
+
+// Progress is told how far an encode or decode has got: the frames written
+// or read so far and the bytes of the file encoded or decoded so far, each
+// with the total expected or 0 when that is not known.
+type Progress func(frame, totalFrames, bytesDone, totalBytes int64)
+
+// payloadFrames is how many frames of l the size bytes of a file named name
+// take once sealed as opts says, the index frame included. Compression is
+// not allowed for.
+func payloadFrames(size int64, name string, opts encodeOptions, l layout) int64 {
+	payload := size
+	if opts.secret != nil {
+		payload = envelopeLength(int64(len(namePrefix(name)))+size, opts.secret.padTo)
+	}
+	if opts.macKey != nil {
+		payload += macSize
+	}
+	return dataFrames(payload, int64(l.dataBytes())) + 1
+}
+
+// progressReader reports the progress of an encode after every read of its
+// payload, r.
+type progressReader struct {
+	r      io.Reader
+	report Progress
+	per    int64 // data bytes per frame
+	frames int64 // expected in all, 0 when not known
+	n      int64
+	input  *countingReader // the input, when the payload is made from it
+	size   int64           // of the input, 0 when not known
+	// or else the length of the payload, made from the input beforehand
+	payload int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	done := p.n
+	switch {
+	case p.input != nil:
+		done = p.input.n
+	case p.payload > 0:
+		done = int64(float64(p.n) / float64(p.payload) * float64(p.size))
+	}
+	p.report((p.n+p.per-1)/p.per, p.frames, done, p.size)
+	return n, err
+}
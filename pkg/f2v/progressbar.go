@@ -0,0 +1,237 @@
+package f2v
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// The command line tool shows how far an encode or decode has got on
+// stderr: a line for the file at hand, with its frames, throughput and the
+// time left, and when it works through a folder, a line for the whole batch
+// below it. On a terminal the lines are redrawn in place a few times a
+// second; anywhere else, such as a CI log, they are printed every
+// progressLogEvery instead.
+
+const (
+	progressRedrawEvery = 100 * time.Millisecond
+	progressLogEvery    = 10 * time.Second
+	progressBarWidth    = 20
+)
+
+// progressBar draws the progress of one encode or decode run. Its report
+// method is the run's Progress; encodeTree and decodeTree tell it where the
+// batch is. A nil progressBar draws nothing.
+type progressBar struct {
+	w     io.Writer
+	verb  string // "Encoding" or "Decoding"
+	live  bool   // redraw in place, on a terminal
+	width int    // of the terminal, to keep lines from wrapping
+
+	mu                   sync.Mutex
+	name                 string // of the file at hand
+	fileStart            time.Time
+	frame, totalFrames   int64
+	bytesDone, totalSize int64
+	// The batch, when there is more than one file: how many files and how
+	// large they are, and how many and how much of that is done
+	files, filesDone    int
+	batchSize, sizeDone int64
+	fileSize            int64 // of the file at hand, counted into sizeDone once it is done
+	batchStart, drawn   time.Time
+	shown               bool // lines are on the terminal to be redrawn
+}
+
+// newProgressBar returns a progress bar for verb, drawn on w.
+func newProgressBar(w *os.File, verb string) *progressBar {
+	b := &progressBar{w: w, verb: verb, width: 80, fileStart: time.Now(), batchStart: time.Now()}
+	if fd := int(w.Fd()); term.IsTerminal(fd) {
+		b.live = true
+		if width, _, err := term.GetSize(fd); err == nil && width > 0 {
+			b.width = width
+		}
+	}
+	return b
+}
+
+// logProgress starts a progress bar for verb on stderr, with the log
+// written through it when it is redrawn in place.
+func logProgress(verb string) *progressBar {
+	b := newProgressBar(os.Stderr, verb)
+	if b.live {
+		log.SetOutput(b)
+	}
+	return b
+}
+
+// batch starts a batch of files making size bytes together.
+func (b *progressBar) batch(files int, size int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files, b.batchSize, b.batchStart = files, size, time.Now()
+}
+
+// file starts on the file called name, of size bytes, within the batch.
+func (b *progressBar) file(name string, size int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.name, b.fileSize, b.fileStart = name, size, time.Now()
+	b.frame, b.totalFrames, b.bytesDone, b.totalSize = 0, 0, 0, 0
+}
+
+// fileDone counts the file at hand as done, whether it worked or not.
+func (b *progressBar) fileDone() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.filesDone++
+	b.sizeDone += b.fileSize
+	b.fileSize = 0
+}
+
+// report is the Progress of the run.
+func (b *progressBar) report(frame, totalFrames, bytesDone, totalBytes int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.frame, b.totalFrames, b.bytesDone, b.totalSize = frame, totalFrames, bytesDone, totalBytes
+	every := progressLogEvery
+	if b.live {
+		every = progressRedrawEvery
+	}
+	if now := time.Now(); now.Sub(b.drawn) >= every {
+		b.drawn = now
+		b.draw()
+	}
+}
+
+// finish takes the lines off the terminal, before what the run prints last.
+func (b *progressBar) finish() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.live && b.shown {
+		fmt.Fprint(b.w, "\r\033[J")
+		b.shown = false
+	}
+}
+
+// Write writes p, a log line, where the progress lines are, taking them
+// off first so the two do not garble each other; the next report draws
+// them again below it.
+func (b *progressBar) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.live && b.shown {
+		fmt.Fprint(b.w, "\r\033[J")
+		b.shown = false
+	}
+	return b.w.Write(p)
+}
+
+// fraction is how much of the file at hand is done, from its bytes if
+// their total is known, else its frames, or -1 if neither is.
+func (b *progressBar) fraction() float64 {
+	switch {
+	case b.totalSize > 0:
+		return min(float64(b.bytesDone)/float64(b.totalSize), 1)
+	case b.totalFrames > 0:
+		return min(float64(b.frame)/float64(b.totalFrames), 1)
+	}
+	return -1
+}
+
+func (b *progressBar) draw() {
+	lines := []string{b.fileLine()}
+	if b.files > 1 {
+		lines = append(lines, b.batchLine())
+	}
+	for i, line := range lines {
+		if b.live && len([]rune(line)) >= b.width {
+			lines[i] = string([]rune(line)[:b.width-1])
+		}
+	}
+	if !b.live {
+		fmt.Fprintln(b.w, strings.Join(lines, "\n"))
+		return
+	}
+	// The cursor rests at the start of the first line between draws
+	fmt.Fprint(b.w, "\r\033[J"+strings.Join(lines, "\n"))
+	if len(lines) > 1 {
+		fmt.Fprintf(b.w, "\033[%dA", len(lines)-1)
+	}
+	fmt.Fprint(b.w, "\r")
+	b.shown = true
+}
+
+// fileLine is the line of the file at hand: its bar, frames, throughput and
+// time left, as far as they are known.
+func (b *progressBar) fileLine() string {
+	elapsed := time.Since(b.fileStart)
+	parts := []string{b.verb + " " + filepath.Base(b.name)}
+	f := b.fraction()
+	if f >= 0 {
+		parts = append(parts, bar(f))
+	}
+	frames := display.count(b.frame) + " frames"
+	if b.totalFrames > 0 {
+		frames = display.count(b.frame) + "/" + display.count(b.totalFrames) + " frames"
+	}
+	parts = append(parts, frames, display.bytes(b.bytesDone))
+	if s := elapsed.Seconds(); s > 0 {
+		parts = append(parts, display.bytes(int64(float64(b.bytesDone)/s))+"/s")
+	}
+	if f > 0 {
+		parts = append(parts, "ETA "+display.duration(remaining(elapsed, f)))
+	}
+	return strings.Join(parts, "  ")
+}
+
+// batchLine is the line of the whole batch: files done, its bar and the
+// time left, reckoned by size if the files have one and by count if not.
+func (b *progressBar) batchLine() string {
+	f := float64(b.filesDone) / float64(b.files)
+	if b.batchSize > 0 {
+		f = float64(b.sizeDone) / float64(b.batchSize)
+		if cur := b.fraction(); cur > 0 {
+			f += cur * float64(b.fileSize) / float64(b.batchSize)
+		}
+	}
+	f = min(f, 1)
+	parts := []string{fmt.Sprintf("All: %s of %s files", display.count(int64(b.filesDone)), display.count(int64(b.files))), bar(f)}
+	if f > 0 {
+		parts = append(parts, "ETA "+display.duration(remaining(time.Since(b.batchStart), f)))
+	}
+	return strings.Join(parts, "  ")
+}
+
+// bar draws fraction f of the way as [=====>    ] 50%.
+func bar(f float64) string {
+	filled := int(f * progressBarWidth)
+	s := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		s += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	return fmt.Sprintf("[%s] %3.0f%%", s, 100*f)
+}
+
+// remaining is how long the rest takes at the rate fraction f took elapsed.
+func remaining(elapsed time.Duration, f float64) time.Duration {
+	return time.Duration(float64(elapsed) * (1 - f) / f)
+}
@@ -0,0 +1,142 @@
+package f2v
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+)
+
+// A one-way transfer needs nothing from the receiving side but a camera
+// pointed at the sender's screen. The sender plays the video, ideally on a
+// loop; the receiver keeps every intact frame it catches, by sequence
+// number, and finishes once it holds all of them. Frames missed on one pass
+// are picked up on the next, so no back channel is required.
+
+// receiveState collects the frames caught so far.
+type receiveState struct {
+	frames map[uint32][]byte
+	last   int64 // sequence number of the final frame, -1 until it is seen
+	flags  uint8 // frameFlagDeflate and frameFlagEncrypt as set on the data frames
+	table  bool  // frame 0 is a segment table rather than data
+}
+
+func newReceiveState() *receiveState {
+	return &receiveState{frames: make(map[uint32][]byte), last: -1}
+}
+
+func (r *receiveState) complete() bool {
+	return r.last >= 0 && int64(len(r.frames)) == r.last+1
+}
+
+// add keeps f if it is an intact frame of data not caught before, and
+// reports whether it was.
+func (r *receiveState) add(f scannedFrame) bool {
+	// Blurred, torn or off-screen frames are simply missed this pass
+	if f.err != nil || f.header.parity() || f.header.flags&frameFlagInfo != 0 {
+		return false
+	}
+	seq := f.header.seq
+	if _, seen := r.frames[seq]; seen {
+		return false
+	}
+	r.frames[seq] = bytes.Clone(f.data)
+	r.flags |= f.header.flags & dataFlags
+	r.table = r.table || f.header.table()
+	if f.header.last() {
+		r.last = int64(seq)
+	}
+	return true
+}
+
+// data puts the file back together from the frames of a complete transfer,
+// logging what it decrypts to log.
+func (r *receiveState) data(s *secret, log *slog.Logger) ([]byte, error) {
+	var data bytes.Buffer
+	for seq := uint32(0); int64(seq) <= r.last; seq++ {
+		if seq == 0 && r.table {
+			continue
+		}
+		data.Write(r.frames[seq])
+	}
+	return unwrapPayload(data.Bytes(), r.flags, s, log)
+}
+
+// Receiver puts a file back together from the frames of its video as a
+// camera catches them, for programs that capture frames themselves, such
+// as an app on a phone. Frames may come in any order and any number of
+// times; the sender plays the video on a loop until AddFrame reports that
+// every frame is in. A Receiver is not safe for concurrent use.
+type Receiver struct {
+	state   *receiveState
+	held    *heldFrame
+	scanner *frameScanner
+	log     *slog.Logger
+}
+
+// Receiver starts receiving a video of d's Layout, which must have sync
+// markers: block, dct or barcode mode. The Receiver must be closed.
+func (d *Decoder) Receiver() (*Receiver, error) {
+	opts, err := d.options(nil)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.layout.markers {
+		return nil, fmt.Errorf("camera transfer needs sync markers; use block, dct or barcode mode")
+	}
+	r := &Receiver{state: newReceiveState(), held: &heldFrame{}, log: opts.log()}
+	r.scanner = newFrameScanner(r.held, opts.layout)
+	return r, nil
+}
+
+// AddFrame takes a frame caught by the camera, width*height*3 bytes of BGR
+// pixels row by row, and reports whether every frame of the video is now
+// in. Frames that cannot be read, blurred, torn or off screen, are passed
+// over.
+func (r *Receiver) AddFrame(bgr []byte, width, height int) (bool, error) {
+	if width <= 0 || height <= 0 || len(bgr) != width*height*3 {
+		return false, fmt.Errorf("frame of %d bytes is not %dx%d BGR pixels", len(bgr), width, height)
+	}
+	*r.held = heldFrame{bgr: bgr, width: width, height: height, ok: true}
+	f, ok, err := r.scanner.next()
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		r.state.add(f)
+	}
+	return r.state.complete(), nil
+}
+
+// Received returns how many frames are in and how many the video has, 0
+// until its final frame has been seen.
+func (r *Receiver) Received() (frames, total int64) {
+	return int64(len(r.state.frames)), r.state.last + 1
+}
+
+// Data returns the file once every frame is in.
+func (r *Receiver) Data() ([]byte, error) {
+	if !r.state.complete() {
+		return nil, fmt.Errorf("%d frames received, the video is incomplete", len(r.state.frames))
+	}
+	return r.state.data(nil, r.log)
+}
+
+// Close lets go of the Receiver's frame.
+func (r *Receiver) Close() error {
+	return r.scanner.Close()
+}
+
+// heldFrame is the frameSource of the one frame a Receiver was handed.
+type heldFrame struct {
+	bgr           []byte
+	width, height int
+	ok            bool // not read yet
+}
+
+func (h *heldFrame) Read(m *mat) bool {
+	if !h.ok {
+		return false
+	}
+	h.ok = false
+	return readBGR(m, h.bgr, h.width, h.height)
+}
@@ -0,0 +1,305 @@
+package f2v
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// recover is the last resort for a video that neither decodes nor repairs:
+// it reads every frame the sync markers let it find, puts the data areas
+// back together as best it can and carves files with recognizable
+// signatures out of the result. Frames whose header is intact go where
+// their sequence number says; damaged ones fill the sequence numbers
+// missing before the next intact frame, in the order they were read. With
+// -no-header every frame's whole data area is taken as it comes, for
+// videos whose headers are unreadable throughout, e.g. after a re-encode
+// at the wrong settings.
+
+// recoverResult is what recover got out of a video.
+type recoverResult struct {
+	frames     int // frames read
+	intact     int // with a header that checked out
+	duplicates int
+	deflated   bool // intact headers say the data is compressed, by -tune
+	compressed bool // or by -compress
+	encrypted  bool
+	inflated   bool // and it decompressed, at least in part
+	data       []byte
+	carved     []carvedFile
+}
+
+// carvedFile is a file found in the recovered data by its signature.
+type carvedFile struct {
+	kind   string // jpg, zip or pdf
+	offset int64
+	data   []byte
+}
+
+func recoverVideo(video string, l layout, noHeader bool) (*recoverResult, error) {
+	cap, cleanup, err := openVideo(video, l)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	r := &recoverResult{}
+	slots := make(map[uint32][]byte)
+	var pending [][]byte // damaged frames since the last intact one
+	next := uint32(0)
+	place := func(seq uint32, data []byte) {
+		slots[seq] = data
+		next = seq + 1
+	}
+	err = scanFrames(cap, l, func(f scannedFrame) (bool, error) {
+		r.frames++
+		if noHeader {
+			r.data = append(r.data, f.raw...)
+			return true, nil
+		}
+		if f.err != nil {
+			pending = append(pending, f.raw)
+			return true, nil
+		}
+		if f.header.parity() {
+			return false, fmt.Errorf("%s is a recovery volume; use repair with its data video", video)
+		}
+		r.intact++
+		r.deflated = r.deflated || f.header.deflated()
+		r.compressed = r.compressed || f.header.compressed()
+		r.encrypted = r.encrypted || f.header.encrypted()
+		if _, ok := slots[f.header.seq]; ok || f.header.table() || f.header.index() {
+			r.duplicates++
+			pending = nil
+			return true, nil
+		}
+		// The damaged frames read since the last intact one most likely
+		// hold the sequence numbers in between; any more were duplicates
+		for i := 0; i < len(pending) && next < f.header.seq && f.header.seq-next <= maxSeqJump; i++ {
+			place(next, pending[i])
+		}
+		pending = nil
+		place(f.header.seq, f.data)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !noHeader {
+		for _, raw := range pending {
+			place(next, raw)
+		}
+		seqs := make([]uint32, 0, len(slots))
+		for seq := range slots {
+			seqs = append(seqs, seq)
+		}
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+		for _, seq := range seqs {
+			r.data = append(r.data, slots[seq]...)
+		}
+	}
+
+	if r.deflated && !r.encrypted {
+		// Decompress as far as the stream goes; everything after the first
+		// damaged byte is lost
+		var out bytes.Buffer
+		io.Copy(&out, flate.NewReader(bytes.NewReader(r.data)))
+		if out.Len() > 0 {
+			r.data, r.inflated = out.Bytes(), true
+		}
+	}
+	if r.compressed && !r.encrypted {
+		var out bytes.Buffer
+		decompressStream(&out, bytes.NewReader(r.data))
+		if out.Len() > 0 {
+			r.data, r.inflated = out.Bytes(), true
+		}
+	}
+	if !r.encrypted {
+		r.carved = carveFiles(r.data)
+	}
+	return r, nil
+}
+
+var carveSignatures = []struct {
+	kind  string
+	magic []byte
+}{
+	{"jpg", []byte{0xFF, 0xD8, 0xFF}},
+	{"zip", []byte("PK\x03\x04")},
+	{"pdf", []byte("%PDF-")},
+}
+
+// carveFiles finds JPEG, ZIP and PDF files in data by their signatures and
+// structure. Files inside a carved file are left to it.
+func carveFiles(data []byte) []carvedFile {
+	eocds := findAll(data, []byte("PK\x05\x06"))
+	eofs := findAll(data, []byte("%%EOF"))
+	var out []carvedFile
+	for pos := 0; pos < len(data); {
+		kind, start := "", len(data)
+		for _, sig := range carveSignatures {
+			if i := bytes.Index(data[pos:], sig.magic); i >= 0 && pos+i < start {
+				kind, start = sig.kind, pos+i
+			}
+		}
+		if kind == "" {
+			break
+		}
+		end := -1
+		switch kind {
+		case "jpg":
+			end = jpegEnd(data, start)
+		case "zip":
+			end = zipEnd(data, start, eocds)
+		case "pdf":
+			end = pdfEnd(data, start, eofs)
+		}
+		if end < 0 {
+			pos = start + 1
+			continue
+		}
+		out = append(out, carvedFile{kind: kind, offset: int64(start), data: data[start:end]})
+		pos = end
+	}
+	return out
+}
+
+func findAll(data, sep []byte) []int {
+	var at []int
+	for i := 0; ; {
+		j := bytes.Index(data[i:], sep)
+		if j < 0 {
+			return at
+		}
+		at = append(at, i+j)
+		i += j + 1
+	}
+}
+
+// jpegEnd walks the marker segments of a JPEG starting at start and returns
+// where its EOI marker ends, or -1 if it breaks off first.
+func jpegEnd(data []byte, start int) int {
+	scanned := false
+	for i := start + 2; i+1 < len(data); {
+		if data[i] != 0xFF {
+			return -1
+		}
+		switch m := data[i+1]; {
+		case m == 0xFF: // fill byte
+			i++
+			continue
+		case m == 0xD9:
+			if !scanned {
+				return -1
+			}
+			return i + 2
+		case m >= 0xD0 && m <= 0xD7 || m == 0x01:
+			i += 2
+			continue
+		}
+		if i+4 > len(data) {
+			return -1
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 {
+			return -1
+		}
+		m := data[i+1]
+		i += 2 + n
+		if m == 0xDA {
+			// Entropy-coded data runs to the next marker that is neither a
+			// stuffed zero nor a restart
+			for i+1 < len(data) && (data[i] != 0xFF || data[i+1] == 0 || data[i+1] >= 0xD0 && data[i+1] <= 0xD7) {
+				i++
+			}
+			scanned = true
+		}
+	}
+	return -1
+}
+
+// zipEnd returns where the ZIP starting at start ends: after the first
+// end-of-central-directory record whose directory sits right before it.
+func zipEnd(data []byte, start int, eocds []int) int {
+	for _, e := range eocds[sort.SearchInts(eocds, start):] {
+		if e+22 > len(data) {
+			break
+		}
+		size := int64(binary.LittleEndian.Uint32(data[e+12:]))
+		offset := int64(binary.LittleEndian.Uint32(data[e+16:]))
+		comment := int(binary.LittleEndian.Uint16(data[e+20:]))
+		if offset+size == int64(e-start) && e+22+comment <= len(data) {
+			return e + 22 + comment
+		}
+	}
+	return -1
+}
+
+// pdfEnd returns where the PDF starting at start ends: after the last %%EOF
+// before the next PDF signature, since incremental updates append more.
+func pdfEnd(data []byte, start int, eofs []int) int {
+	limit := len(data)
+	if next := bytes.Index(data[start+1:], []byte("%PDF-")); next >= 0 {
+		limit = start + 1 + next
+	}
+	end := -1
+	for _, e := range eofs[sort.SearchInts(eofs, start):] {
+		if e+5 > limit {
+			break
+		}
+		end = e + 5
+	}
+	for end > 0 && end < limit && (data[end] == '\r' || data[end] == '\n') {
+		end++
+	}
+	return end
+}
+
+// runRecover recovers a video into dir: the reassembled data and every
+// carved file.
+func runRecover(video, dir string, l layout, noHeader bool) error {
+	r, err := recoverVideo(video, l, noHeader)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	base := filepath.Join(dir, filepath.Base(video))
+	if err := os.WriteFile(base+".recovered", r.data, 0644); err != nil {
+		return fmt.Errorf("failed to write recovered data: %w", err)
+	}
+	paths := make([]string, len(r.carved))
+	for i, c := range r.carved {
+		paths[i] = fmt.Sprintf("%s.%03d.%s", base, i+1, c.kind)
+		if err := os.WriteFile(paths[i], c.data, 0644); err != nil {
+			return fmt.Errorf("failed to write carved file: %w", err)
+		}
+	}
+	r.print(os.Stdout, video, base+".recovered", paths)
+	return nil
+}
+
+func (r *recoverResult) print(w io.Writer, video, out string, paths []string) {
+	fmt.Fprintf(w, "Recovered %s: %d frames read, %d with intact headers, %d duplicates\n", video, r.frames, r.intact, r.duplicates)
+	what := "data"
+	if r.inflated {
+		what = "decompressed data, as far as the stream held together"
+	}
+	fmt.Fprintf(w, "  %s of %s in %s\n", display.bytes(int64(len(r.data))), what, out)
+	switch {
+	case r.encrypted:
+		fmt.Fprintln(w, "  the data is encrypted, so nothing can be carved from it; try decode -lenient with its key")
+	case len(r.carved) == 0:
+		fmt.Fprintln(w, "  no JPEG, ZIP or PDF files found")
+	}
+	for i, c := range r.carved {
+		fmt.Fprintf(w, "  %s at byte %s: %s in %s\n", c.kind, display.count(c.offset), display.bytes(int64(len(c.data))), paths[i])
+	}
+}
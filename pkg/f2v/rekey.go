@@ -0,0 +1,116 @@
+package f2v
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// rekey rotates the secret an encrypted video is sealed under without the
+// file it holds ever reaching the disk: the frames' data is decrypted as it
+// is read and sealed again on its way into the frames of the new video.
+// Compressed data stays compressed and the layout stays the same; only the
+// envelope changes. A video of a -shares set comes out as a single video
+// under the new secret. What the old envelope's padding hid does not carry
+// over, and a recovery volume made for the old video does not cover the new
+// one.
+
+// rekeyVideo re-encrypts video, decrypted with old, under next into output
+// and returns the name sealed with the data and the bytes of it written.
+func rekeyVideo(video, output string, l layout, fps int, old, next *secret) (string, int64, error) {
+	first, err := firstDataHeader(video, l)
+	if err != nil {
+		return "", 0, err
+	}
+	if !first.encrypted() {
+		return "", 0, fmt.Errorf("%s is not encrypted; decode it and encode it again with -encrypt", video)
+	}
+	flags := frameFlagEncrypt | first.flags&(frameFlagDeflate|frameFlagCompress)
+
+	pr, pw := io.Pipe()
+	d := newDecrypter(pw, old, l.log())
+	go func() {
+		err := decodeVideo(video, d, decodeOptions{layout: l, stored: true}, nil)
+		if err == nil {
+			err = d.Close()
+		} else {
+			d.abort(err)
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+	// The name comes ahead of the data, so it is known once any data, or
+	// the end of it, has come through
+	plain := bufio.NewReader(pr)
+	if _, err := plain.Peek(1); err != nil && err != io.EOF {
+		return "", 0, err
+	}
+	name := d.name()
+	in := &countingReader{r: plain}
+	sealed := sealReader(in, name, next)
+	defer sealed.Close()
+	if _, err := streamToVideo(sealed, output, l, fps, flags); err != nil {
+		return "", 0, err
+	}
+	return name, in.n, nil
+}
+
+// firstDataHeader returns the header of the first intact frame of a video
+// that holds data, which carries the flags every data frame has.
+func firstDataHeader(video string, l layout) (frameHeader, error) {
+	cap, cleanup, err := openVideo(video, l)
+	if err != nil {
+		return frameHeader{}, err
+	}
+	defer cleanup()
+	var h frameHeader
+	found := false
+	err = scanFrames(cap, l, func(f scannedFrame) (bool, error) {
+		if f.err != nil || f.header.table() {
+			return true, nil
+		}
+		if f.header.parity() {
+			return false, fmt.Errorf("%s is a recovery volume; rekey its data video", video)
+		}
+		h, found = f.header, true
+		return false, nil
+	})
+	if err != nil {
+		return frameHeader{}, err
+	}
+	if !found {
+		return frameHeader{}, malformed("%s has no readable data frames", video)
+	}
+	return h, nil
+}
+
+// runRekey rekeys video into output and records the new video in the
+// catalog, if one is in use, as holding what the old one did.
+func runRekey(video, output string, l layout, fps int, old, next *secret, cat *catalog) error {
+	if cat != nil {
+		if err := cat.checkWritable(output); err != nil {
+			return err
+		}
+	}
+	name, n, err := rekeyVideo(video, output, l, fps, old, next)
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+	summarize(os.Stdout, "Re-encrypted %s (%s, %s) into %s", video, name, display.bytes(n), output)
+	if _, err := os.Stat(recoveryPath(video)); err == nil {
+		l.log().Warn("The recovery volume only covers the old video; encode again with -parity for one", "volume", recoveryPath(video))
+	}
+	if cat == nil {
+		return nil
+	}
+	entry := catalogEntry{Source: name, Size: n}
+	if i := cat.find(video); i >= 0 {
+		entry = catalogEntry{Source: cat.Entries[i].Source, Size: cat.Entries[i].Size, Owner: cat.Entries[i].Owner}
+	}
+	if err := cat.add(entry, output); err != nil {
+		return err
+	}
+	return cat.save()
+}
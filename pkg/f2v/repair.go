@@ -0,0 +1,161 @@
+package f2v
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// repairResult is a data video's content after damaged frames were rebuilt
+// from its recovery volume.
+type repairResult struct {
+	data          []byte
+	frames        uint32   // data frames in the original video
+	rebuilt       []uint32 // sequence numbers reconstructed from parity
+	frameBytes    int
+	damagedParity int   // recovery volume frames that failed validation
+	flags         uint8 // the dataFlags set on the data frames
+}
+
+// repairVideo reads every intact frame of a data video and rebuilds the
+// damaged or missing ones from the recovery volume. The result is checked
+// against the SHA-256 recorded in the volume.
+func repairVideo(video, volume string, l layout) (*repairResult, error) {
+	v, err := readRecoveryVolume(volume, l)
+	if err != nil {
+		return nil, err
+	}
+	info := v.info
+
+	cap, cleanup, err := openVideo(video, l)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	// Frames are kept by number rather than in a slice of dataFrames, which
+	// only the descriptor vouches for
+	frames := make(map[uint32][]byte)
+	var flags uint8
+	err = scanFrames(cap, l, func(f scannedFrame) (bool, error) {
+		if f.err != nil {
+			return true, nil
+		}
+		if f.header.parity() {
+			return false, fmt.Errorf("%s is a recovery volume, not a data video", video)
+		}
+		if seq := f.header.seq; seq < info.dataFrames && frames[seq] == nil {
+			frames[seq] = f.data
+		}
+		flags |= f.header.flags & dataFlags
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &repairResult{frames: info.dataFrames, frameBytes: int(info.frameBytes), damagedParity: v.damaged, flags: flags}
+	for s := 0; s < info.stripes(); s++ {
+		first := uint32(s * info.stripe)
+		shards := make([][]byte, min(uint32(info.stripe), info.dataFrames-first))
+		var lost []uint32
+		for i := range shards {
+			if shards[i] = frames[first+uint32(i)]; shards[i] == nil {
+				lost = append(lost, first+uint32(i))
+			}
+		}
+		if len(lost) == 0 {
+			continue
+		}
+		if err := rsReconstruct(shards, v.stripeParity(s), int(info.frameBytes)); err != nil {
+			return nil, fmt.Errorf("cannot rebuild frames %v: %w", lost, err)
+		}
+		for _, seq := range lost {
+			frames[seq] = shards[seq-first]
+		}
+		r.rebuilt = append(r.rebuilt, lost...)
+	}
+
+	for seq := range info.dataFrames {
+		r.data = append(r.data, frames[seq]...)
+	}
+	if uint64(len(r.data)) < info.dataSize {
+		return nil, fmt.Errorf("repaired data holds %d bytes, expected %d", len(r.data), info.dataSize)
+	}
+	r.data = r.data[:info.dataSize]
+	if sha256.Sum256(r.data) != info.sha256 {
+		return nil, mismatched("repaired data does not match the checksum in the recovery volume")
+	}
+	return r, nil
+}
+
+func (r *repairResult) print(w io.Writer, name string) {
+	fmt.Fprintf(w, "Repaired %s: %d of %d frames rebuilt from parity\n", name, len(r.rebuilt), r.frames)
+	for _, seq := range r.rebuilt {
+		start := int64(seq) * int64(r.frameBytes)
+		end := min(start+int64(r.frameBytes), int64(len(r.data)))
+		fmt.Fprintf(w, "  sequence %d: bytes %d-%d\n", seq, start, end-1)
+	}
+	if r.damagedParity > 0 {
+		fmt.Fprintf(w, "  %d frames of the recovery volume were damaged\n", r.damagedParity)
+	}
+}
+
+// unrepairable reports which stripes of a checked video have more lost frames
+// than the recovery volume can rebuild.
+func (v *recoveryVolume) unrepairable(r *checkReport) []int {
+	lost := make(map[int]int)
+	for _, d := range r.damage {
+		lost[int(d.seq)/v.info.stripe]++
+	}
+	if !r.complete {
+		for seq := r.next; seq < v.info.dataFrames; seq++ {
+			lost[int(seq)/v.info.stripe]++
+		}
+	}
+
+	var stripes []int
+	for s := 0; s < v.info.stripes(); s++ {
+		intact := 0
+		for _, p := range v.stripeParity(s) {
+			if p != nil {
+				intact++
+			}
+		}
+		if lost[s] > intact {
+			stripes = append(stripes, s)
+		}
+	}
+	return stripes
+}
+
+// runRepair repairs a data video with its recovery volume and writes either
+// a corrected video, when output ends in .mkv, or the recovered file.
+func runRepair(video, volume, output string, l layout, fps int, s *secret) error {
+	r, err := repairVideo(video, volume, l)
+	if err != nil {
+		return err
+	}
+	if summarizing() {
+		r.print(os.Stdout, video)
+	}
+
+	if strings.HasSuffix(output, ".mkv") {
+		if err := dataToVideo(r.data, output, l, fps, r.flags); err != nil {
+			return err
+		}
+		summarize(os.Stdout, "Wrote corrected video %s", output)
+		return nil
+	}
+	data, err := unwrapPayload(r.data, r.flags, s, l.log())
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(output, data, 0644); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	summarize(os.Stdout, "Wrote recovered file %s", output)
+	return nil
+}
@@ -0,0 +1,307 @@
+package f2v
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// restore brings back a set of wanted files from everything a catalog
+// records. Every source encoded more than once has a snapshot per encode;
+// the newest one up to -as-of is the state restored, so older snapshots are
+// never read. A file inside a -pack tar archive only needs the frames that
+// hold its bytes, and with a seek index next to the video only the clusters
+// holding those frames need to be fetched, however large the archive.
+
+// restoreItem is one snapshot to read from.
+type restoreItem struct {
+	entry  catalogEntry
+	whole  bool          // the whole video, as its source was encoded
+	files  []catalogFile // or just these files of its archive
+	frames [][2]int64    // first and last frame holding them, merged
+	fetch  int64         // bytes of video to fetch
+	index  bool          // fetch is counted from a seek index
+}
+
+// restorePlan is what restoring the wanted files takes.
+type restorePlan struct {
+	items   []restoreItem
+	missing []string // wanted names no snapshot holds
+	fetch   int64
+	full    int64 // bytes in every snapshot of the sources read
+	all     int   // number of those snapshots
+}
+
+// readWantList reads the wanted names from a file, one per line; blank
+// lines and lines starting with # are skipped. A name ending in / wants
+// everything under it.
+func readWantList(listPath string) ([]string, error) {
+	data, err := os.ReadFile(listPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read list of wanted files: %w", err)
+	}
+	var wanted []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			wanted = append(wanted, line)
+		}
+	}
+	return wanted, nil
+}
+
+// parseAsOf reads a -as-of time, RFC 3339 or a date that means the end of
+// that day.
+func parseAsOf(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, want 2006-01-02 or RFC 3339", s)
+	}
+	return t.Add(24 * time.Hour), nil
+}
+
+// matches reports whether want names the whole of e's source, or else
+// which of the files in its archive it names.
+func (e catalogEntry) matches(want string) (bool, []catalogFile) {
+	want = filepath.ToSlash(want)
+	source := filepath.ToSlash(filepath.Clean(e.Source))
+	if want == source || want == path.Base(source) {
+		return true, nil
+	}
+	var files []catalogFile
+	for _, f := range e.Files {
+		if f.Name == want || strings.HasSuffix(want, "/") && strings.HasPrefix(f.Name, want) {
+			files = append(files, f)
+		}
+	}
+	return false, files
+}
+
+// planRestore works out which snapshots, and which frames of them, hold the
+// wanted files as of asOf, zero for the newest. l is the layout the videos
+// were encoded with.
+func planRestore(c *catalog, wanted []string, asOf time.Time, l layout) (*restorePlan, error) {
+	latest := make(map[string]int) // source to entry
+	for i, e := range c.Entries {
+		if !asOf.IsZero() && !e.Created.Before(asOf) {
+			continue
+		}
+		if j, ok := latest[e.Source]; !ok || !e.Created.Before(c.Entries[j].Created) {
+			latest[e.Source] = i
+		}
+	}
+	snapshots := make([]int, 0, len(latest))
+	for _, i := range latest {
+		snapshots = append(snapshots, i)
+	}
+	// Oldest first, so that where two sources hold the same name the
+	// newest is written last
+	slices.SortFunc(snapshots, func(a, b int) int { return c.Entries[a].Created.Compare(c.Entries[b].Created) })
+
+	p := &restorePlan{}
+	items := make(map[int]*restoreItem)
+	for _, want := range wanted {
+		found := false
+		for _, i := range snapshots {
+			whole, files := c.Entries[i].matches(want)
+			if !whole && files == nil {
+				continue
+			}
+			found = true
+			it := items[i]
+			if it == nil {
+				it = &restoreItem{entry: c.Entries[i]}
+				items[i] = it
+			}
+			it.whole = it.whole || whole
+			for _, f := range files {
+				if !slices.Contains(it.files, f) {
+					it.files = append(it.files, f)
+				}
+			}
+		}
+		if !found {
+			p.missing = append(p.missing, want)
+		}
+	}
+
+	per := int64(l.capacity() - frameHeaderSize)
+	for _, i := range snapshots {
+		it := items[i]
+		if it == nil {
+			continue
+		}
+		if it.whole {
+			it.files = nil
+		}
+		slices.SortFunc(it.files, func(a, b catalogFile) int { return cmp.Compare(a.Offset, b.Offset) })
+		for _, f := range it.files {
+			if !filepath.IsLocal(filepath.FromSlash(f.Name)) {
+				return nil, fmt.Errorf("%s lists a file outside its archive: %s", it.entry.Video, f.Name)
+			}
+			if f.Size == 0 {
+				continue
+			}
+			first, last := f.Offset/per, (f.Offset+f.Size-1)/per
+			if n := len(it.frames); n > 0 && first <= it.frames[n-1][1]+1 {
+				it.frames[n-1][1] = max(it.frames[n-1][1], last)
+			} else {
+				it.frames = append(it.frames, [2]int64{first, last})
+			}
+		}
+		it.fetch = it.entry.VideoSize
+		if !it.whole {
+			it.fetch, it.index = c.fetchSize(it.entry, it.frames)
+		}
+		p.items = append(p.items, *it)
+		p.fetch += it.fetch
+	}
+	for _, e := range c.Entries {
+		if i, ok := latest[e.Source]; ok && items[i] != nil && (asOf.IsZero() || e.Created.Before(asOf)) {
+			p.full += e.VideoSize
+			p.all++
+		}
+	}
+	return p, nil
+}
+
+// fetchSize returns how many bytes of e's video hold the given frames: the
+// header and the clusters covering them according to its seek index, or
+// without one the whole video.
+func (c *catalog) fetchSize(e catalogEntry, frames [][2]int64) (int64, bool) {
+	data, err := os.ReadFile(indexPath(c.resolve(e.Video)))
+	if err != nil {
+		return e.VideoSize, false
+	}
+	var idx seekIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return e.VideoSize, false
+	}
+	n := idx.HeaderSize
+	for _, u := range idx.Units {
+		first, last := int64(u.FirstFrame), int64(u.FirstFrame+u.Frames-1)
+		if slices.ContainsFunc(frames, func(r [2]int64) bool { return first <= r[1] && r[0] <= last }) {
+			n += u.Length
+		}
+	}
+	return n, true
+}
+
+func (p *restorePlan) print(w io.Writer) {
+	for _, it := range p.items {
+		at := it.entry.Created.Local().Format("2006-01-02 15:04")
+		what := "whole video"
+		if !it.whole {
+			spans := make([]string, len(it.frames))
+			for i, r := range it.frames {
+				spans[i] = fmt.Sprintf("%d-%d", r[0], r[1])
+			}
+			what = fmt.Sprintf("%d files in frames %s", len(it.files), strings.Join(spans, ", "))
+		}
+		fmt.Fprintf(w, "  %s (%s, %s): %s, %s to fetch", it.entry.Video, it.entry.Source, at, what, display.bytes(it.fetch))
+		if !it.whole && !it.index {
+			fmt.Fprint(w, " (no seek index; index the video to fetch only these frames)")
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "Fetching %s of video for %d snapshots, instead of %s for all %d snapshots of these sources\n", display.bytes(p.fetch), len(p.items), display.bytes(p.full), p.all)
+	if len(p.missing) > 0 {
+		fmt.Fprintf(w, "Not in any snapshot: %s\n", strings.Join(p.missing, ", "))
+	}
+}
+
+// run carries out the plan into dir: whole videos are decoded as their
+// source's name, files of an archive are cut out of the frames holding them.
+func (p *restorePlan) run(c *catalog, dir string, opts decodeOptions) error {
+	for _, it := range p.items {
+		video := c.resolve(it.entry.Video)
+		if it.whole {
+			out := filepath.Join(dir, filepath.Base(it.entry.Source))
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("failed to create output directory: %w", err)
+			}
+			out, err := decodeNamed(video, out, opts)
+			if err != nil {
+				return fmt.Errorf("%s: %w", video, err)
+			}
+			opts.log().Info("Restored", "file", out, "video", video)
+			continue
+		}
+		per := int64(opts.layout.capacity() - frameHeaderSize)
+		spans := make([][]byte, len(it.frames))
+		for i, r := range it.frames {
+			var err error
+			if spans[i], err = readFrameSpan(video, opts.layout, r[0], r[1]); err != nil {
+				return fmt.Errorf("%s: %w", video, err)
+			}
+		}
+		for _, f := range it.files {
+			var data []byte
+			if f.Size > 0 {
+				i := slices.IndexFunc(it.frames, func(r [2]int64) bool { return r[0] <= f.Offset/per && f.Offset/per <= r[1] })
+				start := f.Offset - it.frames[i][0]*per
+				data = spans[i][start : start+f.Size]
+			}
+			out := filepath.Join(dir, filepath.FromSlash(f.Name))
+			if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+				return fmt.Errorf("failed to create output directory: %w", err)
+			}
+			if err := os.WriteFile(out, data, 0644); err != nil {
+				return fmt.Errorf("failed to write %s: %w", out, err)
+			}
+		}
+		opts.log().Info("Restored", "files", len(it.files), "video", video)
+	}
+	return nil
+}
+
+// readFrameSpan returns the data of frames first to last of a video, read
+// by seeking to the first rather than from the start.
+func readFrameSpan(video string, l layout, first, last int64) ([]byte, error) {
+	cap, cleanup, err := openVideo(video, l)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	for seek := first; ; seek = 0 {
+		cap.SeekFrame(seek)
+		out := make([]byte, 0, (last-first+1)*int64(l.capacity()-frameHeaderSize))
+		next, overshot := first, false
+		err := scanFrames(cap, l, func(f scannedFrame) (bool, error) {
+			if f.err != nil {
+				return false, fmt.Errorf("frame %d: %w", next, f.err)
+			}
+			switch {
+			case int64(f.header.seq) < next:
+				return true, nil // a duplicate, or seeking landed early
+			case int64(f.header.seq) > next:
+				// Duplicated frames earlier in the video put frame numbers
+				// off from sequence numbers
+				overshot = next == first && seek > 0
+				return false, nil
+			}
+			out = append(out, f.data...)
+			next++
+			return next <= last, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if overshot {
+			continue
+		}
+		if next <= last {
+			return nil, malformed("frame %d is missing", next)
+		}
+		return out, nil
+	}
+}
@@ -0,0 +1,98 @@
+package f2v
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Result is what an encode or decode did, so callers can report how
+// efficiently the videos carry the data without working it out again.
+type Result struct {
+	// Frames written or read: index frames, segment tables, recovery
+	// volumes and any other video the run writes included
+	Frames int64
+	// PayloadBytes is the data encoded, as read, or decoded, as written
+	PayloadBytes int64
+	// FrameBytes is what those frames can carry after their headers
+	FrameBytes int64
+	// ParityBytes is what the recovery volume's frames carry, 0 without one
+	ParityBytes int64
+	// Overhead is how much more FrameBytes is than PayloadBytes, as a
+	// fraction of it: 0.25 when the frames could carry a quarter more.
+	// Compression makes it negative when it pays off.
+	Overhead   float64
+	Duration   time.Duration // wall time
+	Throughput float64       // payload bytes per second of it
+}
+
+// resultTally adds up a Result as the frames of a run are written or read,
+// from whichever goroutines do that. A nil tally counts nothing.
+type resultTally struct {
+	frames, payload, frameBytes, parity atomic.Int64
+}
+
+// frame counts a frame that can carry capacity bytes after its header and
+// carries n bytes of recovery volume parity, 0 for a frame of data.
+func (t *resultTally) frame(capacity, parity int) {
+	if t == nil {
+		return
+	}
+	t.frames.Add(1)
+	t.frameBytes.Add(int64(capacity))
+	t.parity.Add(int64(parity))
+}
+
+// addPayload counts n bytes of the data encoded or decoded.
+func (t *resultTally) addPayload(n int64) {
+	if t != nil {
+		t.payload.Add(n)
+	}
+}
+
+// writer returns w counting what is written through it as payload.
+func (t *resultTally) writer(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	return tallyWriter{w, t}
+}
+
+// result returns what was counted for a run started at start.
+func (t *resultTally) result(start time.Time) Result {
+	r := Result{
+		Frames:       t.frames.Load(),
+		PayloadBytes: t.payload.Load(),
+		FrameBytes:   t.frameBytes.Load(),
+		ParityBytes:  t.parity.Load(),
+		Duration:     time.Since(start),
+	}
+	if r.PayloadBytes > 0 {
+		r.Overhead = float64(r.FrameBytes-r.PayloadBytes) / float64(r.PayloadBytes)
+	}
+	if s := r.Duration.Seconds(); s > 0 {
+		r.Throughput = float64(r.PayloadBytes) / s
+	}
+	return r
+}
+
+type tallyWriter struct {
+	w io.Writer
+	t *resultTally
+}
+
+func (w tallyWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.t.addPayload(int64(n))
+	return n, err
+}
+
+// describe says what r counted, for the command line tool.
+func (r Result) describe(u units) string {
+	s := fmt.Sprintf("%s frames, %s of data in %s (%s/s), overhead %s", u.count(r.Frames), u.bytes(r.PayloadBytes), u.duration(r.Duration), u.bytes(int64(r.Throughput)), u.percent(r.Overhead, 1))
+	if r.ParityBytes > 0 {
+		s += fmt.Sprintf(", %s of parity", u.bytes(r.ParityBytes))
+	}
+	return s
+}
@@ -0,0 +1,323 @@
+package f2v
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 reads and writes the objects of a bucket on Amazon S3, or on any store
+// that speaks its API, such as MinIO, with names being their keys. Requests
+// are signed with AWS Signature Version 4 when there are credentials and go
+// unsigned, for public buckets, when there are none. An object is uploaded
+// in a single PUT, which S3 takes up to 5 GiB.
+type S3 struct {
+	Bucket string
+	Region string // us-east-1 if ""
+	// Endpoint is the URL of the store, for one other than AWS, addressed
+	// with the bucket in the path; "" for AWS, with the bucket in the host
+	Endpoint     string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string       // for temporary credentials
+	Client       *http.Client // http.DefaultClient if nil
+}
+
+// S3FromEnv returns the bucket with the credentials, region and endpoint of
+// the standard AWS environment variables: AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION or
+// AWS_DEFAULT_REGION, and AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL.
+func S3FromEnv(bucket string) *S3 {
+	s := &S3{
+		Bucket:       bucket,
+		Region:       os.Getenv("AWS_REGION"),
+		Endpoint:     os.Getenv("AWS_ENDPOINT_URL_S3"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.Region == "" {
+		s.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	return s
+}
+
+// s3Location splits s3://bucket/key into the bucket, set up from the
+// environment, and the key.
+func s3Location(location string) (*S3, string, error) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+	if bucket == "" {
+		return nil, "", fmt.Errorf("invalid S3 location %q; use s3://bucket/key", location)
+	}
+	return S3FromEnv(bucket), key, nil
+}
+
+func (s *S3) region() string {
+	if s.Region == "" {
+		return "us-east-1"
+	}
+	return s.Region
+}
+
+// objectURL returns the URL of the object key, or of the bucket itself for
+// "", with query added.
+func (s *S3) objectURL(key string, query url.Values) (*url.URL, error) {
+	raw := "https://" + s.Bucket + ".s3." + s.region() + ".amazonaws.com/" + s3Escape(key, false)
+	if s.Endpoint != "" {
+		raw = strings.TrimSuffix(s.Endpoint, "/") + "/" + s3Escape(s.Bucket, true) + "/" + s3Escape(key, false)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = s3Query(query)
+	return u, nil
+}
+
+// do sends a request for key, signed if there are credentials, and fails
+// on any status but a 2xx one.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	return s.doWith(ctx, method, key, query, nil, body, size)
+}
+
+// doWith is do sending header too.
+func (s *S3) doWith(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := s.objectURL(key, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if s.AccessKey != "" {
+		s.sign(req, time.Now().UTC())
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		var e struct{ Code, Message string }
+		if xml.Unmarshal(msg, &e) == nil && e.Code != "" {
+			return nil, &statusError{code: resp.StatusCode, msg: fmt.Sprintf("S3 %s s3://%s/%s: %s: %s", method, s.Bucket, key, e.Code, e.Message)}
+		}
+		return nil, &statusError{code: resp.StatusCode, msg: fmt.Sprintf("S3 %s s3://%s/%s: %s", method, s.Bucket, key, resp.Status)}
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 authorization to req. The payload is
+// left unsigned, so it can be streamed, unless req already has its hash.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	payload := req.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = "UNSIGNED-PAYLOAD"
+		req.Header.Set("X-Amz-Content-Sha256", payload)
+	}
+	stamp := now.Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	names := []string{"host"}
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers.String(), signed, payload}, "\n")
+
+	scope := day + "/" + s.region() + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{day, s.region(), "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the characters AWS leaves as
+// they are, and slashes too unless all is set.
+func s3Escape(s string, all bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !all:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes query sorted by key, as signing wants it.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Open downloads the object key.
+func (s *S3) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List returns the keys of the bucket starting with prefix.
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("S3 listing of s3://%s/%s: %w", s.Bucket, prefix, err)
+		}
+		for _, c := range page.Contents {
+			if !strings.HasSuffix(c.Key, "/") { // folder placeholders
+				keys = append(keys, c.Key)
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Create uploads the object key once it is finalized.
+func (s *S3) Create(ctx context.Context, key string) (SinkWriter, error) {
+	return s.create(ctx, key, nil)
+}
+
+// CreateDescribed uploads the object key once it is finalized, with m as
+// its user metadata: x-amz-meta-title, -description, -tags, comma
+// separated, and -visibility. archive.org's S3 API, an Endpoint on
+// archive.org, takes the title, description and tags, as subjects, as the
+// item's own metadata instead, and has no visibility.
+func (s *S3) CreateDescribed(ctx context.Context, key string, m UploadMetadata) (SinkWriter, error) {
+	return s.create(ctx, key, s.metadataHeader(m))
+}
+
+func (s *S3) create(ctx context.Context, key string, header http.Header) (SinkWriter, error) {
+	return newSpoolWriter(func(f *os.File, size int64) error {
+		resp, err := s.doWith(ctx, http.MethodPut, key, nil, header, f, size)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	})
+}
+
+// isArchiveOrg reports whether the store is archive.org's S3 API.
+func (s *S3) isArchiveOrg() bool {
+	u, err := url.Parse(s.Endpoint)
+	return err == nil && (u.Hostname() == "archive.org" || strings.HasSuffix(u.Hostname(), ".archive.org"))
+}
+
+// metadataHeader returns the headers that store m with an object, each
+// value encoded as the store wants text that is not plain ASCII.
+func (s *S3) metadataHeader(m UploadMetadata) http.Header {
+	h := http.Header{}
+	set := func(name, value string) {
+		if value != "" {
+			h.Set(name, mime.QEncoding.Encode("utf-8", value))
+		}
+	}
+	if s.isArchiveOrg() {
+		set = func(name, value string) {
+			if value == "" {
+				return
+			}
+			if mime.QEncoding.Encode("utf-8", value) != value {
+				value = "uri(" + url.PathEscape(value) + ")"
+			}
+			h.Set(name, value)
+		}
+		set("X-Archive-Meta-Title", m.Title)
+		set("X-Archive-Meta-Description", m.Description)
+		for i, tag := range m.Tags {
+			set(fmt.Sprintf("X-Archive-Meta%02d-Subject", i+1), tag)
+		}
+		return h
+	}
+	set("X-Amz-Meta-Title", m.Title)
+	set("X-Amz-Meta-Description", m.Description)
+	set("X-Amz-Meta-Tags", strings.Join(m.Tags, ","))
+	set("X-Amz-Meta-Visibility", m.Visibility)
+	return h
+}
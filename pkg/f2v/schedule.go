@@ -0,0 +1,76 @@
+package f2v
+
+import (
+	"io"
+	"sync"
+)
+
+// The server runs encodes in the background while users wait on decodes
+// and downloads. Encoding is paced by its input: before reading the data
+// for its next frame, an encode waits for any interactive request to
+// finish, so it only ever stops between frames and picks up where it left
+// off, with the video it is writing untouched in the meantime.
+
+// scheduler gives interactive requests priority over background encodes.
+type scheduler struct {
+	mu          sync.Mutex
+	idle        *sync.Cond // signalled when the last interactive request ends
+	interactive int
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{}
+	s.idle = sync.NewCond(&s.mu)
+	return s
+}
+
+// begin marks an interactive request as running until the returned
+// function is called.
+func (s *scheduler) begin() func() {
+	s.mu.Lock()
+	s.interactive++
+	s.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			if s.interactive--; s.interactive == 0 {
+				s.idle.Broadcast()
+			}
+			s.mu.Unlock()
+		})
+	}
+}
+
+// wait blocks while interactive requests are running.
+func (s *scheduler) wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.interactive > 0 {
+		s.idle.Wait()
+	}
+}
+
+func (s *scheduler) busy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.interactive > 0
+}
+
+// pacedReader reads from r for a background encode, waiting out
+// interactive requests before each read. paused is called with true when
+// it starts waiting and with false when it goes on.
+type pacedReader struct {
+	r      io.Reader
+	sched  *scheduler
+	paused func(bool)
+}
+
+func (p *pacedReader) Read(b []byte) (int, error) {
+	if p.sched.busy() {
+		p.paused(true)
+		p.sched.wait()
+		p.paused(false)
+	}
+	return p.r.Read(b)
+}
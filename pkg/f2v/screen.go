@@ -0,0 +1,135 @@
+package f2v
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// screenRules decide in server mode which uploads may be encoded at all,
+// loaded from the JSON file given to -screen:
+//
+//	{"max_bytes": 53687091200,
+//	 "blocked_extensions": [".exe", ".iso"],
+//	 "command": "clamscan --no-summary -"}
+//
+// Size and name are checked as soon as they are known, before any data is
+// stored; the command runs on each complete upload before its job is
+// queued, with the file on stdin, its name in F2V_NAME, its owner in
+// F2V_USER and its stored path in F2V_PATH. A command that exits non-zero
+// rejects the file, and the first line of its output is the reason.
+type screenRules struct {
+	MaxBytes          int64    `json:"max_bytes,omitempty"`
+	AllowedExtensions []string `json:"allowed_extensions,omitempty"` // when set, only these
+	BlockedExtensions []string `json:"blocked_extensions,omitempty"`
+	Command           string   `json:"command,omitempty"`
+}
+
+func loadScreenRules(path string) (screenRules, error) {
+	var rules screenRules
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rules, fmt.Errorf("failed to read screening rules: %w", err)
+	}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return rules, fmt.Errorf("failed to parse screening rules %s: %w", path, err)
+	}
+	if rules.MaxBytes < 0 {
+		return rules, fmt.Errorf("screening rules %s: max_bytes must not be negative", path)
+	}
+	for _, list := range [][]string{rules.AllowedExtensions, rules.BlockedExtensions} {
+		for i, ext := range list {
+			list[i] = normalizeExtension(ext)
+		}
+	}
+	return rules, nil
+}
+
+// normalizeExtension lower-cases ext and gives it a leading dot, so "TAR.GZ"
+// and ".tar.gz" are the same rule.
+func normalizeExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// hasExtension reports whether name ends in any of exts, which may have
+// more than one dot.
+func hasExtension(name string, exts []string) bool {
+	name = strings.ToLower(name)
+	return slices.ContainsFunc(exts, func(ext string) bool { return strings.HasSuffix(name, ext) })
+}
+
+// rejection is the error response for an upload a screening rule turned
+// down. Rule is max_bytes, extension or command, for clients to act on.
+type rejection struct {
+	status  int
+	Message string `json:"error"`
+	Rule    string `json:"rule"`
+	Name    string `json:"name"`
+}
+
+func writeRejection(w http.ResponseWriter, rej *rejection) {
+	writeJSON(w, rej.status, rej)
+}
+
+// checkUpload applies the size and name rules. size is -1 when it is not
+// known yet, in which case the upload has to be cut off at MaxBytes.
+func (r *screenRules) checkUpload(name string, size int64) *rejection {
+	if r.MaxBytes > 0 && size > r.MaxBytes {
+		return r.tooLarge(name)
+	}
+	if len(r.AllowedExtensions) > 0 && !hasExtension(name, r.AllowedExtensions) {
+		return &rejection{status: http.StatusUnsupportedMediaType, Rule: "extension", Name: name,
+			Message: fmt.Sprintf("files of this type are not accepted; allowed: %s", strings.Join(r.AllowedExtensions, ", "))}
+	}
+	if hasExtension(name, r.BlockedExtensions) {
+		return &rejection{status: http.StatusUnsupportedMediaType, Rule: "extension", Name: name,
+			Message: fmt.Sprintf("files of this type are not accepted; blocked: %s", strings.Join(r.BlockedExtensions, ", "))}
+	}
+	return nil
+}
+
+func (r *screenRules) tooLarge(name string) *rejection {
+	return &rejection{status: http.StatusRequestEntityTooLarge, Rule: "max_bytes", Name: name,
+		Message: fmt.Sprintf("files over %s are not accepted", display.bytes(r.MaxBytes))}
+}
+
+// maxRejectReason caps how much of a screening command's output reaches
+// the client.
+const maxRejectReason = 200
+
+// checkContent runs the screening command on a stored upload.
+func (r *screenRules) checkContent(path, name, owner string) *rejection {
+	if r.Command == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return &rejection{status: http.StatusInternalServerError, Rule: "command", Name: name, Message: "failed to read upload for screening"}
+	}
+	defer f.Close()
+	abs, _ := filepath.Abs(path)
+	var out bytes.Buffer
+	cmd := shellCommand(r.Command, name)
+	cmd.Env = append(cmd.Env, "F2V_USER="+owner, "F2V_PATH="+abs)
+	cmd.Stdin, cmd.Stdout = f, &out
+	if err := cmd.Run(); err != nil {
+		reason, _, _ := strings.Cut(strings.TrimSpace(out.String()), "\n")
+		if reason == "" {
+			reason = err.Error()
+		}
+		if len(reason) > maxRejectReason {
+			reason = reason[:maxRejectReason] + "..."
+		}
+		return &rejection{status: http.StatusUnprocessableEntity, Rule: "command", Name: name, Message: "rejected by screening: " + reason}
+	}
+	return nil
+}
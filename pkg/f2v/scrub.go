@@ -0,0 +1,220 @@
+package f2v
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Cold storage keeps uploaded videos from saying where they came from. The
+// muxer leaves its name and version in every file, and may add a title and
+// a creation time; those are blanked once a video is written, in place, so
+// that every offset in it stays valid. Videos are named by a random ID as
+// for -encrypt, and their frame rate is drawn from the common ones for each
+// run. The frame size stays what decoding expects, and the frames still look
+// like data.
+
+const (
+	ebmlIDInfo       = 0x1549A966
+	ebmlIDTags       = 0x1254C367
+	ebmlIDMuxingApp  = 0x4D80
+	ebmlIDWritingApp = 0x5741
+	ebmlIDDateUTC    = 0x4461
+	ebmlIDTitle      = 0x7BA9
+	ebmlIDTrackName  = 0x536E
+	ebmlIDVoid       = 0xEC
+)
+
+// coldRates are the frame rates cold storage picks from.
+var coldRates = []int{24, 25, 30}
+
+// coldRate returns a frame rate from coldRates at random.
+func coldRate() int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(len(coldRates))))
+	if err != nil {
+		return coldRates[len(coldRates)-1]
+	}
+	return coldRates[i.Int64()]
+}
+
+// scrubMetadata blanks what identifies the writer of the video at path.
+func scrubMetadata(path string) error {
+	if strings.EqualFold(filepath.Ext(path), ".mp4") {
+		return scrubMP4(path)
+	}
+	return scrubMatroska(path)
+}
+
+// scrubMatroska turns the muxer and writing application, date, title and
+// track names of a Matroska file, and its tags, into Void elements of the
+// same size.
+func scrubMatroska(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open video: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open video: %w", err)
+	}
+	e := &ebmlReader{r: bufio.NewReaderSize(f, 1<<20), end: info.Size()}
+	id, size, err := e.header()
+	if err != nil || id != ebmlIDHeader || size == ebmlUnknown {
+		return malformed("%s is not a Matroska file", path)
+	}
+	if err := e.skip(size); err != nil {
+		return err
+	}
+	if id, _, err = e.header(); err != nil || id != ebmlIDSegment {
+		return malformed("%s has no Matroska segment", path)
+	}
+
+	var spans [][2]int64 // offset and length of the elements to blank
+	for {
+		start := e.pos
+		id, size, err := e.header()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if size == ebmlUnknown {
+			return malformed("element %x at offset %d has an unknown size", id, start)
+		}
+		switch id {
+		case ebmlIDTags:
+			spans = append(spans, [2]int64{start, e.pos + size - start})
+			err = e.skip(size)
+		case ebmlIDInfo, ebmlIDTracks:
+			var body []byte
+			if body, err = e.read(size); err == nil {
+				spans, err = blankChildren(spans, body, e.pos-size)
+			}
+		default:
+			err = e.skip(size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range spans {
+		if _, err := f.WriteAt(voidElement(s[1]), s[0]); err != nil {
+			return fmt.Errorf("failed to scrub %s: %w", path, err)
+		}
+	}
+	return f.Close()
+}
+
+// blankChildren adds the identifying elements among the children of an
+// Info or Tracks element whose body starts at offset to spans, going into
+// track entries.
+func blankChildren(spans [][2]int64, body []byte, offset int64) ([][2]int64, error) {
+	e := &ebmlReader{r: bufio.NewReader(bytes.NewReader(body)), pos: offset, end: offset + int64(len(body))}
+	for {
+		start := e.pos
+		id, size, err := e.header()
+		if err == io.EOF {
+			return spans, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case ebmlIDMuxingApp, ebmlIDWritingApp, ebmlIDDateUTC, ebmlIDTitle, ebmlIDTrackName:
+			spans = append(spans, [2]int64{start, e.pos + size - start})
+			err = e.skip(size)
+		case ebmlIDTrackEntry:
+			var entry []byte
+			if entry, err = e.read(size); err == nil {
+				spans, err = blankChildren(spans, entry, e.pos-size)
+			}
+		default:
+			err = e.skip(size)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// voidElement returns a Void element n bytes long, n at least 2: its ID, a
+// size of one byte or eight, and zeros.
+func voidElement(n int64) []byte {
+	buf := make([]byte, n)
+	buf[0] = ebmlIDVoid
+	if n-2 < 0x7F {
+		buf[1] = 0x80 | byte(n-2)
+		return buf
+	}
+	binary.BigEndian.PutUint64(buf[1:], uint64(n-9))
+	buf[1] = 0x01
+	return buf
+}
+
+// scrubMP4 turns the user data box of an MP4 file's movie box, which holds
+// the muxer's name, into a free box of the same size.
+func scrubMP4(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open video: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open video: %w", err)
+	}
+	_, moov, moovEnd, err := findBox(f, "moov", 0, info.Size())
+	if err != nil {
+		return err
+	}
+	for pos := moov; pos < moovEnd; {
+		start, _, end, err := findBox(f, "udta", pos, moovEnd)
+		if err != nil {
+			break // no more user data
+		}
+		if _, err := f.WriteAt([]byte("free"), start+4); err != nil {
+			return fmt.Errorf("failed to scrub %s: %w", path, err)
+		}
+		pos = end
+	}
+	return f.Close()
+}
+
+// findBox returns where the first box of a type between from and to
+// starts, where its body starts and where it ends.
+func findBox(f *os.File, kind string, from, to int64) (int64, int64, int64, error) {
+	var head [16]byte
+	for pos := from; pos+8 <= to; {
+		if _, err := f.ReadAt(head[:8], pos); err != nil {
+			return 0, 0, 0, fmt.Errorf("failed to read video: %w", err)
+		}
+		size, body := int64(binary.BigEndian.Uint32(head[:])), pos+8
+		switch size {
+		case 0:
+			size = to - pos
+		case 1:
+			if _, err := f.ReadAt(head[8:], pos+8); err != nil {
+				return 0, 0, 0, fmt.Errorf("failed to read video: %w", err)
+			}
+			size, body = int64(binary.BigEndian.Uint64(head[8:])), pos+16
+		}
+		if size < body-pos || size > to-pos {
+			return 0, 0, 0, malformed("box at offset %d runs past its parent", pos)
+		}
+		if string(head[4:8]) == kind {
+			return pos, body, pos + size, nil
+		}
+		pos += size
+	}
+	return 0, 0, 0, malformed("no %s box", kind)
+}
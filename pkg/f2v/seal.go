@@ -0,0 +1,547 @@
+package f2v
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/bits"
+	"os"
+)
+
+// A version 2 envelope seals the plaintext in chunks of envelopeChunkSize
+// bytes, each an AES-256-GCM message with the header as additional data, in
+// the manner of age's STREAM: chunk i's nonce is the header's nonce with i
+// XORed into bytes 3-10 and byte 11 flipped for the final chunk. A chunk
+// can be checked as soon as it is in, so decoding passes plaintext on as
+// the video streams by, never anything unchecked; and since only the final
+// chunk opens as final, a stream cut short or reordered fails too. Every
+// chunk but the final one is full, and the final one is empty only when the
+// whole plaintext is.
+//
+// Version 3 also hides the plaintext's size: it is padded to the next
+// PADMÉ length (see padmeLength), so the video gives away little more about
+// it than its order of magnitude. The last of the data goes into a boundary
+// chunk, zero-filled and ended by a uint32 of how much of it is data, with
+// byte 11 of its nonce and of every padding chunk after it also XORed with
+// 2. The boundary chunk holds envelopeChunkSize+4 bytes unless it is the
+// final chunk; padding chunks are full ones, except the final one.
+//
+// Version 4, what is written now, always makes the boundary chunk the final
+// one and envelopeChunkSize+4 bytes long, and pads with slack instead:
+// random bytes after it, at least hiddenTrailerSize of them, up to the
+// PADMÉ length of the whole envelope or -pad-to if that is longer. Slack is
+// not authenticated, since nothing is read from it, which is what lets it
+// hold a hidden volume (see hidden.go).
+const envelopeChunkSize = 64 << 10
+
+// Bits XORed into byte 11 of a chunk's nonce.
+const (
+	chunkFinal    = 1
+	chunkPastData = 2 // the boundary chunk and the padding after it
+)
+
+// chunkNonce derives the nonce of chunk counter from the header's.
+func chunkNonce(base [12]byte, counter uint64, flags byte) []byte {
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], counter)
+	for i := range c {
+		base[3+i] ^= c[i]
+	}
+	base[11] ^= flags
+	return base[:]
+}
+
+// padmeLength rounds n up to a length with at most about log2(log2(n))
+// significant bits, so a padded length leaks O(log log n) bits about n at
+// a cost of at most 12% (Nikitin et al., "Reducing Metadata Leakage from
+// Encrypted Files and Communication with PURBs", 2019).
+func padmeLength(n int64) int64 {
+	if n < 2 {
+		return n
+	}
+	e := bits.Len64(uint64(n)) - 1
+	s := bits.Len64(uint64(e))
+	mask := int64(1)<<(e-s) - 1
+	return (n + mask) &^ mask
+}
+
+// chunksSize returns the size of the version 4 chunks sealing n bytes: the
+// data chunks and the boundary chunk.
+func chunksSize(n int64) int64 {
+	const tagSize = 16 // AES-GCM
+	full := max(n-1, 0) / envelopeChunkSize
+	return full*(envelopeChunkSize+tagSize) + envelopeChunkSize + 4 + tagSize
+}
+
+// envelopeLength returns the size of the envelope sealing n bytes of
+// plaintext, header and slack included, when padding to at least padTo.
+func envelopeLength(n, padTo int64) int64 {
+	used := envelopeHeaderSize + chunksSize(n)
+	return max(padmeLength(used+hiddenTrailerSize), padTo)
+}
+
+// envelopeSealer encrypts what is written to it into dst, chunk by chunk.
+type envelopeSealer struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	nonce   [12]byte
+	counter uint64
+	buf     []byte
+	written int64
+	slack   func(used int64) error // writes the slack; nil for a hidden volume's chunks
+}
+
+func (s *secret) newEnvelopeSealer(dst io.Writer) (*envelopeSealer, error) {
+	h, err := s.newHeader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate salt and nonce: %w", err)
+	}
+	key, err := s.key(h)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := h.marshal()
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+	e := newChunkSealer(dst, aead, h)
+	e.slack = func(used int64) error { return s.writeSlack(dst, h, used) }
+	return e, nil
+}
+
+func newChunkSealer(dst io.Writer, aead cipher.AEAD, h envelopeHeader) *envelopeSealer {
+	return &envelopeSealer{dst: dst, aead: aead, header: h.marshal(), nonce: h.nonce, buf: make([]byte, 0, envelopeChunkSize+4)}
+}
+
+func (e *envelopeSealer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// A full chunk waits for more data, since it goes in the boundary chunk if none comes
+		if len(e.buf) == envelopeChunkSize {
+			if err := e.seal(0); err != nil {
+				return n - len(p), err
+			}
+		}
+		k := min(len(p), envelopeChunkSize-len(e.buf))
+		e.buf = append(e.buf, p[:k]...)
+		e.written += int64(k)
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// Close seals the boundary chunk and writes the slack.
+func (e *envelopeSealer) Close() error {
+	data := len(e.buf)
+	e.buf = append(e.buf, make([]byte, envelopeChunkSize-data)...)
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(data))
+	if err := e.seal(chunkPastData | chunkFinal); err != nil {
+		return err
+	}
+	if e.slack == nil {
+		return nil
+	}
+	return e.slack(envelopeHeaderSize + chunksSize(e.written))
+}
+
+func (e *envelopeSealer) seal(flags byte) error {
+	out := e.aead.Seal(nil, chunkNonce(e.nonce, e.counter, flags), e.buf, e.header)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.dst.Write(out)
+	return err
+}
+
+// envelopeOpener checks and decrypts the chunks written to it, passing the
+// plaintext to dst as each one is found good.
+type envelopeOpener struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	nonce   [12]byte
+	counter uint64
+	buf     []byte
+	version uint8
+	past    bool // the boundary chunk is in, and only padding or slack follows
+}
+
+func (s *secret) newEnvelopeOpener(dst io.Writer, h envelopeHeader) (*envelopeOpener, error) {
+	key, err := s.key(h)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return newChunkOpener(dst, aead, h), nil
+}
+
+func newChunkOpener(dst io.Writer, aead cipher.AEAD, h envelopeHeader) *envelopeOpener {
+	return &envelopeOpener{dst: dst, aead: aead, header: h.marshal(), nonce: h.nonce, version: h.version}
+}
+
+// boundaryFlags returns the nonce flags of the boundary chunk when it is
+// the final one, as it always is from version 4.
+func (e *envelopeOpener) boundaryFlags() byte {
+	if e.version >= 4 {
+		return chunkPastData | chunkFinal
+	}
+	return chunkPastData
+}
+
+func (e *envelopeOpener) Write(p []byte) (int, error) {
+	if e.past && e.version >= 4 {
+		return len(p), nil // slack
+	}
+	sealed := envelopeChunkSize + e.aead.Overhead()
+	e.buf = append(e.buf, p...)
+	// As when sealing, a full chunk may be the final one until more follows
+	for len(e.buf) > sealed {
+		switch {
+		case e.past:
+			if _, err := e.open(e.buf[:sealed], chunkPastData); err != nil {
+				return 0, err
+			}
+		case e.version < 3:
+			if err := e.pass(e.buf[:sealed], 0); err != nil {
+				return 0, err
+			}
+		default:
+			// A chunk that does not open as data has to be the longer
+			// boundary chunk, and may be the final one until more follows
+			plain, err := e.aead.Open(nil, chunkNonce(e.nonce, e.counter, 0), e.buf[:sealed], e.header)
+			if err == nil {
+				e.counter++
+				if err := e.write(plain); err != nil {
+					return 0, err
+				}
+				break
+			}
+			if len(e.buf) <= sealed+4 {
+				return len(p), nil
+			}
+			if err := e.pass(e.buf[:sealed+4], e.boundaryFlags()); err != nil {
+				return 0, err
+			}
+			if e.version >= 4 {
+				e.buf = nil
+				return len(p), nil
+			}
+			e.buf = append(e.buf[:0], e.buf[sealed+4:]...)
+			continue
+		}
+		e.buf = append(e.buf[:0], e.buf[sealed:]...)
+	}
+	return len(p), nil
+}
+
+// Close opens the final chunk.
+func (e *envelopeOpener) Close() error {
+	switch {
+	case e.past && e.version >= 4:
+		return nil
+	case e.past:
+		_, err := e.open(e.buf, chunkPastData|chunkFinal)
+		return err
+	case e.version < 3:
+		return e.pass(e.buf, chunkFinal)
+	}
+	return e.pass(e.buf, chunkPastData|chunkFinal)
+}
+
+// opens reports whether the first chunk of data, the envelope after its
+// header, opens under the opener's key, without using it up.
+func (e *envelopeOpener) opens(data []byte) bool {
+	sealed := envelopeChunkSize + e.aead.Overhead()
+	for _, c := range []struct {
+		size  int
+		flags byte
+	}{{sealed, 0}, {sealed + 4, e.boundaryFlags()}} {
+		if len(data) >= c.size {
+			if _, err := e.aead.Open(nil, chunkNonce(e.nonce, 0, c.flags), data[:c.size], e.header); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *envelopeOpener) open(chunk []byte, flags byte) ([]byte, error) {
+	plain, err := e.aead.Open(nil, chunkNonce(e.nonce, e.counter, flags), chunk, e.header)
+	if err != nil {
+		if e.counter == 0 {
+			return nil, mismatched("decryption failed: wrong key, or the data was altered")
+		}
+		return nil, mismatched("decryption failed at byte %d: the data was altered or cut short", e.counter*envelopeChunkSize)
+	}
+	e.counter++
+	return plain, nil
+}
+
+// pass opens a data or boundary chunk and writes its data to dst.
+func (e *envelopeOpener) pass(chunk []byte, flags byte) error {
+	plain, err := e.open(chunk, flags)
+	if err != nil {
+		return err
+	}
+	if flags&chunkPastData != 0 {
+		if len(plain) < 4 || int(binary.BigEndian.Uint32(plain[len(plain)-4:])) > len(plain)-4 {
+			return malformed("invalid encrypted payload")
+		}
+		plain = plain[:binary.BigEndian.Uint32(plain[len(plain)-4:])]
+		e.past = true
+	}
+	return e.write(plain)
+}
+
+func (e *envelopeOpener) write(plain []byte) error {
+	if _, err := e.dst.Write(plain); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
+
+// newSealer returns a writer that encrypts a file's name and then what is
+// written to it into dst, in whichever form s encrypts to; Close finishes
+// the encryption but leaves dst open.
+func newSealer(dst io.Writer, name string, s *secret) (io.WriteCloser, error) {
+	var w io.WriteCloser
+	var err error
+	switch {
+	case len(s.ageRecipients) > 0:
+		w, err = ageEncrypt(dst, s.ageRecipients)
+	case len(s.pgpRecipients) > 0:
+		w, err = pgpEncrypt(dst, s.pgpRecipients)
+	default:
+		w, err = s.newEnvelopeSealer(dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(namePrefix(name)); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// namePrefix returns what goes ahead of the data in the plaintext: the
+// name's length and the name, cut to 64 KiB.
+func namePrefix(name string) []byte {
+	if len(name) > 0xFFFF {
+		name = name[:0xFFFF]
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(name))), name...)
+}
+
+// sealReader returns the encryption of what r yields, made as it is read.
+// Closing the result stops the encryption early.
+func sealReader(r io.Reader, name string, s *secret) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := newSealer(pw, name, s)
+		if err == nil {
+			if _, err = io.Copy(w, r); err == nil {
+				err = w.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// nameStripper takes the file name off the front of a decrypted stream and
+// passes the data after it on to dst.
+type nameStripper struct {
+	dst  io.Writer
+	log  *slog.Logger // told the name
+	head []byte
+	name string
+	done bool
+}
+
+func (n *nameStripper) Write(p []byte) (int, error) {
+	if n.done {
+		return n.dst.Write(p)
+	}
+	n.head = append(n.head, p...)
+	if len(n.head) < 2 || len(n.head) < 2+int(binary.BigEndian.Uint16(n.head)) {
+		return len(p), nil
+	}
+	end := 2 + int(binary.BigEndian.Uint16(n.head))
+	n.name = string(n.head[2:end])
+	n.log.Info("Decrypted", "name", n.name)
+	n.done = true
+	if _, err := n.dst.Write(n.head[end:]); err != nil {
+		return 0, err
+	}
+	n.head = nil
+	return len(p), nil
+}
+
+func (n *nameStripper) finish() error {
+	if !n.done {
+		return malformed("invalid encrypted payload")
+	}
+	return nil
+}
+
+// decrypter decrypts an encrypted stream into dst. Chunked envelopes and age
+// files are checked and passed on as they stream in; version 1 envelopes
+// and OpenPGP messages only vouch for their data once all of it is in, so
+// they are collected and written on Close. A version 4 envelope whose first
+// chunk does not open with the secret may still hold a hidden volume, found
+// from the end of the data, so it is spooled to a temporary file.
+type decrypter struct {
+	dst    *nameStripper
+	secret *secret
+	buf    bytes.Buffer
+	stream io.WriteCloser // once the data is known to stream
+	whole  bool           // once the data is known not to
+	spool  *os.File       // the envelope, when its hidden volume is tried
+	header envelopeHeader // of the spooled envelope
+	outer  error          // why the spooled envelope did not open
+}
+
+// newDecrypter returns a decrypter writing to dst that logs the name sealed
+// with the data to log.
+func newDecrypter(dst io.Writer, s *secret, log *slog.Logger) *decrypter {
+	return &decrypter{dst: &nameStripper{dst: dst, log: log}, secret: s}
+}
+
+func (d *decrypter) Write(p []byte) (int, error) {
+	if d.stream != nil {
+		return d.stream.Write(p)
+	}
+	if d.spool != nil {
+		if _, err := d.spool.Write(p); err != nil {
+			return 0, fmt.Errorf("failed to spool encrypted data: %w", err)
+		}
+		return len(p), nil
+	}
+	d.buf.Write(p)
+	if !d.whole && d.buf.Len() >= envelopeHeaderSize {
+		if err := d.start(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start looks at the head of the data to see whether it can stream.
+func (d *decrypter) start() error {
+	if bytes.HasPrefix(d.buf.Bytes(), keyShareMagic[:]) {
+		if d.buf.Len() < keyShareSize+envelopeHeaderSize {
+			return nil
+		}
+		share, err := parseKeyShare(d.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		d.secret = d.secret.withShare(share)
+		d.buf.Next(keyShareSize)
+	}
+	data := d.buf.Bytes()
+	h, headerErr := parseEnvelopeHeader(data)
+	canStream := bytes.HasPrefix(data, ageMagic) || headerErr == nil && h.version >= 2
+	if !canStream {
+		d.whole = true
+		return nil
+	}
+	if d.secret == nil {
+		return fmt.Errorf("the video is encrypted; give -key, -password, -age-identity or -pgp-keyring")
+	}
+	if headerErr == nil {
+		if h.version >= 4 && len(data) < envelopeHeaderSize+envelopeChunkSize+4+16 {
+			return nil // until the first chunk is in
+		}
+		opener, err := d.secret.newEnvelopeOpener(d.dst, h)
+		if err == nil && h.version >= 4 && !opener.opens(data[envelopeHeaderSize:]) {
+			err = mismatched("decryption failed: wrong key, or the data was altered")
+		}
+		if err != nil {
+			if h.version < 4 {
+				return err
+			}
+			return d.startSpool(h, err)
+		}
+		d.stream, data = opener, data[envelopeHeaderSize:]
+	} else {
+		d.stream = newAgeStream(d.dst, d.secret.ageIdentities)
+	}
+	_, err := d.stream.Write(data)
+	d.buf = bytes.Buffer{}
+	return err
+}
+
+// startSpool moves the data to a temporary file, to look for a hidden
+// volume once all of it is in.
+func (d *decrypter) startSpool(h envelopeHeader, outer error) error {
+	f, err := os.CreateTemp("", "f2v-spool-*")
+	if err != nil {
+		return fmt.Errorf("failed to spool encrypted data: %w", err)
+	}
+	d.spool, d.header, d.outer = f, h, outer
+	_, err = d.Write(d.buf.Bytes())
+	d.buf = bytes.Buffer{}
+	return err
+}
+
+func (d *decrypter) Close() error {
+	if d.spool != nil {
+		defer os.Remove(d.spool.Name())
+		defer d.spool.Close()
+		size, err := d.spool.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		found, err := d.secret.openHidden(d.spool, size, d.header, d.dst)
+		if !found {
+			return d.outer
+		}
+		if err != nil {
+			return err
+		}
+		return d.dst.finish()
+	}
+	if d.stream == nil {
+		name, plain, err := decryptPayload(d.buf.Bytes(), d.secret)
+		if err != nil {
+			return err
+		}
+		d.dst.log.Info("Decrypted", "name", name)
+		d.dst.name = name
+		if _, err := d.dst.dst.Write(plain); err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
+		}
+		return nil
+	}
+	if err := d.stream.Close(); err != nil {
+		return err
+	}
+	return d.dst.finish()
+}
+
+// name returns the file name sealed with the data, once it is known.
+func (d *decrypter) name() string {
+	return d.dst.name
+}
+
+// abort gives up on a decryption that will not be finished.
+func (d *decrypter) abort(err error) {
+	if d.spool != nil {
+		d.spool.Close()
+		os.Remove(d.spool.Name())
+	}
+	if a, ok := d.stream.(*ageStream); ok {
+		a.abort(err)
+	}
+}
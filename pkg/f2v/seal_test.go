@@ -0,0 +1,190 @@
+package f2v
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// decryptStream runs sealed through a decrypter in pieces of step bytes
+// and returns what it passed on, the name it found and how it ended.
+func decryptStream(sealed []byte, s *secret, step int) ([]byte, string, error) {
+	var out bytes.Buffer
+	d := newDecrypter(&out, s, discardLog)
+	for len(sealed) > 0 {
+		n := min(step, len(sealed))
+		if _, err := d.Write(sealed[:n]); err != nil {
+			d.abort(err)
+			return out.Bytes(), d.name(), err
+		}
+		sealed = sealed[n:]
+	}
+	err := d.Close()
+	return out.Bytes(), d.name(), err
+}
+
+func TestDecrypterStreamsEveryVersion(t *testing.T) {
+	s := testKeySecret(t)
+	for _, n := range []int{0, 1000, 2*envelopeChunkSize - 2, 2 * envelopeChunkSize} {
+		data := randomBytes(t, n)
+		plain := append(namePrefix("stream.bin"), data...)
+		current, err := encryptPayload(data, "stream.bin", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for version, sealed := range map[int][]byte{
+			1: sealVersion(t, s, 1, plain, 0),
+			2: sealVersion(t, s, 2, plain, 0),
+			3: sealVersion(t, s, 3, plain, 300),
+			4: current,
+		} {
+			for _, step := range []int{1000, envelopeChunkSize + 3, len(sealed) + 1} {
+				got, name, err := decryptStream(sealed, s, step)
+				if err != nil || name != "stream.bin" || !bytes.Equal(got, data) {
+					t.Errorf("version %d, %d bytes in steps of %d: %q, %d bytes, %v", version, n, step, name, len(got), err)
+				}
+			}
+		}
+	}
+}
+
+func TestTruncatedChunk(t *testing.T) {
+	s := testKeySecret(t)
+	data := randomBytes(t, 3*envelopeChunkSize)
+	plain := append(namePrefix("cut.bin"), data...)
+	current, err := encryptPayload(data, "cut.bin", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedChunk := envelopeChunkSize + 16
+	for version, sealed := range map[int][]byte{2: sealVersion(t, s, 2, plain, 0), 3: sealVersion(t, s, 3, plain, 0), 4: current} {
+		for _, c := range []struct {
+			what string
+			cut  []byte
+		}{
+			{"without its last chunks", sealed[:envelopeHeaderSize+2*sealedChunk]},
+			{"cut inside a chunk", sealed[:envelopeHeaderSize+2*sealedChunk+100]},
+			{"cut inside the first chunk", sealed[:envelopeHeaderSize+100]},
+			{"with two chunks swapped", append(append(append(bytes.Clone(sealed[:envelopeHeaderSize]), sealed[envelopeHeaderSize+sealedChunk:envelopeHeaderSize+2*sealedChunk]...), sealed[envelopeHeaderSize:envelopeHeaderSize+sealedChunk]...), sealed[envelopeHeaderSize+2*sealedChunk:]...)},
+		} {
+			if _, _, err := decryptPayload(c.cut, s); err == nil {
+				t.Errorf("version %d %s opened whole", version, c.what)
+			}
+			got, _, err := decryptStream(c.cut, s, 4096)
+			if err == nil {
+				t.Errorf("version %d %s streamed without an error", version, c.what)
+			}
+			if !bytes.HasPrefix(data, got) {
+				t.Errorf("version %d %s passed on data that was not sealed", version, c.what)
+			}
+		}
+	}
+}
+
+func TestDecrypterPassesOnlyCheckedData(t *testing.T) {
+	s := testKeySecret(t)
+	data := randomBytes(t, 3*envelopeChunkSize)
+	sealed, err := encryptPayload(data, "f", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Alter the second chunk: only the first one's data may come out
+	sealed[envelopeHeaderSize+envelopeChunkSize+16+5] ^= 1
+	got, _, err := decryptStream(sealed, s, 1000)
+	if err == nil {
+		t.Fatal("an altered chunk streamed through")
+	}
+	if want := envelopeChunkSize - len(namePrefix("f")); len(got) != want || !bytes.Equal(got, data[:want]) {
+		t.Errorf("passed on %d bytes before the altered chunk, want the %d of the first chunk", len(got), want)
+	}
+}
+
+func TestPadmeLength(t *testing.T) {
+	for n, want := range map[int64]int64{0: 0, 1: 1, 9: 10, 100: 104, 1000: 1024, 1 << 20: 1 << 20, 1<<20 + 1: 1<<20 + 1<<15} {
+		if got := padmeLength(n); got != want {
+			t.Errorf("padmeLength(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+// sealVersion seals plain under s in the envelope version given, as older
+// releases wrote them: version 1 as one message, version 2 in chunks, and
+// version 3 with the boundary chunk followed by a padding chunk of pad
+// bytes, or final when pad is 0.
+func sealVersion(t *testing.T, s *secret, version uint8, plain []byte, pad int) []byte {
+	t.Helper()
+	h, err := s.newHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.version = version
+	key, err := s.key(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := h.marshal()
+	out := bytes.Clone(header)
+	if version == 1 {
+		return aead.Seal(out, h.nonce[:], plain, header)
+	}
+	var counter uint64
+	seal := func(chunk []byte, flags byte) {
+		out = aead.Seal(out, chunkNonce(h.nonce, counter, flags), chunk, header)
+		counter++
+	}
+	for len(plain) > envelopeChunkSize {
+		seal(plain[:envelopeChunkSize], 0)
+		plain = plain[envelopeChunkSize:]
+	}
+	if version == 2 {
+		seal(plain, chunkFinal)
+		return out
+	}
+	boundary := append(bytes.Clone(plain), make([]byte, envelopeChunkSize-len(plain)+4)...)
+	binary.BigEndian.PutUint32(boundary[envelopeChunkSize:], uint32(len(plain)))
+	if pad == 0 {
+		seal(boundary, chunkPastData|chunkFinal)
+		return out
+	}
+	seal(boundary, chunkPastData)
+	seal(make([]byte, pad), chunkPastData|chunkFinal)
+	return out
+}
+
+func TestEnvelopeReadsOlderVersions(t *testing.T) {
+	s := testPasswordSecret("pw")
+	for _, v := range []struct {
+		version uint8
+		pad     int
+	}{{1, 0}, {2, 0}, {3, 0}, {3, 1000}} {
+		for _, n := range []int{0, 100, envelopeChunkSize - 2, 2*envelopeChunkSize + 5} {
+			data := randomBytes(t, n)
+			sealed := sealVersion(t, s, v.version, append(namePrefix("old.bin"), data...), v.pad)
+			name, got, err := decryptPayload(sealed, s)
+			if err != nil || name != "old.bin" || !bytes.Equal(got, data) {
+				t.Errorf("version %d with %d bytes and %d of padding: %q, %d bytes, %v", v.version, n, v.pad, name, len(got), err)
+			}
+		}
+	}
+}
+
+func TestEnvelopeSlackUnread(t *testing.T) {
+	s := testKeySecret(t)
+	data := randomBytes(t, envelopeChunkSize+100)
+	sealed, err := encryptPayload(data, "f", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The slack after the boundary chunk is random and never read
+	sealed[len(sealed)-1] ^= 0x40
+	if _, got, err := decryptPayload(sealed, s); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("altered slack: %v", err)
+	}
+	if got, _, err := decryptStream(sealed, s, 1000); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("altered slack streamed: %v", err)
+	}
+}
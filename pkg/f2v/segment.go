@@ -0,0 +1,230 @@
+package f2v
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// A segmented video mixes densities: each segment of the data is encoded
+// with its own layout, so small critical parts (a header, a manifest, an
+// index) can use very robust frames while the bulk stays dense. Frame 0 is a
+// segment table (frameFlagTable), always written in tableLayout so a decoder
+// can read it without knowing the segments' settings. Its data holds:
+//
+//	magic    [4]byte "FVST"
+//	version  uint8
+//	count    uint16
+//	count times:
+//	  mode, blockSize, bitsPerChannel, coefficients uint8
+//	  frames uint32
+//	  bytes  uint64
+//
+// Data frames follow with sequence numbers from 1, segment after segment.
+
+const (
+	segmentTableVersion = 1
+	segmentRecordSize   = 16
+)
+
+var segmentTableMagic = [4]byte{'F', 'V', 'S', 'T'}
+
+// segment is one part of the data and the layout its frames use.
+type segment struct {
+	layout layout
+	frames uint32
+	size   uint64
+}
+
+// segmentTable is a parsed segment table along with where each segment's
+// frames and bytes start.
+type segmentTable struct {
+	segments  []segment
+	firstSeq  []uint32
+	firstByte []uint64
+}
+
+// tableLayout returns the layout segment tables are written in: the most
+// robust dct setting at the video's frame size.
+func tableLayout(l layout) layout {
+	return l.writtenLike(layout{width: l.width, height: l.height, mode: modeDCT, coefficients: 2, markers: true})
+}
+
+func newSegmentTable(segments []segment) *segmentTable {
+	t := &segmentTable{segments: segments}
+	seq, offset := uint32(1), uint64(0)
+	for _, s := range segments {
+		t.firstSeq = append(t.firstSeq, seq)
+		t.firstByte = append(t.firstByte, offset)
+		seq += s.frames
+		offset += s.size
+	}
+	return t
+}
+
+func (t *segmentTable) marshal() []byte {
+	buf := make([]byte, 7, 7+len(t.segments)*segmentRecordSize)
+	copy(buf, segmentTableMagic[:])
+	buf[4] = segmentTableVersion
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(t.segments)))
+	for _, s := range t.segments {
+		l := s.layout
+		buf = append(buf, byte(l.mode), byte(l.blockSize), byte(l.bitsPerChannel), byte(l.coefficients))
+		buf = binary.BigEndian.AppendUint32(buf, s.frames)
+		buf = binary.BigEndian.AppendUint64(buf, s.size)
+	}
+	return buf
+}
+
+// parseSegmentTable decodes a table; the segment layouts take their frame
+// size from base.
+func parseSegmentTable(buf []byte, base layout) (*segmentTable, error) {
+	if len(buf) < 7 || !bytes.Equal(buf[:4], segmentTableMagic[:]) {
+		return nil, malformed("invalid segment table")
+	}
+	if buf[4] != segmentTableVersion {
+		return nil, unsupported("unsupported segment table version %d", buf[4])
+	}
+	count := int(binary.BigEndian.Uint16(buf[5:]))
+	if len(buf) != 7+count*segmentRecordSize {
+		return nil, malformed("segment table is truncated")
+	}
+	var segments []segment
+	frames := uint64(1) // the table frame
+	for rec := buf[7:]; len(rec) > 0; rec = rec[segmentRecordSize:] {
+		l := layout{
+			width:          base.width,
+			height:         base.height,
+			mode:           frameMode(rec[0]),
+			blockSize:      int(rec[1]),
+			bitsPerChannel: int(rec[2]),
+			coefficients:   int(rec[3]),
+		}
+		l.markers = l.mode.hasMarkers()
+		if err := l.validate(); err != nil {
+			return nil, malformed("segment table lists an invalid layout: %v", err)
+		}
+		s := segment{layout: l, frames: binary.BigEndian.Uint32(rec[4:]), size: binary.BigEndian.Uint64(rec[8:])}
+		// Frame numbers and offsets are sums over the segments, so they
+		// must not wrap
+		if s.frames == 0 || s.size > uint64(s.frames)*uint64(l.capacity()-frameHeaderSize) {
+			return nil, malformed("segment table lists %s in %d frames", display.bytes(int64(min(s.size, math.MaxInt64))), s.frames)
+		}
+		if frames += uint64(s.frames); frames >= math.MaxUint32 {
+			return nil, malformed("segment table lists more than %d frames", uint32(math.MaxUint32-1))
+		}
+		segments = append(segments, s)
+	}
+	return newSegmentTable(segments), nil
+}
+
+// find returns the index of the segment holding the frame with sequence
+// number seq, or -1 for the table frame or a number past the end.
+func (t *segmentTable) find(seq uint32) int {
+	for i := len(t.segments) - 1; i >= 0; i-- {
+		if seq >= t.firstSeq[i] {
+			if seq-t.firstSeq[i] < t.segments[i].frames {
+				return i
+			}
+			return -1
+		}
+	}
+	return -1
+}
+
+// byteRange returns the span of the original data held by frame seq.
+func (t *segmentTable) byteRange(seq uint32) (start, end int64) {
+	i := t.find(seq)
+	if i < 0 {
+		return 0, 0
+	}
+	s := t.segments[i]
+	per := uint64(s.layout.capacity() - frameHeaderSize)
+	start64 := t.firstByte[i] + uint64(seq-t.firstSeq[i])*per
+	return int64(start64), int64(min(start64+per, t.firstByte[i]+s.size))
+}
+
+// candidates returns the layouts worth trying on a frame, most likely first:
+// the segment that should come next, then every other segment. Before the
+// table is known that is the caller's layout, then the table layout.
+func (t *segmentTable) candidates(base layout, next uint32) []layout {
+	if t == nil {
+		return []layout{base, tableLayout(base)}
+	}
+	var out []layout
+	if i := t.find(next); i >= 0 {
+		out = append(out, t.segments[i].layout)
+	}
+	for _, s := range t.segments {
+		if !slices.Contains(out, s.layout) {
+			out = append(out, s.layout)
+		}
+	}
+	return out
+}
+
+// segmentsToVideo writes a segmented video: the table, then every part of
+// data in its own layout. All layouts must share the frame size.
+func segmentsToVideo(parts [][]byte, layouts []layout, outputFilename string, fps int) error {
+	var segments []segment
+	for i, part := range parts {
+		per := layouts[i].capacity() - frameHeaderSize
+		frames := (len(part) + per - 1) / per
+		if frames == 0 {
+			continue
+		}
+		segments = append(segments, segment{layout: layouts[i], frames: uint32(frames), size: uint64(len(part))})
+	}
+	table := newSegmentTable(segments)
+	descriptor := table.marshal()
+	tl := tableLayout(layouts[0])
+	if len(descriptor) > tl.capacity()-frameHeaderSize {
+		return fmt.Errorf("too many segments for one table frame")
+	}
+
+	w, err := newFrameWriter(outputFilename, tl, fps)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	h := frameHeader{flags: frameFlagTable}
+	if len(segments) == 0 {
+		h.flags |= frameFlagLast
+	}
+	if err := w.write(h, descriptor); err != nil {
+		return err
+	}
+
+	seq := uint32(1)
+	for i, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+		l := layouts[i]
+		w.setLayout(l)
+		per := l.capacity() - frameHeaderSize
+		for off := 0; off < len(part); off += per {
+			h := frameHeader{seq: seq}
+			if off+per >= len(part) && i == lastNonEmpty(parts) {
+				h.flags |= frameFlagLast
+			}
+			if err := w.write(h, part[off:min(off+per, len(part))]); err != nil {
+				return err
+			}
+			seq++
+		}
+	}
+	return nil
+}
+
+func lastNonEmpty(parts [][]byte) int {
+	for i := len(parts) - 1; i >= 0; i-- {
+		if len(parts[i]) > 0 {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,31 @@
+package f2v
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzParseSegmentTable(f *testing.F) {
+	base := defaultLayout()
+	robust := tableLayout(base)
+	f.Add(newSegmentTable([]segment{{layout: base, frames: 3, size: 1000}}).marshal())
+	f.Add(newSegmentTable([]segment{
+		{layout: robust, frames: 1, size: 10},
+		{layout: base, frames: 1 << 20, size: 1 << 30},
+	}).marshal())
+	f.Add(append(segmentTableMagic[:], segmentTableVersion, 0, 0))
+	f.Add(append(segmentTableMagic[:], segmentTableVersion, 0xff, 0xff))
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		table, err := parseSegmentTable(buf, base)
+		if err != nil {
+			return
+		}
+		if got := table.marshal(); !bytes.Equal(got, buf) {
+			t.Fatalf("table %x parsed into one marshalling as %x", buf, got)
+		}
+		if _, err := parseSegmentTable(buf[:len(buf)-1], base); err == nil {
+			t.Fatal("parsed a table cut short")
+		}
+	})
+}
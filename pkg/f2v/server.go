@@ -0,0 +1,621 @@
+package f2v
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverUser is an account allowed to use the server. Only a SHA-256 of the
+// bearer token is stored, e.g. `printf %s "$TOKEN" | sha256sum`. A non-zero
+// QuotaBytes caps the total size of the files the user may have encoded.
+type serverUser struct {
+	Name        string `json:"name"`
+	TokenSHA256 string `json:"token_sha256"`
+	Admin       bool   `json:"admin,omitempty"`
+	QuotaBytes  int64  `json:"quota_bytes,omitempty"`
+}
+
+type usersFile struct {
+	Users []serverUser `json:"users"`
+}
+
+func loadUsers(path string) ([]serverUser, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users file: %w", err)
+	}
+	var f usersFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse users file %s: %w", path, err)
+	}
+	if len(f.Users) == 0 {
+		return nil, fmt.Errorf("users file %s defines no users", path)
+	}
+	return f.Users, nil
+}
+
+// job tracks an encode submitted to the server.
+type job struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	Kind    string    `json:"kind"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Status  string    `json:"status"` // queued, running, paused, done or failed
+	Error   string    `json:"error,omitempty"`
+	Archive string    `json:"archive,omitempty"` // archive ID once done
+	Created time.Time `json:"created"`
+	// Where the frame bytes written beyond the file went, once done
+	Overhead *capacityOverhead `json:"overhead,omitempty"`
+}
+
+// archiveInfo is the API view of a catalog entry. Its ID is the video's SHA-256.
+type archiveInfo struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Owner   string    `json:"owner,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// maxDecodeUpload is the largest video /decode takes.
+const maxDecodeUpload = 16 << 30
+
+// server exposes the encoder as a shared HTTP service. Every archive and job
+// belongs to the user who created it; only its owner or an admin can list,
+// download or extract it.
+type server struct {
+	dataDir string
+	layout  layout
+	fps     int
+	users   []serverUser
+	screen  screenRules
+	sched   *scheduler // pauses encodes while decodes and downloads run
+	// maxDecode caps the video a /decode request may send, so that one
+	// request cannot fill the data directory
+	maxDecode int64
+
+	mu       sync.Mutex // guards catalog, jobs, patching and reserved
+	catalog  *catalog
+	jobs     map[string]*job
+	patching map[string]bool  // resumable uploads currently receiving data
+	reserved map[string]int64 // quota held per user for uploads being received
+}
+
+func newServer(dataDir string, cat *catalog, users []serverUser, screen screenRules, l layout, fps int) (*server, error) {
+	for _, dir := range []string{"uploads", "videos"} {
+		if err := os.MkdirAll(filepath.Join(dataDir, dir), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory: %w", err)
+		}
+	}
+	// Jobs share frame buffers and Mats rather than allocating them afresh
+	l.pool = &framePool{}
+	return &server{
+		dataDir:   dataDir,
+		layout:    l,
+		fps:       fps,
+		users:     users,
+		screen:    screen,
+		sched:     newScheduler(),
+		maxDecode: maxDecodeUpload,
+		catalog:   cat,
+		jobs:      make(map[string]*job),
+		patching:  make(map[string]bool),
+		reserved:  make(map[string]int64),
+	}, nil
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /encode", s.withUser(s.handleEncode))
+	mux.HandleFunc("POST /decode", s.withUser(s.handleDecode))
+	mux.HandleFunc("OPTIONS /uploads", s.handleTusOptions)
+	mux.HandleFunc("POST /uploads", s.withUser(withTus(s.handleTusCreate)))
+	mux.HandleFunc("HEAD /uploads/{id}", s.withUser(withTus(s.handleTusHead)))
+	mux.HandleFunc("PATCH /uploads/{id}", s.withUser(withTus(s.handleTusPatch)))
+	mux.HandleFunc("DELETE /uploads/{id}", s.withUser(withTus(s.handleTusDelete)))
+	mux.HandleFunc("GET /jobs", s.withUser(s.handleListJobs))
+	mux.HandleFunc("GET /jobs/{id}", s.withUser(s.handleGetJob))
+	mux.HandleFunc("GET /usage", s.withUser(s.handleUsage))
+	mux.HandleFunc("GET /estimate", s.withUser(s.handleEstimate))
+	mux.HandleFunc("GET /archives", s.withUser(s.handleListArchives))
+	mux.HandleFunc("GET /archives/{id}/video", s.withUser(s.handleArchiveVideo))
+	mux.HandleFunc("GET /archives/{id}/index", s.withUser(s.handleArchiveIndex))
+	mux.HandleFunc("GET /archives/{id}/file", s.withUser(s.handleArchiveFile))
+	return mux
+}
+
+type userHandler func(w http.ResponseWriter, r *http.Request, u *serverUser)
+
+// withUser rejects requests without a valid bearer token.
+func (s *server) withUser(h userHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+		u := s.authenticate(token)
+		if u == nil {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		h(w, r, u)
+	}
+}
+
+func (s *server) authenticate(token string) *serverUser {
+	sum := sha256.Sum256([]byte(token))
+	got := []byte(hex.EncodeToString(sum[:]))
+	for i := range s.users {
+		if subtle.ConstantTimeCompare(got, []byte(strings.ToLower(s.users[i].TokenSHA256))) == 1 {
+			return &s.users[i]
+		}
+	}
+	return nil
+}
+
+func canAccess(u *serverUser, owner string) bool {
+	return u.Admin || owner == u.Name
+}
+
+// handleEncode stores the request body as an upload named by the "name"
+// query parameter and queues it for encoding once it passes screening.
+func (s *server) handleEncode(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	name := filepath.Base(r.URL.Query().Get("name"))
+	if name == "." || name == string(filepath.Separator) {
+		writeError(w, http.StatusBadRequest, "missing name parameter")
+		return
+	}
+	if rej := s.screen.checkUpload(name, r.ContentLength); rej != nil {
+		writeRejection(w, rej)
+		return
+	}
+
+	body := r.Body
+	if s.screen.MaxBytes > 0 {
+		// Without a Content-Length the size rule is enforced as the body arrives
+		body = http.MaxBytesReader(w, body, s.screen.MaxBytes)
+	}
+	limit, ok := s.reserveQuota(u, r.ContentLength)
+	if !ok {
+		writeError(w, http.StatusForbidden, "quota exceeded")
+		return
+	}
+	if limit >= 0 {
+		// Held until the job is registered, or the upload fails
+		defer s.releaseQuota(u.Name, limit)
+		body = http.MaxBytesReader(w, body, limit)
+	}
+
+	j := &job{ID: newID(), Owner: u.Name, Kind: "encode", Name: name, Status: "queued", Created: time.Now().UTC()}
+	upload := filepath.Join(s.dataDir, "uploads", j.ID)
+	f, err := os.Create(upload)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	_, err = io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(upload)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			if s.screen.MaxBytes > 0 && tooLarge.Limit == s.screen.MaxBytes {
+				writeRejection(w, s.screen.tooLarge(name))
+				return
+			}
+			writeError(w, http.StatusForbidden, "quota exceeded")
+			return
+		}
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to receive upload: %v", err))
+		return
+	}
+
+	if info, err := os.Stat(upload); err == nil {
+		j.Size = info.Size()
+	}
+	if rej := s.screen.checkContent(upload, name, u.Name); rej != nil {
+		s.layout.log().Warn("Upload rejected", "name", name, "user", u.Name, "reason", rej.Message)
+		os.Remove(upload)
+		writeRejection(w, rej)
+		return
+	}
+
+	s.queueEncode(j, upload, "")
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// queueEncode registers a job for a fully received upload and starts it.
+// pending, if set, is the state of a resumable upload, which counts it
+// towards its owner's quota until the job does; it is removed as the job
+// is registered, so the upload is never out of usedBytes in between.
+func (s *server) queueEncode(j *job, upload, pending string) {
+	s.mu.Lock()
+	s.jobs[j.ID] = j
+	if pending != "" {
+		os.Remove(pending)
+	}
+	s.mu.Unlock()
+
+	go s.runEncodeJob(j, upload)
+}
+
+func (s *server) runEncodeJob(j *job, upload string) {
+	defer os.Remove(upload)
+	s.setJob(j, func(j *job) { j.Status = "running" })
+
+	video := filepath.Join(s.dataDir, "videos", j.ID+".mkv")
+	var archive string
+	err := safely(func() error {
+		err := s.encodeUpload(j, upload, video)
+		if err == nil {
+			archive, err = s.recordArchive(j, upload, video)
+		}
+		return err
+	})
+	s.mu.Lock()
+	s.catalog.logRun("encode", video, j.Size, err)
+	if serr := s.catalog.save(); serr != nil {
+		s.layout.log().Error("Recording the job failed", "job", j.ID, "err", serr)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		s.layout.log().Error("Job failed", "job", j.ID, "user", j.Owner, "err", err)
+		os.Remove(video)
+		s.setJob(j, func(j *job) { j.Status, j.Error = "failed", err.Error() })
+		return
+	}
+	var overhead *capacityOverhead
+	if plan, err := planCapacity(j.Size, profileFromLayout(s.layout, s.fps), planOptions{}); err == nil {
+		overhead = &plan.Overhead
+	}
+	s.setJob(j, func(j *job) { j.Status, j.Archive, j.Overhead = "done", archive, overhead })
+}
+
+// encodeUpload encodes an upload into video, standing aside for
+// interactive requests between frames; the job shows as paused meanwhile.
+func (s *server) encodeUpload(j *job, upload, video string) error {
+	f, err := os.Open(upload)
+	if err != nil {
+		return fmt.Errorf("failed to read input file: %w", err)
+	}
+	defer f.Close()
+	in := &pacedReader{r: f, sched: s.sched, paused: func(paused bool) {
+		status := "running"
+		if paused {
+			status = "paused"
+		}
+		s.setJob(j, func(j *job) { j.Status = status })
+	}}
+	_, err = streamToVideo(in, video, s.layout, s.fps, 0)
+	return err
+}
+
+func (s *server) recordArchive(j *job, upload, video string) (string, error) {
+	info, err := os.Stat(upload)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.catalog.add(catalogEntry{Source: j.Name, Size: info.Size(), Owner: j.Owner}, video); err != nil {
+		return "", err
+	}
+	if err := s.catalog.save(); err != nil {
+		return "", err
+	}
+	return s.catalog.Entries[s.catalog.find(video)].VideoHash, nil
+}
+
+// usedBytes returns the bytes a user has encoded so far, counting jobs that
+// are still queued, running or paused, unfinished resumable uploads and the
+// quota reserved for uploads being received.
+func (s *server) usedBytes(owner string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usedBytesLocked(owner)
+}
+
+// usedBytesLocked is usedBytes with s.mu held.
+func (s *server) usedBytesLocked(owner string) int64 {
+	used := s.pendingUploadBytes(owner) + s.reserved[owner]
+	used += s.catalog.ownerUsage(owner).Encoded
+	for _, j := range s.jobs {
+		if j.Owner == owner && j.Status != "done" && j.Status != "failed" {
+			used += j.Size
+		}
+	}
+	return used
+}
+
+// reserveQuota holds quota for an upload of length bytes, or of whatever
+// is left when the length is not known (-1), so that uploads received side
+// by side cannot pass the check together and overshoot the quota. It
+// returns the bytes held, which the upload may not exceed and which
+// releaseQuota gives back, or -1 when the user has no quota; ok is false
+// when there is not enough left.
+func (s *server) reserveQuota(u *serverUser, length int64) (held int64, ok bool) {
+	if u.QuotaBytes <= 0 {
+		return -1, true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remaining := u.QuotaBytes - s.usedBytesLocked(u.Name)
+	if remaining <= 0 || length > remaining {
+		return 0, false
+	}
+	held = remaining
+	if length >= 0 {
+		held = length
+	}
+	s.reserved[u.Name] += held
+	return held, true
+}
+
+// releaseQuota gives back quota reserveQuota held for owner.
+func (s *server) releaseQuota(owner string, held int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reserved[owner] -= held; s.reserved[owner] <= 0 {
+		delete(s.reserved, owner)
+	}
+}
+
+func (s *server) setJob(j *job, update func(*job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(j)
+}
+
+func (s *server) handleListJobs(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	s.mu.Lock()
+	jobs := []job{}
+	for _, j := range s.jobs {
+		if canAccess(u, j.Owner) {
+			jobs = append(jobs, *j)
+		}
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(jobs, func(a, b job) int { return a.Created.Compare(b.Created) })
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *server) handleGetJob(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	s.mu.Lock()
+	j, ok := s.jobs[r.PathValue("id")]
+	var copied job
+	if ok {
+		copied = *j
+	}
+	s.mu.Unlock()
+
+	if !ok || !canAccess(u, copied.Owner) {
+		writeError(w, http.StatusNotFound, "no such job")
+		return
+	}
+	writeJSON(w, http.StatusOK, copied)
+}
+
+// usageReport is the /usage response. Users get their own totals; admins
+// also get the breakdown per user and per storage backend.
+type usageReport struct {
+	User       string                 `json:"user"`
+	Usage      usageTotals            `json:"usage"`
+	Summary    string                 `json:"summary"` // Usage for people, in the locale of Accept-Language
+	QuotaBytes int64                  `json:"quota_bytes,omitempty"`
+	ByUser     map[string]usageTotals `json:"by_user,omitempty"`
+	ByBackend  map[string]usageTotals `json:"by_backend,omitempty"`
+}
+
+func (s *server) handleUsage(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	s.mu.Lock()
+	report := usageReport{User: u.Name, Usage: s.catalog.ownerUsage(u.Name), QuotaBytes: u.QuotaBytes}
+	report.Summary = report.Usage.describe(localeUnits(r.Header.Get("Accept-Language")))
+	if u.Admin {
+		report.ByUser, report.ByBackend = s.catalog.usage()
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleEstimate plans the encode of a file of the "size" query parameter's
+// bytes, with the catalog or built-in profile of the "profile" parameter or
+// the server's own settings, for clients to show before uploading.
+func (s *server) handleEstimate(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil || size < 0 {
+		writeError(w, http.StatusBadRequest, "missing or invalid size parameter")
+		return
+	}
+	p := profileFromLayout(s.layout, s.fps)
+	if name := r.URL.Query().Get("profile"); name != "" {
+		s.mu.Lock()
+		var err error
+		p, err = findProfile(name, s.catalog, nil)
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, http.StatusNotFound, "no such profile")
+			return
+		}
+	}
+	plan, err := planCapacity(size, p, planOptions{parity: p.Parity})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// handleListArchives lists the caller's archives. Admins see every archive,
+// including those recorded outside server mode, which have no owner.
+func (s *server) handleListArchives(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	s.mu.Lock()
+	archives := []archiveInfo{}
+	for _, e := range s.catalog.Entries {
+		if canAccess(u, e.Owner) {
+			archives = append(archives, archiveInfo{ID: e.VideoHash, Name: e.Source, Size: e.Size, Owner: e.Owner, Created: e.Created})
+		}
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, archives)
+}
+
+// lookupArchive finds the catalog entry for an archive ID the user may access.
+func (s *server) lookupArchive(u *serverUser, id string) (catalogEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.catalog.Entries {
+		if e.VideoHash == id && canAccess(u, e.Owner) {
+			return e, true
+		}
+	}
+	return catalogEntry{}, false
+}
+
+func (s *server) handleArchiveVideo(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	e, ok := s.lookupArchive(u, r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such archive")
+		return
+	}
+	defer s.sched.begin()()
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(e.Video)))
+	http.ServeFile(w, r, s.catalog.resolve(e.Video))
+}
+
+// handleArchiveIndex returns the seek index of an archive's video, whose
+// byte ranges can be fetched from the video endpoint with Range requests.
+func (s *server) handleArchiveIndex(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	e, ok := s.lookupArchive(u, r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such archive")
+		return
+	}
+	idx, err := buildSeekIndex(s.catalog.resolve(e.Video), s.layout)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	idx.Video = filepath.Base(e.Video)
+	writeJSON(w, http.StatusOK, idx)
+}
+
+// handleArchiveFile extracts the original file from an archive's video.
+func (s *server) handleArchiveFile(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	e, ok := s.lookupArchive(u, r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such archive")
+		return
+	}
+	s.streamDecode(r.Context(), w, s.catalog.resolve(e.Video), filepath.Base(e.Source))
+}
+
+// handleDecode decodes an uploaded video and streams the file back. The
+// video has to be stored first because it is read through OpenCV.
+func (s *server) handleDecode(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	name := filepath.Base(r.URL.Query().Get("name"))
+	if name == "." || name == string(filepath.Separator) {
+		name = "decoded"
+	}
+
+	video, err := os.CreateTemp(filepath.Join(s.dataDir, "uploads"), "decode-*.mkv")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	defer os.Remove(video.Name())
+	_, err = io.Copy(video, http.MaxBytesReader(w, r.Body, s.maxDecode))
+	if cerr := video.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("videos over %s are not accepted", display.bytes(tooLarge.Limit)))
+			return
+		}
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to receive upload: %v", err))
+		return
+	}
+	s.streamDecode(r.Context(), w, video.Name(), name)
+}
+
+// streamDecode decodes a video straight into the response with chunked
+// transfer encoding, flushing after every frame, so the client receives the
+// file while it is being reconstructed. Errors before the first byte get a
+// normal error response, 422 when the video is malformed; later ones abort
+// the connection so the client cannot mistake a truncated file for a
+// complete one. A client that hangs up stops the decode.
+func (s *server) streamDecode(ctx context.Context, w http.ResponseWriter, video, name string) {
+	defer s.sched.begin()()
+	out := &flushWriter{w: w, rc: http.NewResponseController(w), name: name}
+	err := safely(func() error { return decodeVideo(video, out, decodeOptions{layout: s.layout, ctx: ctx}, nil) })
+	if err != nil {
+		if !out.started {
+			status := http.StatusInternalServerError
+			if isMalformed(err) {
+				status = http.StatusUnprocessableEntity
+			}
+			writeError(w, status, fmt.Sprintf("decoding failed: %v", err))
+			return
+		}
+		s.layout.log().Error("Decoding failed mid-stream", "video", video, "err", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+type flushWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	name    string
+	started bool
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	if !f.started {
+		f.w.Header().Set("Content-Type", "application/octet-stream")
+		f.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", f.name))
+		f.started = true
+	}
+	n, err := f.w.Write(p)
+	if err == nil {
+		err = f.rc.Flush()
+	}
+	return n, err
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,186 @@
+package f2v
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// discardLog is a logger for tests that do not look at what is logged.
+var discardLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newTestServer returns a server with its data under a temporary folder.
+func newTestServer(t *testing.T, users ...serverUser) *server {
+	t.Helper()
+	dir := t.TempDir()
+	cat, err := loadCatalog(filepath.Join(dir, "catalog.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServer(dir, cat, users, screenRules{}, defaultLayout(), defaultFPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestUsedBytesCountsUnfinishedJobs(t *testing.T) {
+	s := newTestServer(t)
+	for id, status := range map[string]string{"q": "queued", "r": "running", "p": "paused", "d": "done", "f": "failed"} {
+		s.jobs[id] = &job{ID: id, Owner: "alice", Status: status, Size: 100}
+	}
+	s.jobs["other"] = &job{ID: "other", Owner: "bob", Status: "paused", Size: 1000}
+	if got := s.usedBytes("alice"); got != 300 {
+		t.Errorf("usedBytes = %d, want 300 for the queued, running and paused jobs", got)
+	}
+}
+
+func TestReserveQuotaWhilePaused(t *testing.T) {
+	u := serverUser{Name: "alice", QuotaBytes: 150}
+	s := newTestServer(t, u)
+	s.jobs["p"] = &job{ID: "p", Owner: "alice", Status: "paused", Size: 100}
+	if _, ok := s.reserveQuota(&u, 60); ok {
+		t.Error("reserved 60 bytes of a 150-byte quota with a paused job of 100")
+	}
+	if held, ok := s.reserveQuota(&u, 50); !ok || held != 50 {
+		t.Errorf("reserveQuota(50) = %d, %v; want 50, true", held, ok)
+	}
+}
+
+func TestConcurrentUploadsStayWithinQuota(t *testing.T) {
+	u := serverUser{Name: "alice", QuotaBytes: 1000}
+	s := newTestServer(t, u)
+	const uploads, size = 5, 400
+	codes := make(chan int, uploads)
+	for range uploads {
+		pr, pw := io.Pipe()
+		t.Cleanup(func() { pw.CloseWithError(errors.New("test over")) })
+		req := httptest.NewRequest(http.MethodPost, "/encode?name=f.bin", pr)
+		req.ContentLength = size
+		go func() {
+			rec := httptest.NewRecorder()
+			s.handleEncode(rec, req, &u)
+			codes <- rec.Code
+		}()
+	}
+	// Two uploads fit; the rest are refused while those two are still
+	// being received
+	for range uploads - 2 {
+		select {
+		case code := <-codes:
+			if code != http.StatusForbidden {
+				t.Fatalf("an upload over the quota got status %d, want %d", code, http.StatusForbidden)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("more uploads passed the quota check together than fit in it")
+		}
+	}
+	if got := s.usedBytes("alice"); got != 2*size {
+		t.Errorf("usedBytes = %d while two uploads are received, want %d", got, 2*size)
+	}
+}
+
+func TestFailedUploadReleasesQuota(t *testing.T) {
+	u := serverUser{Name: "alice", QuotaBytes: 1000}
+	s := newTestServer(t, u)
+	pr, pw := io.Pipe()
+	req := httptest.NewRequest(http.MethodPost, "/encode?name=f.bin", pr)
+	req.ContentLength = 400
+	go pw.CloseWithError(errors.New("connection dropped"))
+	rec := httptest.NewRecorder()
+	s.handleEncode(rec, req, &u)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("a dropped upload got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if got := s.usedBytes("alice"); got != 0 {
+		t.Errorf("usedBytes = %d after a dropped upload, want 0", got)
+	}
+}
+
+func TestDecodeUploadTooLarge(t *testing.T) {
+	u := serverUser{Name: "alice"}
+	s := newTestServer(t, u)
+	s.maxDecode = 10
+	req := httptest.NewRequest(http.MethodPost, "/decode?name=f.bin", bytes.NewReader(make([]byte, 20)))
+	rec := httptest.NewRecorder()
+	s.handleDecode(rec, req, &u)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("a video over the limit got status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestConcurrentTusFinishesStayWithinQuota(t *testing.T) {
+	u := serverUser{Name: "alice", QuotaBytes: 1000}
+	s := newTestServer(t, u)
+	s.layout.width, s.layout.height, s.layout.logger = 64, 48, discardLog
+	const uploads, size = 20, 50
+	var ups []*tusUpload
+	for range uploads {
+		up := &tusUpload{ID: newID(), Owner: "alice", Name: "f.bin", Length: size, Created: time.Now().UTC()}
+		state, _ := json.Marshal(up)
+		if err := os.WriteFile(s.tusPath(up.ID, ".json"), state, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(s.tusPath(up.ID, ".part"), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ups = append(ups, up)
+	}
+
+	// The uploads fill the quota from the moment they are pending to the
+	// moment their jobs are done, so nothing more fits in while they finish
+	var finishing sync.WaitGroup
+	for _, up := range ups {
+		finishing.Add(1)
+		go func() {
+			defer finishing.Done()
+			if _, rej := s.finishTusUpload(up); rej != nil {
+				t.Errorf("finishing an upload: %s", rej.Message)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		finishing.Wait()
+		close(done)
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		if held, ok := s.reserveQuota(&u, 1); ok {
+			s.releaseQuota(u.Name, held)
+			t.Fatal("reserved quota that finishing uploads still hold")
+		}
+	}
+
+	// Let the encodes end before their folder goes
+	for deadline := time.Now().Add(30 * time.Second); ; {
+		s.mu.Lock()
+		busy := 0
+		for _, j := range s.jobs {
+			if j.Status != "done" && j.Status != "failed" {
+				busy++
+			}
+		}
+		s.mu.Unlock()
+		if busy == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d encodes still running", busy)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,196 @@
+package f2v
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// With -shares K/N an encode writes N videos with the same encrypted data,
+// under a random key that is split with Shamir's secret sharing so that any
+// K of the videos recover it and fewer reveal nothing. Each video's data
+// starts with its share, ahead of the envelope:
+//
+//	magic     [3]byte "FVS"
+//	version   uint8
+//	threshold uint8     K
+//	count     uint8     N
+//	index     uint8     the share's x coordinate, 1 to N
+//	set       [16]byte  random, the same in every video of a set
+//	share     [32]byte
+//
+// and the envelope's key derivation is kdfShares. Decoding one of the
+// videos takes the others' shares from -share.
+const keyShareSize = 55
+
+const keyShareVersion = 1
+
+var keyShareMagic = [3]byte{'F', 'V', 'S'}
+
+type keyShare struct {
+	threshold, count, index uint8
+	set                     [16]byte
+	y                       [32]byte
+}
+
+func (k keyShare) marshal() []byte {
+	buf := make([]byte, 0, keyShareSize)
+	buf = append(buf, keyShareMagic[:]...)
+	buf = append(buf, keyShareVersion, k.threshold, k.count, k.index)
+	buf = append(buf, k.set[:]...)
+	return append(buf, k.y[:]...)
+}
+
+func parseKeyShare(buf []byte) (keyShare, error) {
+	var k keyShare
+	if len(buf) < keyShareSize || !bytes.Equal(buf[:3], keyShareMagic[:]) {
+		return k, malformed("missing key share")
+	}
+	if buf[3] != keyShareVersion {
+		return k, unsupported("unsupported key share version %d", buf[3])
+	}
+	k.threshold, k.count, k.index = buf[4], buf[5], buf[6]
+	if k.threshold == 0 || k.threshold > k.count || k.index == 0 || k.index > k.count {
+		return k, malformed("invalid key share %d of %d with threshold %d", k.index, k.count, k.threshold)
+	}
+	copy(k.set[:], buf[7:23])
+	copy(k.y[:], buf[23:55])
+	return k, nil
+}
+
+// parseShareSpec parses -shares K/N.
+func parseShareSpec(spec string) (k, n int, err error) {
+	ks, ns, ok := strings.Cut(spec, "/")
+	if ok {
+		if k, err = strconv.Atoi(ks); err == nil {
+			n, err = strconv.Atoi(ns)
+		}
+	}
+	if !ok || err != nil || k < 1 || k > n || n < 2 || n > 255 {
+		return 0, 0, fmt.Errorf("want K/N with 1 <= K <= N and 2 <= N <= 255, got %q", spec)
+	}
+	return k, n, nil
+}
+
+// sharePath returns where share i (from 1) of n of a video goes.
+func sharePath(video string, i, n int) string {
+	return fmt.Sprintf("%s.share%dof%d.mkv", strings.TrimSuffix(video, ".mkv"), i, n)
+}
+
+// newKeyShares makes a random key and splits it into n shares, any k of
+// which recover it.
+func newKeyShares(k, n int) ([]byte, []keyShare, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, nil, err
+	}
+	shares, err := splitKey(key, k, n)
+	return key[:], shares, err
+}
+
+// splitKey splits key into n shares, any k of which recover it. Each key
+// byte is the constant term of its own random polynomial of degree k-1 over
+// GF(2^8), and share i holds the polynomials' values at x = i.
+func splitKey(key [32]byte, k, n int) ([]keyShare, error) {
+	shares := make([]keyShare, n)
+	var set [16]byte
+	if _, err := rand.Read(set[:]); err != nil {
+		return nil, err
+	}
+	coeffs := make([]byte, k-1)
+	for b := range key {
+		if _, err := rand.Read(coeffs); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			// Horner's rule, from the highest coefficient down
+			x, y := byte(i+1), byte(0)
+			for j := len(coeffs) - 1; j >= 0; j-- {
+				y = gfMul(y, x) ^ coeffs[j]
+			}
+			shares[i].y[b] = gfMul(y, x) ^ key[b]
+		}
+	}
+	for i := range shares {
+		shares[i].threshold, shares[i].count, shares[i].index, shares[i].set = uint8(k), uint8(n), uint8(i+1), set
+	}
+	return shares, nil
+}
+
+// combineShares recovers the key from the shares of the first share's set,
+// interpolating each byte's polynomial at x = 0.
+func combineShares(shares []keyShare) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("no key shares")
+	}
+	first := shares[0]
+	var use []keyShare
+	seen := make(map[uint8]bool)
+	for _, s := range shares {
+		if s.set == first.set && !seen[s.index] && len(use) < int(first.threshold) {
+			seen[s.index] = true
+			use = append(use, s)
+		}
+	}
+	if len(use) < int(first.threshold) {
+		return nil, fmt.Errorf("the video's key needs %d of its %d shares but got %d; give other videos of the set with -share", first.threshold, first.count, len(use))
+	}
+	key := make([]byte, 32)
+	for i, s := range use {
+		// Lagrange basis polynomial i at 0: the product of x_j / (x_j - x_i),
+		// where subtraction is XOR
+		l := byte(1)
+		for j, o := range use {
+			if j != i {
+				l = gfMul(l, gfMul(o.index, gfInv(o.index^s.index)))
+			}
+		}
+		for b := range key {
+			key[b] ^= gfMul(l, s.y[b])
+		}
+	}
+	return key, nil
+}
+
+// withShare returns a copy of s that also holds share, ahead of any others
+// so its set is the one combined.
+func (s *secret) withShare(share keyShare) *secret {
+	var c secret
+	if s != nil {
+		c = *s
+	}
+	c.shares = append([]keyShare{share}, c.shares...)
+	return &c
+}
+
+// readVideoShare reads the key share at the start of a video's data.
+func readVideoShare(video string, l layout) (keyShare, error) {
+	cap, cleanup, err := openVideo(video, l)
+	if err != nil {
+		return keyShare{}, err
+	}
+	defer cleanup()
+	var head []byte
+	next := uint32(0)
+	err = scanFrames(cap, l, func(f scannedFrame) (bool, error) {
+		if f.err != nil || f.header.seq != next {
+			return true, nil
+		}
+		if !f.header.encrypted() {
+			return false, fmt.Errorf("%s is not encrypted", video)
+		}
+		head = append(head, f.data...)
+		next++
+		return len(head) < keyShareSize && !f.header.last(), nil
+	})
+	if err != nil {
+		return keyShare{}, err
+	}
+	share, err := parseKeyShare(head)
+	if err != nil {
+		return keyShare{}, fmt.Errorf("%s: %w", video, err)
+	}
+	return share, nil
+}
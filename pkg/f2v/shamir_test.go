@@ -0,0 +1,145 @@
+package f2v
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeySharesThreshold(t *testing.T) {
+	key, shares, err := newKeyShares(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a := range shares {
+		for b := a + 1; b < len(shares); b++ {
+			for c := b + 1; c < len(shares); c++ {
+				got, err := combineShares([]keyShare{shares[c], shares[a], shares[b]})
+				if err != nil || !bytes.Equal(got, key) {
+					t.Errorf("shares %d, %d and %d recovered %x, %v", a+1, b+1, c+1, got, err)
+				}
+			}
+			if _, err := combineShares([]keyShare{shares[a], shares[b]}); err == nil {
+				t.Errorf("shares %d and %d alone recovered a key", a+1, b+1)
+			}
+		}
+	}
+	if got, err := combineShares(shares); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("all five shares recovered %x, %v", got, err)
+	}
+
+	// A duplicate or a share of another set does not count towards K
+	_, others, err := newKeyShares(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, use := range [][]keyShare{
+		{shares[0], shares[1], shares[1]},
+		{shares[0], shares[1], others[2]},
+		nil,
+	} {
+		if _, err := combineShares(use); err == nil {
+			t.Errorf("recovered a key from %d shares short of the threshold", len(use))
+		}
+	}
+	// The first share's set is the one combined
+	if got, err := combineShares([]keyShare{shares[4], others[0], others[1], shares[2], others[2], shares[0]}); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("mixed sets recovered %x, %v", got, err)
+	}
+}
+
+func TestKeySharesOpenEnvelope(t *testing.T) {
+	key, shares, err := newKeyShares(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := randomBytes(t, envelopeChunkSize+10)
+	sealed, err := encryptPayload(data, "shared.bin", &secret{shareKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := append(shares[0].marshal(), sealed...)
+
+	name, got, err := decryptPayload(video, &secret{shares: []keyShare{shares[2]}})
+	if err != nil || name != "shared.bin" || !bytes.Equal(got, data) {
+		t.Errorf("two shares opened it as %q, %d bytes, %v", name, len(got), err)
+	}
+	if got, name, err := decryptStream(video, &secret{shares: []keyShare{shares[1]}}, 1000); err != nil || name != "shared.bin" || !bytes.Equal(got, data) {
+		t.Errorf("two shares streamed it as %q, %d bytes, %v", name, len(got), err)
+	}
+	if _, _, err := decryptPayload(video, nil); err == nil {
+		t.Error("one share opened it")
+	}
+	if _, _, err := decryptPayload(video, &secret{shares: []keyShare{shares[0]}}); err == nil {
+		t.Error("one share given twice opened it")
+	}
+}
+
+func TestParseKeyShare(t *testing.T) {
+	_, shares, err := newKeyShares(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := shares[1].marshal()
+	if got, err := parseKeyShare(buf); err != nil || got != shares[1] {
+		t.Errorf("share came back as %+v, %v", got, err)
+	}
+	with := func(i int, b byte) []byte {
+		c := bytes.Clone(buf)
+		c[i] = b
+		return c
+	}
+	for _, c := range []struct {
+		what string
+		buf  []byte
+		want error
+	}{
+		{"short", buf[:keyShareSize-1], ErrCorruptFrame},
+		{"no magic", with(0, 'X'), ErrCorruptFrame},
+		{"version 2", with(3, 2), ErrUnsupportedVersion},
+		{"threshold 0", with(4, 0), ErrCorruptFrame},
+		{"threshold past the count", with(4, 4), ErrCorruptFrame},
+		{"index 0", with(6, 0), ErrCorruptFrame},
+		{"index past the count", with(6, 4), ErrCorruptFrame},
+	} {
+		if _, err := parseKeyShare(c.buf); !errors.Is(err, c.want) {
+			t.Errorf("%s share: %v, want %v", c.what, err, c.want)
+		}
+	}
+}
+
+func TestParseShareSpec(t *testing.T) {
+	for spec, want := range map[string][2]int{"2/3": {2, 3}, "1/2": {1, 2}, "255/255": {255, 255}} {
+		if k, n, err := parseShareSpec(spec); err != nil || k != want[0] || n != want[1] {
+			t.Errorf("%s parsed as %d/%d, %v", spec, k, n, err)
+		}
+	}
+	for _, spec := range []string{"", "3", "0/3", "4/3", "1/1", "2/256", "a/3", "2/b", "-1/3"} {
+		if k, n, err := parseShareSpec(spec); err == nil {
+			t.Errorf("%q parsed as %d/%d", spec, k, n)
+		}
+	}
+}
+
+func TestEncodeSharesRefusesBufferedPath(t *testing.T) {
+	l := defaultLayout()
+	l.backend = PNGSequence{}
+	for what, opts := range map[string]encodeOptions{
+		"parity":        {parity: 10},
+		"tuning":        {tune: true},
+		"a robust head": {head: 100},
+		"extra outputs": {extra: []outputSpec{{name: "also", layout: l}}},
+		"a secret":      {secret: testKeySecret(t)},
+	} {
+		opts.layout, opts.fps, opts.shares = l, defaultFPS, []int{2, 3}
+		video := filepath.Join(t.TempDir(), "shared.mkv")
+		if err := encodeStream("f", "f", bytes.NewReader([]byte("data")), video, opts); err == nil {
+			t.Errorf("encoded with key shares and %s", what)
+		}
+		if _, err := os.Stat(sharePath(video, 1, 3)); err == nil {
+			t.Errorf("wrote a share video with %s", what)
+		}
+	}
+}
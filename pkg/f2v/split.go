@@ -0,0 +1,246 @@
+package f2v
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -max-video-size, -max-frames and -max-duration split a file too big for
+// one video, or for what a platform takes, across numbered part videos,
+// name.part1of3.mkv and so on. Each part is a whole video of its own,
+// encrypted or tagged on its own if need be, holding the next stretch of
+// the file; the header of every frame says which part it belongs to and how
+// many there are, so that a part is never mistaken for the whole file.
+// Decoding any part decodes them all, in order, from the same folder; a
+// manifest (see manifest.go) can list them for fetching from elsewhere.
+
+var partPattern = regexp.MustCompile(`^(.*)\.part(\d+)of(\d+)(\.[^.]+)$`)
+
+// partPath names part i of n of video.
+func partPath(video string, i, n int) string {
+	ext := filepath.Ext(video)
+	return fmt.Sprintf("%s.part%dof%d%s", video[:len(video)-len(ext)], i, n, ext)
+}
+
+// parsePartPath undoes partPath, returning the video named and the part
+// number and count, or ok false if p does not name a part.
+func parsePartPath(p string) (video string, i, n int, ok bool) {
+	m := partPattern.FindStringSubmatch(p)
+	if m == nil {
+		return "", 0, 0, false
+	}
+	i, _ = strconv.Atoi(m[2])
+	n, _ = strconv.Atoi(m[3])
+	if i < 1 || i > n {
+		return "", 0, 0, false
+	}
+	return m[1] + m[4], i, n, true
+}
+
+// isLaterPart reports whether p names a part other than the first, which
+// a folder decode leaves to the first part to pick up.
+func isLaterPart(p string) bool {
+	_, i, _, ok := parsePartPath(filepath.Base(p))
+	return ok && i > 1
+}
+
+// maxPartFrames turns the -max-video-size, -max-frames and -max-duration
+// limits, each 0 when not given, into the most frames a part may have, the
+// smallest limit winning. A frame is counted at its raw pixel size, with a
+// percent kept back for the container.
+func maxPartFrames(size, frames int64, d time.Duration, l layout, fps int) (int64, error) {
+	var limit int64
+	take := func(n int64) {
+		if limit == 0 || n < limit {
+			limit = n
+		}
+	}
+	if size > 0 {
+		take(size * 99 / 100 / int64(l.width*l.height*3))
+	}
+	if frames > 0 {
+		take(frames)
+	}
+	if d > 0 {
+		take(int64(d.Seconds() * float64(fps)))
+	}
+	if (size > 0 || frames > 0 || d > 0) && limit < 1 {
+		return 0, fmt.Errorf("a part could not hold a single %dx%d frame", l.width, l.height)
+	}
+	return limit, nil
+}
+
+// splitPlan works out how many bytes of a size-byte file named name go into
+// each part so that none needs more than opts.maxFrames frames, and how many
+// parts that makes; 1 part means the file fits in one video as it is.
+func splitPlan(size int64, name string, opts encodeOptions) (partBytes int64, parts int, err error) {
+	frames := func(n int64, l layout) int64 {
+		return payloadFrames(n, name, opts, l)
+	}
+	if frames(size, opts.layout) <= opts.maxFrames {
+		return size, 1, nil
+	}
+	l := opts.layout
+	l.parts = 1
+	// The largest stretch of the file whose part fits
+	lo, hi := int64(0), opts.maxFrames*int64(l.dataBytes())
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		if frames(mid, l) <= opts.maxFrames {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	if lo == 0 {
+		return 0, 0, fmt.Errorf("%d frames cannot hold any of the data once sealed", opts.maxFrames)
+	}
+	n := (size + lo - 1) / lo
+	if n > 0xFFFF {
+		return 0, 0, fmt.Errorf("%s would take %d parts of %d frames, more than %d", name, n, opts.maxFrames, 0xFFFF)
+	}
+	// Spread the data evenly rather than leave a runt at the end
+	return (size + n - 1) / n, int(n), nil
+}
+
+// splitConflict names what in opts rules out encoding into parts, or is
+// empty. Limits given as flags are checked against these up front; a
+// -target's only come into play for files that exceed them.
+func splitConflict(opts encodeOptions) string {
+	switch {
+	case opts.tune:
+		return "-tune"
+	case opts.parity > 0:
+		return "-parity"
+	case opts.head > 0:
+		return "-robust-head"
+	case opts.shares != nil:
+		return "-shares"
+	case len(opts.extra) > 0:
+		return "-also"
+	case opts.layout.cover != "":
+		return "-cover"
+	case opts.compress != nil:
+		return "-compress"
+	case opts.secret != nil && opts.secret.hidden != nil:
+		return "-hidden"
+	case opts.secret != nil && (len(opts.secret.ageRecipients) > 0 || len(opts.secret.pgpRecipients) > 0):
+		return "encryption to age or OpenPGP keys"
+	}
+	return ""
+}
+
+// encodeParts encodes the size bytes of f into part videos of outputVideo,
+// or into outputVideo itself if they fit in one, and returns what it wrote
+// for messages.
+func encodeParts(inputFile string, f io.Reader, size int64, outputVideo string, opts encodeOptions) (string, error) {
+	name := filepath.Base(inputFile)
+	partBytes, n, err := splitPlan(size, name, opts)
+	if err != nil {
+		return "", err
+	}
+	if n == 1 {
+		return encodedAs(outputVideo, opts), encodeStream(inputFile, name, f, outputVideo, opts)
+	}
+	if why := splitConflict(opts); why != "" {
+		return "", fmt.Errorf("%s needs %d parts to stay under the limits, and %s does not split", inputFile, n, why)
+	}
+	var m *spanManifest
+	whole := sha256.New()
+	if opts.manifest {
+		m = &spanManifest{Version: manifestVersion, Name: name, Size: size}
+	}
+	for i := 1; i <= n; i++ {
+		popts := opts
+		popts.layout.part, popts.layout.parts = i, n
+		popts.size = min(partBytes, size-int64(i-1)*partBytes)
+		source := fmt.Sprintf("%s (part %d of %d)", inputFile, i, n)
+		out := partPath(outputVideo, i, n)
+		part := &hashCounter{w: sha256.New()}
+		r := io.TeeReader(io.LimitReader(f, partBytes), io.MultiWriter(whole, part))
+		if err := encodeStream(source, name, r, out, popts); err != nil {
+			return "", fmt.Errorf("part %d of %d: %w", i, n, err)
+		}
+		if m != nil {
+			m.Parts = append(m.Parts, manifestPart{Video: partRef(out, opts.partURL), Size: part.n, SHA256: hex.EncodeToString(part.w.Sum(nil))})
+		}
+	}
+	written := fmt.Sprintf("%s to %s", partPath(outputVideo, 1, n), partPath(outputVideo, n, n))
+	if m != nil {
+		m.SHA256 = hex.EncodeToString(whole.Sum(nil))
+		path, err := writeManifest(m, outputVideo, opts)
+		if err != nil {
+			return "", err
+		}
+		written += ", listed in " + path
+	}
+	return written, nil
+}
+
+// partVideos returns the videos to decode for video in order: every part of
+// a split encode when video is one of them, or nil when it stands alone. A
+// part whose name lost its part number is decoded alone, with a warning.
+func partVideos(video string, l layout) ([]string, error) {
+	if isURL(video) {
+		return nil, nil
+	}
+	h, err := firstDataHeader(video, l)
+	if err != nil || h.parts == 0 {
+		return nil, nil // the decode itself reports what is wrong
+	}
+	whole, i, n, ok := parsePartPath(filepath.Base(video))
+	if !ok || i != int(h.part) || n != int(h.parts) {
+		l.log().Warn("The video is part of a split file, but its name does not say so; decoding it alone", "video", video, "part", h.part, "parts", h.parts)
+		return nil, nil
+	}
+	whole = filepath.Join(filepath.Dir(video), whole)
+	var parts []string
+	for j := 1; j <= n; j++ {
+		p := partPath(whole, j, n)
+		if _, err := os.Stat(p); err != nil {
+			return nil, fmt.Errorf("part %d of %d is missing: %w", j, n, err)
+		}
+		ph, err := firstDataHeader(p, l)
+		if err != nil {
+			return nil, fmt.Errorf("part %d of %d: %w", j, n, err)
+		}
+		if int(ph.part) != j || int(ph.parts) != n {
+			return nil, malformed("%s holds part %d of %d, not part %d of %d", p, ph.part, ph.parts, j, n)
+		}
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
+
+// decodeParts decodes the parts of a split encode one after the other into w.
+func decodeParts(parts []string, w io.Writer, opts decodeOptions) error {
+	for i, p := range parts {
+		opts.log().Info("Decoding part", "part", i+1, "parts", len(parts), "video", p)
+		if err := decodeVideo(p, w, opts, nil); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// decodedName is the output file name for decoding video: the video's
+// name without .mkv, and without the part number or .manifest of a split
+// encode, plus .decoded.
+func decodedName(video string) string {
+	name := filepath.Base(video)
+	if whole, _, _, ok := parsePartPath(name); ok {
+		name = whole
+	}
+	if isManifestPath(name) {
+		name = strings.TrimSuffix(name, ".manifest.mkv")
+	}
+	return strings.TrimSuffix(name, ".mkv") + ".decoded"
+}
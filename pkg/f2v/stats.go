@@ -0,0 +1,201 @@
+package f2v
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+)
+
+// Every encode and check run against a catalog leaves a run record in it,
+// whether it worked or not, so that stats can show over months how much
+// has been archived, how far the videos blow up the data and where things
+// fail. Records are not part of the entry chain, so logging them does not
+// touch a frozen catalog's history; only the latest maxRuns are kept.
+
+const maxRuns = 10000
+
+// runRecord is one encode or check of a video.
+type runRecord struct {
+	Op      string    `json:"op"` // encode or check
+	Video   string    `json:"video"`
+	Backend string    `json:"backend"`        // where the video is stored, as for entries
+	Host    string    `json:"host,omitempty"` // machine the run was on
+	Time    time.Time `json:"time"`
+	Bytes   int64     `json:"bytes,omitempty"` // source bytes, for encodes
+	Error   string    `json:"error,omitempty"` // empty when the run succeeded
+}
+
+// logRun records a run on video that ended with err, nil for success. The
+// caller saves the catalog.
+func (c *catalog) logRun(op, video string, size int64, err error) {
+	r := runRecord{Op: op, Video: c.relPath(video), Backend: "local", Time: time.Now().UTC(), Bytes: size}
+	if isURL(video) {
+		r.Video = video
+		if u, perr := url.Parse(video); perr == nil {
+			r.Backend = u.Host
+		}
+	} else if i := c.find(video); i >= 0 {
+		r.Backend = c.Entries[i].storageBackend()
+	}
+	r.Host, _ = os.Hostname()
+	if err != nil {
+		r.Error = err.Error()
+	}
+	c.Runs = append(c.Runs, r)
+	if len(c.Runs) > maxRuns {
+		c.Runs = c.Runs[len(c.Runs)-maxRuns:]
+	}
+}
+
+// periodStats sums the entries created in one month.
+type periodStats struct {
+	usageTotals
+	measured usageTotals // entries whose video size is known
+}
+
+// expansion is stored bytes per encoded byte, 0 if nothing was measured.
+func (p periodStats) expansion() float64 {
+	if p.measured.Encoded == 0 {
+		return 0
+	}
+	return float64(p.measured.Stored) / float64(p.measured.Encoded)
+}
+
+func (p *periodStats) add(e catalogEntry) {
+	p.usageTotals.add(e)
+	if e.VideoSize > 0 {
+		p.measured.add(e)
+	}
+}
+
+// runTally counts runs and their failures.
+type runTally struct {
+	runs, failed int
+	last         *runRecord // latest failure
+}
+
+func (r *runTally) add(rec *runRecord) {
+	r.runs++
+	if rec.Error != "" {
+		r.failed++
+		if r.last == nil || rec.Time.After(r.last.Time) {
+			r.last = rec
+		}
+	}
+}
+
+func (r runTally) describe(u units) string {
+	s := fmt.Sprintf("%s runs, %s failed (%s)", u.count(int64(r.runs)), u.count(int64(r.failed)), u.percent(float64(r.failed)/float64(r.runs), 1))
+	if r.last != nil {
+		s += fmt.Sprintf(", last %s %s: %s", r.last.Op, r.last.Time.Format(time.DateOnly), r.last.Error)
+	}
+	return s
+}
+
+// catalogStats is what stats reports.
+type catalogStats struct {
+	months          map[string]*periodStats // by YYYY-MM
+	total           periodStats
+	byBackend       map[string]*runTally
+	byHost          map[string]*runTally
+	runs            int
+	firstRun        time.Time
+	encodes, checks runTally
+}
+
+func (c *catalog) stats() *catalogStats {
+	st := &catalogStats{months: make(map[string]*periodStats), byBackend: make(map[string]*runTally), byHost: make(map[string]*runTally)}
+	for _, e := range c.Entries {
+		month := e.Created.UTC().Format("2006-01")
+		if st.months[month] == nil {
+			st.months[month] = &periodStats{}
+		}
+		st.months[month].add(e)
+		st.total.add(e)
+	}
+	count := func(m map[string]*runTally, key string, r *runRecord) {
+		if m[key] == nil {
+			m[key] = &runTally{}
+		}
+		m[key].add(r)
+	}
+	for i := range c.Runs {
+		r := &c.Runs[i]
+		if st.runs == 0 || r.Time.Before(st.firstRun) {
+			st.firstRun = r.Time
+		}
+		st.runs++
+		count(st.byBackend, r.Backend, r)
+		host := r.Host
+		if host == "" {
+			host = "(unknown)"
+		}
+		count(st.byHost, host, r)
+		if r.Op == "check" {
+			st.checks.add(r)
+		} else {
+			st.encodes.add(r)
+		}
+	}
+	return st
+}
+
+func (st *catalogStats) print(w io.Writer, name string, u units) {
+	fmt.Fprintf(w, "%s: %s archives, %s encoded, %s stored", name, u.count(int64(st.total.Archives)), u.bytes(st.total.Encoded), u.bytes(st.total.Stored))
+	if x := st.total.expansion(); x > 0 {
+		fmt.Fprintf(w, ", %sx expansion on average", u.number(x, 2))
+	}
+	fmt.Fprintln(w)
+
+	if len(st.months) > 0 {
+		fmt.Fprintln(w, "Archived by month:")
+		var archived int64
+		for _, month := range slices.Sorted(maps.Keys(st.months)) {
+			p := st.months[month]
+			archived += p.Encoded
+			line := fmt.Sprintf("  %s  %s archives, %s encoded, %s stored", month, u.count(int64(p.Archives)), u.bytes(p.Encoded), u.bytes(p.Stored))
+			if x := p.expansion(); x > 0 {
+				line += fmt.Sprintf(", %sx", u.number(x, 2))
+			}
+			fmt.Fprintf(w, "%s; %s in total\n", line, u.bytes(archived))
+		}
+	}
+
+	if st.runs == 0 {
+		fmt.Fprintln(w, "No runs recorded yet; encodes and checks with -catalog record them")
+		return
+	}
+	fmt.Fprintf(w, "Runs since %s:\n", st.firstRun.Format(time.DateOnly))
+	if st.encodes.runs > 0 {
+		fmt.Fprintf(w, "  %-20s %s\n", "encode", st.encodes.describe(u))
+	}
+	if st.checks.runs > 0 {
+		fmt.Fprintf(w, "  %-20s %s\n", "check", st.checks.describe(u))
+	}
+	printRunStats(w, "By backend", st.byBackend, u)
+	printRunStats(w, "By host", st.byHost, u)
+}
+
+func printRunStats(w io.Writer, title string, byKey map[string]*runTally, u units) {
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, k := range slices.Sorted(maps.Keys(byKey)) {
+		fmt.Fprintf(w, "  %-20s %s\n", k, byKey[k].describe(u))
+	}
+}
+
+// runStats implements stats <catalog.json>, for the catalog at path.
+func runStats(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("failed to read catalog: %w", err)
+	}
+	c, err := loadCatalog(path)
+	if err != nil {
+		return err
+	}
+	c.stats().print(os.Stdout, c.path, display)
+	return nil
+}
@@ -0,0 +1,179 @@
+package f2v
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// stressCase is one simulated platform re-encode of a data video.
+type stressCase struct {
+	crf           int
+	width, height int // 0 keeps the video's size
+	fps           int // 0 keeps the frame rate
+}
+
+func (c stressCase) String() string {
+	s := fmt.Sprintf("H.264 CRF %d", c.crf)
+	if c.width > 0 {
+		s += fmt.Sprintf(", %dx%d", c.width, c.height)
+	}
+	if c.fps > 0 {
+		s += fmt.Sprintf(", %d fps", c.fps)
+	}
+	return s
+}
+
+func (c stressCase) ffmpegArgs(input, output string) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", input}
+	if c.width > 0 {
+		args = append(args, "-vf", fmt.Sprintf("scale=%d:%d", c.width, c.height))
+	}
+	if c.fps > 0 {
+		args = append(args, "-r", strconv.Itoa(c.fps))
+	}
+	return append(args, "-c:v", "libx264", "-crf", strconv.Itoa(c.crf), "-pix_fmt", "yuv420p", output)
+}
+
+// parseStressCases builds every combination of the comma-separated CRF,
+// size (WxH) and frame rate lists. Empty size and rate lists keep the
+// video's own.
+func parseStressCases(crfs, sizes, rates string) ([]stressCase, error) {
+	var crfList []int
+	for _, v := range splitList(crfs) {
+		crf, err := strconv.Atoi(v)
+		if err != nil || crf < 0 || crf > 51 {
+			return nil, fmt.Errorf("invalid CRF %q, expected 0-51", v)
+		}
+		crfList = append(crfList, crf)
+	}
+	if len(crfList) == 0 {
+		return nil, fmt.Errorf("no CRF values given")
+	}
+
+	sizeList := [][2]int{{0, 0}}
+	if s := splitList(sizes); len(s) > 0 {
+		sizeList = nil
+		for _, v := range s {
+			w, h, ok := strings.Cut(v, "x")
+			width, werr := strconv.Atoi(w)
+			height, herr := strconv.Atoi(h)
+			if !ok || werr != nil || herr != nil || width <= 0 || height <= 0 {
+				return nil, fmt.Errorf("invalid size %q, expected WxH", v)
+			}
+			sizeList = append(sizeList, [2]int{width, height})
+		}
+	}
+
+	rateList := []int{0}
+	if r := splitList(rates); len(r) > 0 {
+		rateList = nil
+		for _, v := range r {
+			fps, err := strconv.Atoi(v)
+			if err != nil || fps <= 0 {
+				return nil, fmt.Errorf("invalid frame rate %q", v)
+			}
+			rateList = append(rateList, fps)
+		}
+	}
+
+	var cases []stressCase
+	for _, crf := range crfList {
+		for _, size := range sizeList {
+			for _, fps := range rateList {
+				cases = append(cases, stressCase{crf: crf, width: size[0], height: size[1], fps: fps})
+			}
+		}
+	}
+	return cases, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// stressResult is the outcome of one case.
+type stressResult struct {
+	stressCase
+	report *checkReport
+	err    error // the re-encode or the scan itself failed
+}
+
+// decodes reports whether the data survived, possibly with help from the
+// recovery volume.
+func (r stressResult) decodes() bool {
+	if r.err != nil {
+		return false
+	}
+	return r.report.ok() || (r.report.recovery != "" && r.report.recoveryErr == nil && len(r.report.unrepairable) == 0)
+}
+
+// runStress re-encodes video through ffmpeg once per case and checks whether
+// each result still decodes. A recovery volume next to the video is taken
+// into account, so damage that parity can rebuild counts as a pass.
+func runStress(video string, cases []stressCase, l layout) ([]stressResult, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("%w: stress needs ffmpeg on the PATH: %w", ErrCodecUnavailable, err)
+	}
+	tempDir, err := os.MkdirTemp("", "f2v-stress-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	volume := recoveryPath(video)
+	if _, err := os.Stat(volume); err != nil {
+		volume = ""
+	}
+
+	var results []stressResult
+	for i, c := range cases {
+		r := stressResult{stressCase: c}
+		out := filepath.Join(tempDir, fmt.Sprintf("case%d.mp4", i))
+		cmd := exec.Command(ffmpeg, c.ffmpegArgs(video, out)...)
+		if msg, err := cmd.CombinedOutput(); err != nil {
+			r.err = fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(string(msg)))
+		} else if r.report, r.err = checkVideo(out, l); r.err == nil && !r.report.ok() && volume != "" {
+			r.report.checkRecovery(volume, l)
+		}
+		os.Remove(out)
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func printStressResults(w io.Writer, name string, results []stressResult) {
+	fmt.Fprintf(w, "Stress test of %s:\n", name)
+	passed := 0
+	for _, r := range results {
+		var status string
+		switch {
+		case r.err != nil:
+			status = "FAIL: " + r.err.Error()
+		case r.report.ok():
+			status = "ok"
+		case r.decodes():
+			status = fmt.Sprintf("ok with repair (%d damaged frames)", len(r.report.damage))
+		case !r.report.complete:
+			status = fmt.Sprintf("FAIL: truncated, %d damaged frames", len(r.report.damage))
+		default:
+			status = fmt.Sprintf("FAIL: %d of %d frames damaged", len(r.report.damage), r.report.frames)
+		}
+		if r.decodes() {
+			passed++
+		}
+		fmt.Fprintf(w, "  %-32s %s\n", r.stressCase, status)
+	}
+	fmt.Fprintf(w, "%d of %d cases decode\n", passed, len(results))
+}
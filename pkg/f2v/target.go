@@ -0,0 +1,75 @@
+package f2v
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// -target names a platform the videos are for. Frames are written at a
+// size and rate it serves unchanged, and files are split into parts under
+// its length and size limits for one upload, so that nothing is rejected,
+// cut short or scaled on the way in.
+
+// volumeTarget is what a platform takes in one upload.
+type volumeTarget struct {
+	maxSize     int64
+	maxDuration time.Duration
+	sizes       [][2]int // frame sizes it serves as uploaded, smallest first
+	rates       []int    // frame rates it keeps
+}
+
+var volumeTargets = map[string]volumeTarget{
+	// 12 hours is the limit for verified accounts; others get 15 minutes
+	"youtube": {
+		maxSize:     256e9,
+		maxDuration: 12 * time.Hour,
+		sizes:       [][2]int{{426, 240}, {640, 360}, {854, 480}, {1280, 720}, {1920, 1080}, {2560, 1440}, {3840, 2160}},
+		rates:       []int{24, 25, 30, 48, 50, 60},
+	},
+}
+
+func lookupTarget(name string) (volumeTarget, error) {
+	t, ok := volumeTargets[name]
+	if !ok {
+		return t, fmt.Errorf("unknown target %q (known: %s)", name, strings.Join(slices.Sorted(maps.Keys(volumeTargets)), ", "))
+	}
+	return t, nil
+}
+
+// fit moves l's frame size to the smallest the platform serves that is at
+// least as tall, or its largest, and fps to the nearest rate it keeps, the
+// lower of two as near. Changes are logged.
+func (t volumeTarget) fit(name string, l layout, fps int) (layout, int) {
+	if !slices.Contains(t.sizes, [2]int{l.width, l.height}) {
+		size := t.sizes[len(t.sizes)-1]
+		for _, s := range t.sizes {
+			if s[1] >= l.height {
+				size = s
+				break
+			}
+		}
+		l.log().Info("Writing frames of another size for the target", "video", name, "width", size[0], "height", size[1])
+		l.width, l.height = size[0], size[1]
+	}
+	if !slices.Contains(t.rates, fps) {
+		rate := t.rates[0]
+		for _, r := range t.rates {
+			if abs(r-fps) < abs(rate-fps) {
+				rate = r
+			}
+		}
+		l.log().Info("Writing another frame rate for the target", "video", name, "fps", rate)
+		fps = rate
+	}
+	return l, fps
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
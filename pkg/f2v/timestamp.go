@@ -0,0 +1,177 @@
+package f2v
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// RFC 3161 time-stamp protocol structures, limited to the fields needed to
+// request a token and check that it covers the expected hash.
+
+var oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional"`
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []asn1.RawValue `asn1:"optional"`
+	FailInfo     asn1.BitString  `asn1:"optional"`
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	EncapContentInfo encapsulatedContentInfo
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time     `asn1:"generalized"`
+	Accuracy       asn1.RawValue `asn1:"optional"`
+	Ordering       bool          `asn1:"optional"`
+	Nonce          *big.Int      `asn1:"optional"`
+}
+
+// timestampRecord is a time-stamp token kept in a catalog entry.
+type timestampRecord struct {
+	TSA     string    `json:"tsa"`
+	Imprint string    `json:"imprint"` // hex SHA-256 the token covers
+	Time    time.Time `json:"time"`
+	Token   []byte    `json:"token"` // DER TimeStampToken, base64 in JSON
+}
+
+// requestTimestamp asks the TSA at tsaURL for a token over a SHA-256 digest.
+func requestTimestamp(tsaURL string, digest []byte) (*timestampRecord, error) {
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	req, err := asn1.Marshal(timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: digest,
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build time-stamp request: %w", err)
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(tsaURL, "application/timestamp-query", bytes.NewReader(req))
+	if err != nil {
+		return nil, fmt.Errorf("time-stamp request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("time-stamp authority returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read time-stamp response: %w", err)
+	}
+
+	var tsResp timeStampResp
+	if _, err := asn1.Unmarshal(body, &tsResp); err != nil {
+		return nil, fmt.Errorf("failed to parse time-stamp response: %w", err)
+	}
+	// 0 = granted, 1 = granted with modifications
+	if tsResp.Status.Status > 1 {
+		return nil, fmt.Errorf("time-stamp request rejected with status %d", tsResp.Status.Status)
+	}
+
+	token := tsResp.TimeStampToken.FullBytes
+	if len(token) == 0 {
+		return nil, fmt.Errorf("time-stamp response contains no token")
+	}
+	info, err := parseTimestampToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return nil, fmt.Errorf("time-stamp response nonce does not match the request")
+	}
+	if !bytes.Equal(info.MessageImprint.HashedMessage, digest) {
+		return nil, fmt.Errorf("time-stamp token covers a different hash")
+	}
+
+	return &timestampRecord{
+		TSA:     tsaURL,
+		Imprint: hex.EncodeToString(digest),
+		Time:    info.GenTime,
+		Token:   token,
+	}, nil
+}
+
+// parseTimestampToken extracts the TSTInfo from a DER TimeStampToken. It does
+// not check the TSA's signature; use `openssl ts -verify` for that.
+func parseTimestampToken(token []byte) (*tstInfo, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(token, &ci); err != nil {
+		return nil, fmt.Errorf("failed to parse time-stamp token: %w", err)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("failed to parse time-stamp signed data: %w", err)
+	}
+	var info tstInfo
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse time-stamp info: %w", err)
+	}
+	return &info, nil
+}
+
+// check confirms the stored token still parses and covers one of the
+// accepted hashes.
+func (t *timestampRecord) check(accepted ...string) error {
+	if !slices.Contains(accepted, t.Imprint) {
+		return fmt.Errorf("time-stamp covers %s, which no longer matches the entry", t.Imprint)
+	}
+	info, err := parseTimestampToken(t.Token)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(info.MessageImprint.HashedMessage) != t.Imprint {
+		return fmt.Errorf("time-stamp token does not match its recorded imprint")
+	}
+	return nil
+}
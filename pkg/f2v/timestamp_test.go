@@ -0,0 +1,93 @@
+package f2v
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testTimestampToken returns a DER TimeStampToken over digest, without a
+// signature, as parseTimestampToken does not look for one.
+func testTimestampToken(t testing.TB, digest []byte) []byte {
+	t.Helper()
+	accuracy, err := asn1.Marshal(struct{ Seconds int }{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := asn1.Marshal(tstInfo{
+		Version:        1,
+		Policy:         asn1.ObjectIdentifier{1, 2, 3},
+		MessageImprint: messageImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}, HashedMessage: digest},
+		SerialNumber:   big.NewInt(42),
+		GenTime:        time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Accuracy:       asn1.RawValue{FullBytes: accuracy},
+		Nonce:          big.NewInt(7),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := asn1.Marshal(signedData{
+		Version:          3,
+		DigestAlgorithms: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true},
+		EncapContentInfo: encapsulatedContentInfo{EContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}, EContent: info},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The explicit [0] around the signed data is written by hand, as
+	// Marshal writes a RawValue as it is
+	content, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := asn1.Marshal(contentInfo{
+		ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2},
+		Content:     asn1.RawValue{FullBytes: content},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestParseTimestampToken(t *testing.T) {
+	digest := bytes.Repeat([]byte{0xab}, 32)
+	token := testTimestampToken(t, digest)
+	info, err := parseTimestampToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(info.MessageImprint.HashedMessage, digest) || info.Nonce == nil || info.Nonce.Int64() != 7 {
+		t.Errorf("token parsed as %+v", info)
+	}
+	for n := range token {
+		if _, err := parseTimestampToken(token[:n]); err == nil {
+			t.Fatalf("parsed a token cut to %d of its %d bytes", n, len(token))
+		}
+	}
+}
+
+func FuzzParseTimestampToken(f *testing.F) {
+	token := testTimestampToken(f, bytes.Repeat([]byte{1}, 32))
+	f.Add(token)
+	f.Add(token[:len(token)/2])
+	f.Add([]byte{0x30, 0x80})
+	f.Add([]byte{0x30, 0x84, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, token []byte) {
+		if _, err := parseTimestampToken(token); err != nil {
+			return
+		}
+		// Bytes after the token are ignored; cutting into it is not
+		var whole asn1.RawValue
+		if _, err := asn1.Unmarshal(token, &whole); err != nil {
+			t.Fatalf("parsed a token that is not DER: %v", err)
+		}
+		if _, err := parseTimestampToken(whole.FullBytes[:len(whole.FullBytes)-1]); err == nil {
+			t.Fatal("parsed a token cut short")
+		}
+	})
+}
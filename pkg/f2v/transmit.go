@@ -0,0 +1,78 @@
+//go:build !(js && wasm)
+
+package f2v
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// The sending side of a screen-to-camera transfer: instead of writing a
+// video, the frames are shown full screen at a fixed rate, looping so that
+// a receiver that misses frames catches them on a later pass.
+
+const transmitWindow = "f2v transmit"
+
+// transmitFile shows the frames of a file in a full-screen window, loops
+// times over (0 to repeat until a key is pressed).
+func transmitFile(inputFilename string, l layout, fps, loops int) error {
+	if !l.markers {
+		return fmt.Errorf("camera transfer needs sync markers; use block, dct or barcode mode")
+	}
+	if fps <= 0 {
+		return fmt.Errorf("frame rate must be positive")
+	}
+	data, err := os.ReadFile(inputFilename)
+	if err != nil {
+		return fmt.Errorf("failed to read input file: %w", err)
+	}
+	bytesPerFrame := l.capacity() - frameHeaderSize
+	totalFrames := max(int(math.Ceil(float64(len(data))/float64(bytesPerFrame))), 1)
+
+	frame := gocv.NewMatWithSize(l.height, l.width, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+	frameData, _ := frame.DataPtrUint8()
+	if frameData == nil {
+		return fmt.Errorf("failed to get frame data pointer")
+	}
+	payload := make([]byte, l.capacity())
+
+	window := gocv.NewWindow(transmitWindow)
+	defer window.Close()
+	window.SetWindowProperty(gocv.WindowPropertyFullscreen, gocv.WindowFullscreen)
+
+	summarize(os.Stderr, "Transmitting %d frames at %d fps; press any key to stop", totalFrames, fps)
+	interval := time.Second / time.Duration(fps)
+	next := time.Now()
+	for pass := 1; loops == 0 || pass <= loops; pass++ {
+		for f := 0; f < totalFrames; f++ {
+			h := frameHeader{seq: uint32(f)}
+			if f == totalFrames-1 {
+				h.flags |= frameFlagLast
+			}
+			sealFrame(payload, h, data[min(f*bytesPerFrame, len(data)):min((f+1)*bytesPerFrame, len(data))])
+			l.pack(frameData, payload)
+			window.IMShow(frame)
+
+			// WaitKey also lets the window draw; sleep off the rest of the interval in it
+			next = next.Add(interval)
+			wait := max(int(time.Until(next)/time.Millisecond), 1)
+			if window.WaitKey(wait) >= 0 {
+				summarize(os.Stderr, "")
+				return nil
+			}
+			if time.Until(next) < -interval {
+				next = time.Now() // fell behind; don't rush to catch up
+			}
+			if summarizing() {
+				fmt.Fprintf(os.Stderr, "\rPass %d, frame %d of %d", pass, f+1, totalFrames)
+			}
+		}
+	}
+	summarize(os.Stderr, "")
+	return nil
+}
@@ -0,0 +1,169 @@
+package f2v
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// platformSims lists the re-encodes that approximate what a hosting
+// platform does to an upload. A setting must survive all of them.
+var platformSims = map[string][]stressCase{
+	"youtube": {{crf: 28}, {crf: 33}},
+	"vimeo":   {{crf: 23}, {crf: 28}},
+}
+
+const tuneSampleFrames = 4
+
+// tuneTrial is the outcome of one candidate setting.
+type tuneTrial struct {
+	layout    layout
+	errorRate float64 // worst byte error rate over the simulated re-encodes
+	clean     bool    // every simulated re-encode still decoded
+	err       error
+}
+
+// tuneCandidates returns the block and dct mode settings for l's frame
+// size, densest first.
+func tuneCandidates(l layout) []layout {
+	var out []layout
+	for _, block := range []int{2, 3, 4, 5, 6, 8, 10, 12} {
+		for bits := 4; bits >= 1; bits-- {
+			c := l.writtenLike(layout{width: l.width, height: l.height, mode: modeBlock, blockSize: block, bitsPerChannel: bits, markers: true})
+			if c.validate() == nil {
+				out = append(out, c)
+			}
+		}
+	}
+	for coefficients := len(dctPositions); coefficients >= 1; coefficients-- {
+		c := l.writtenLike(layout{width: l.width, height: l.height, mode: modeDCT, coefficients: coefficients, markers: true})
+		if c.validate() == nil {
+			out = append(out, c)
+		}
+	}
+	slices.SortStableFunc(out, func(a, b layout) int { return cmp.Compare(b.capacity(), a.capacity()) })
+	return out
+}
+
+// autoTune encodes a random sample with candidate settings from densest to
+// most robust, runs each through the platform's simulated re-compression and
+// returns the first that decodes cleanly.
+func autoTune(platform string, l layout, fps int, w io.Writer) (layout, error) {
+	sims, ok := platformSims[platform]
+	if !ok {
+		return l, fmt.Errorf("unknown platform %q (known: %s)", platform, strings.Join(slices.Sorted(maps.Keys(platformSims)), ", "))
+	}
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return l, fmt.Errorf("%w: auto-tune needs ffmpeg on the PATH: %w", ErrCodecUnavailable, err)
+	}
+	tempDir, err := os.MkdirTemp("", "f2v-tune-*")
+	if err != nil {
+		return l, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	fmt.Fprintf(w, "Auto-tuning for %s at %dx%d:\n", platform, l.width, l.height)
+	for _, c := range tuneCandidates(l) {
+		t := runTuneTrial(ffmpeg, tempDir, c, fps, sims)
+		status := "decodes"
+		switch {
+		case t.err != nil:
+			status = "error: " + t.err.Error()
+		case !t.clean:
+			status = "fails"
+		}
+		fmt.Fprintf(w, "  %-22s (%7d bytes/frame): byte error rate %6.3f%%, %s\n",
+			c.describe(), c.capacity()-frameHeaderSize, 100*t.errorRate, status)
+		if t.err == nil && t.clean {
+			return c, nil
+		}
+	}
+	return l, fmt.Errorf("no setting survived the %s simulation", platform)
+}
+
+func runTuneTrial(ffmpeg, tempDir string, l layout, fps int, sims []stressCase) tuneTrial {
+	t := tuneTrial{layout: l, clean: true}
+
+	// A fixed seed keeps runs comparable
+	bytesPerFrame := l.capacity() - frameHeaderSize
+	sample := make([]byte, tuneSampleFrames*bytesPerFrame)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range sample {
+		sample[i] = byte(rng.Uint32())
+	}
+	expected := make([][]byte, tuneSampleFrames)
+	for f := range expected {
+		h := frameHeader{seq: uint32(f)}
+		if f == tuneSampleFrames-1 {
+			h.flags |= frameFlagLast
+		}
+		expected[f] = make([]byte, l.capacity())
+		sealFrame(expected[f], h, sample[f*bytesPerFrame:(f+1)*bytesPerFrame])
+	}
+
+	video := filepath.Join(tempDir, "sample.mkv")
+	if t.err = dataToVideo(sample, video, l, fps, 0); t.err != nil {
+		return t
+	}
+	for i, sim := range sims {
+		out := filepath.Join(tempDir, fmt.Sprintf("sim%d.mp4", i))
+		if msg, err := exec.Command(ffmpeg, sim.ffmpegArgs(video, out)...).CombinedOutput(); err != nil {
+			t.err = fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(string(msg)))
+			return t
+		}
+		rate, err := byteErrorRate(out, l, expected)
+		if err != nil {
+			t.err = err
+			return t
+		}
+		t.errorRate = max(t.errorRate, rate)
+		report, err := checkVideo(out, l)
+		if err != nil {
+			t.err = err
+			return t
+		}
+		t.clean = t.clean && report.ok()
+		os.Remove(out)
+	}
+	return t
+}
+
+// byteErrorRate compares the payload of each frame of a re-encoded video
+// with what was written. Frames that never came back count as all wrong.
+func byteErrorRate(video string, l layout, expected [][]byte) (float64, error) {
+	cap, cleanup, err := openVideo(video, l)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+
+	frame := newMat()
+	defer frame.Close()
+
+	wrong, total := 0, 0
+	for i := range expected {
+		total += len(expected[i])
+		if ok := cap.Read(&frame); !ok || frame.Empty() {
+			wrong += len(expected[i])
+			continue
+		}
+		payload, _, err := readFramePayload(frame, l, i)
+		if err != nil {
+			return 0, err
+		}
+		for j, b := range expected[i] {
+			if j >= len(payload) || payload[j] != b {
+				wrong++
+			}
+		}
+	}
+	return float64(wrong) / float64(total), nil
+}
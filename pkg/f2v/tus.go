@@ -0,0 +1,310 @@
+package f2v
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable uploads follow the tus protocol 1.0.0 (https://tus.io) with the
+// creation and termination extensions. A client creates an upload with
+// POST /uploads, sends the data with one or more PATCH requests and, after a
+// dropped connection, asks HEAD /uploads/{id} where to resume. Once all
+// bytes have arrived the upload is queued for encoding like POST /encode and
+// the job ID is returned in the F2V-Job header.
+
+const tusVersion = "1.0.0"
+
+// tusUpload is the state of a resumable upload. It is kept as JSON next to
+// the partial data in the uploads directory, so uploads survive a server
+// restart; the offset is the size of the data file.
+type tusUpload struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	Name    string    `json:"name"`
+	Length  int64     `json:"length"`
+	Created time.Time `json:"created"`
+}
+
+func (s *server) tusPath(id, ext string) string {
+	return filepath.Join(s.dataDir, "uploads", "tus-"+id+ext)
+}
+
+func (s *server) loadTusUpload(u *serverUser, id string) (*tusUpload, bool) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, false
+	}
+	data, err := os.ReadFile(s.tusPath(id, ".json"))
+	if err != nil {
+		return nil, false
+	}
+	var up tusUpload
+	if err := json.Unmarshal(data, &up); err != nil || !canAccess(u, up.Owner) {
+		return nil, false
+	}
+	return &up, true
+}
+
+func (s *server) tusOffset(id string) (int64, error) {
+	info, err := os.Stat(s.tusPath(id, ".part"))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// pendingUploadBytes sums the announced lengths of an owner's unfinished
+// resumable uploads.
+func (s *server) pendingUploadBytes(owner string) int64 {
+	paths, _ := filepath.Glob(s.tusPath("*", ".json"))
+	var total int64
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var up tusUpload
+		if json.Unmarshal(data, &up) == nil && up.Owner == owner {
+			total += up.Length
+		}
+	}
+	return total
+}
+
+// withTus rejects requests that do not speak the supported protocol version.
+func withTus(h userHandler) userHandler {
+	return func(w http.ResponseWriter, r *http.Request, u *serverUser) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			writeError(w, http.StatusPreconditionFailed, "unsupported tus version")
+			return
+		}
+		h(w, r, u)
+	}
+}
+
+func (s *server) handleTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTusCreate starts a resumable upload. The file name comes from the
+// "filename" (or "name") key of Upload-Metadata.
+func (s *server) handleTusCreate(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, http.StatusBadRequest, "missing or invalid Upload-Length")
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	name = filepath.Base(name)
+	if name == "." || name == string(filepath.Separator) {
+		writeError(w, http.StatusBadRequest, "Upload-Metadata has no filename")
+		return
+	}
+	if rej := s.screen.checkUpload(name, length); rej != nil {
+		writeRejection(w, rej)
+		return
+	}
+	held, ok := s.reserveQuota(u, length)
+	if !ok {
+		writeError(w, http.StatusForbidden, "quota exceeded")
+		return
+	}
+	if held >= 0 {
+		// Once its state is written the upload counts as pending instead
+		defer s.releaseQuota(u.Name, held)
+	}
+
+	up := tusUpload{ID: newID(), Owner: u.Name, Name: name, Length: length, Created: time.Now().UTC()}
+	state, err := json.Marshal(up)
+	if err == nil {
+		err = os.WriteFile(s.tusPath(up.ID, ".part"), nil, 0644)
+	}
+	if err == nil {
+		err = os.WriteFile(s.tusPath(up.ID, ".json"), state, 0644)
+	}
+	if err != nil {
+		os.Remove(s.tusPath(up.ID, ".part"))
+		writeError(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+
+	if length == 0 {
+		j, rej := s.finishTusUpload(&up)
+		if rej != nil {
+			writeRejection(w, rej)
+			return
+		}
+		w.Header().Set("F2V-Job", j.ID)
+	}
+	w.Header().Set("Location", "/uploads/"+up.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *server) handleTusHead(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	up, ok := s.loadTusUpload(u, r.PathValue("id"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	offset, err := s.tusOffset(up.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTusPatch appends the request body at Upload-Offset. Whatever
+// arrives before a dropped connection is kept, so the client can resume
+// from the offset HEAD reports.
+func (s *server) handleTusPatch(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	up, ok := s.loadTusUpload(u, r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such upload")
+		return
+	}
+	if !s.lockTusUpload(up.ID) {
+		writeError(w, http.StatusLocked, "upload is already receiving data")
+		return
+	}
+	defer s.unlockTusUpload(up.ID)
+
+	offset, err := s.tusOffset(up.ID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "no such upload")
+		return
+	}
+	if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("upload is at offset %d", offset))
+		return
+	}
+
+	f, err := os.OpenFile(s.tusPath(up.ID, ".part"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to open upload")
+		return
+	}
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, up.Length-offset))
+	if err := f.Close(); copyErr == nil {
+		copyErr = err
+	}
+	offset += n
+	if copyErr != nil {
+		s.layout.log().Warn("Upload interrupted", "upload", up.ID, "user", up.Owner, "offset", offset, "err", copyErr)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to receive data: %v", copyErr))
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if offset == up.Length {
+		j, rej := s.finishTusUpload(up)
+		if rej != nil {
+			writeRejection(w, rej)
+			return
+		}
+		w.Header().Set("F2V-Job", j.ID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handleTusDelete(w http.ResponseWriter, r *http.Request, u *serverUser) {
+	up, ok := s.loadTusUpload(u, r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such upload")
+		return
+	}
+	if !s.lockTusUpload(up.ID) {
+		writeError(w, http.StatusLocked, "upload is receiving data")
+		return
+	}
+	defer s.unlockTusUpload(up.ID)
+
+	os.Remove(s.tusPath(up.ID, ".json"))
+	os.Remove(s.tusPath(up.ID, ".part"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload hands a complete upload over to an encode job, unless the
+// screening command rejects it, in which case the upload is removed.
+func (s *server) finishTusUpload(up *tusUpload) (*job, *rejection) {
+	if rej := s.screen.checkContent(s.tusPath(up.ID, ".part"), up.Name, up.Owner); rej != nil {
+		s.layout.log().Warn("Upload rejected", "name", up.Name, "user", up.Owner, "reason", rej.Message)
+		os.Remove(s.tusPath(up.ID, ".json"))
+		os.Remove(s.tusPath(up.ID, ".part"))
+		return nil, rej
+	}
+	j := &job{ID: newID(), Owner: up.Owner, Kind: "encode", Name: up.Name, Size: up.Length, Status: "queued", Created: time.Now().UTC()}
+	upload := filepath.Join(s.dataDir, "uploads", j.ID)
+	if err := os.Rename(s.tusPath(up.ID, ".part"), upload); err != nil {
+		j.Status, j.Error = "failed", fmt.Sprintf("failed to store upload: %v", err)
+		s.mu.Lock()
+		s.jobs[j.ID] = j
+		s.mu.Unlock()
+		return j, nil
+	}
+	s.queueEncode(j, upload, s.tusPath(up.ID, ".json"))
+	return j, nil
+}
+
+func (s *server) lockTusUpload(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.patching[id] {
+		return false
+	}
+	s.patching[id] = true
+	return true
+}
+
+func (s *server) unlockTusUpload(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.patching, id)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated keys,
+// each optionally followed by a space and a base64 value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, " ")
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", key)
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
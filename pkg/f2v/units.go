@@ -0,0 +1,150 @@
+package f2v
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reports write sizes, counts and durations through units. For people they
+// read 1.5 MiB, 12,345 and 2m5s, with the decimal and digit group separators
+// of the user's locale; with -raw they are plain numbers in bytes and
+// seconds, so scripts can parse them. The CLI takes the locale from LC_ALL,
+// LC_NUMERIC or LANG, and the server from a request's Accept-Language.
+type units struct {
+	raw     bool
+	decimal string
+	group   string
+}
+
+// display formats everything the CLI prints.
+var display = localeUnits(envLocale())
+
+func envLocale() string {
+	for _, name := range []string{"LC_ALL", "LC_NUMERIC", "LANG"} {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Languages that write 1.234,5 and 1 234,5; everything else writes 1,234.5.
+var (
+	dotGroupLanguages   = []string{"ca", "da", "de", "el", "es", "hr", "id", "it", "nl", "pt", "ro", "sl", "sr", "tr"}
+	spaceGroupLanguages = []string{"bg", "cs", "et", "fi", "fr", "hu", "lt", "lv", "nb", "nn", "no", "pl", "ru", "sk", "sv", "uk"}
+)
+
+// localeUnits returns the human units for a POSIX locale (de_DE.UTF-8) or a
+// language tag list (de-DE,de;q=0.9), going by the first language named.
+func localeUnits(locale string) units {
+	lang, _, _ := strings.Cut(strings.ToLower(locale), ",")
+	if i := strings.IndexAny(lang, "_-.@;"); i >= 0 {
+		lang = lang[:i]
+	}
+	switch {
+	case slices.Contains(dotGroupLanguages, lang):
+		return units{decimal: ",", group: "."}
+	case slices.Contains(spaceGroupLanguages, lang):
+		return units{decimal: ",", group: " "}
+	}
+	return units{decimal: ".", group: ","}
+}
+
+// count formats a number of things, or an exact position such as a byte
+// offset.
+func (u units) count(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	if u.raw {
+		return s
+	}
+	sign := ""
+	if n < 0 {
+		sign, s = "-", s[1:]
+	}
+	var b strings.Builder
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteString(u.group)
+		}
+		b.WriteRune(c)
+	}
+	return sign + b.String()
+}
+
+// bytes formats a size in binary units.
+func (u units) bytes(n int64) string {
+	if u.raw {
+		return strconv.FormatInt(n, 10)
+	}
+	if n < 1024 && n > -1024 {
+		return u.count(n) + " B"
+	}
+	value, unit := float64(n), ""
+	for _, next := range []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"} {
+		if value > -1024 && value < 1024 {
+			break
+		}
+		value, unit = value/1024, next
+	}
+	return u.number(value, 1) + " " + unit
+}
+
+// duration formats a span of time.
+func (u units) duration(d time.Duration) string {
+	if u.raw {
+		return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+	}
+	switch {
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return u.number(d.Seconds(), 1) + "s"
+	}
+	return d.Round(time.Second).String()
+}
+
+// percent formats a fraction as a percentage.
+func (u units) percent(f float64, decimals int) string {
+	if u.raw {
+		return strconv.FormatFloat(100*f, 'f', -1, 64)
+	}
+	return u.number(100*f, decimals) + "%"
+}
+
+// number formats a fractional value with the locale's decimal separator.
+func (u units) number(f float64, decimals int) string {
+	s := fmt.Sprintf("%.*f", decimals, f)
+	if u.raw {
+		return s
+	}
+	whole, frac, ok := strings.Cut(s, ".")
+	n, _ := strconv.ParseInt(whole, 10, 64)
+	whole = u.count(n)
+	if strings.HasPrefix(s, "-") && n == 0 {
+		whole = "-" + whole
+	}
+	if !ok {
+		return whole
+	}
+	return whole + u.decimal + frac
+}
+
+// parseBytes parses a size such as 1500, 50GB or 1.5GiB: decimal units for
+// kB, MB, GB and TB, binary ones for KiB, MiB, GiB and TiB.
+func parseBytes(s string) (int64, error) {
+	num := strings.TrimRightFunc(s, func(r rune) bool { return r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' })
+	multiplier := map[string]float64{
+		"": 1, "b": 1,
+		"kb": 1e3, "mb": 1e6, "gb": 1e9, "tb": 1e12,
+		"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40,
+	}[strings.ToLower(strings.TrimSpace(s[len(num):]))]
+	f, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || multiplier == 0 || f < 0 || f*multiplier >= 1<<63 {
+		return 0, fmt.Errorf("invalid size %q; give bytes or a size such as 50GB or 1.5GiB", s)
+	}
+	return int64(f * multiplier), nil
+}
@@ -0,0 +1,155 @@
+package f2v
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Videos uploaded to hosts that list what they hold, such as archive.org
+// through its S3 API or YouTube through a plugin, can be described with a
+// title, description, tags and visibility, so an upload says what it is
+// and can be found again (see locate.go). The "upload" section of the
+// config file holds the templates:
+//
+//	{"upload": {"title": "{{.Name}}", "description": "Backup {{.Manifest}}, part {{.Part}} of {{.Parts}}",
+//	            "tags": ["f2v", "{{.Manifest}}"], "visibility": "unlisted"}}
+//
+// Each is a text/template of an uploadFacts. An empty title is the video's
+// file name and an empty description one naming the video's SHA-256 and,
+// for a split encode, the manifest's and the part, so that every upload
+// carries the hashes locate searches for. Only encode uploads are
+// described, and only on a remote output whose Sink is a DescribedSink.
+
+// UploadMetadata describes an object being uploaded.
+type UploadMetadata struct {
+	Title       string
+	Description string
+	Tags        []string
+	Visibility  string // "public", "unlisted" or "private"; the host's default if ""
+}
+
+// A DescribedSink is a Sink that stores a description with what is
+// uploaded to it.
+type DescribedSink interface {
+	Sink
+	// CreateDescribed starts writing the object called name, described by m.
+	CreateDescribed(ctx context.Context, name string, m UploadMetadata) (SinkWriter, error)
+}
+
+// uploadTemplate is the "upload" section of the config file.
+type uploadTemplate struct {
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Visibility  string   `json:"visibility,omitempty"`
+}
+
+const (
+	defaultUploadTitle       = "{{.Name}}"
+	defaultUploadDescription = "f2v video, SHA-256 {{.SHA256}}{{if .Parts}}, part {{.Part}} of {{.Parts}}{{end}}{{if .Manifest}}, manifest SHA-256 {{.Manifest}}{{end}}"
+)
+
+// uploadFacts is what the templates of an upload are executed on.
+type uploadFacts struct {
+	Name     string // the video's file name
+	SHA256   string // the video's, as the catalog records it
+	Manifest string // of the manifest video listing it, or its own for the manifest; "" for none
+	Part     int    // the part number of a split encode, 0 for a whole video
+	Parts    int
+}
+
+// parsedUpload is an uploadTemplate ready to execute.
+type parsedUpload struct {
+	title, description *template.Template
+	tags               []*template.Template
+	visibility         string
+}
+
+// parse checks the templates, so a mistake in them fails before an encode
+// rather than after it.
+func (t *uploadTemplate) parse() (*parsedUpload, error) {
+	switch t.Visibility {
+	case "", "public", "unlisted", "private":
+	default:
+		return nil, fmt.Errorf("upload visibility %q is not public, unlisted or private", t.Visibility)
+	}
+	p := &parsedUpload{visibility: t.Visibility}
+	title, description := t.Title, t.Description
+	if title == "" {
+		title = defaultUploadTitle
+	}
+	if description == "" {
+		description = defaultUploadDescription
+	}
+	var err error
+	if p.title, err = template.New("title").Option("missingkey=error").Parse(title); err != nil {
+		return nil, fmt.Errorf("upload title: %w", err)
+	}
+	if p.description, err = template.New("description").Option("missingkey=error").Parse(description); err != nil {
+		return nil, fmt.Errorf("upload description: %w", err)
+	}
+	for i, tag := range t.Tags {
+		tt, err := template.New("tag").Option("missingkey=error").Parse(tag)
+		if err != nil {
+			return nil, fmt.Errorf("upload tag %d: %w", i+1, err)
+		}
+		p.tags = append(p.tags, tt)
+	}
+	return p, nil
+}
+
+// execute describes the upload f tells of. Tags that come out empty, such
+// as the manifest of a whole video, are left out.
+func (p *parsedUpload) execute(f uploadFacts) (UploadMetadata, error) {
+	m := UploadMetadata{Visibility: p.visibility}
+	run := func(t *template.Template) (string, error) {
+		var b strings.Builder
+		if err := t.Execute(&b, f); err != nil {
+			return "", fmt.Errorf("upload %s of %s: %w", t.Name(), f.Name, err)
+		}
+		return strings.TrimSpace(b.String()), nil
+	}
+	var err error
+	if m.Title, err = run(p.title); err != nil {
+		return m, err
+	}
+	if m.Description, err = run(p.description); err != nil {
+		return m, err
+	}
+	for _, t := range p.tags {
+		tag, err := run(t)
+		if err != nil {
+			return m, err
+		}
+		if tag != "" {
+			m.Tags = append(m.Tags, tag)
+		}
+	}
+	return m, nil
+}
+
+// describe works out the facts of the video at local, the part of a split
+// encode or its manifest finding the manifest next to it.
+func (p *parsedUpload) describe(local string) (UploadMetadata, error) {
+	sum, err := hashFile(local)
+	if err != nil {
+		return UploadMetadata{}, err
+	}
+	f := uploadFacts{Name: filepath.Base(local), SHA256: sum}
+	if isManifestPath(local) {
+		f.Manifest = sum
+	} else if whole, i, n, ok := parsePartPath(f.Name); ok {
+		f.Part, f.Parts = i, n
+		manifest := manifestPath(filepath.Join(filepath.Dir(local), whole))
+		if _, err := os.Stat(manifest); err == nil {
+			if f.Manifest, err = hashFile(manifest); err != nil {
+				return UploadMetadata{}, err
+			}
+		}
+	}
+	return p.execute(f)
+}
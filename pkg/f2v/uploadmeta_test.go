@@ -0,0 +1,119 @@
+package f2v
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// roundTripper answers requests with a function instead of a server.
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// okResponse is an empty 200 OK.
+func okResponse(r *http.Request) *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{}, Body: readCloser(""), Request: r}
+}
+
+func readCloser(s string) io.ReadCloser { return io.NopCloser(strings.NewReader(s)) }
+
+func TestUploadMetadataOfParts(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"disk.img.part1of2.mkv": "one", "disk.img.part2of2.mkv": "two", "disk.img.manifest.mkv": "list"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest, _ := hashFile(filepath.Join(dir, "disk.img.manifest.mkv"))
+	part, _ := hashFile(filepath.Join(dir, "disk.img.part2of2.mkv"))
+
+	tmpl := uploadTemplate{Title: "{{.Name}}", Tags: []string{"f2v", "{{.Manifest}}"}, Visibility: "unlisted"}
+	p, err := tmpl.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := p.describe(filepath.Join(dir, "disk.img.part2of2.mkv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Title != "disk.img.part2of2.mkv" || m.Visibility != "unlisted" {
+		t.Errorf("described as %q, %q", m.Title, m.Visibility)
+	}
+	for _, want := range []string{part, manifest, "part 2 of 2"} {
+		if !strings.Contains(m.Description, want) {
+			t.Errorf("description %q does not hold %q", m.Description, want)
+		}
+	}
+	if len(m.Tags) != 2 || m.Tags[1] != manifest {
+		t.Errorf("tags %q, want f2v and the manifest's hash", m.Tags)
+	}
+
+	whole := filepath.Join(dir, "notes.txt.mkv")
+	os.WriteFile(whole, []byte("whole"), 0644)
+	if m, err = p.describe(whole); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Tags) != 1 || strings.Contains(m.Description, "manifest") {
+		t.Errorf("a whole video is described with a manifest: %q, %q", m.Description, m.Tags)
+	}
+}
+
+func TestUploadTemplateChecked(t *testing.T) {
+	for _, tmpl := range []uploadTemplate{
+		{Visibility: "hidden"},
+		{Title: "{{.Name"},
+		{Tags: []string{"{{.Nope}}"}},
+	} {
+		p, err := tmpl.parse()
+		if err == nil {
+			_, err = p.execute(uploadFacts{Name: "x.mkv"})
+		}
+		if err == nil {
+			t.Errorf("%+v was taken", tmpl)
+		}
+	}
+}
+
+func TestS3UploadMetadata(t *testing.T) {
+	local := filepath.Join(t.TempDir(), "v.mkv")
+	os.WriteFile(local, []byte("video"), 0644)
+	p, err := (&uploadTemplate{Title: "Backup – {{.Name}}", Tags: []string{"a", "b"}, Visibility: "private"}).parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		endpoint string
+		want     map[string]string
+	}{
+		{"https://s3.example.com", map[string]string{
+			"X-Amz-Meta-Title":      "=?utf-8?q?Backup_=E2=80=93_v.mkv?=",
+			"X-Amz-Meta-Tags":       "a,b",
+			"X-Amz-Meta-Visibility": "private",
+		}},
+		{"https://s3.us.archive.org", map[string]string{
+			"X-Archive-Meta-Title":      "uri(Backup%20%E2%80%93%20v.mkv)",
+			"X-Archive-Meta01-Subject":  "a",
+			"X-Archive-Meta02-Subject":  "b",
+			"X-Archive-Meta-Visibility": "",
+		}},
+	} {
+		var got http.Header
+		s := &S3{Bucket: "b", Endpoint: tc.endpoint, Client: &http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+			got = r.Header
+			return okResponse(r), nil
+		})}}
+		if err := upload(context.Background(), s, local, "v.mkv", p); err != nil {
+			t.Fatalf("%s: %v", tc.endpoint, err)
+		}
+		for name, want := range tc.want {
+			if v := got.Get(name); v != want {
+				t.Errorf("%s: %s is %q, want %q", tc.endpoint, name, v, want)
+			}
+		}
+	}
+}
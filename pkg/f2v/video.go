@@ -0,0 +1,1097 @@
+package f2v
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileToVideo reads a file and encodes it into a video.
+// The layout decides how many bytes each frame holds: in raw mode each pixel
+// stores 3 bytes (one in each channel: Blue, Green, Red).
+func fileToVideo(inputFilename, outputFilename string, l layout, fps int) error {
+	data, err := os.ReadFile(inputFilename)
+	if err != nil {
+		return fmt.Errorf("failed to read input file: %w", err)
+	}
+	return dataToVideo(data, outputFilename, l, fps, 0)
+}
+
+// dataToVideo encodes data into a video, one sealed frame at a time. flags
+// are set on every frame, e.g. frameFlagDeflate for compressed data.
+func dataToVideo(data []byte, outputFilename string, l layout, fps int, flags uint8) error {
+	_, err := streamToVideo(bytes.NewReader(data), outputFilename, l, fps, flags)
+	return err
+}
+
+// streamToVideo encodes the data read from r into a video as it arrives,
+// holding back one frame so the final one can be flagged, follows it with
+// an index frame, and returns the number of bytes encoded.
+func streamToVideo(r io.Reader, outputFilename string, l layout, fps int, flags uint8) (int64, error) {
+	return streamToVideoFrom(r, outputFilename, l, fps, flags, 0)
+}
+
+// streamToVideoFrom is streamToVideo with frames numbered from first, for
+// frames that carry on another video's.
+func streamToVideoFrom(r io.Reader, outputFilename string, l layout, fps int, flags uint8, first uint32) (int64, error) {
+	// Each frame starts with a header; the rest carries file data
+	bytesPerFrame := l.dataBytes()
+	w, err := newFrameWriter(outputFilename, l, fps)
+	if err != nil {
+		return 0, err
+	}
+	defer w.Close()
+
+	cur, next := make([]byte, bytesPerFrame), make([]byte, bytesPerFrame)
+	n, curErr := io.ReadFull(r, cur)
+	var total int64
+	for seq := first; ; seq++ {
+		m, nextErr := 0, curErr
+		if curErr == nil {
+			m, nextErr = io.ReadFull(r, next)
+		}
+		if nextErr != nil && nextErr != io.EOF && nextErr != io.ErrUnexpectedEOF {
+			return total, fmt.Errorf("failed to read input: %w", nextErr)
+		}
+
+		// A short or empty read ends the data; an empty file still gets a final frame
+		h := frameHeader{flags: flags, seq: seq}
+		last := curErr != nil || nextErr == io.EOF
+		if last {
+			h.flags |= frameFlagLast
+		}
+		if err := w.write(h, cur[:n]); err != nil {
+			return total, err
+		}
+		total += int64(n)
+		if last {
+			// Frames carried on from another video were full
+			size := int64(first)*int64(bytesPerFrame) + total
+			if h, index, ok := videoIndexFrame(size, bytesPerFrame, flags); ok {
+				if err := w.write(h, index); err != nil {
+					return total, err
+				}
+			}
+			return total, nil
+		}
+		cur, next = next, cur
+		n, curErr = m, nextErr
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// frameWriter seals payloads into frames of a layout and appends them to a video.
+type frameWriter struct {
+	writer    VideoWriter
+	frameData []byte
+	payload   []byte
+	layout    layout
+	frames    int
+	cover     *coverVideo // the frames to embed data in, if the layout has one
+	output    string
+	cold      bool // scrub the finished video's metadata
+	log       *slog.Logger
+}
+
+func newFrameWriter(outputFilename string, l layout, fps int) (*frameWriter, error) {
+	// Use a lossless codec (FFV1) to prevent data corruption, unless the
+	// file is meant for a platform that wants H.264 or another was asked for
+	codec := l.codecFor(outputFilename)
+	if err := fitCodec(codec, l.width, l.height, fps); err != nil {
+		return nil, err
+	}
+	writer, err := l.codecBackend().Create(outputFilename, codec, float64(fps), l.width, l.height)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create video writer: %w", err)
+	}
+
+	// The output frame, 3 channels of 8 bits per pixel
+	frameData := l.pool.buffer(l.width * l.height * 3)
+
+	w := &frameWriter{writer: writer, frameData: frameData, payload: l.pool.buffer(l.capacity()), layout: l, output: outputFilename, cold: l.cold, log: l.log()}
+	if l.cover != "" {
+		if w.cover, err = openCover(l.codecBackend(), l.cover, outputFilename); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// write appends one frame holding data, which must fit the layout's capacity
+// after the header.
+func (w *frameWriter) write(h frameHeader, data []byte) error {
+	if w.cover != nil {
+		if err := w.cover.next(w.frameData); err != nil {
+			return err
+		}
+	}
+	h.part, h.parts = uint16(w.layout.part), uint16(w.layout.parts)
+	sealFrame(w.payload, h, data)
+	w.layout.pack(w.frameData, w.payload)
+
+	if err := w.writer.WriteFrame(w.frameData); err != nil {
+		return fmt.Errorf("error writing frame %d: %w", w.frames, err)
+	}
+	w.log.Debug("Frame written", "video", w.output, "frame", w.frames, "seq", h.seq, "bytes", len(data))
+	parity := 0
+	if h.parity() {
+		parity = len(data)
+	}
+	w.layout.tally.frame(w.layout.dataBytes(), parity)
+	w.frames++
+	return nil
+}
+
+// setLayout switches the layout of the following frames. It must keep the
+// frame size.
+func (w *frameWriter) setLayout(l layout) {
+	w.layout = l
+	if len(w.payload) != l.capacity() {
+		l.pool.putBuffer(w.payload)
+		w.payload = l.pool.buffer(l.capacity())
+	}
+}
+
+func (w *frameWriter) Close() error {
+	defer func() {
+		w.layout.pool.putBuffer(w.frameData)
+		w.layout.pool.putBuffer(w.payload)
+		w.frameData, w.payload = nil, nil
+	}()
+	if w.cover != nil {
+		// The rest of the cover plays on after the data
+		defer w.cover.Close()
+		if err := w.cover.finish(w.writer); err != nil {
+			w.writer.Close()
+			return err
+		}
+	}
+	if err := w.writer.Close(); err != nil {
+		return err
+	}
+	if w.cover != nil {
+		if err := w.cover.muxAudio(); err != nil {
+			return err
+		}
+	}
+	if w.cold {
+		if err := scrubMetadata(w.output); err != nil {
+			// The video still decodes; it just says what wrote it
+			w.log.Warn("Scrubbing the video's metadata failed", "video", w.output, "err", err)
+		}
+	}
+	return nil
+}
+
+// decodeOptions collects the settings shared by every video in a decode run.
+type decodeOptions struct {
+	layout  layout
+	hooks   []decodeHook  // run in order on each decoded file before it is written
+	discard bool          // run the hooks but write nothing
+	lenient bool          // leave holes for unreadable frames and write a gap map
+	follow  bool          // wait for a growing video until its final frame
+	idle    time.Duration // when following, give up after this long without new frames
+	secret  *secret       // for encrypted videos
+	// feed each decoded file to this shell command's stdin instead of writing it
+	outputCmd string
+	// or else write the data here as it decodes, standard output for -
+	output io.Writer
+	// called with the file name sealed in an encrypted video
+	named func(name string)
+	// called with where an f2v archive was unpacked, instead of writing it
+	unpacked func(root string)
+	// write the data as the frames hold it, still encrypted or compressed
+	stored bool
+	// decode only bytes [0] to [1] of the data, end exclusive and 0 for the end
+	byteRange *[2]int64
+	ctx       context.Context // cancels the decode, nil for never
+	progress  Progress        // told how far the decode has got, if set
+	frames    int64           // in the video, for progress; 0 when not known
+	bar       *progressBar    // the progress line drawn, told where a folder's batch is
+	report    *jsonReport     // told what became of each video, with -json
+}
+
+// videoToFile decodes a video (either from local file or URL) created by fileToVideo back into a file.
+// The layout must use the same mode as the encoder; the frame size is taken from the video itself.
+func videoToFile(inputVideo, outputFilename string, opts decodeOptions) error {
+	var gaps *gapMap
+	if opts.lenient {
+		gaps = &gapMap{}
+	}
+	decode := func(w io.Writer) error {
+		if opts.follow {
+			return followVideo(inputVideo, w, opts, gaps)
+		}
+		if r := opts.byteRange; r != nil {
+			return decodeRange(inputVideo, w, opts, r[0], r[1])
+		}
+		if gaps == nil {
+			if m, err := readManifest(inputVideo, opts); err != nil {
+				return err
+			} else if m != nil {
+				return m.decode(inputVideo, w, opts)
+			}
+			// A part of a split file brings the other parts with it
+			parts, err := partVideos(inputVideo, opts.layout)
+			if err != nil {
+				return err
+			}
+			if parts != nil {
+				return decodeParts(parts, w, opts)
+			}
+			if at, ok := w.(writerAt); ok && opts.output == nil {
+				if done, err := decodeAt(inputVideo, at, opts); done {
+					return err
+				}
+			}
+		}
+		return decodeVideo(inputVideo, w, opts, gaps)
+	}
+
+	var dst io.Writer
+	var live, out *os.File
+	var sink *commandSink
+	switch {
+	case opts.discard:
+		dst = io.Discard
+	case opts.outputCmd != "":
+		var err error
+		if sink, err = startCommandSink(opts.outputCmd, filepath.Base(outputFilename)); err != nil {
+			return err
+		}
+		defer sink.abort()
+		dst = sink
+	case opts.output != nil:
+		dst = opts.output
+	case opts.follow:
+		// A live archive is written out as it arrives rather than held until the end
+		f, err := os.Create(outputFilename)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		dst, live = f, f
+	default:
+		// The data goes into a file next to the output until it is all
+		// there, so files larger than memory decode and a failed decode
+		// leaves nothing under the output's name
+		f, err := os.CreateTemp(filepath.Dir(outputFilename), "."+filepath.Base(outputFilename)+".*")
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		dst, out = f, f
+	}
+	if len(opts.hooks) == 0 {
+		if err := decode(dst); err != nil {
+			return err
+		}
+	} else {
+		chain := newHookChain(filepath.Base(outputFilename), opts.hooks, dst)
+		if err := decode(chain); err != nil {
+			chain.abort(err)
+			return err
+		}
+		if err := chain.Close(); err != nil {
+			return err
+		}
+	}
+	if gaps != nil && !gaps.empty() {
+		if opts.output != nil {
+			gaps.print(os.Stderr)
+		} else {
+			gaps.print(os.Stdout)
+		}
+		if !opts.discard && sink == nil && opts.output == nil {
+			if err := gaps.save(gapMapPath(outputFilename)); err != nil {
+				return err
+			}
+			opts.log().Info("Wrote gap map", "path", gapMapPath(outputFilename))
+		}
+	}
+	if opts.discard {
+		return nil
+	}
+	if sink != nil {
+		return sink.finish()
+	}
+	if opts.output != nil {
+		return nil
+	}
+	if live != nil {
+		if err := live.Close(); err != nil {
+			return fmt.Errorf("failed to write output file: %w", err)
+		}
+		return nil
+	}
+
+	size, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	if gaps != nil && len(gaps.Gaps) > 0 && len(opts.hooks) == 0 {
+		return writeSparse(outputFilename, out, size, gaps)
+	}
+
+	// An f2v archive is unpacked, unless it is not one after all
+	head := make([]byte, archiveHeaderSize)
+	if n, _ := out.ReadAt(head, 0); isArchive(head[:n]) && len(opts.hooks) == 0 && !opts.stored && opts.byteRange == nil {
+		// Read from the file a file at a time, never whole
+		if d, err := readArchiveAt(out, size); err != nil {
+			opts.log().Warn("Writing the archive as it is", "path", outputFilename, "err", err)
+		} else {
+			r := &archiveReader{dir: d, video: inputVideo, opts: decodeOptions{layout: opts.layout, secret: opts.secret}, data: out, size: size}
+			root, err := unpackArchive(r, filepath.Dir(outputFilename))
+			if err == nil && opts.unpacked != nil {
+				opts.unpacked(root)
+			}
+			return err
+		}
+	}
+
+	// Move the reconstructed bytes into place
+	if err := out.Chmod(0644); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	if err := os.Rename(out.Name(), outputFilename); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	return nil
+}
+
+// decodeVideo decodes a video and writes the data of each frame to w as soon
+// as it has been validated, in sequence order. On error w has received the
+// intact data up to the failing frame. With a gap map the decode is lenient:
+// frames that cannot be read are left as holes (zeros) and recorded in gaps.
+func decodeVideo(inputVideo string, w io.Writer, opts decodeOptions, gaps *gapMap) error {
+	cap, cleanup, err := openVideoContext(opts.context(), inputVideo, opts.layout)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	opts.frames = cap.Info().Frames
+	return decodeFrames(cap, inputVideo, w, opts, gaps)
+}
+
+// decodeFrames does the work of decodeVideo on frames read from src.
+func decodeFrames(src frameSource, inputVideo string, w io.Writer, opts decodeOptions, gaps *gapMap) error {
+	// Platforms that change the frame rate repeat frames; the sequence
+	// numbers in the frame headers let us drop the copies. Screen recordings
+	// also catch frames halfway through a refresh, so a damaged frame only
+	// counts once the frame after it shows that data is really lost.
+	var next uint32
+	duplicates, skipped := 0, 0
+	complete := false
+	var probes probeStats
+	var damaged error
+	var inflate *inflater
+	var unpack *decompressor
+	var decrypt *decrypter
+	var check *macChecker
+	var written int64
+
+	if !isManifestPath(inputVideo) {
+		w = opts.layout.tally.writer(w) // a manifest's list is not the data
+	}
+
+	err := scanFrames(src, opts.layout, func(f scannedFrame) (bool, error) {
+		if err := opts.context().Err(); err != nil {
+			return false, err
+		}
+		opts.layout.tally.frame(f.capacity, 0)
+		probes.add(f.probe)
+		if f.err != nil {
+			if gaps != nil {
+				opts.log().Warn("Skipping frame", "video", inputVideo, "frame", f.index, "err", f.err)
+			}
+			if damaged == nil {
+				damaged = fmt.Errorf("frame %d: %w", f.index, f.err)
+			}
+			return true, nil
+		}
+		if f.header.parity() {
+			return false, fmt.Errorf("%s is a recovery volume; use repair with its data video", inputVideo)
+		}
+		if f.header.index() {
+			return false, nil // past the data, whose final frame never came
+		}
+		if f.header.seq < next {
+			duplicates++
+			return true, nil
+		}
+		if f.header.seq-next > maxSeqJump {
+			// No real gap is this long; the frame's header is garbage
+			err := malformed("frame %d claims sequence number %d, far past %d", f.index, f.header.seq, next)
+			if gaps == nil {
+				return false, err
+			}
+			opts.log().Warn("Skipping frame", "video", inputVideo, "frame", f.index, "err", err)
+			return true, nil
+		}
+		if f.header.seq > next && gaps == nil {
+			if damaged != nil {
+				return false, damaged
+			}
+			return false, malformed("frame %d: expected sequence number %d, got %d (frames missing)", f.index, next, f.header.seq)
+		}
+		if f.header.seq > next {
+			// Zeros keep the data after the gap at its offset; in a compressed
+			// or encrypted stream nothing after a gap can be recovered
+			if inflate != nil || unpack != nil || decrypt != nil || f.header.flags&(frameFlagDeflate|frameFlagCompress|frameFlagEncrypt) != 0 {
+				return false, fmt.Errorf("compressed or encrypted data cannot be salvaged past frame %d", next)
+			}
+			start := written
+			for seq := next; seq < f.header.seq; seq++ {
+				n := int64(f.capacity)
+				if f.table != nil {
+					first, end := f.table.byteRange(seq)
+					n = end - first
+				}
+				if err := writeZeros(w, n); err != nil {
+					return false, fmt.Errorf("failed to write output: %w", err)
+				}
+				written += n
+			}
+			gaps.add(start, written-start, next, int(f.header.seq-next))
+			opts.log().Warn("Left frames as a hole", "video", inputVideo, "first", next, "last", f.header.seq-1, "offset", start, "bytes", written-start)
+			next, damaged = f.header.seq, nil
+		}
+
+		// A segment table only tells scanFrames how to read what follows
+		if !f.header.table() {
+			// Decryption comes first, then decompression
+			if f.header.deflated() && inflate == nil && !opts.stored {
+				inflate = newInflater(w)
+				w = inflate
+			}
+			if f.header.compressed() && unpack == nil && !opts.stored {
+				unpack = newDecompressor(w)
+				w = unpack
+			}
+			if f.header.encrypted() && decrypt == nil && !opts.stored {
+				decrypt = newDecrypter(w, opts.secret, opts.log())
+				w = decrypt
+			}
+			// and before either the tag is checked
+			if f.header.tagged() && check == nil && !opts.stored {
+				check = newMACChecker(w, opts.secret.mac(), opts.log())
+				w = check
+			}
+			if _, err := w.Write(f.data); err != nil {
+				return false, fmt.Errorf("failed to write output: %w", err)
+			}
+			written += int64(len(f.data))
+		}
+		opts.log().Debug("Frame read", "video", inputVideo, "frame", f.index, "seq", f.header.seq, "bytes", len(f.data))
+		if opts.progress != nil {
+			opts.progress(int64(f.index)+1, opts.frames, written, 0)
+		}
+		if damaged != nil {
+			skipped++
+			damaged = nil
+		}
+		next++
+		complete = f.header.last()
+		return !complete, nil
+	})
+	if err == nil && !complete {
+		// A followed video stops being waited for once the run is cancelled
+		err = opts.context().Err()
+	}
+	if err == nil && !complete && gaps != nil {
+		opts.log().Warn("Video ended without its final frame; the rest of the data is missing", "video", inputVideo, "frames", next)
+		gaps.Truncated = true
+	} else if err == nil && !complete {
+		err = damaged
+		if err == nil {
+			err = malformed("video ended after %d frames without its final frame", next)
+		}
+	}
+	if check != nil && err == nil && gaps != nil && gaps.Truncated {
+		// The data breaks off before its end, so what was held back as
+		// the tag is data
+		err = check.flush()
+	} else if check != nil && err == nil {
+		if err = check.Close(); err != nil && gaps != nil && !gaps.empty() {
+			// The holes were bound to break it
+			opts.log().Warn("Check failed on frames left as holes", "video", inputVideo, "err", err)
+			err = nil
+		}
+	}
+	if decrypt != nil {
+		if err != nil {
+			decrypt.abort(err)
+		} else if err = decrypt.Close(); err == nil && opts.named != nil {
+			opts.named(decrypt.name())
+		}
+	}
+	if unpack != nil {
+		if err != nil {
+			unpack.abort(err)
+		} else {
+			err = unpack.Close()
+		}
+	}
+	if inflate != nil {
+		if err != nil {
+			inflate.abort(err)
+		} else {
+			err = inflate.Close()
+		}
+	}
+	if err != nil {
+		// Say what the host did to the video, which usually explains why
+		if class := probes.class(); class != "" && opts.context().Err() == nil {
+			err = fmt.Errorf("%w (host processing looks %s; run check for details)", err, class)
+		}
+		return err
+	}
+
+	if gaps != nil {
+		gaps.Size, gaps.NextFrame = written, next
+	}
+	if duplicates > 0 {
+		opts.log().Info("Skipped duplicated frames", "video", inputVideo, "frames", duplicates)
+	}
+	if skipped > 0 {
+		opts.log().Info("Skipped unreadable frames followed by an intact copy", "video", inputVideo, "frames", skipped)
+	}
+	if class := probes.class(); class != "" && class != "bit-exact" {
+		opts.log().Info("Host processing detected; the video still decoded", "video", inputVideo, "class", class)
+	}
+	return nil
+}
+
+// isURL reports whether path is the location of a remote object, read and
+// written through the backend SourceFor and SinkFor pick for it.
+func isURL(path string) bool {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "s3://") {
+		return true
+	}
+	_, ok := pluginScheme(path)
+	return ok
+}
+
+// encodeOptions collects the settings shared by every file in an encode run.
+type encodeOptions struct {
+	layout   layout
+	fps      int
+	catalog  *catalog     // optional
+	tsaURL   string       // optional RFC 3161 time-stamp authority, requires a catalog
+	parity   int          // recovery volume parity in percent, 0 for none
+	head     int          // leading bytes written in robust frames, 0 for none
+	tune     bool         // pick compression, density and parity per file
+	compress *compression // or compress the data first with this, if set
+	extra    []outputSpec
+	secret   *secret     // encrypt the data, if set
+	macKey   []byte      // or else append an integrity tag made with this key, if set
+	shares   []int       // K and N: encrypt under a key split across N videos, any K of which decrypt them
+	pack     string      // encode the input as one archive of this format, "" for a video per file
+	filter   *pathFilter // the files to take from a folder, nil for all
+	dedup    bool        // store the chunks of an f2v archive's files once
+	perFile  bool        // compress each file of an f2v archive on its own rather than the archive whole
+	base     string      // archive video whose chunks an f2v archive refers to instead
+	// split a file into part videos of at most this many frames, 0 for one video
+	maxFrames int64
+	manifest  bool   // also write a manifest video listing the parts
+	partURL   string // URL prefix the manifest lists the parts under
+	// encode this shell command's output, named after the input argument
+	inputCmd string
+	ctx      context.Context // cancels the encode, nil for never
+	progress Progress        // told how far the encode has got, if set
+	size     int64           // of the input, for progress; 0 when not known
+	bar      *progressBar    // the progress line drawn, told where a folder's batch is
+	report   *jsonReport     // told what became of each file, with -json
+	// told what -tune chose for each file and what each layer added to it,
+	// if set, as well as the Debug events logged for them
+	tuned  func(source string, a *inputAnalysis)
+	layers func(source string, plan capacityPlan)
+}
+
+// encodeFile encodes a single file and records the result in the catalog, if
+// one is in use. It returns what it wrote, for messages.
+func encodeFile(inputFile, outputVideo string, opts encodeOptions) (string, error) {
+	f, err := os.Open(inputFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read input file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to read input file: %w", err)
+	}
+	opts.size = info.Size()
+	if opts.maxFrames > 0 {
+		return encodeParts(inputFile, f, info.Size(), outputVideo, opts)
+	}
+	return encodedAs(outputVideo, opts), encodeStream(inputFile, filepath.Base(inputFile), f, outputVideo, opts)
+}
+
+// encodeStream encodes what r yields, recorded in the catalog as coming from
+// source and sealed under name if it is encrypted. The data goes into the
+// video as it is read, compressed and encrypted on the way if need be, unless tuning,
+// parity or a robust head needs all of it first.
+func encodeStream(source, name string, r io.Reader, outputVideo string, opts encodeOptions) (err error) {
+	cat := opts.catalog
+	if cat != nil {
+		if err := cat.checkWritable(outputVideo); err != nil {
+			return err
+		}
+		for _, o := range opts.extra {
+			if err := cat.checkWritable(o.path(outputVideo)); err != nil {
+				return err
+			}
+		}
+	}
+	r = contextReader{opts.context(), r}
+	defer func() {
+		if err != nil && opts.context().Err() != nil {
+			// Cancelled part way: what was written is of no use
+			for _, p := range writtenPaths(outputVideo, opts) {
+				os.Remove(p)
+			}
+		}
+	}()
+	outputs := []string{outputVideo}
+	layouts := []layout{opts.layout}
+	for _, o := range opts.extra {
+		outputs = append(outputs, o.path(outputVideo))
+		layouts = append(layouts, o.layout)
+	}
+	var heads [][]byte
+	encryptWith := opts.secret
+	if opts.shares != nil {
+		// Only the streaming path below seals under the shares
+		switch {
+		case opts.secret != nil:
+			return fmt.Errorf("key shares make their own key; encrypt with them or with a secret, not both")
+		case opts.tune || opts.parity > 0 || opts.head > 0 || len(opts.extra) > 0:
+			return fmt.Errorf("key shares do not combine with tuning, parity, a robust head or extra outputs")
+		}
+		key, shares, err := newKeyShares(opts.shares[0], opts.shares[1])
+		if err != nil {
+			return fmt.Errorf("failed to make key shares: %w", err)
+		}
+		outputs, layouts = nil, nil
+		for i, share := range shares {
+			outputs = append(outputs, sharePath(outputVideo, i+1, len(shares)))
+			layouts = append(layouts, opts.layout)
+			heads = append(heads, share.marshal())
+		}
+		encryptWith = &secret{shareKey: key[:]}
+	}
+
+	var size, compressed, payload int64
+	if cat != nil {
+		defer func() {
+			if err != nil {
+				// Failures count for stats too
+				cat.logRun("encode", outputVideo, size, err)
+				if serr := cat.save(); serr != nil {
+					opts.log().Warn("Recording the failed run failed", "err", serr)
+				}
+			}
+		}()
+	}
+	var mac uint8
+	if opts.macKey != nil {
+		mac = frameFlagMAC
+	}
+	if opts.tune || opts.parity > 0 || opts.head > 0 {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failed to read input file: %w", err)
+		}
+		size = int64(len(data))
+		var flags uint8
+		if opts.tune {
+			a, err := analyzeInput(data, opts)
+			if err != nil {
+				return err
+			}
+			opts.log().Debug("Tuned", "input", source, "entropy", a.entropy, "compress", a.compress, "layout", a.layout.describe(), "parity", a.parity)
+			if opts.tuned != nil {
+				opts.tuned(source, a)
+			}
+			data, opts.layout, opts.parity, layouts[0] = a.data, a.layout, a.parity, a.layout
+			if a.compress {
+				flags |= frameFlagDeflate
+				compressed = int64(len(data))
+			}
+		}
+		if opts.compress != nil {
+			if why := skipCompression(data[:min(len(data), compressProbeSize)]); why != "" {
+				opts.log().Info("Not compressing", "input", source, "reason", why)
+			} else {
+				if data, err = compressBytes(data, *opts.compress); err != nil {
+					return err
+				}
+				flags |= frameFlagCompress
+				compressed = int64(len(data))
+			}
+		}
+		if opts.secret != nil {
+			if data, err = encryptPayload(data, name, opts.secret); err != nil {
+				return err
+			}
+			flags |= frameFlagEncrypt
+			payload = int64(len(data))
+		}
+		if opts.macKey != nil {
+			data = appendMAC(data, opts.macKey)
+			flags |= mac
+		}
+		err = writeOutputs(len(outputs), func(i int) error {
+			if opts.head > 0 {
+				// The head gets the segment table's own robust setting
+				head := data[:min(opts.head, len(data))]
+				parts := [][]byte{head, data[len(head):]}
+				return segmentsToVideo(parts, []layout{tableLayout(layouts[i]), layouts[i]}, outputs[i], opts.fps)
+			}
+			if i == 0 && opts.progress != nil {
+				per := int64(layouts[0].dataBytes())
+				r := &progressReader{r: bytes.NewReader(data), report: opts.progress, per: per, frames: dataFrames(int64(len(data)), per) + 1, size: size, payload: int64(len(data))}
+				_, err := streamToVideo(r, outputs[0], layouts[0], opts.fps, flags)
+				return err
+			}
+			return dataToVideo(data, outputs[i], layouts[i], opts.fps, flags)
+		})
+		if err != nil {
+			return err
+		}
+		if opts.parity > 0 {
+			if err := writeRecoveryVolume(data, recoveryPath(outputVideo), opts.layout, opts.fps, opts.parity); err != nil {
+				return err
+			}
+		}
+	} else {
+		compress := opts.compress
+		if compress != nil {
+			// Look at the start of the input before deciding
+			br := bufio.NewReaderSize(r, compressProbeSize)
+			head, err := br.Peek(compressProbeSize)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("failed to read input file: %w", err)
+			}
+			if why := skipCompression(head); why != "" {
+				opts.log().Info("Not compressing", "input", source, "reason", why)
+				compress = nil
+			}
+			r = br
+		}
+		in := &countingReader{r: r}
+		src, flags := io.Reader(in), uint8(0)
+		var packed *countingReader
+		if compress != nil {
+			z := compressReader(in, *compress)
+			defer z.Close()
+			packed = &countingReader{r: z}
+			src, flags = packed, frameFlagCompress
+		}
+		if encryptWith != nil {
+			sealed := sealReader(src, name, encryptWith)
+			defer sealed.Close()
+			src, flags = sealed, flags|frameFlagEncrypt
+		}
+		if opts.macKey != nil {
+			src, flags = newMACReader(src, opts.macKey), flags|mac
+		}
+		if opts.progress != nil {
+			p := &progressReader{r: src, report: opts.progress, per: int64(layouts[0].dataBytes()), input: in, size: opts.size}
+			if opts.size > 0 && compress == nil && opts.shares == nil {
+				p.frames = payloadFrames(opts.size, name, opts, layouts[0])
+			}
+			src = p
+		}
+		n, err := streamOutputs(src, outputs, layouts, opts.fps, flags, heads)
+		if err != nil {
+			return err
+		}
+		size = in.n
+		if packed != nil {
+			compressed = packed.n
+		}
+		if encryptWith != nil {
+			payload = n
+		}
+	}
+	if opts.head == 0 && (compressed > 0 || encryptWith != nil || opts.macKey != nil || opts.parity > 0) {
+		// What each layer added for this run, as measured; a robust head
+		// lays the data out differently
+		po := planOptions{parity: opts.parity, encrypt: encryptWith != nil, mac: opts.macKey != nil, compressed: compressed, payload: payload}
+		if opts.shares != nil {
+			po.shares = opts.shares[1]
+		}
+		if plan, err := planCapacity(size, profileFromLayout(opts.layout, opts.fps), po); err == nil {
+			opts.log().Debug("Layers", "input", source, "size", plan.Size, "frame_bytes", plan.TotalBytes, "overhead", plan.Overhead)
+			if opts.layers != nil {
+				opts.layers(source, plan)
+			}
+		}
+	}
+	if !isManifestPath(outputVideo) {
+		opts.layout.tally.addPayload(size) // a manifest's list is not the data
+	}
+	for i, o := range opts.extra {
+		opts.log().Info("Also wrote", "video", outputs[i+1], "layout", o.layout.describe())
+	}
+	if cat == nil {
+		return nil
+	}
+	for _, output := range outputs {
+		if err := cat.add(catalogEntry{Source: source, Size: size}, output); err != nil {
+			return err
+		}
+	}
+	if opts.tsaURL != "" {
+		if err := cat.timestamp(outputs[0], opts.tsaURL); err != nil {
+			// The video itself is fine; keep the entry without a token
+			opts.log().Warn("Time-stamping failed", "video", outputs[0], "err", err)
+		}
+	}
+	cat.logRun("encode", outputs[0], size, nil)
+	return cat.save()
+}
+
+// videoPath returns where the video for an input named name goes in
+// outputPath: name.mkv, or for encrypted data a random ID.mkv, so that only
+// the ciphertext tells what the video holds; the name is sealed inside.
+func (opts encodeOptions) videoPath(outputPath, name string) string {
+	if opts.secret == nil && opts.shares == nil && !opts.layout.cold {
+		return filepath.Join(outputPath, name+".mkv")
+	}
+	return filepath.Join(outputPath, newID()+".mkv")
+}
+
+// encodedAs names what encoding into outputVideo writes, for messages.
+func encodedAs(outputVideo string, opts encodeOptions) string {
+	if opts.shares == nil {
+		return outputVideo
+	}
+	k, n := opts.shares[0], opts.shares[1]
+	return fmt.Sprintf("%s to %s, any %d of which decrypt it", sharePath(outputVideo, 1, n), sharePath(outputVideo, n, n), k)
+}
+
+// writtenPaths lists every file encoding into outputVideo writes.
+func writtenPaths(outputVideo string, opts encodeOptions) []string {
+	paths := []string{outputVideo}
+	if opts.shares != nil {
+		paths = nil
+		for i := range opts.shares[1] {
+			paths = append(paths, sharePath(outputVideo, i+1, opts.shares[1]))
+		}
+	}
+	for _, o := range opts.extra {
+		paths = append(paths, o.path(outputVideo))
+	}
+	return append(paths, recoveryPath(outputVideo))
+}
+
+// treeFile is a file encodeTree or decodeTree found to work on.
+type treeFile struct {
+	input, output string
+	size          int64 // for the progress of the batch
+}
+
+// encodeTree encodes every file under dir, subdirectories included, into a
+// video at the same relative path under outputPath. A file that fails is
+// reported and skipped.
+func encodeTree(dir, outputPath string, opts encodeOptions) error {
+	files, total, err := encodeTreeFiles(dir, outputPath, opts)
+	if err != nil {
+		return err
+	}
+
+	opts.bar.batch(len(files), total)
+	for _, f := range files {
+		outputDir := filepath.Dir(f.output)
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			return fmt.Errorf("failed to create output folder: %w", err)
+		}
+		outputVideo := opts.videoPath(outputDir, filepath.Base(f.input))
+
+		opts.log().Info("Encoding", "file", f.input)
+		opts.bar.file(f.input, f.size)
+		start := time.Now()
+		written, err := encodeFile(f.input, outputVideo, opts)
+		opts.bar.fileDone()
+		opts.report.file(f.input, written, f.input, start, err)
+		if cerr := opts.context().Err(); cerr != nil {
+			return cerr // the rest would only fail the same way
+		}
+		if err != nil {
+			opts.log().Error("Encoding failed", "file", f.input, "err", err)
+			continue
+		}
+		opts.log().Info("Encoded", "file", f.input, "video", written)
+	}
+	return nil
+}
+
+// encodeTreeFiles walks dir for the files encodeTree encodes, each with its
+// path under outputPath, and returns them with their total size.
+func encodeTreeFiles(dir, outputPath string, opts encodeOptions) ([]treeFile, int64, error) {
+	// Encoding into a folder inside the input must not pick up its own videos
+	skip, _ := filepath.Abs(outputPath)
+	var files []treeFile
+	var total int64
+	err := filepath.WalkDir(dir, func(inputFile string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if abs, _ := filepath.Abs(inputFile); d.IsDir() && abs == skip && inputFile != dir {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(dir, inputFile)
+		if err != nil {
+			return err
+		}
+		if opts.filter.skip(filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			opts.log().Warn("Skipping what is not a regular file", "path", inputFile)
+			return nil
+		}
+		f := treeFile{input: inputFile, output: filepath.Join(outputPath, rel)}
+		if info, err := d.Info(); err == nil {
+			f.size = info.Size()
+		}
+		files, total = append(files, f), total+f.size
+		return nil
+	})
+	return files, total, err
+}
+
+// decodeTree decodes every video under dir, subdirectories included, into
+// the same relative folder under outputPath, mirroring encodeTree.
+func decodeTree(dir, outputPath string, opts decodeOptions) error {
+	videos, total, err := decodeTreeFiles(dir, outputPath)
+	if err != nil {
+		return err
+	}
+
+	opts.bar.batch(len(videos), total)
+	for _, v := range videos {
+		if err := os.MkdirAll(filepath.Dir(v.output), 0755); err != nil {
+			return fmt.Errorf("failed to create output folder: %w", err)
+		}
+
+		opts.log().Info("Decoding", "video", v.input)
+		opts.bar.file(v.input, v.size)
+		start := time.Now()
+		outputFile, err := decodeNamed(v.input, v.output, opts)
+		opts.bar.fileDone()
+		opts.report.file(v.input, outputFile, outputFile, start, err)
+		if cerr := opts.context().Err(); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			opts.log().Error("Decoding failed", "video", v.input, "err", err)
+			continue
+		}
+		opts.log().Info("Decoded", "video", v.input, "file", outputFile)
+	}
+	return nil
+}
+
+// decodeTreeFiles walks dir for the videos decodeTree decodes, each with
+// the file it decodes into under outputPath, and returns them with their
+// total size.
+func decodeTreeFiles(dir, outputPath string) ([]treeFile, int64, error) {
+	skip, _ := filepath.Abs(outputPath)
+	var videos []treeFile
+	var total int64
+	err := filepath.WalkDir(dir, func(inputVideo string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if abs, _ := filepath.Abs(inputVideo); d.IsDir() && abs == skip && inputVideo != dir {
+			return filepath.SkipDir
+		}
+		sequence := d.IsDir() && isFrameSequence(inputVideo)
+		if d.IsDir() && !sequence || !strings.HasSuffix(d.Name(), ".mkv") || isRecoveryPath(d.Name()) || isLaterPart(d.Name()) || isManifestPath(d.Name()) {
+			return nil // Skip non-mkv files, recovery volumes, and the parts and manifests the first part brings in
+		}
+		rel, err := filepath.Rel(dir, inputVideo)
+		if err != nil {
+			return err
+		}
+		v := treeFile{input: inputVideo, output: filepath.Join(outputPath, filepath.Dir(rel), decodedName(d.Name()))}
+		if info, err := d.Info(); err == nil && !sequence {
+			v.size = info.Size()
+		}
+		videos, total = append(videos, v), total+v.size
+		if sequence {
+			return filepath.SkipDir // a video written as PNG frames, not a folder of videos
+		}
+		return nil
+	})
+	return videos, total, err
+}
+
+// decodeNamed decodes a video into outputFile, or when the video was
+// encrypted, into a file next to it named after the name sealed inside,
+// and returns the path written. An f2v archive is unpacked next to
+// outputFile instead, and the folder it went into returned.
+func decodeNamed(inputVideo, outputFile string, opts decodeOptions) (string, error) {
+	var sealed, unpacked string
+	opts.named = func(name string) { sealed = name }
+	opts.unpacked = func(root string) { unpacked = root }
+	if err := videoToFile(inputVideo, outputFile, opts); err != nil {
+		return outputFile, err
+	}
+	if unpacked != "" {
+		return unpacked, nil
+	}
+	name := filepath.Base(sealed)
+	if sealed == "" || name == "." || name == ".." || opts.discard || opts.outputCmd != "" || opts.output != nil {
+		return outputFile, nil
+	}
+	if _, err := os.Stat(gapMapPath(outputFile)); err == nil {
+		return outputFile, nil // keep the file next to its gap map
+	}
+	named := filepath.Join(filepath.Dir(outputFile), name+".decoded")
+	if named == outputFile {
+		return outputFile, nil
+	}
+	if _, err := os.Stat(named); err == nil {
+		opts.log().Warn("Keeping the decoded file's name since the sealed one exists", "file", outputFile, "sealed", named)
+		return outputFile, nil
+	}
+	if err := os.Rename(outputFile, named); err != nil {
+		opts.log().Warn("Keeping the decoded file's name", "file", outputFile, "err", err)
+		return outputFile, nil
+	}
+	return named, nil
+}
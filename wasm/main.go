@@ -0,0 +1,145 @@
+//go:build js && wasm
+
+// Command wasm is the encoder and decoder for web pages, built with
+//
+//	GOOS=js GOARCH=wasm go build -o f2v.wasm ./wasm
+//
+// and loaded with the wasm_exec.js that comes with Go. There is no OpenCV in
+// a browser, so the page turns frames into and out of videos itself, with a
+// <video> and a canvas, WebCodecs or whatever else it has; frames cross as
+// the RGBA pixels of canvas ImageData. Once loaded, the module sets
+//
+//	f2v.encode(data, options) // Uint8Array -> Promise of {width, height, fps, frames}
+//	f2v.decode(video, options) // {width, height, frames} -> Promise of Uint8Array
+//
+// where frames is an array of Uint8Array, one per frame, and options, which
+// may be left out, are JSON of the fields of an Encoder or Decoder, such as
+// {"Mode": "block", "Compress": "zstd"}.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"syscall/js"
+
+	"video-file-encoder-decoder/pkg/f2v"
+)
+
+// video is the name videos go by in the Memory backend.
+const video = "video.mkv"
+
+func main() {
+	js.Global().Set("f2v", js.ValueOf(map[string]any{
+		"encode": js.FuncOf(func(this js.Value, args []js.Value) any {
+			return promise(func() (any, error) { return encode(args) })
+		}),
+		"decode": js.FuncOf(func(this js.Value, args []js.Value) any {
+			return promise(func() (any, error) { return decode(args) })
+		}),
+	}))
+	select {}
+}
+
+// promise runs fn in a goroutine, as a call from JavaScript must not block,
+// and returns a Promise of its result.
+func promise(fn func() (any, error)) js.Value {
+	return js.Global().Get("Promise").New(js.FuncOf(func(this js.Value, args []js.Value) any {
+		resolve, reject := args[0], args[1]
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					reject.Invoke(js.Global().Get("Error").New(fmt.Sprintf("internal error: %v", r)))
+				}
+			}()
+			v, err := fn()
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(v)
+		}()
+		return nil
+	}))
+}
+
+// options reads args[i], JSON of the fields of an Encoder or Decoder, into
+// v, if it is there.
+func options(args []js.Value, i int, v any) error {
+	if len(args) <= i || args[i].IsUndefined() || args[i].IsNull() {
+		return nil
+	}
+	text := args[i].String()
+	if args[i].Type() == js.TypeObject {
+		text = js.Global().Get("JSON").Call("stringify", args[i]).String()
+	}
+	if err := json.Unmarshal([]byte(text), v); err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+	return nil
+}
+
+func encode(args []js.Value) (any, error) {
+	if len(args) == 0 || args[0].Type() != js.TypeObject {
+		return nil, fmt.Errorf("encode takes the data as a Uint8Array")
+	}
+	data := make([]byte, args[0].Get("length").Int())
+	js.CopyBytesToGo(data, args[0])
+	mem := &f2v.Memory{}
+	enc := f2v.Encoder{}
+	if err := options(args, 1, &enc); err != nil {
+		return nil, err
+	}
+	enc.Backend = mem
+	if _, err := enc.Encode(context.Background(), bytes.NewReader(data), video); err != nil {
+		return nil, err
+	}
+	v := mem.Video(video)
+	frames := make([]any, len(v.Frames))
+	rgba := make([]byte, v.Width*v.Height*4)
+	for i, bgr := range v.Frames {
+		for p := range v.Width * v.Height {
+			rgba[p*4], rgba[p*4+1], rgba[p*4+2], rgba[p*4+3] = bgr[p*3+2], bgr[p*3+1], bgr[p*3], 255
+		}
+		frame := js.Global().Get("Uint8Array").New(len(rgba))
+		js.CopyBytesToJS(frame, rgba)
+		frames[i] = frame
+	}
+	return js.ValueOf(map[string]any{"width": v.Width, "height": v.Height, "fps": v.FPS, "frames": frames}), nil
+}
+
+func decode(args []js.Value) (any, error) {
+	if len(args) == 0 || args[0].Type() != js.TypeObject {
+		return nil, fmt.Errorf("decode takes the video as {width, height, frames}")
+	}
+	width, height := args[0].Get("width").Int(), args[0].Get("height").Int()
+	frames := args[0].Get("frames")
+	v := &f2v.MemoryVideo{Width: width, Height: height}
+	rgba := make([]byte, width*height*4)
+	for i := range frames.Length() {
+		if n := frames.Index(i).Get("length").Int(); n != len(rgba) {
+			return nil, fmt.Errorf("frame %d has %d bytes, not the %d of %dx%d RGBA pixels", i, n, len(rgba), width, height)
+		}
+		js.CopyBytesToGo(rgba, frames.Index(i))
+		bgr := make([]byte, width*height*3)
+		for p := range width * height {
+			bgr[p*3], bgr[p*3+1], bgr[p*3+2] = rgba[p*4+2], rgba[p*4+1], rgba[p*4]
+		}
+		v.Frames = append(v.Frames, bgr)
+	}
+	mem := &f2v.Memory{}
+	mem.Put(video, v)
+	dec := f2v.Decoder{}
+	if err := options(args, 1, &dec); err != nil {
+		return nil, err
+	}
+	dec.Backend = mem
+	var out bytes.Buffer
+	if _, err := dec.Decode(context.Background(), video, &out); err != nil {
+		return nil, err
+	}
+	data := js.Global().Get("Uint8Array").New(out.Len())
+	js.CopyBytesToJS(data, out.Bytes())
+	return data, nil
+}